@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/shadowaead"
+)
+
+// accessLog records each relay of the server, nil unless -access-log is set.
+var accessLog *accessLogger
+
+// accessLogger writes one JSON line per TCP relay or UDP NAT session, for
+// operators to audit abuse reports.
+type accessLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// accessEntry is a line of the access log. Sent and Received count the bytes
+// exchanged with the target.
+type accessEntry struct {
+	Time     time.Time      `json:"time"`
+	Proto    string         `json:"proto"`
+	Listener string         `json:"listener"`
+	Client   string         `json:"client"`
+	User     string         `json:"user,omitempty"`
+	Target   string         `json:"target"`
+	Sent     int64          `json:"sent"`
+	Received int64          `json:"received"`
+	Duration float64        `json:"duration"` // in seconds
+	Close    string         `json:"close,omitempty"`
+	Chain    transportChain `json:"chain"`
+}
+
+// newAccessLogger appends to the file at path, or writes to stdout if path
+// is "-".
+func newAccessLogger(path string) (*accessLogger, error) {
+	if path == "-" {
+		return &accessLogger{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{w: f}, nil
+}
+
+func (a *accessLogger) log(e accessEntry) {
+	if a == nil {
+		return
+	}
+	e.Duration = time.Since(e.Time).Round(time.Millisecond).Seconds()
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		mainLog.Warnf("failed to write access log: %v", err)
+	}
+}
+
+// closeReason describes why a relay ended with err.
+func closeReason(ctx context.Context, err error) string {
+	switch {
+	case errors.Is(context.Cause(ctx), errRelayEnded):
+		return "ended"
+	case ctx.Err() != nil:
+		return "shutdown"
+	case err == nil, errors.Is(err, io.EOF), errors.Is(err, shadowaead.ErrZeroChunk): // how AEAD peers may mark the end
+		return "eof"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "idle"
+	}
+	return err.Error()
+}
+
+// countConn counts the bytes read from and written to a connection.
+type countConn struct {
+	net.Conn
+	read, written atomic.Int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *countConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, countReader{r, func(n int) { c.written.Add(int64(n)) }})
+}
+
+func (c *countConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(countWriter{w, func(n int) { c.read.Add(int64(n)) }}, c.Conn)
+}
+
+func (c *countConn) spliceTo() net.Conn { return c.Conn }
+
+func (c *countConn) spliced(n int64, read bool) {
+	if read {
+		c.read.Add(n)
+	} else {
+		c.written.Add(n)
+	}
+}
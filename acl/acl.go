@@ -0,0 +1,156 @@
+// Package acl implements access control lists deciding which destinations
+// the client connects to directly instead of through the server.
+//
+// The file format follows shadowsocks-libev:
+//
+//	[proxy_all]       # default action: proxy everything (or [bypass_all])
+//	[bypass_lan]      # bypass loopback, link-local and private ranges
+//	[bypass_list]     # addresses below are connected to directly
+//	192.168.0.0/16
+//	[proxy_list]      # addresses below are proxied
+//	8.8.8.8
+//
+// Addresses are IPs or CIDR prefixes, one per line. Lines starting with #
+// are comments.
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// Action is what to do with a destination.
+type Action int
+
+const (
+	Proxy Action = iota
+	Bypass
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Bypass:
+		return "bypass"
+	case Block:
+		return "block"
+	}
+	return "proxy"
+}
+
+// LAN is the list of local ranges bypassed by [bypass_lan].
+var LAN = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// ACL maps destination addresses to actions.
+type ACL struct {
+	Default Action
+	bypass  []netip.Prefix
+	proxy   []netip.Prefix
+}
+
+// Load reads the ACL file at path.
+func Load(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("acl %s: %v", path, err)
+	}
+	return a, nil
+}
+
+// Parse reads an ACL from r.
+func Parse(r io.Reader) (*ACL, error) {
+	a := &ACL{}
+	var list *[]netip.Prefix
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch line {
+		case "":
+		case "[proxy_all]", "[accept_all]":
+			a.Default = Proxy
+		case "[bypass_all]", "[reject_all]":
+			a.Default = Bypass
+		case "[bypass_lan]":
+			a.bypass = append(a.bypass, LAN...)
+		case "[bypass_list]", "[black_list]":
+			list = &a.bypass
+		case "[proxy_list]", "[white_list]":
+			list = &a.proxy
+		default:
+			if list == nil {
+				return nil, fmt.Errorf("line %d: address outside of a list", n)
+			}
+			p, err := parsePrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			*list = append(*list, p)
+		}
+	}
+	return a, s.Err()
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// Match returns the action for ip. An address on the list of the other
+// action than the default gets that action, unless it is also on the list
+// of the default action.
+func (a *ACL) Match(ip netip.Addr) Action {
+	ip = ip.Unmap()
+	switch a.Default {
+	case Proxy:
+		if contains(a.bypass, ip) && !contains(a.proxy, ip) {
+			return Bypass
+		}
+	case Bypass:
+		if contains(a.proxy, ip) && !contains(a.bypass, ip) {
+			return Proxy
+		}
+	}
+	return a.Default
+}
+
+func contains(ps []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package acl
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	a, err := Parse(strings.NewReader(`
+[proxy_all]
+[bypass_lan]
+[bypass_list]
+1.2.3.0/24 # comment
+2001:db8::/32
+[proxy_list]
+1.2.3.4
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		ip   string
+		want Action
+	}{
+		{"8.8.8.8", Proxy},
+		{"192.168.1.1", Bypass},
+		{"::ffff:10.0.0.1", Bypass},
+		{"1.2.3.5", Bypass},
+		{"1.2.3.4", Proxy},
+		{"2001:db8::1", Bypass},
+		{"2001:db9::1", Proxy},
+	} {
+		if got := a.Match(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestBypassAll(t *testing.T) {
+	a, err := Parse(strings.NewReader("[bypass_all]\n[proxy_list]\n8.8.8.0/24\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Match(netip.MustParseAddr("8.8.8.8")) != Proxy || a.Match(netip.MustParseAddr("9.9.9.9")) != Bypass {
+		t.Error("proxy_list not honored in bypass_all mode")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	if _, err := Parse(strings.NewReader("[bypass_list]\nnot-an-ip\n")); err == nil {
+		t.Error("invalid address accepted")
+	}
+	if _, err := Parse(strings.NewReader("1.2.3.4\n")); err == nil {
+		t.Error("address outside of a list accepted")
+	}
+}
+
+func TestRulesOrder(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+DOMAIN-SUFFIX,ads.example,DIRECT
+DOMAIN-KEYWORD,ads,BLOCK
+DOMAIN,ads.example,BLOCK
+DOMAIN-WILDCARD,*.test,DIRECT
+DOMAIN-SUFFIX,x.test,BLOCK
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host string
+		want Action
+	}{
+		{"ads.example", Bypass},
+		{"cdn.ads.example", Bypass},
+		{"myads.test", Block},
+		{"a.x.test", Bypass},
+	} {
+		if got, _ := rs.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+# comment
+DOMAIN,exact.example,BLOCK
+DOMAIN-SUFFIX,example.com,DIRECT
+DOMAIN-KEYWORD,ads,reject
+DOMAIN-REGEX,^cdn[0-9]+\.,PROXY
+DOMAIN-WILDCARD,tracker?.*.example.org,BLOCK
+DOMAIN-SUFFIX,example.org,DIRECT
+GEOIP,cn,DIRECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host  string
+		want  Action
+		match bool
+	}{
+		{"exact.example", Block, true},
+		{"sub.exact.example", Proxy, false},
+		{"example.com", Bypass, true},
+		{"WWW.Example.COM.", Bypass, true},
+		{"notexample.com", Proxy, false},
+		{"myads.net", Block, true},
+		{"cdn42.net", Proxy, true},
+		{"tracker1.eu.example.org", Block, true},
+		{"tracker.eu.example.org", Bypass, true},
+		{"tracker1.example.org", Bypass, true},
+		{"example.org", Bypass, true},
+		{"xexample.org", Proxy, false},
+	} {
+		got, ok := rs.Match(tt.host)
+		if got != tt.want || ok != tt.match {
+			t.Errorf("Match(%s) = %v, %v, want %v, %v", tt.host, got, ok, tt.want, tt.match)
+		}
+	}
+	if !rs.HasGeoIP() {
+		t.Error("HasGeoIP() = false")
+	}
+	if got, ok := rs.MatchCountry("CN"); got != Bypass || !ok {
+		t.Errorf("MatchCountry(CN) = %v, %v", got, ok)
+	}
+	if _, ok := rs.MatchCountry("US"); ok {
+		t.Error("MatchCountry(US) matched")
+	}
+	if _, rule, _ := rs.MatchRule("cdn.example.com"); rule != "DOMAIN-SUFFIX,example.com" {
+		t.Errorf("MatchRule(cdn.example.com) rule = %q", rule)
+	}
+	if _, rule, _ := rs.MatchCountryRule("CN"); rule != "GEOIP,CN" {
+		t.Errorf("MatchCountryRule(CN) rule = %q", rule)
+	}
+	if _, err := ParseRules(strings.NewReader("DOMAIN-SUFFIX,example.com,DROP\n")); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
+
+func TestIPRules(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+DOMAIN-SUFFIX,example.com,DIRECT
+IP-CIDR,10.0.0.0/8,DIRECT
+IP-CIDR,10.1.2.3,BLOCK
+GEOIP,cn,DIRECT
+IP-CIDR6,2001:db8::/32,BLOCK
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.HasIPRules() {
+		t.Error("HasIPRules() = false")
+	}
+	lookups := 0
+	country := func(cc string) func() string {
+		return func() string { lookups++; return cc }
+	}
+	for _, tt := range []struct {
+		ip      string
+		country string
+		want    Action
+		rule    string
+		lookups int
+	}{
+		{"10.1.2.3", "", Bypass, "IP-CIDR,10.0.0.0/8", 0},
+		{"::ffff:10.0.0.1", "", Bypass, "IP-CIDR,10.0.0.0/8", 0},
+		{"1.2.3.4", "CN", Bypass, "GEOIP,CN", 1},
+		{"2001:db8::1", "US", Block, "IP-CIDR6,2001:db8::/32", 1},
+		{"1.2.3.4", "US", Proxy, "", 1},
+	} {
+		lookups = 0
+		got, rule, _ := rs.MatchIPRule(netip.MustParseAddr(tt.ip), country(tt.country))
+		if got != tt.want || rule != tt.rule || lookups != tt.lookups {
+			t.Errorf("MatchIPRule(%s) = %v, %q with %d lookups, want %v, %q with %d",
+				tt.ip, got, rule, lookups, tt.want, tt.rule, tt.lookups)
+		}
+	}
+	ip := netip.MustParseAddr("192.0.2.1")
+	if n := testing.AllocsPerRun(100, func() { rs.MatchIPRule(ip, func() string { return "" }) }); n != 0 {
+		t.Errorf("MatchIPRule allocates %v times", n)
+	}
+	if _, err := ParseRules(strings.NewReader("IP-CIDR,10.0.0.0/33,DIRECT\n")); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+}
+
+func TestPAC(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+DOMAIN-SUFFIX,example.cn,DIRECT
+DOMAIN,ads.example.com,BLOCK
+IP-CIDR,10.0.0.0/8,DIRECT
+GEOIP,CN,DIRECT
+IP-CIDR,192.0.2.0/24,DIRECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pac := PAC(nil, rs, "SOCKS5 127.0.0.1:1080")
+	for _, want := range []string{
+		`var proxy = "SOCKS5 127.0.0.1:1080";`,
+		`if (host == "example.cn" || dnsDomainIs(host, ".example.cn")) return "DIRECT";`,
+		`if (host == "ads.example.com") return proxy;`,
+		`if (isInNet(ip, "10.0.0.0", "255.0.0.0")) return "DIRECT";`,
+		`return proxy; // GEOIP,CN, up to the proxy`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC lacks %s:\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "192.0.2.0") {
+		t.Errorf("PAC routes past a GEOIP rule:\n%s", pac)
+	}
+	if pac := PAC(nil, nil, "SOCKS5 127.0.0.1:1080"); strings.Contains(pac, "dnsResolve") {
+		t.Errorf("PAC resolves names without IP rules:\n%s", pac)
+	}
+}
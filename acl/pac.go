@@ -0,0 +1,124 @@
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// PAC returns a proxy auto-config script sending the destinations a and rs
+// bypass directly and the others to proxy, e.g. "SOCKS5 127.0.0.1:1080".
+// Either may be nil. Destinations whose route the script cannot tell, as
+// those reached by GEOIP rules and IPv6 addresses, go to proxy, which is
+// expected to route them itself, as are blocked ones.
+func PAC(a *ACL, rs *Rules, proxy string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	fmt.Fprintf(&b, "\tvar proxy = %s;\n", jsString(proxy))
+	ipRules := false
+	if rs != nil {
+		for _, ru := range rs.rules {
+			if ru.typ == ruleGeoIP || ru.typ == ruleCIDR {
+				ipRules = true
+				continue
+			}
+			if ru.typ == ruleRegex {
+				// RE2 and JavaScript agree on common expressions; with one
+				// the script cannot compile, the route is up to the proxy.
+				fmt.Fprintf(&b, "\ttry { if (new RegExp(%s).test(host)) return %s; } catch (e) { return proxy; } // %s\n",
+					jsString(ru.value), pacResult(ru.action), ru.name)
+				continue
+			}
+			fmt.Fprintf(&b, "\tif (%s) return %s; // %s\n", pacHostCond(ru), pacResult(ru.action), ru.name)
+		}
+	}
+	if !ipRules && (a == nil || !a.bypasses()) {
+		b.WriteString("\treturn proxy;\n}\n")
+		return b.String()
+	}
+
+	b.WriteString("\tvar ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) ? host : dnsResolve(host);\n")
+	b.WriteString("\tif (!ip || ip.indexOf(\":\") >= 0) return proxy;\n")
+	if rs != nil {
+		for _, ru := range rs.rules {
+			switch ru.typ {
+			case ruleGeoIP:
+				fmt.Fprintf(&b, "\treturn proxy; // %s, up to the proxy\n}\n", ru.name)
+				return b.String()
+			case ruleCIDR:
+				if ru.prefix.Addr().Is4() {
+					fmt.Fprintf(&b, "\tif (%s) return %s; // %s\n", pacInNet(ru.prefix), pacResult(ru.action), ru.name)
+				}
+			}
+		}
+	}
+	if a != nil && a.bypasses() {
+		bypass, proxied := pacInNets(a.bypass), pacInNets(a.proxy)
+		switch a.Default {
+		case Proxy:
+			fmt.Fprintf(&b, "\tif ((%s) && !(%s)) return \"DIRECT\"; // ACL\n", bypass, proxied)
+		case Bypass:
+			fmt.Fprintf(&b, "\tif ((%s) && !(%s)) return proxy; // ACL\n", proxied, bypass)
+			b.WriteString("\treturn \"DIRECT\"; // ACL\n}\n")
+			return b.String()
+		}
+	}
+	b.WriteString("\treturn proxy;\n}\n")
+	return b.String()
+}
+
+// bypasses reports whether the ACL bypasses any destination.
+func (a *ACL) bypasses() bool {
+	return a.Default == Bypass || len(a.bypass) > 0
+}
+
+func pacResult(action Action) string {
+	if action == Bypass {
+		return `"DIRECT"`
+	}
+	return "proxy"
+}
+
+// pacHostCond returns the condition matching host in the script, for the
+// host name rule ru other than DOMAIN-REGEX.
+func pacHostCond(ru rule) string {
+	v := jsString(ru.value)
+	switch ru.typ {
+	case ruleDomain:
+		return "host == " + v
+	case ruleSuffix:
+		return fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", v, jsString("."+ru.value))
+	case ruleKeyword:
+		return fmt.Sprintf("host.indexOf(%s) >= 0", v)
+	}
+	return fmt.Sprintf("shExpMatch(host, %s)", v) // DOMAIN-WILDCARD
+}
+
+// pacInNet returns the condition of ip being in the IPv4 prefix p.
+func pacInNet(p netip.Prefix) string {
+	m := uint32(0xFFFFFFFF) << (32 - p.Bits()) // 0 for /0, shifted out
+	mask := netip.AddrFrom4([4]byte{byte(m >> 24), byte(m >> 16), byte(m >> 8), byte(m)})
+	return fmt.Sprintf("isInNet(ip, %q, %q)", p.Addr().String(), mask.String())
+}
+
+// pacInNets returns the condition of ip being in any of the IPv4 prefixes
+// of ps, false if none.
+func pacInNets(ps []netip.Prefix) string {
+	var conds []string
+	for _, p := range ps {
+		if p.Addr().Is4() {
+			conds = append(conds, pacInNet(p))
+		}
+	}
+	if len(conds) == 0 {
+		return "false"
+	}
+	return strings.Join(conds, " || ")
+}
+
+// jsString returns s as a JavaScript string literal.
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,285 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rules route destinations by host name. Each line of a rules file is
+//
+//	TYPE,VALUE,ACTION
+//
+// where TYPE is DOMAIN (exact match), DOMAIN-SUFFIX (the domain and its
+// subdomains), DOMAIN-KEYWORD (substring), DOMAIN-WILDCARD (the whole name,
+// * matching any characters and ? one, e.g. ads*.*.example.com) or
+// DOMAIN-REGEX, and ACTION is PROXY, DIRECT or BLOCK. The first matching rule
+// applies. IP rules match the destination address and apply after the host
+// name rules: IP-CIDR (or IP-CIDR6), whose VALUE is an IP or CIDR prefix,
+// and GEOIP, whose VALUE is a country code. Lines starting with # are
+// comments.
+type Rules struct {
+	rules []rule
+
+	domains  domainTrie     // DOMAIN and DOMAIN-SUFFIX rules
+	patterns []int          // indexes of the other host name rules
+	anyRe    *regexp.Regexp // matches if any DOMAIN-WILDCARD or DOMAIN-REGEX rule does
+	ips      []int          // indexes of the IP rules
+	geo      bool           // whether there are GEOIP rules
+}
+
+type ruleType int
+
+const (
+	ruleDomain ruleType = iota
+	ruleSuffix
+	ruleKeyword
+	ruleWildcard
+	ruleRegex
+	ruleGeoIP
+	ruleCIDR
+)
+
+var ruleTypes = map[string]ruleType{
+	"DOMAIN":          ruleDomain,
+	"DOMAIN-SUFFIX":   ruleSuffix,
+	"DOMAIN-KEYWORD":  ruleKeyword,
+	"DOMAIN-WILDCARD": ruleWildcard,
+	"DOMAIN-REGEX":    ruleRegex,
+	"GEOIP":           ruleGeoIP,
+	"IP-CIDR":         ruleCIDR,
+	"IP-CIDR6":        ruleCIDR,
+}
+
+var actions = map[string]Action{
+	"PROXY":  Proxy,
+	"DIRECT": Bypass,
+	"BYPASS": Bypass,
+	"BLOCK":  Block,
+	"REJECT": Block,
+}
+
+type rule struct {
+	typ    ruleType
+	value  string
+	re     *regexp.Regexp
+	prefix netip.Prefix // of IP-CIDR rules
+	action Action
+	name   string // TYPE,VALUE
+}
+
+// LoadRules reads the rules file at path.
+func LoadRules(path string) (*Rules, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rs, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("rules %s: %v", path, err)
+	}
+	return rs, nil
+}
+
+// ParseRules reads rules from r.
+func ParseRules(r io.Reader) (*Rules, error) {
+	rs := &Rules{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, ",")
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: want TYPE,VALUE,ACTION", n)
+		}
+		typ, ok := ruleTypes[strings.ToUpper(strings.TrimSpace(f[0]))]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown rule type %q", n, f[0])
+		}
+		action, ok := actions[strings.ToUpper(strings.TrimSpace(f[2]))]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown action %q", n, f[2])
+		}
+		ru := rule{typ: typ, value: strings.TrimSpace(f[1]), action: action}
+		switch typ {
+		case ruleRegex:
+			re, err := regexp.Compile(ru.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			ru.re = re
+		case ruleWildcard:
+			ru.value = normalize(ru.value)
+			ru.re = regexp.MustCompile(wildcardRegexp(ru.value))
+		case ruleGeoIP:
+			ru.value = strings.ToUpper(ru.value)
+		case ruleCIDR:
+			p, err := parsePrefix(ru.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			ru.prefix = p
+			ru.value = p.String()
+		default:
+			ru.value = normalize(ru.value)
+		}
+		ru.name = strings.ToUpper(strings.TrimSpace(f[0])) + "," + ru.value
+		rs.rules = append(rs.rules, ru)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	rs.compile()
+	return rs, nil
+}
+
+// wildcardRegexp returns the regular expression matching the same names as
+// the wildcard pattern.
+func wildcardRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// compile indexes the host name rules for Match.
+func (rs *Rules) compile() {
+	var res []string
+	for i, ru := range rs.rules {
+		switch ru.typ {
+		case ruleDomain, ruleSuffix:
+			rs.domains.add(ru.value, i, ru.typ == ruleSuffix)
+		case ruleKeyword:
+			rs.patterns = append(rs.patterns, i)
+		case ruleWildcard, ruleRegex:
+			rs.patterns = append(rs.patterns, i)
+			res = append(res, "(?:"+ru.re.String()+")")
+		case ruleGeoIP, ruleCIDR:
+			rs.ips = append(rs.ips, i)
+			rs.geo = rs.geo || ru.typ == ruleGeoIP
+		}
+	}
+	if len(res) > 0 {
+		rs.anyRe = regexp.MustCompile(strings.Join(res, "|"))
+	}
+}
+
+func normalize(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Match returns the action of the first rule matching host, if any.
+func (rs *Rules) Match(host string) (Action, bool) {
+	action, _, ok := rs.MatchRule(host)
+	return action, ok
+}
+
+// MatchRule is like Match but also returns the matching rule as TYPE,VALUE,
+// e.g. to tag the traffic it routes.
+func (rs *Rules) MatchRule(host string) (Action, string, bool) {
+	host = normalize(host)
+	best := rs.domains.match(host)
+	anyRe := -1 // unknown
+	for _, i := range rs.patterns {
+		if best >= 0 && i > best {
+			break
+		}
+		ru := rs.rules[i]
+		var ok bool
+		switch ru.typ {
+		case ruleKeyword:
+			ok = strings.Contains(host, ru.value)
+		case ruleWildcard, ruleRegex:
+			if anyRe < 0 {
+				anyRe = 0
+				if rs.anyRe.MatchString(host) {
+					anyRe = 1
+				}
+			}
+			ok = anyRe == 1 && ru.re.MatchString(host)
+		}
+		if ok {
+			best = i
+			break
+		}
+	}
+	if best < 0 {
+		return Proxy, "", false
+	}
+	return rs.rules[best].action, rs.rules[best].name, true
+}
+
+// HasGeoIP reports whether there are GEOIP rules.
+func (rs *Rules) HasGeoIP() bool {
+	return rs.geo
+}
+
+// HasIPRules reports whether there are IP-CIDR or GEOIP rules.
+func (rs *Rules) HasIPRules() bool {
+	return len(rs.ips) > 0
+}
+
+// MatchIPRule returns the action of the first IP rule matching ip, and the
+// rule as TYPE,VALUE, if any. country returns the country code of ip, and is
+// called only if a GEOIP rule is reached. It does not allocate.
+func (rs *Rules) MatchIPRule(ip netip.Addr, country func() string) (Action, string, bool) {
+	ip = ip.Unmap()
+	var cc string
+	looked := false
+	for _, i := range rs.ips {
+		ru := &rs.rules[i]
+		switch ru.typ {
+		case ruleCIDR:
+			if !ru.prefix.Contains(ip) {
+				continue
+			}
+		case ruleGeoIP:
+			if !looked {
+				cc, looked = country(), true
+			}
+			if cc == "" || ru.value != cc {
+				continue
+			}
+		}
+		return ru.action, ru.name, true
+	}
+	return Proxy, "", false
+}
+
+// MatchCountry returns the action of the first GEOIP rule matching the
+// country code, if any.
+func (rs *Rules) MatchCountry(country string) (Action, bool) {
+	action, _, ok := rs.MatchCountryRule(country)
+	return action, ok
+}
+
+// MatchCountryRule is like MatchCountry but also returns the matching rule
+// as TYPE,VALUE.
+func (rs *Rules) MatchCountryRule(country string) (Action, string, bool) {
+	if country == "" {
+		return Proxy, "", false
+	}
+	for _, ru := range rs.rules {
+		if ru.typ == ruleGeoIP && ru.value == country {
+			return ru.action, ru.name, true
+		}
+	}
+	return Proxy, "", false
+}
@@ -0,0 +1,62 @@
+package acl
+
+import "strings"
+
+// domainTrie finds the first DOMAIN or DOMAIN-SUFFIX rule matching a host
+// name by walking its labels from the top-level domain down, instead of
+// trying every rule.
+type domainTrie struct {
+	children map[string]*domainTrie
+	exact    int // 1 + index of the first DOMAIN rule ending here, 0 if none
+	suffix   int // same for DOMAIN-SUFFIX rules
+}
+
+// add adds the rule at index i for the normalized domain.
+func (t *domainTrie) add(domain string, i int, suffix bool) {
+	n := t
+	labels := strings.Split(domain, ".")
+	for j := len(labels) - 1; j >= 0; j-- {
+		c := n.children[labels[j]]
+		if c == nil {
+			c = &domainTrie{}
+			if n.children == nil {
+				n.children = make(map[string]*domainTrie)
+			}
+			n.children[labels[j]] = c
+		}
+		n = c
+	}
+	p := &n.exact
+	if suffix {
+		p = &n.suffix
+	}
+	if *p == 0 { // the first rule wins
+		*p = i + 1
+	}
+}
+
+// match returns the index of the first rule matching the normalized host, or
+// -1 if none does.
+func (t *domainTrie) match(host string) int {
+	best := 0
+	n := t
+	labels := strings.Split(host, ".")
+	for j := len(labels) - 1; j >= 0; j-- {
+		if n = n.children[labels[j]]; n == nil {
+			break
+		}
+		best = first(best, n.suffix)
+		if j == 0 {
+			best = first(best, n.exact)
+		}
+	}
+	return best - 1
+}
+
+// first returns the lower of the 1-based indexes a and b, 0 meaning none.
+func first(a, b int) int {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
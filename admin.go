@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// The admin API serves JSON over HTTP on -admin-addr. Requests authenticate
+// with "Authorization: Bearer TOKEN", where the token of -admin-token grants
+// every operation and that of -admin-read-token only those reading state,
+// for monitoring systems:
+//
+//	GET    /stats                    counters and quotas (read)
+//	GET    /sessions                 relays in progress and their transport chains (read)
+//	GET    /traffic                  traffic summed by day, listener and user (read)
+//	DELETE /sessions/{id}            end a relay (admin)
+//	GET    /bans                     banned client IPs (read)
+//	DELETE /bans/{ip}                lift a ban (admin)
+//	GET    /listeners                listening addresses (read)
+//	POST   /listeners/{addr}/pause   stop accepting new sessions (admin)
+//	POST   /listeners/{addr}/resume  accept new sessions again (admin)
+//	POST   /users/{name}/drain       stop accepting new sessions of a user (admin)
+//	POST   /users/{name}/resume      accept new sessions of a user again (admin)
+//	GET    /rates                    bandwidth limits (read)
+//	PUT    /rates/global             set the limit shared by all sessions (admin)
+//	PUT    /listeners/{addr}/rate    set the limit of a listener (admin)
+//	PUT    /users/{name}/rate        set the limit of a user (admin)
+//	DELETE /listeners/{addr}/usage   reset the usage counted for the quota of a listener (admin)
+//	DELETE /users/{name}/usage       reset the usage counted for the quota of a user (admin)
+//
+// Pausing a listener or draining a user ends the relays in progress after
+// ?grace=, such as 30s or 0 for at once, if set. Limits are set with a body
+// as {"rate": 1000000, "burst": 2000000} in bytes per second and bytes, a
+// rate of 0 lifting the limit.
+
+// errRelayEnded ends relays on request.
+var errRelayEnded = errors.New("relay ended through the admin API")
+
+type adminRole int
+
+const (
+	roleNone adminRole = iota
+	roleRead
+	roleAdmin
+)
+
+type adminAPI struct {
+	tokens map[adminRole]string
+	mux    *http.ServeMux
+	start  time.Time
+}
+
+// serveAdmin serves the admin API on addr.
+func serveAdmin(addr, adminToken, readToken string) error {
+	if adminToken == "" && readToken == "" {
+		return errors.New("the admin API requires -admin-token or -admin-read-token")
+	}
+	a := &adminAPI{
+		tokens: map[adminRole]string{roleAdmin: adminToken, roleRead: readToken},
+		mux:    http.NewServeMux(),
+		start:  time.Now(),
+	}
+	a.handle("GET /stats", roleRead, a.stats)
+	a.handle("GET /sessions", roleRead, a.sessions)
+	a.handle("GET /traffic", roleRead, a.traffic)
+	a.handle("DELETE /sessions/{id}", roleAdmin, a.endSession)
+	a.handle("GET /bans", roleRead, a.bans)
+	a.handle("DELETE /bans/{ip}", roleAdmin, a.unban)
+	a.handle("GET /listeners", roleRead, a.listeners)
+	a.handle("POST /listeners/{addr}/pause", roleAdmin, a.pause(true))
+	a.handle("POST /listeners/{addr}/resume", roleAdmin, a.pause(false))
+	a.handle("POST /users/{name}/drain", roleAdmin, a.drain(true))
+	a.handle("POST /users/{name}/resume", roleAdmin, a.drain(false))
+	a.handle("DELETE /listeners/{addr}/usage", roleAdmin, a.resetListenerUsage)
+	a.handle("DELETE /users/{name}/usage", roleAdmin, a.resetUserUsage)
+	a.handle("GET /rates", roleRead, a.rates)
+	a.handle("PUT /rates/global", roleAdmin, a.setRate(func(r *http.Request, l rateLimit) bool {
+		setGlobalLimit(l.Rate, l.Burst)
+		return true
+	}))
+	a.handle("PUT /listeners/{addr}/rate", roleAdmin, a.setRate(func(r *http.Request, l rateLimit) bool {
+		addr := r.PathValue("addr")
+		if findListener(addr) == nil {
+			return false
+		}
+		listenerLimiter(addr) // not to be set to -listener-rate afterwards
+		setLimiter(&listenerLimiters, addr, l.Rate, l.Burst)
+		return true
+	}))
+	a.handle("PUT /users/{name}/rate", roleAdmin, a.setRate(func(r *http.Request, l rateLimit) bool {
+		name := r.PathValue("name")
+		if !serverUsers.has(name) {
+			return false
+		}
+		setLimiter(&userLimiters, name, l.Rate, l.Burst)
+		return true
+	}))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mainLog.Infof("admin API on %s", l.Addr())
+	go (&http.Server{Handler: a.mux, ErrorLog: mainLog.std(slog.LevelDebug)}).Serve(l)
+	return nil
+}
+
+// handle serves pattern with h to requests with at least role.
+func (a *adminAPI) handle(pattern string, role adminRole, h http.HandlerFunc) {
+	a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		switch got := a.role(r); {
+		case got == roleNone:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case got < role:
+			http.Error(w, "forbidden for read-only tokens", http.StatusForbidden)
+		default:
+			h(w, r)
+		}
+	})
+}
+
+// role returns the role granted by the token of r.
+func (a *adminAPI) role(r *http.Request) adminRole {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return roleNone
+	}
+	for _, role := range []adminRole{roleAdmin, roleRead} {
+		if t := a.tokens[role]; t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return role
+		}
+	}
+	return roleNone
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (a *adminAPI) stats(w http.ResponseWriter, r *http.Request) {
+	tcp, udp := activeRelays.count()
+	writeJSON(w, map[string]any{
+		"uptime":       time.Since(a.start).Round(time.Second).Seconds(),
+		"tcp":          tcp,
+		"udp":          udp,
+		"udp_dropped":  udpDropped.Load(),
+		"udp_evicted":  udpEvicted.Load(),
+		"tcp_rejected": tcpRejected.Load(),
+		"udp_nat":      natEntries(),
+		"bans":         len(clientBans.bans()),
+		"quotas":       quotaStates(),
+	})
+}
+
+// sessions lists the relays in progress, those of a listener, user or proto
+// if set in the query.
+func (a *adminAPI) sessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	l := activeRelays.list()
+	matching := l[:0]
+	for _, s := range l {
+		if matchesQuery(q, "listener", s.Listener) && matchesQuery(q, "user", s.User) && matchesQuery(q, "proto", s.Proto) {
+			matching = append(matching, s)
+		}
+	}
+	writeJSON(w, matching)
+}
+
+// traffic sums the traffic of the relays by day and the comma-separated
+// fields of "by" in the query (listener and user, by default both), those
+// of a day ("today" for the current one), listener or user if set.
+func (a *adminAPI) traffic(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	by := map[string]bool{"listener": true, "user": true}
+	if s := q.Get("by"); s != "" {
+		by = make(map[string]bool)
+		for _, f := range strings.Split(s, ",") {
+			if f != "listener" && f != "user" {
+				http.Error(w, "unknown field "+strconv.Quote(f), http.StatusBadRequest)
+				return
+			}
+			by[f] = true
+		}
+	}
+	if q.Get("day") == "today" {
+		q.Set("day", time.Now().Format(time.DateOnly))
+	}
+	sums := make(map[trafficKey]*trafficSum)
+	for _, s := range activeRelays.traffic() {
+		if !matchesQuery(q, "day", s.Day) || !matchesQuery(q, "listener", s.Listener) || !matchesQuery(q, "user", s.User) {
+			continue
+		}
+		k := s.trafficKey
+		if !by["listener"] {
+			k.Listener = ""
+		}
+		if !by["user"] {
+			k.User = ""
+		}
+		if sums[k] == nil {
+			sums[k] = &trafficSum{trafficKey: k}
+		}
+		sums[k].add(s)
+	}
+	l := make([]trafficSum, 0, len(sums))
+	for _, s := range sums {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		a, b := l[i].trafficKey, l[j].trafficKey
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Listener != b.Listener {
+			return a.Listener < b.Listener
+		}
+		return a.User < b.User
+	})
+	writeJSON(w, l)
+}
+
+// matchesQuery reports whether v is the value of key in q, if set.
+func matchesQuery(q url.Values, key, v string) bool {
+	return !q.Has(key) || q.Get(key) == v
+}
+
+func (a *adminAPI) endSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil || !activeRelays.end(id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) bans(w http.ResponseWriter, r *http.Request) {
+	bans := clientBans.bans()
+	if bans == nil {
+		bans = []ban{}
+	}
+	writeJSON(w, bans)
+}
+
+func (a *adminAPI) unban(w http.ResponseWriter, r *http.Request) {
+	ip, err := netip.ParseAddr(r.PathValue("ip"))
+	if err != nil || !clientBans.unban(ip) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) listeners(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listListeners())
+}
+
+// pause returns the handler pausing or resuming a listener.
+func (a *adminAPI) pause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ls := findListener(r.PathValue("addr"))
+		if ls == nil {
+			http.NotFound(w, r)
+			return
+		}
+		grace, err := parseGrace(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ls.paused.Swap(paused) != paused {
+			state := "resumed"
+			if paused {
+				state = "paused"
+			}
+			mainLog.Infof("listener %s %s through the admin API", ls.addr, state)
+		}
+		key := "listener " + ls.addr
+		if paused && grace >= 0 {
+			endAfter(key, grace, func(e accessEntry) bool { return e.Listener == ls.addr })
+		} else {
+			cancelEnd(key)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// drain returns the handler draining or resuming a user.
+func (a *adminAPI) drain(drained bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !drained {
+			resumeUser(name)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !serverUsers.has(name) {
+			http.NotFound(w, r)
+			return
+		}
+		grace, err := parseGrace(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		drainUser(name, grace)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (a *adminAPI) resetListenerUsage(w http.ResponseWriter, r *http.Request) {
+	addr := r.PathValue("addr")
+	if findListener(addr) == nil {
+		http.NotFound(w, r)
+		return
+	}
+	resetUsage(&listenerUsage, addr)
+	mainLog.Infof("usage of listener %s reset through the admin API", addr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) resetUserUsage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !serverUsers.has(name) {
+		http.NotFound(w, r)
+		return
+	}
+	resetUsage(&userUsage, name)
+	mainLog.Infof("usage of user %s reset through the admin API", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rateLimit is a bandwidth limit, in bytes per second and bytes.
+type rateLimit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst,omitempty"`
+}
+
+// limitOf returns the limit of l, if any.
+func limitOf(l *rate.Limiter) (rateLimit, bool) {
+	if l == nil || l.Limit() == rate.Inf {
+		return rateLimit{}, false
+	}
+	return rateLimit{Rate: int(l.Limit()), Burst: l.Burst()}, true
+}
+
+func (a *adminAPI) rates(w http.ResponseWriter, r *http.Request) {
+	res := struct {
+		Global    *rateLimit           `json:"global,omitempty"`
+		Listeners map[string]rateLimit `json:"listeners"`
+		Users     map[string]rateLimit `json:"users"`
+	}{Listeners: map[string]rateLimit{}, Users: map[string]rateLimit{}}
+	if l, ok := limitOf(globalLimiter.Load()); ok {
+		res.Global = &l
+	}
+	for _, ls := range listListeners() {
+		if l, ok := limitOf(listenerLimiter(ls.Addr)); ok {
+			res.Listeners[ls.Addr] = l
+		}
+	}
+	userLimiters.Range(func(k, v any) bool {
+		if l, ok := limitOf(v.(*rate.Limiter)); ok && serverUsers.has(k.(string)) {
+			res.Users[k.(string)] = l
+		}
+		return true
+	})
+	writeJSON(w, res)
+}
+
+// setRate returns the handler setting a limit with set, which reports
+// whether what it limits exists.
+func (a *adminAPI) setRate(set func(*http.Request, rateLimit) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var l rateLimit
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&l); err != nil {
+			http.Error(w, "invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if l.Rate < 0 || l.Burst < 0 {
+			http.Error(w, "invalid limit: negative rate or burst", http.StatusBadRequest)
+			return
+		}
+		if !set(r, l) {
+			http.NotFound(w, r)
+			return
+		}
+		mainLog.Infof("rate limit of %s set to %d bytes per second through the admin API", r.URL.Path, l.Rate)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// activeRelays tracks the relays of the server in progress, nil unless the
+// admin API is enabled.
+var activeRelays *relayTable
+
+type relayTable struct {
+	mu     sync.Mutex
+	m      map[uint64]*liveRelay
+	nextID uint64
+	ended  map[trafficKey]*trafficSum // traffic of the ended relays
+}
+
+// trafficDays is the number of days the traffic of ended relays is kept.
+const trafficDays = 31
+
+// trafficKey tags the traffic of relays started on Day.
+type trafficKey struct {
+	Day      string `json:"day"`
+	Listener string `json:"listener,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+type trafficSum struct {
+	trafficKey
+	Sessions int64 `json:"sessions"`
+	Sent     int64 `json:"sent"`
+	Received int64 `json:"received"`
+}
+
+func (s *trafficSum) add(o trafficSum) {
+	s.Sessions += o.Sessions
+	s.Sent += o.Sent
+	s.Received += o.Received
+}
+
+// trafficOf returns the traffic of the relay of e.
+func trafficOf(e accessEntry) trafficSum {
+	k := trafficKey{Day: e.Time.Format(time.DateOnly), Listener: e.Listener, User: e.User}
+	return trafficSum{trafficKey: k, Sessions: 1, Sent: e.Sent, Received: e.Received}
+}
+
+type liveRelay struct {
+	entry  accessEntry
+	update func(*accessEntry) // fills in the traffic so far
+	cancel context.CancelFunc
+}
+
+// liveSession is a relay in progress as listed by the admin API.
+type liveSession struct {
+	ID uint64 `json:"id"`
+	accessEntry
+}
+
+func newRelayTable() *relayTable {
+	return &relayTable{m: make(map[uint64]*liveRelay), ended: make(map[trafficKey]*trafficSum)}
+}
+
+// add tracks the relay of e, updated by update and ended by cancel, until
+// remove is called.
+func (t *relayTable) add(e accessEntry, update func(*accessEntry), cancel context.CancelFunc) (remove func()) {
+	if t == nil {
+		return func() {}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	id := t.nextID
+	r := &liveRelay{e, update, cancel}
+	t.m[id] = r
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.m, id)
+		r.update(&r.entry)
+		s := trafficOf(r.entry)
+		if t.ended[s.trafficKey] == nil {
+			t.ended[s.trafficKey] = &trafficSum{trafficKey: s.trafficKey}
+			oldest := time.Now().AddDate(0, 0, -trafficDays).Format(time.DateOnly)
+			for k := range t.ended {
+				if k.Day < oldest {
+					delete(t.ended, k)
+				}
+			}
+		}
+		t.ended[s.trafficKey].add(s)
+	}
+}
+
+// traffic returns the traffic of the ended relays and of those in progress
+// so far, summed by day, listener and user.
+func (t *relayTable) traffic() []trafficSum {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sums := make(map[trafficKey]*trafficSum, len(t.ended))
+	for k, s := range t.ended {
+		c := *s
+		sums[k] = &c
+	}
+	for _, r := range t.m {
+		e := r.entry
+		r.update(&e)
+		s := trafficOf(e)
+		if sums[s.trafficKey] == nil {
+			sums[s.trafficKey] = &trafficSum{trafficKey: s.trafficKey}
+		}
+		sums[s.trafficKey].add(s)
+	}
+	l := make([]trafficSum, 0, len(sums))
+	for _, s := range sums {
+		l = append(l, *s)
+	}
+	return l
+}
+
+// list returns the relays in progress, the oldest first.
+func (t *relayTable) list() []liveSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := make([]liveSession, 0, len(t.m))
+	for id, r := range t.m {
+		s := liveSession{id, r.entry}
+		r.update(&s.accessEntry)
+		s.Duration = time.Since(s.Time).Round(time.Millisecond).Seconds()
+		l = append(l, s)
+	}
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+	return l
+}
+
+// count returns the number of TCP and UDP relays in progress.
+func (t *relayTable) count() (tcp, udp int) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range t.m {
+		if r.entry.Proto == "tcp" {
+			tcp++
+		} else {
+			udp++
+		}
+	}
+	return tcp, udp
+}
+
+// end ends the relay with id, reporting whether there is one.
+func (t *relayTable) end(id uint64) bool {
+	t.mu.Lock()
+	r := t.m[id]
+	t.mu.Unlock()
+	if r == nil {
+		return false
+	}
+	r.cancel()
+	return true
+}
+
+// endMatching ends the relays in progress matching match, returning how many.
+func (t *relayTable) endMatching(match func(accessEntry) bool) int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	var cancels []context.CancelFunc
+	for _, r := range t.m {
+		if match(r.entry) {
+			cancels = append(cancels, r.cancel)
+		}
+	}
+	t.mu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return len(cancels)
+}
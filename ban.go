@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clientBans bans client IPs failing the TCP handshake too often, nil unless
+// -ban-failures is set. This slows down guessing the password and probing.
+// Packets failing to decrypt are not counted: their source can be forged to
+// have any client banned.
+var clientBans *banList
+
+type banList struct {
+	limit    int
+	window   time.Duration
+	duration time.Duration
+
+	mu       sync.Mutex
+	failures map[netip.Addr]*failures
+	banned   map[netip.Addr]time.Time // until
+}
+
+type failures struct {
+	n     int
+	start time.Time
+}
+
+// ban is a banned client IP.
+type ban struct {
+	IP    netip.Addr `json:"ip"`
+	Until time.Time  `json:"until"`
+}
+
+// newBanList bans for duration the IPs failing limit handshakes within window.
+func newBanList(limit int, window, duration time.Duration) *banList {
+	b := &banList{
+		limit:    limit,
+		window:   window,
+		duration: duration,
+		failures: make(map[netip.Addr]*failures),
+		banned:   make(map[netip.Addr]time.Time),
+	}
+	go b.prune()
+	return b
+}
+
+// fail records a failed handshake from ip, banning it past the limit.
+func (b *banList) fail(ip netip.Addr) {
+	if b == nil || !ip.IsValid() {
+		return
+	}
+	ip = ip.Unmap()
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f := b.failures[ip]
+	if f == nil || now.Sub(f.start) > b.window {
+		f = &failures{start: now}
+		b.failures[ip] = f
+	}
+	if f.n++; f.n >= b.limit {
+		delete(b.failures, ip)
+		b.banned[ip] = now.Add(b.duration)
+		serverLog.Infof("banned %v for %v after %d failed handshakes", ip, b.duration, f.n)
+	}
+}
+
+// failAddr records a failed handshake from the client at addr.
+func (b *banList) failAddr(addr net.Addr) {
+	if b == nil {
+		return
+	}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		b.fail(a.AddrPort().Addr())
+	case *net.UDPAddr:
+		b.fail(a.AddrPort().Addr())
+	}
+}
+
+// isBanned reports whether ip is banned.
+func (b *banList) isBanned(ip netip.Addr) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.banned[ip.Unmap()]
+	return ok && time.Now().Before(until)
+}
+
+// unban lifts the ban of ip, reporting whether it was banned.
+func (b *banList) unban(ip netip.Addr) bool {
+	if b == nil {
+		return false
+	}
+	ip = ip.Unmap()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.banned[ip]
+	delete(b.banned, ip)
+	return ok && time.Now().Before(until)
+}
+
+// bans returns the current bans, the earliest to expire first.
+func (b *banList) bans() []ban {
+	if b == nil {
+		return nil
+	}
+	now := time.Now()
+	b.mu.Lock()
+	bans := make([]ban, 0, len(b.banned))
+	for ip, until := range b.banned {
+		if now.Before(until) {
+			bans = append(bans, ban{ip, until})
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// prune forgets expired bans and failures.
+func (b *banList) prune() {
+	for range time.Tick(b.window) {
+		now := time.Now()
+		b.mu.Lock()
+		for ip, until := range b.banned {
+			if !now.Before(until) {
+				delete(b.banned, ip)
+			}
+		}
+		for ip, f := range b.failures {
+			if now.Sub(f.start) > b.window {
+				delete(b.failures, ip)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
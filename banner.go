@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// secretFlags are the flags whose values are never logged.
+var secretFlags = map[string]bool{
+	"password":           true,
+	"key":                true,
+	"shadowtls-password": true,
+	"admin-token":        true,
+	"admin-read-token":   true,
+}
+
+// fileFlags are the flags naming files whose contents are identified by a
+// hash in the startup banner, so that edited files can be told apart.
+var fileFlags = map[string]bool{
+	"acl":      true,
+	"rules":    true,
+	"users":    true,
+	"geoip":    true,
+	configFlag: true,
+	"tls-cert": true,
+}
+
+// logBanner logs the effective configuration, with secrets redacted, so that
+// support requests can include what the process actually runs with.
+func logBanner() {
+	version := "(devel)"
+	if bi, ok := debug.ReadBuildInfo(); ok && bi.Main.Version != "" {
+		version = bi.Main.Version
+	}
+	mainLog.Infof("go-shadowsocks2 %s %s %s/%s", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if v == f.DefValue {
+			return
+		}
+		mainLog.Infof("  -%s=%s", f.Name, bannerValue(f.Name, v))
+	})
+}
+
+// bannerValue returns the value v of the flag name as shown in the banner.
+func bannerValue(name, v string) string {
+	switch {
+	case v == "":
+		return v
+	case secretFlags[name]:
+		return "[redacted]"
+	case fileFlags[name]:
+		b, err := os.ReadFile(v)
+		if err != nil {
+			return fmt.Sprintf("%s (%v)", v, err)
+		}
+		sum := sha256.Sum256(b)
+		return fmt.Sprintf("%s (sha256 %s)", v, hex.EncodeToString(sum[:6]))
+	case name == "plugin-opts":
+		return redactOpts(v)
+	case strings.Contains(v, "://"):
+		parts := strings.Split(v, ",")
+		for i, p := range parts {
+			parts[i] = redactURL(p)
+		}
+		return strings.Join(parts, ",")
+	}
+	return v
+}
+
+// redactURL hides the password and query parameters of the URL s, except
+// for the server weight and priority.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "[redacted]"
+	}
+	q := u.Query()
+	for k := range q {
+		if k != "weight" && k != "priority" {
+			q.Set(k, "redacted")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.Redacted()
+}
+
+// redactOpts hides the values of SIP003 plugin options looking like secrets.
+func redactOpts(s string) string {
+	opts := strings.Split(s, ";")
+	for i, o := range opts {
+		k, _, ok := strings.Cut(o, "=")
+		if lk := strings.ToLower(k); ok && (strings.Contains(lk, "pass") || strings.Contains(lk, "key") || strings.Contains(lk, "secret")) {
+			opts[i] = k + "=[redacted]"
+		}
+	}
+	return strings.Join(opts, ";")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/protect"
+)
+
+// Outbound sockets, those of the server to targets and of the client to its
+// servers and direct targets, are bound to -outbound-ip and, on Linux, to
+// the device of -outbound-interface (SO_BINDTODEVICE), for multi-homed hosts
+// and policy routing. On Linux, they also carry the firewall mark of
+// -fwmark (SO_MARK), so that routing rules can tell them from the traffic a
+// client on a router proxies and avoid sending them back into it.
+var (
+	outboundIP        net.IP
+	outboundInterface string
+	outboundMark      int
+)
+
+// setMark marks outbound sockets with mark, none if 0.
+func setMark(mark int) error {
+	if mark != 0 && !canBindDevice {
+		return errors.New("-fwmark is not supported on this system")
+	}
+	outboundMark = mark
+	return nil
+}
+
+// setOutbound binds outbound sockets to ip and iface, either possibly empty.
+func setOutbound(ip, iface string) error {
+	if ip != "" {
+		if outboundIP = net.ParseIP(ip); outboundIP == nil {
+			return fmt.Errorf("invalid outbound IP %q", ip)
+		}
+	}
+	if iface != "" {
+		if !canBindDevice {
+			return errors.New("-outbound-interface is not supported on this system")
+		}
+		if _, err := net.InterfaceByName(iface); err != nil {
+			return fmt.Errorf("outbound interface %s: %v", iface, err)
+		}
+		outboundInterface = iface
+	}
+	return nil
+}
+
+// outboundBound reports whether outbound sockets are bound, marked or
+// protected.
+func outboundBound() bool {
+	return outboundIP != nil || outboundInterface != "" || outboundMark != 0 || protect.Func != nil
+}
+
+// outboundDialer returns a dialer of outbound TCP connections, timing out
+// after -dial-timeout.
+func outboundDialer() *net.Dialer {
+	d := &net.Dialer{Control: bindControl, Timeout: config.DialTimeout}
+	if outboundIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: outboundIP}
+	}
+	return d
+}
+
+// dialOutbound connects to the TCP address addr within timeout, if not 0.
+func dialOutbound(addr string, timeout time.Duration) (net.Conn, error) {
+	d := outboundDialer()
+	if timeout > 0 {
+		d.Timeout = timeout
+	}
+	return d.Dial("tcp", addr)
+}
+
+// listenOutbound opens an outbound UDP socket bound to laddr or, if empty,
+// any port of the outbound IP.
+func listenOutbound(laddr string) (net.PacketConn, error) {
+	if laddr == "" && outboundIP != nil {
+		laddr = net.JoinHostPort(outboundIP.String(), "0")
+	}
+	lc := net.ListenConfig{Control: bindControl}
+	return lc.ListenPacket(context.Background(), "udp", laddr)
+}
+
+// bindControl protects the socket of c from a VPN, binds it to the outbound
+// interface and sets its mark, if set.
+func bindControl(network, address string, c syscall.RawConn) error {
+	if err := protect.Control(network, address, c); err != nil {
+		return err
+	}
+	if outboundInterface == "" && outboundMark == 0 {
+		return nil
+	}
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		if outboundInterface != "" {
+			err = bindToDevice(fd, outboundInterface)
+		}
+		if err == nil && outboundMark != 0 {
+			err = markSocket(fd, outboundMark)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+package main
+
+import "syscall"
+
+// canBindDevice reports whether sockets can be bound to a device and marked.
+const canBindDevice = true
+
+func bindToDevice(fd uintptr, iface string) error {
+	return syscall.BindToDevice(int(fd), iface)
+}
+
+func markSocket(fd uintptr, mark int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+}
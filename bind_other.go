@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// canBindDevice reports whether sockets can be bound to a device and marked.
+const canBindDevice = false
+
+var errSockopt = errors.New("socket option not supported on this system")
+
+func bindToDevice(fd uintptr, iface string) error { return errSockopt }
+func markSocket(fd uintptr, mark int) error       { return errSockopt }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// How relays to destinations blocked by policy are treated, set with
+// -block-mode. Refusing at once lets applications inside the tunnel tell
+// the destination is blocked; the other modes look like an unresponsive or
+// nonexistent destination instead. Blocked UDP packets are never answered
+// except in fake mode.
+const (
+	blockReject = "reject" // close the connection at once
+	blockDrop   = "drop"   // accept and discard
+	blockFake   = "fake"   // answer DNS queries with NXDOMAIN, discard the rest
+)
+
+// blockedError is the reason a destination is blocked by policy, as opposed
+// to being unreachable.
+type blockedError struct {
+	error
+}
+
+func blocked(format string, a ...any) error {
+	return blockedError{fmt.Errorf(format, a...)}
+}
+
+func isBlocked(err error) bool {
+	var be blockedError
+	return errors.As(err, &be)
+}
+
+func checkBlockMode(mode string) error {
+	switch mode {
+	case blockReject, blockDrop, blockFake:
+		return nil
+	}
+	return fmt.Errorf("unknown block mode %q", mode)
+}
+
+// serveBlocked serves c, a stream relayed to port of a blocked destination,
+// until c is closed or ctx is done.
+func serveBlocked(ctx context.Context, c net.Conn, port uint16) {
+	if config.BlockMode == blockReject {
+		return
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	if config.BlockMode == blockFake && port == 53 {
+		for {
+			var l [2]byte
+			if _, err := io.ReadFull(c, l[:]); err != nil {
+				return
+			}
+			q := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(c, q); err != nil {
+				return
+			}
+			r := nxdomain(q)
+			if r == nil {
+				break
+			}
+			if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(r))), r...)); err != nil {
+				return
+			}
+		}
+	}
+	io.Copy(io.Discard, c)
+}
+
+// blockedConn returns a connection to the blocked destination address served
+// by serveBlocked, as if the client had sent early first.
+func blockedConn(address string, early []byte) net.Conn {
+	var port uint64
+	if _, p, err := net.SplitHostPort(address); err == nil {
+		port, _ = strconv.ParseUint(p, 10, 16)
+	}
+	c, s := net.Pipe()
+	go func() {
+		defer s.Close()
+		serveBlocked(sessions, &bufferedConn{Conn: s, r: bufio.NewReader(io.MultiReader(bytes.NewReader(early), s))}, uint16(port))
+	}()
+	return c
+}
+
+// targetPort returns the port of tgt.
+func targetPort(tgt socks.Addr) uint16 {
+	return binary.BigEndian.Uint16(tgt[len(tgt)-2:])
+}
+
+// fakeReply returns the answer to a UDP payload sent to port of a blocked
+// destination, nil if there should be none.
+func fakeReply(port uint16, payload []byte) []byte {
+	if config.BlockMode != blockFake || port != 53 {
+		return nil
+	}
+	return nxdomain(payload)
+}
+
+// nxdomain returns an NXDOMAIN answer to the DNS query q, or nil if q is not
+// a standard query with one question.
+func nxdomain(q []byte) []byte {
+	return dnsError(q, 3)
+}
+
+// dnsError returns an answer to the DNS query q with rcode and no records, or
+// nil if q is not a standard query with one question.
+func dnsError(q []byte, rcode byte) []byte {
+	if len(q) < 12 || q[2]&0x80 != 0 || binary.BigEndian.Uint16(q[4:]) != 1 {
+		return nil
+	}
+	i := 12
+	for i < len(q) && q[i] != 0 {
+		if q[i]&0xC0 != 0 { // no compression in questions
+			return nil
+		}
+		i += int(q[i]) + 1
+	}
+	i += 1 + 4 // root label, type and class
+	if i > len(q) {
+		return nil
+	}
+	r := make([]byte, i)
+	copy(r, q)
+	r[2] = 0x80 | q[2]&0x79 // response, keeping opcode and RD
+	r[3] = 0x80 | rcode     // RA
+	clear(r[6:12])          // no answer, authority or additional records
+	return r
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+)
+
+// Ciphers compared by the benchmark. Which one is faster depends on whether
+// the CPU accelerates AES, which many ARM routers do not.
+var benchCiphers = []string{"AEAD_AES_128_GCM", "AEAD_AES_256_GCM", "AEAD_CHACHA20_POLY1305"}
+
+const (
+	autoCipher      = "AUTO"
+	benchDuration   = 50 * time.Millisecond
+	cipherHintRatio = 1.5 // how much faster another cipher must be to suggest it
+)
+
+type cipherSpeed struct {
+	name        string
+	bytesPerSec float64
+}
+
+// benchmarkCiphers measures the encryption throughput of benchCiphers on
+// this CPU, fastest first.
+func benchmarkCiphers() []cipherSpeed {
+	speeds := make([]cipherSpeed, 0, len(benchCiphers))
+	for _, name := range benchCiphers {
+		if bps, err := cipherThroughput(name, benchDuration); err == nil {
+			speeds = append(speeds, cipherSpeed{name, bps})
+		}
+	}
+	sort.Slice(speeds, func(i, j int) bool { return speeds[i].bytesPerSec > speeds[j].bytesPerSec })
+	return speeds
+}
+
+// cipherThroughput seals payload-sized chunks with the named cipher for d.
+func cipherThroughput(name string, d time.Duration) (float64, error) {
+	ciph, err := core.PickCipher(name, nil, "benchmark")
+	if err != nil {
+		return 0, err
+	}
+	ac, ok := ciph.(*core.AeadCipher)
+	if !ok {
+		return 0, fmt.Errorf("%s is not an AEAD cipher", name)
+	}
+	aead, err := ac.Encrypter(make([]byte, ac.SaltSize()))
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 0x3FFF+aead.Overhead())
+	nonce := make([]byte, aead.NonceSize())
+	var n int
+	start := time.Now()
+	for time.Since(start) < d {
+		aead.Seal(buf[:0], nonce, buf[:0x3FFF], nil)
+		n += 0x3FFF
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
+
+// fastestCipher returns the cipher picked for -cipher auto.
+func fastestCipher() string {
+	speeds := benchmarkCiphers()
+	if len(speeds) == 0 {
+		return "AEAD_CHACHA20_POLY1305"
+	}
+	return speeds[0].name
+}
+
+// resolveCipher replaces the auto cipher by the fastest one on this CPU.
+// Both ends must end up with the same cipher, so auto suits peers with
+// similar CPUs.
+func resolveCipher(name string) string {
+	if strings.ToUpper(name) != autoCipher {
+		return name
+	}
+	name = fastestCipher()
+	mainLog.Infof("cipher auto: using %s, the fastest on this CPU; the peer must use it too", name)
+	return name
+}
+
+// hintCipher logs a suggestion if another cipher is much faster on this CPU
+// than the chosen one.
+func hintCipher(name string) {
+	name = strings.ToUpper(name)
+	speeds := benchmarkCiphers()
+	for _, s := range speeds {
+		if s.name == name && len(speeds) > 0 && speeds[0].bytesPerSec > cipherHintRatio*s.bytesPerSec {
+			mainLog.Infof("%s runs at %s/s on this CPU while %s runs at %s/s; consider switching both ends to it",
+				name, formatBytes(int64(s.bytesPerSec)), speeds[0].name, formatBytes(int64(speeds[0].bytesPerSec)))
+		}
+	}
+}
+
+// printCipherBenchmark writes the benchmark results for -recommend-cipher.
+func printCipherBenchmark(w io.Writer) {
+	speeds := benchmarkCiphers()
+	for _, s := range speeds {
+		fmt.Fprintf(w, "%-24s %s/s\n", s.name, formatBytes(int64(s.bytesPerSec)))
+	}
+	if len(speeds) > 0 {
+		fmt.Fprintf(w, "recommended: %s\n", speeds[0].name)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The config file is a JSON object whose keys are flag names without the
+// leading dash, e.g. {"s": "ss://...", "udp": true, "udptimeout": "5m"}.
+// Flags given on the command line take precedence.
+
+const configFlag = "config"
+
+// loadConfigFile sets the flags not given on the command line from path.
+func loadConfigFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for name, v := range values {
+		f := flag.Lookup(name)
+		if f == nil || name == configFlag {
+			return fmt.Errorf("config %s: unknown option %q", path, name)
+		}
+		if set[name] {
+			continue
+		}
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case bool:
+			s = strconv.FormatBool(v)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("config %s: invalid value for %q", path, name)
+		}
+		if err := f.Value.Set(s); err != nil {
+			return fmt.Errorf("config %s: invalid value for %q: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// writeConfigSchema writes a JSON Schema of the config file, derived from
+// the registered flags.
+func writeConfigSchema(w io.Writer) error {
+	props := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == configFlag {
+			return
+		}
+		p := map[string]any{"description": f.Usage}
+		switch v := f.Value.(flag.Getter).Get().(type) {
+		case bool:
+			p["type"] = "boolean"
+			p["default"] = v
+		case int, int64, uint, uint64:
+			p["type"] = "integer"
+			p["default"] = v
+		case float64:
+			p["type"] = "number"
+			p["default"] = v
+		case time.Duration:
+			p["type"] = "string"
+			p["pattern"] = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$|^0$`
+			p["default"] = f.DefValue
+		default:
+			p["type"] = "string"
+			if f.DefValue != "" {
+				p["default"] = f.DefValue
+			}
+		}
+		props[f.Name] = p
+	})
+
+	schema := map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "go-shadowsocks2 config",
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
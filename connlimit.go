@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpSlots and udpSlots bound the TCP connections and UDP NAT entries the
+// server holds at once, in all and per client IP, with -tcp-max-conns,
+// -udp-max-nat and their -per-ip counterparts. Connections beyond them are
+// closed as soon as accepted, before anything is read from them, and packets
+// which would start a session are dropped before a socket is opened, so that
+// a flood cannot run a small server out of file descriptors. Unlike
+// -udp-max-sessions, the sessions in progress are never evicted.
+var tcpSlots, udpSlots *slotLimit
+
+var errTooManySessions = errors.New("too many sessions")
+
+// tcpRejected counts the connections closed for lack of a slot.
+var (
+	tcpRejected   atomic.Int64
+	lastRejectLog atomic.Int64
+)
+
+// slotLimit counts the sessions in progress, in all and per client IP.
+type slotLimit struct {
+	max, perIP int // 0 for unlimited
+
+	mu    sync.Mutex
+	total int
+	byIP  map[netip.Addr]int
+}
+
+// newSlotLimit returns a limit of max sessions and perIP per client IP, nil
+// if neither is positive.
+func newSlotLimit(max, perIP int) *slotLimit {
+	if max <= 0 && perIP <= 0 {
+		return nil
+	}
+	return &slotLimit{max: max, perIP: perIP, byIP: make(map[netip.Addr]int)}
+}
+
+// acquire takes a slot for a session of ip, reporting whether there was one
+// left. A nil limit has them all.
+func (l *slotLimit) acquire(ip netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip = ip.Unmap()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.total >= l.max || l.perIP > 0 && l.byIP[ip] >= l.perIP {
+		return false
+	}
+	l.total++
+	l.byIP[ip]++
+	return true
+}
+
+// release gives back the slot of a session of ip.
+func (l *slotLimit) release(ip netip.Addr) {
+	if l == nil {
+		return
+	}
+	ip = ip.Unmap()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.byIP[ip]--; l.byIP[ip] <= 0 {
+		delete(l.byIP, ip)
+	}
+}
+
+// addrIP returns the IP address of addr, the zero Addr if it has none.
+func addrIP(addr net.Addr) netip.Addr {
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap.Addr()
+}
+
+// rejectConn counts and closes c, accepted beyond tcpSlots, logging at most
+// once a second.
+func rejectConn(c net.Conn) {
+	c.Close()
+	n := tcpRejected.Add(1)
+	now := time.Now().UnixNano()
+	if last := lastRejectLog.Load(); now-last >= int64(time.Second) && lastRejectLog.CompareAndSwap(last, now) {
+		tcpLog.Warnf("connection from %v rejected: %v (%d rejected so far)", c.RemoteAddr(), errTooManySessions, n)
+	}
+}
+
+// slotPacketConn gives back the slot of its NAT entry once closed.
+type slotPacketConn struct {
+	net.PacketConn
+	once    sync.Once
+	release func()
+}
+
+func (c *slotPacketConn) Close() error {
+	c.once.Do(c.release)
+	return c.PacketConn.Close()
+}
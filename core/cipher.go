@@ -27,6 +27,13 @@ type PacketConnCipher interface {
 // ErrCipherNotSupported occurs when a cipher is not supported (likely because of security concerns).
 var ErrCipherNotSupported = errors.New("cipher not supported")
 
+// ErrLegacyCipher occurs when a legacy cipher is picked without AllowLegacy.
+var ErrLegacyCipher = errors.New("legacy cipher not allowed")
+
+// AllowLegacy enables the legacy ciphers, kept to interoperate with old
+// deployments while they are migrated.
+var AllowLegacy bool
+
 const (
 	aeadAes128Gcm         = "AEAD_AES_128_GCM"
 	aeadAes192Gcm         = "AEAD_AES_192_GCM"
@@ -34,6 +41,8 @@ const (
 	aeadChacha20Poly1305  = "AEAD_CHACHA20_POLY1305"
 	aeadXChacha20Poly1305 = "AEAD_XCHACHA20_POLY1305"
 	sm4128Gcm             = "SM4_128_GCM"
+
+	chacha20Poly1305Legacy = "CHACHA20-POLY1305" // 8-byte nonce, as in old libev releases
 )
 
 // List of AEAD ciphers: key size in bytes and constructor
@@ -49,6 +58,15 @@ var aeadList = map[string]struct {
 	sm4128Gcm:             {16, shadowaead.SM4GCM},
 }
 
+// List of legacy AEAD ciphers, left out of ListCipher and only picked with
+// AllowLegacy.
+var legacyList = map[string]struct {
+	KeySize int
+	New     func([]byte) (shadowaead.Cipher, error)
+}{
+	chacha20Poly1305Legacy: {32, shadowaead.Chacha20Poly1305Legacy},
+}
+
 // List of stream ciphers: key size in bytes and constructor
 var streamList = map[string]struct {
 	KeySize int
@@ -80,7 +98,7 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 	name = strings.ToUpper(name)
 
 	switch name {
-	case "DUMMY":
+	case "DUMMY", "NONE", "PLAIN":
 		return &dummy{}, nil
 	case "CHACHA20-IETF-POLY1305":
 		name = aeadChacha20Poly1305
@@ -96,7 +114,14 @@ func PickCipher(name string, key []byte, password string) (Cipher, error) {
 		name = sm4128Gcm
 	}
 
-	if choice, ok := aeadList[name]; ok {
+	choice, ok := aeadList[name]
+	if legacy, isLegacy := legacyList[name]; isLegacy {
+		if !AllowLegacy {
+			return nil, ErrLegacyCipher
+		}
+		choice, ok = legacy, true
+	}
+	if ok {
 		if len(key) == 0 {
 			key = Kdf(password, choice.KeySize)
 		}
@@ -146,6 +171,12 @@ func (ciph *StreamCipher) PacketConn(c net.PacketConn) net.PacketConn {
 // dummy cipher does not encrypt
 type dummy struct{}
 
+// IsPlain reports whether c leaves traffic unencrypted.
+func IsPlain(c Cipher) bool {
+	_, ok := c.(*dummy)
+	return ok
+}
+
 func (dummy) StreamConn(c net.Conn) net.Conn             { return c }
 func (dummy) PacketConn(c net.PacketConn) net.PacketConn { return c }
 
@@ -0,0 +1,147 @@
+package core_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+)
+
+func TestMain(m *testing.M) {
+	// Both ends run in this process, so the replay filter would reject every salt.
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "0")
+	os.Exit(m.Run())
+}
+
+func TestPickCipher_Aliases(t *testing.T) {
+	for alias, saltSize := range map[string]int{
+		"chacha20-ietf-poly1305":  32,
+		"xchacha20-ietf-poly1305": 32,
+		"aes-128-gcm":             16,
+		"aes-256-gcm":             32,
+	} {
+		ciph, err := core.PickCipher(alias, nil, "password")
+		if err != nil {
+			t.Fatalf("PickCipher(%q): %v", alias, err)
+		}
+		aead, ok := ciph.(*core.AeadCipher)
+		if !ok {
+			t.Fatalf("PickCipher(%q) is not an AEAD cipher", alias)
+		}
+		if aead.SaltSize() != saltSize {
+			t.Fatalf("PickCipher(%q) salt size = %d, want %d", alias, aead.SaltSize(), saltSize)
+		}
+	}
+}
+
+func TestXChacha20Poly1305_StreamRoundTrip(t *testing.T) {
+	ciph, err := core.PickCipher("xchacha20-ietf-poly1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	ca, cb := ciph.StreamConn(a), ciph.StreamConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	msg := bytes.Repeat([]byte("shadowsocks"), 4096)
+	go func() {
+		if _, err := ca.Write(msg); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(cb, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("decrypted stream differs from plaintext")
+	}
+}
+
+func TestXChacha20Poly1305_PacketRoundTrip(t *testing.T) {
+	ciph, err := core.PickCipher("xchacha20-ietf-poly1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pa, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, cb := ciph.PacketConn(pa), ciph.PacketConn(pb)
+	defer ca.Close()
+	defer cb.Close()
+
+	msg := []byte("shadowsocks")
+	if _, err := ca.WriteTo(msg, cb.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64*1024)
+	n, _, err := cb.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("got %q, want %q", buf[:n], msg)
+	}
+}
+
+func TestLegacyChacha20Poly1305(t *testing.T) {
+	if _, err := core.PickCipher("chacha20-poly1305", nil, "password"); err != core.ErrLegacyCipher {
+		t.Fatalf("picked the legacy cipher without AllowLegacy: %v", err)
+	}
+	core.AllowLegacy = true
+	defer func() { core.AllowLegacy = false }()
+	ciph, err := core.PickCipher("chacha20-poly1305", nil, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := net.Pipe()
+	ca, cb := ciph.StreamConn(a), ciph.StreamConn(b)
+	defer ca.Close()
+	defer cb.Close()
+
+	msg := bytes.Repeat([]byte("shadowsocks"), 4096)
+	go func() {
+		if _, err := ca.Write(msg); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(cb, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("decrypted stream differs from plaintext")
+	}
+}
+
+func BenchmarkStreamConn(b *testing.B) {
+	for _, name := range []string{"none", "aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		ciph, err := core.PickCipher(name, nil, "password")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(name, func(b *testing.B) {
+			buf := make([]byte, 16*1024)
+			w := ciph.StreamConn(discardConn{})
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.Write(buf)
+			}
+		})
+	}
+}
+
+// discardConn is a net.Conn swallowing all writes.
+type discardConn struct{ net.Conn }
+
+func (discardConn) Write(b []byte) (int, error) { return len(b), nil }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"runtime"
+
+	"github.com/Potterli20/go-shadowsocks2/metrics"
+)
+
+// serveDebug serves net/http/pprof under /debug/pprof/, expvar under
+// /debug/vars and the metrics under /metrics on addr, for diagnosing and
+// monitoring live processes. None is authenticated, so addr should not be
+// reachable by others.
+func serveDebug(addr string) error {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("udp_dropped", expvar.Func(func() any { return udpDropped.Load() }))
+	expvar.Publish("udp_evicted", expvar.Func(func() any { return udpEvicted.Load() }))
+	expvar.Publish("tcp_rejected", expvar.Func(func() any { return tcpRejected.Load() }))
+	expvar.Publish("udp_nat_entries", expvar.Func(func() any { return natEntries() }))
+	expvar.Publish("servers", expvar.Func(func() any { return serverStates() }))
+	expvar.Publish("relays", expvar.Func(func() any {
+		tcp, udp := activeRelays.count()
+		return map[string]int{"tcp": tcp, "udp": udp}
+	}))
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.WriteText(w, metrics.Default)
+	})
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mainLog.Infof("debug endpoint on http://%s/debug/pprof/", l.Addr())
+	go http.Serve(l, http.DefaultServeMux) // where pprof and expvar register
+	return nil
+}
+
+// natEntries returns the number of UDP NAT entries of each server listener.
+func natEntries() map[string]int {
+	n := make(map[string]int)
+	remoteNATs.Range(func(k, v any) bool {
+		n[k.(string)] = v.(*natmap).Len()
+		return true
+	})
+	return n
+}
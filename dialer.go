@@ -2,7 +2,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Potterli20/go-shadowsocks2/core"
 	"github.com/Potterli20/go-shadowsocks2/socks"
@@ -13,25 +19,216 @@ type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
 
+// dialer connects to targets through the servers of its serverSet, replaced
+// as a whole when the servers of an online config change.
 type dialer struct {
+	set atomic.Pointer[serverSet]
+}
+
+// serverSet is the servers of the client and how to pick among them.
+type serverSet struct {
 	*speeddial.Dialer
+	servers []string        // ss:// URLs or addresses
+	checks  []*serverHealth // nil without -health-check
 }
 
-func (d dialer) Dial(network, address string) (net.Conn, error) {
+func newDialer(s *serverSet) *dialer {
+	d := &dialer{}
+	d.set.Store(s)
+	return d
+}
+
+func (d *dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialOpts(network, address, dialOpts{})
+}
+
+// DialOpts sends the early data in the same chunk as the target address.
+func (d *dialer) DialOpts(network, address string, o dialOpts) (net.Conn, error) {
 	if network != "tcp" {
 		return nil, errors.New("only TCP network is supported")
 	}
-	c, err := d.Dialer.Dial()
+	c, err := d.set.Load().DialKey(balanceKey(address))
 	if err != nil {
 		return c, err
 	}
-	_, err = c.Write(socks.ParseAddr(address))
+	tagUsage(c, o.tags)
+	_, err = c.Write(append(socks.ParseAddr(address), o.early...))
 	if err != nil {
 		c.Close()
 	}
 	return c, err
 }
 
+// balanceKey returns the key picking the server of address with -balance
+// consistent-hash: its host, for all the ports of a site to go the same way.
+func balanceKey(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// dialOpts are the extras of a connection dialed for a client.
+type dialOpts struct {
+	early []byte    // first data of the client, to send with the target address
+	tags  usageTags // of the traffic in the usage stats
+}
+
+// optDialer is a Dialer taking dialOpts. Sending the early data along with
+// the target address saves a round trip.
+type optDialer interface {
+	DialOpts(network, address string, o dialOpts) (net.Conn, error)
+}
+
+// dialWith connects to address through d with o if d is an optDialer, or
+// else dials and sends the early data.
+func dialWith(d Dialer, network, address string, o dialOpts) (net.Conn, error) {
+	if d, ok := d.(optDialer); ok {
+		return d.DialOpts(network, address, o)
+	}
+	c, err := d.Dial(network, address)
+	if err != nil || len(o.early) == 0 {
+		return c, err
+	}
+	if _, err := c.Write(o.early); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// shadowDial returns a Dial connecting to the server at addr using ciph.
+func shadowDial(addr string, ciph core.StreamConnCipher) speeddial.Dial {
+	return func() (net.Conn, error) {
+		c, err := dial(addr)
+		clientEvents.dialed(addr, err)
+		if err != nil {
+			return c, err
+		}
+		c = clientUsage.conn(tcpSocket(c), addr, routeProxy, usageTags{})
+		uc := c
+		c = clientEvents.conn(c)
+		if config.TCPCork {
+			c = timedCork(c, 10*time.Millisecond, 1280)
+		}
+		return taggable(ciph.StreamConn(c), uc), nil
+	}
+}
+
+// serverDial returns a Dial connecting to the server s, an ss:// URL or an
+// address using cipher, password and key.
+func serverDial(s, cipher, password string, key []byte) (speeddial.Dial, error) {
+	addr := s
+	if strings.HasPrefix(s, "ss://") {
+		var err error
+		if addr, cipher, password, err = parseURL(s); err != nil {
+			return nil, err
+		}
+	}
+	ciph, err := pickCipher(resolveCipher(cipher), key, password)
+	if err != nil {
+		return nil, err
+	}
+	return shadowDial(addr, padded(ciph)), nil
+}
+
+// serverWeight returns the weight of the server s given by the weight
+// parameter of its ss:// URL, 1 by default.
+func serverWeight(s string) (int, error) {
+	return serverParam(s, "weight", 1, 1)
+}
+
+// serverPriority returns the priority of the server s given by the priority
+// parameter of its ss:// URL, 0 by default: -balance failover prefers the
+// servers of lower priorities.
+func serverPriority(s string) (int, error) {
+	return serverParam(s, "priority", 0, 0)
+}
+
+// serverHost returns the address of the server s, an ss:// URL or an address.
+func serverHost(s string) string {
+	if strings.HasPrefix(s, "ss://") {
+		if u, err := url.Parse(s); err == nil {
+			return u.Host
+		}
+	}
+	return s
+}
+
+// serverParam returns the integer parameter name of the ss:// URL s, at
+// least least, or def if missing.
+func serverParam(s, name string, def, least int) (int, error) {
+	if !strings.HasPrefix(s, "ss://") {
+		return def, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return 0, err
+	}
+	v := u.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < least {
+		return 0, fmt.Errorf("invalid %s %q of server %s", name, v, u.Host)
+	}
+	return n, nil
+}
+
+// newServerSet returns the set of servers, dialed by dials, picked among
+// with the -balance strategy, with health checks if checked.
+func newServerSet(servers []string, dials []speeddial.Dial, balance string, checked bool) (*serverSet, error) {
+	sd := speeddial.New(dials...)
+	var err error
+	if sd.Strategy, err = parseStrategy(balance); err != nil {
+		return nil, err
+	}
+	for i, s := range servers {
+		w, err := serverWeight(s)
+		if err != nil {
+			return nil, err
+		}
+		sd.SetWeight(i, w)
+		p, err := serverPriority(s)
+		if err != nil {
+			return nil, err
+		}
+		sd.SetPriority(i, p)
+	}
+	sd.Changed = func(i int, up bool) {
+		if up {
+			mainLog.Infof("server %s is up again", serverHost(servers[i]))
+		} else {
+			mainLog.Warnf("server %s is down", serverHost(servers[i]))
+		}
+	}
+	s := &serverSet{Dialer: sd, servers: servers}
+	if checked {
+		s.checks = newServerChecks(servers, dials)
+	}
+	return s, nil
+}
+
+// parseStrategy parses the -balance strategy.
+func parseStrategy(s string) (speeddial.Strategy, error) {
+	switch s {
+	case "fastest", "least-latency":
+		return speeddial.Fastest, nil
+	case "random":
+		return speeddial.WeightedRandom, nil
+	case "least-conn":
+		return speeddial.LeastConn, nil
+	case "failover":
+		return speeddial.Failover, nil
+	case "round-robin":
+		return speeddial.RoundRobin, nil
+	case "consistent-hash":
+		return speeddial.ConsistentHash, nil
+	}
+	return 0, fmt.Errorf("unknown balancing strategy %q", s)
+}
+
 func fastdialer(u ...string) (*dialer, error) {
 	rs := make([]speeddial.Dial, len(u))
 	for i := range u {
@@ -45,15 +242,7 @@ func fastdialer(u ...string) (*dialer, error) {
 			return nil, err
 		}
 
-		rs[i] = func() (net.Conn, error) {
-			c, err := net.Dial("tcp", addr)
-			if err != nil {
-				return c, err
-			}
-			tcpKeepAlive(c)
-			c = ciph.StreamConn(c)
-			return c, nil
-		}
+		rs[i] = shadowDial(addr, ciph)
 	}
-	return &dialer{speeddial.New(rs...)}, nil
+	return newDialer(&serverSet{Dialer: speeddial.New(rs...), servers: u}), nil
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// dnsRetrier resends the DNS queries of a UDP tunnel to a resolver which get
+// no answer within a timeout, to a fallback resolver if there is one, and
+// answers SERVFAIL once the retries are exhausted. A lost packet then costs
+// a client a fraction of a second rather than its own timeout of seconds.
+type dnsRetrier struct {
+	timeout time.Duration
+	retries int
+	targets []socks.Addr // the tunnel target, then the fallback if any
+	server  net.Addr
+	reply   func(b []byte, client netip.AddrPort) // to the client
+
+	mu      sync.Mutex
+	pending map[dnsQueryKey]*dnsQuery
+}
+
+type dnsQueryKey struct {
+	client netip.AddrPort
+	id     uint16
+}
+
+type dnsQuery struct {
+	q     []byte
+	pc    net.PacketConn // of the session of the client
+	tries int
+	timer *time.Timer
+}
+
+// newDNSRetrier retries queries to tgt through server as configured, or
+// returns nil if retries are disabled or tgt is not a resolver on port 53.
+func newDNSRetrier(tgt socks.Addr, server net.Addr, reply func([]byte, netip.AddrPort)) (*dnsRetrier, error) {
+	if config.DNSTimeout <= 0 || targetPort(tgt) != 53 {
+		return nil, nil
+	}
+	r := &dnsRetrier{
+		timeout: config.DNSTimeout,
+		retries: config.DNSRetries,
+		targets: []socks.Addr{tgt},
+		server:  server,
+		reply:   reply,
+		pending: make(map[dnsQueryKey]*dnsQuery),
+	}
+	if config.DNSFallback != "" {
+		fallback := socks.ParseAddr(config.DNSFallback)
+		if fallback == nil {
+			return nil, fmt.Errorf("invalid DNS fallback address: %q", config.DNSFallback)
+		}
+		r.targets = append(r.targets, fallback)
+	}
+	return r, nil
+}
+
+// conn returns pc, the socket relaying the packets of client, noting the
+// answers read from it.
+func (r *dnsRetrier) conn(pc net.PacketConn, client netip.AddrPort) net.PacketConn {
+	if r == nil {
+		return pc
+	}
+	return &dnsAnswerConn{PacketConn: pc, r: r, client: client}
+}
+
+// sent notes the query q of client relayed through pc, to be retried unless
+// answered in time.
+func (r *dnsRetrier) sent(client netip.AddrPort, pc net.PacketConn, q []byte) {
+	if r == nil || len(q) < 12 || q[2]&0x80 != 0 {
+		return
+	}
+	key := dnsQueryKey{client, binary.BigEndian.Uint16(q)}
+	query := &dnsQuery{q: append([]byte(nil), q...), pc: pc}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old := r.pending[key]; old != nil { // the client retried first
+		old.timer.Stop()
+	}
+	r.pending[key] = query
+	query.timer = time.AfterFunc(r.timeout, func() { r.expire(key, query) })
+}
+
+// answered notes the answer a of client.
+func (r *dnsRetrier) answered(client netip.AddrPort, a []byte) {
+	if len(a) < 12 {
+		return
+	}
+	key := dnsQueryKey{client, binary.BigEndian.Uint16(a)}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if query := r.pending[key]; query != nil {
+		query.timer.Stop()
+		delete(r.pending, key)
+	}
+}
+
+// expire retries query, or fails it if out of retries.
+func (r *dnsRetrier) expire(key dnsQueryKey, query *dnsQuery) {
+	r.mu.Lock()
+	if r.pending[key] != query {
+		r.mu.Unlock()
+		return
+	}
+	if query.tries < r.retries {
+		query.tries++
+		tgt := r.targets[min(query.tries, len(r.targets)-1)]
+		query.timer.Reset(r.timeout)
+		r.mu.Unlock()
+		udpLog.Debugf("DNS query %d of %v unanswered, retrying with %v", key.id, key.client, tgt)
+		query.pc.WriteTo(append(append([]byte(nil), tgt...), query.q...), r.server)
+		return
+	}
+	delete(r.pending, key)
+	r.mu.Unlock()
+	udpLog.Debugf("DNS query %d of %v unanswered, failing it", key.id, key.client)
+	if a := dnsError(query.q, 2); a != nil { // SERVFAIL
+		r.reply(a, key.client)
+	}
+}
+
+// dnsAnswerConn notes the DNS answers to a client read from a relay socket.
+type dnsAnswerConn struct {
+	net.PacketConn
+	r      *dnsRetrier
+	client netip.AddrPort
+}
+
+func (c *dnsAnswerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		if src := socks.SplitAddr(b[:n]); src != nil {
+			c.r.answered(c.client, b[len(src):n])
+		}
+	}
+	return n, addr, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// targetCache, unless disabled with -dns-cache 0, caches the addresses of
+// the host names of targets for TCP and UDP alike, so that a flow of packets
+// to a named target costs one query per -dns-cache-ttl instead of one per
+// packet. The system resolver does not tell the TTL of records, so every
+// entry lives as long.
+var targetCache *dnsCache
+
+// dnsCache is an LRU cache of host name lookups. Concurrent lookups of the
+// same name share a single query.
+type dnsCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *dnsEntry
+	lru     list.List                // the most recently used first
+}
+
+type dnsEntry struct {
+	key     string
+	done    chan struct{} // closed once resolved
+	ips     []netip.Addr
+	err     error
+	expires time.Time
+}
+
+func (e *dnsEntry) resolved() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func newDNSCache(size int, ttl time.Duration) *dnsCache {
+	return &dnsCache{size: size, ttl: ttl, entries: make(map[string]*list.Element)}
+}
+
+// lookup returns the addresses of host for network, "ip", "ip4" or "ip6",
+// resolved with hostResolver if not cached. Names not found are cached
+// too; other failures are not.
+func (c *dnsCache) lookup(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	key := network + " " + host
+	c.mu.Lock()
+	el := c.entries[key]
+	if el != nil {
+		if e := el.Value.(*dnsEntry); e.resolved() && time.Now().After(e.expires) {
+			c.remove(el)
+			el = nil
+		} else {
+			c.lru.MoveToFront(el)
+		}
+	}
+	if el == nil {
+		e := &dnsEntry{key: key, done: make(chan struct{})}
+		el = c.lru.PushFront(e)
+		c.entries[key] = el
+		for c.lru.Len() > c.size {
+			c.remove(c.lru.Back())
+		}
+		c.mu.Unlock()
+
+		// The query goes on for the others waiting if ctx is done.
+		e.ips, e.err = hostResolver.LookupNetIP(context.WithoutCancel(ctx), network, host)
+		e.expires = time.Now().Add(c.ttl)
+		if e.err != nil && !isNotFound(e.err) {
+			c.mu.Lock()
+			if c.entries[key] == el {
+				c.remove(el)
+			}
+			c.mu.Unlock()
+		}
+		close(e.done)
+		return e.addrs()
+	}
+	c.mu.Unlock()
+
+	e := el.Value.(*dnsEntry)
+	select {
+	case <-e.done:
+		return e.addrs()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// addrs returns a copy of the result of e, for callers to reorder.
+func (e *dnsEntry) addrs() ([]netip.Addr, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return append([]netip.Addr(nil), e.ips...), nil
+}
+
+// remove removes el from c, which must be locked.
+func (c *dnsCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*dnsEntry).key)
+}
+
+func isNotFound(err error) bool {
+	var de *net.DNSError
+	return errors.As(err, &de) && de.IsNotFound
+}
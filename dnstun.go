@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// A -dnstun forwarder serves DNS on a local address over UDP and TCP, as a
+// router would to its LAN, answering from its cache or through the tunnel.
+// Queries go to the resolver over a TCP connection kept open and shared by
+// those in flight (RFC 7766), which needs neither UDP relaying by the server
+// nor a connection per query.
+
+// dnsTunTimeout bounds the wait for the answer of a forwarded query.
+const dnsTunTimeout = 5 * time.Second
+
+var errDNSTimeout = errors.New("DNS query timed out")
+
+type dnsForwarder struct {
+	laddr    string
+	resolver string
+	d        Dialer
+	cache    *dnsAnswerCache // nil if disabled
+
+	mu   sync.Mutex
+	pipe *dnsPipe
+}
+
+// dnsTun serves DNS on laddr, forwarding queries to resolver through d and
+// caching up to cacheSize answers.
+func dnsTun(laddr, resolver string, d Dialer, cacheSize int) {
+	start := listenerStarting()
+	defer start.end()
+	if socks.ParseAddr(resolver) == nil {
+		dnsLog.Errorf("invalid resolver address %q", resolver)
+		return
+	}
+	f := &dnsForwarder{laddr: laddr, resolver: resolver, d: d}
+	if cacheSize > 0 {
+		f.cache = &dnsAnswerCache{size: cacheSize, entries: make(map[string]*dnsAnswer)}
+	}
+	uc, err := net.ListenPacket("udp", laddr)
+	if err != nil {
+		dnsLog.Errorf("DNS forwarder listen error: %v", err)
+		return
+	}
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		uc.Close()
+		dnsLog.Errorf("DNS forwarder listen error: %v", err)
+		return
+	}
+	start.bound()
+	dnsLog.Infof("DNS forwarder %s <-> %s", laddr, resolver)
+	go f.serveTCP(l)
+	f.serveUDP(uc)
+}
+
+func (f *dnsForwarder) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, raddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			dnsLog.Debugf("DNS forwarder read error: %v", err)
+			continue
+		}
+		q := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer reportPanic()
+			a := f.answer(q, raddr)
+			if a == nil {
+				return
+			}
+			if len(a) > udpAnswerLimit(q) {
+				a = dnsError(q, 0)
+				a[2] |= 0x02 // truncated, to be asked again over TCP
+			}
+			pc.WriteTo(a, raddr)
+		}()
+	}
+}
+
+func (f *dnsForwarder) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			dnsLog.Warnf("failed to accept: %v", err)
+			continue
+		}
+		go func() {
+			defer reportPanic()
+			defer c.Close()
+			for {
+				c.SetReadDeadline(time.Now().Add(2 * time.Minute))
+				q, err := readDNSMessage(c)
+				if err != nil {
+					return
+				}
+				a := f.answer(q, c.RemoteAddr())
+				if a == nil {
+					return
+				}
+				if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(a))), a...)); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer returns the answer to the query q of client, SERVFAIL if the
+// resolver cannot be reached, or nil if q is not a query.
+func (f *dnsForwarder) answer(q []byte, client net.Addr) []byte {
+	if len(q) < 12 || q[2]&0x80 != 0 {
+		return nil
+	}
+	key := dnsCacheKey(q)
+	if a := f.cache.get(key, q); a != nil {
+		return a
+	}
+	a, err := f.forward(q)
+	if err != nil {
+		dnsLog.Debugf("DNS query of %v to %s: %v", client, f.resolver, err)
+		return dnsError(q, 2)
+	}
+	f.cache.put(key, a)
+	return a
+}
+
+// forward sends q to the resolver and returns its answer, trying again on a
+// new connection if the one kept open is gone, e.g. closed by the resolver
+// while idle.
+func (f *dnsForwarder) forward(q []byte) ([]byte, error) {
+	for try := 0; ; try++ {
+		p, err := f.conn()
+		if err != nil {
+			return nil, err
+		}
+		a, err := p.exchange(q)
+		if err == nil || err == errDNSTimeout || try > 0 {
+			return a, err
+		}
+	}
+}
+
+// conn returns the connection to the resolver, connecting it if needed.
+func (f *dnsForwarder) conn() (*dnsPipe, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pipe != nil && !f.pipe.failed() {
+		return f.pipe, nil
+	}
+	c, err := dialWith(f.d, "tcp", f.resolver, dialOpts{tags: usageTags{Listener: f.laddr}})
+	if err != nil {
+		return nil, err
+	}
+	f.pipe = &dnsPipe{c: c, pending: make(map[uint16]chan []byte)}
+	go f.pipe.read()
+	return f.pipe, nil
+}
+
+// dnsPipe is a TCP connection to a resolver carrying the queries in flight
+// at once, matched to their answers by the IDs it gives them.
+type dnsPipe struct {
+	c   net.Conn
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	id      uint16
+	pending map[uint16]chan []byte
+	err     error // once the connection failed
+}
+
+func (p *dnsPipe) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
+
+// fail closes p for err, failing the queries in flight.
+func (p *dnsPipe) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+		for _, ch := range p.pending {
+			close(ch)
+		}
+		p.pending = nil
+	}
+	p.mu.Unlock()
+	p.c.Close()
+}
+
+func (p *dnsPipe) exchange(q []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	for p.id++; p.pending[p.id] != nil; p.id++ {
+	}
+	id := p.id
+	p.pending[id] = ch
+	p.mu.Unlock()
+
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(q)))
+	b = append(b, q...)
+	binary.BigEndian.PutUint16(b[2:], id)
+	p.wmu.Lock()
+	_, err := p.c.Write(b)
+	p.wmu.Unlock()
+	if err != nil {
+		p.fail(err)
+		return nil, err
+	}
+
+	t := time.NewTimer(dnsTunTimeout)
+	defer t.Stop()
+	select {
+	case a, ok := <-ch:
+		if !ok {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return nil, p.err
+		}
+		copy(a, q[:2]) // the ID of the client
+		return a, nil
+	case <-t.C:
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+		return nil, errDNSTimeout
+	}
+}
+
+// read hands the answers read from p to the queries waiting for them.
+func (p *dnsPipe) read() {
+	for {
+		a, err := readDNSMessage(p.c)
+		if err != nil {
+			p.fail(err)
+			return
+		}
+		if len(a) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(a)
+		p.mu.Lock()
+		ch := p.pending[id]
+		delete(p.pending, id)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- a
+		}
+	}
+}
+
+// readDNSMessage reads a message prefixed with its length, as over TCP.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// udpAnswerLimit returns the size of the largest answer to q over UDP: 512
+// bytes, or as advertised with EDNS.
+func udpAnswerLimit(q []byte) int {
+	var p dnsmessage.Parser
+	if _, err := p.Start(q); err != nil || p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return 512
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err != nil {
+			return 512
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(int(h.Class), 512) // the UDP payload size
+		}
+		if p.SkipAdditional() != nil {
+			return 512
+		}
+	}
+}
+
+// dnsCacheKey returns the key of the answers to q in the cache: its question
+// and whether DNSSEC records are asked for, or "" if it cannot be cached.
+func dnsCacheKey(q []byte) string {
+	var p dnsmessage.Parser
+	h, err := p.Start(q)
+	if err != nil || h.OpCode != 0 {
+		return ""
+	}
+	qs, err := p.AllQuestions()
+	if err != nil || len(qs) != 1 || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return ""
+	}
+	key := strings.ToLower(qs[0].Name.String()) + " " + qs[0].Type.String() + " " + qs[0].Class.String()
+	if h.CheckingDisabled {
+		key += " cd"
+	}
+	for {
+		ah, err := p.AdditionalHeader()
+		if err != nil {
+			return key
+		}
+		if ah.Type == dnsmessage.TypeOPT && ah.TTL&(1<<15) != 0 {
+			key += " do"
+		}
+		if p.SkipAdditional() != nil {
+			return key
+		}
+	}
+}
+
+// dnsAnswerCache caches the answers of a forwarder for the lowest TTL of
+// their records, giving the remaining TTLs when answering from it.
+type dnsAnswerCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*dnsAnswer
+}
+
+type dnsAnswer struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// get returns the cached answer to q of key, nil if none.
+func (c *dnsAnswerCache) get(key string, q []byte) []byte {
+	if c == nil || key == "" {
+		return nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e := c.entries[key]
+	if e != nil && !now.Before(e.expires) {
+		delete(c.entries, key)
+		e = nil
+	}
+	c.mu.Unlock()
+	if e == nil {
+		return nil
+	}
+	m := e.msg
+	m.Header.ID = binary.BigEndian.Uint16(q)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	m.Answers = agedResources(m.Answers, elapsed)
+	m.Authorities = agedResources(m.Authorities, elapsed)
+	m.Additionals = agedResources(m.Additionals, elapsed)
+	a, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// agedResources returns a copy of rs with elapsed seconds off their TTLs.
+func agedResources(rs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	rs = append([]dnsmessage.Resource(nil), rs...)
+	for i := range rs {
+		if rs[i].Header.Type != dnsmessage.TypeOPT {
+			rs[i].Header.TTL -= min(elapsed, rs[i].Header.TTL)
+		}
+	}
+	return rs
+}
+
+// put caches the answer a of key if it is a success or a name not found and
+// has records to take the TTL of.
+func (c *dnsAnswerCache) put(key string, a []byte) {
+	if c == nil || key == "" {
+		return
+	}
+	var m dnsmessage.Message
+	if m.Unpack(a) != nil || m.Truncated || (m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	ttl, ok := uint32(0), false
+	for _, rs := range [][]dnsmessage.Resource{m.Answers, m.Authorities} {
+		for _, r := range rs {
+			if !ok || r.Header.TTL < ttl {
+				ttl, ok = r.Header.TTL, true
+			}
+		}
+	}
+	if !ok || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	e := &dnsAnswer{msg: m, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = e
+}
+
+// evict removes the expired entries of c, which must be locked, or the one
+// expiring first if none is.
+func (c *dnsAnswerCache) evict(now time.Time) {
+	var first string
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		} else if first == "" || e.expires.Before(c.entries[first].expires) {
+			first = k
+		}
+	}
+	if len(c.entries) >= c.size {
+		delete(c.entries, first)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A drained user has its new sessions refused on every listener, while those
+// in progress go on or end after a grace period, so that a single account is
+// suspended without touching the others. Users stay drained by name across
+// reloads of -users until resumed. A paused listener is drained the same way.
+
+// drainedUsers holds the names of the drained users.
+var drainedUsers sync.Map // string -> struct{}
+
+// drained reports whether u is drained. A nil user, as in single-user mode,
+// never is.
+func (u *user) drained() bool {
+	if u == nil {
+		return false
+	}
+	_, ok := drainedUsers.Load(u.Name)
+	return ok
+}
+
+// has reports whether db has a user named name.
+func (db *userDB) has(name string) bool {
+	return db.named(name) != nil
+}
+
+// named returns the user of db named name, nil if none.
+func (db *userDB) named(name string) *user {
+	if db == nil {
+		return nil
+	}
+	for _, u := range db.set.Load().users {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// pendingEnds holds the timers ending the relays of a drained user or paused
+// listener after the grace period, by "user NAME" or "listener ADDR".
+var pendingEnds = struct {
+	sync.Mutex
+	m map[string]*time.Timer
+}{m: make(map[string]*time.Timer)}
+
+// endAfter ends the relays in progress matching match after grace, instead of
+// those of key pending.
+func endAfter(key string, grace time.Duration, match func(accessEntry) bool) {
+	pendingEnds.Lock()
+	defer pendingEnds.Unlock()
+	if t := pendingEnds.m[key]; t != nil {
+		t.Stop()
+	}
+	var t *time.Timer
+	t = time.AfterFunc(grace, func() {
+		pendingEnds.Lock()
+		if pendingEnds.m[key] != t {
+			pendingEnds.Unlock()
+			return
+		}
+		delete(pendingEnds.m, key)
+		pendingEnds.Unlock()
+		if n := activeRelays.endMatching(match); n > 0 {
+			mainLog.Infof("ended %d relays of drained %s", n, key)
+		}
+	})
+	pendingEnds.m[key] = t
+}
+
+// cancelEnd cancels the pending end of the relays of key.
+func cancelEnd(key string) {
+	pendingEnds.Lock()
+	defer pendingEnds.Unlock()
+	if t := pendingEnds.m[key]; t != nil {
+		t.Stop()
+		delete(pendingEnds.m, key)
+	}
+}
+
+// drainUser drains the user named name, ending the relays in progress after
+// grace unless it is negative.
+func drainUser(name string, grace time.Duration) {
+	if _, loaded := drainedUsers.LoadOrStore(name, struct{}{}); !loaded {
+		mainLog.Infof("user %s drained through the admin API", name)
+	}
+	key := "user " + name
+	if grace < 0 {
+		cancelEnd(key)
+		return
+	}
+	endAfter(key, grace, func(e accessEntry) bool { return e.User == name })
+}
+
+// resumeUser accepts new sessions of the user named name again.
+func resumeUser(name string) {
+	cancelEnd("user " + name)
+	if _, loaded := drainedUsers.LoadAndDelete(name); loaded {
+		mainLog.Infof("user %s resumed through the admin API", name)
+	}
+}
+
+// parseGrace returns the grace period of the query of r, -1 if unset.
+func parseGrace(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("grace")
+	if s == "" {
+		return -1, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid grace %q", s)
+	}
+	return d, nil
+}
+
+// drainCommand drains a user or listener through the admin API, as in
+//
+//	go-shadowsocks2 drain -admin http://127.0.0.1:8489 [-grace 30s] [-resume] [-listener] NAME
+func drainCommand(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:8489", "URL of the admin API of the server")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "token of -admin-token, $ADMIN_TOKEN by default")
+	grace := fs.Duration("grace", -1, "end the sessions in progress after this long, 0 at once, negative to let them go on")
+	resume := fs.Bool("resume", false, "accept new sessions again instead")
+	listener := fs.Bool("listener", false, "NAME is a listening address, such as 127.0.0.1:8488, instead of a user")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("drain: a user name is required")
+	}
+	path := "/users/" + url.PathEscape(fs.Arg(0)) + "/drain"
+	if *listener {
+		path = "/listeners/" + url.PathEscape(fs.Arg(0)) + "/pause"
+	}
+	if *resume {
+		path = path[:strings.LastIndexByte(path, '/')] + "/resume"
+	} else if *grace >= 0 {
+		path += "?grace=" + grace.String()
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*admin, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("drain: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
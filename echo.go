@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// The echo command runs a TCP and UDP echo server to place behind a
+// shadowsocks server, and tests the server through it from a client, so
+// that encryption, UDP relaying and throughput can be checked end to end
+// with this binary alone.
+//
+// TCP connections echo what they receive, unless their first line is one of
+//
+//	SINK    discard the zeros which follow up to a byte 1, then answer
+//	        "<bytes> <nanoseconds>" (shadowsocks relays do not pass on EOF)
+//	SOURCE  send zeros until the connection is closed
+const (
+	echoSink   = "SINK\n"
+	echoSource = "SOURCE\n"
+)
+
+// echoCommand runs the echo command, as in
+//
+//	go-shadowsocks2 echo -s :9999
+//	go-shadowsocks2 echo -c ss://AEAD_CHACHA20_POLY1305:your-password@server:8488 -target 127.0.0.1:9999
+func echoCommand(args []string) error {
+	fs := flag.NewFlagSet("echo", flag.ExitOnError)
+	listen := fs.String("s", "", "serve TCP and UDP echo on this address, e.g. :9999")
+	server := fs.String("c", "", "test the shadowsocks server of this ss:// URL against an echo server")
+	target := fs.String("target", "127.0.0.1:9999", "address of the echo server as seen from the shadowsocks server")
+	duration := fs.Duration("duration", 5*time.Second, "length of each throughput test, 0 to skip them")
+	udp := fs.Bool("udp", true, "test UDP relaying too")
+	fs.Parse(args)
+	switch {
+	case *listen != "":
+		return serveEcho(*listen)
+	case *server != "":
+		return testEcho(os.Stdout, *server, *target, *duration, *udp)
+	}
+	return errors.New("echo: -s or -c is required")
+}
+
+// serveEcho serves TCP and UDP echo on addr.
+func serveEcho(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	mainLog.Infof("echo server on %s, TCP and UDP", addr)
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			pc.WriteTo(buf[:n], raddr)
+		}
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			if err := echoConn(c); err != nil {
+				mainLog.Debugf("echo %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// echoConn serves a TCP connection of the echo server.
+func echoConn(c net.Conn) error {
+	r := bufio.NewReader(c)
+	head, err := r.Peek(len(echoSource))
+	if err != nil && len(head) == 0 {
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte(echoSink)):
+		r.Discard(len(echoSink))
+		start := time.Now()
+		var n int64
+		for {
+			b, err := r.ReadSlice(1)
+			n += int64(len(b))
+			if err == nil {
+				break
+			}
+			if err != bufio.ErrBufferFull {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(c, "%d %d\n", n, time.Since(start))
+		return err
+	case bytes.HasPrefix(head, []byte(echoSource)):
+		zeros := make([]byte, 32*1024)
+		for {
+			if _, err := c.Write(zeros); err != nil {
+				return nil // closed by the client
+			}
+		}
+	}
+	_, err = io.Copy(c, r)
+	return err
+}
+
+// testEcho tests the server of the ss:// URL s against the echo server at
+// target, writing the results to w.
+func testEcho(w io.Writer, s, target string, duration time.Duration, udp bool) error {
+	addr, cipher, password, err := parseURL(s)
+	if err != nil {
+		return err
+	}
+	ciph, err := core.PickCipher(resolveCipher(cipher), nil, password)
+	if err != nil {
+		return err
+	}
+	tgt := socks.ParseAddr(target)
+	if tgt == nil {
+		return fmt.Errorf("invalid target address %q", target)
+	}
+	dial := func() (net.Conn, error) {
+		c, err := shadowDial(addr, ciph)()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Write(tgt); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	failed := false
+	report := func(test string, err error, format string, v ...any) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(w, "%-14s FAIL  %v\n", test, err)
+			return
+		}
+		fmt.Fprintf(w, "%-14s ok    "+format+"\n", append([]any{test}, v...)...)
+	}
+	rtt, err := testTCPEcho(dial)
+	report("TCP echo", err, "round trip %v", rtt)
+	if udp {
+		got, rtt, err := testUDPEcho(addr, ciph, tgt)
+		report("UDP echo", err, "%d/%d packets, round trip %v", got, udpEchoPackets, rtt)
+	}
+	if duration > 0 {
+		rate, err := testUpload(dial, duration)
+		report("upload", err, "%s/s", formatBytes(int64(rate)))
+		rate, err = testDownload(dial, duration)
+		report("download", err, "%s/s", formatBytes(int64(rate)))
+	}
+	if failed {
+		return errors.New("echo: some tests failed")
+	}
+	return nil
+}
+
+// echoTimeout bounds each step of the tests but the throughput ones.
+const echoTimeout = 5 * time.Second
+
+// testTCPEcho checks that random data comes back unchanged.
+func testTCPEcho(dial func() (net.Conn, error)) (time.Duration, error) {
+	start := time.Now()
+	c, err := dial()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(echoTimeout))
+	sent := make([]byte, 64*1024)
+	rand.Read(sent)
+	go c.Write(sent)
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(c, got); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(got, sent) {
+		return 0, errors.New("echoed data differs")
+	}
+	return time.Since(start), nil
+}
+
+// udpEchoPackets is the number of packets of the UDP echo test.
+const udpEchoPackets = 10
+
+// testUDPEcho sends packets of random data through the server at addr and
+// counts those echoed unchanged. Packets may be lost, but not all of them.
+func testUDPEcho(addr string, ciph core.Cipher, tgt socks.Addr) (int, time.Duration, error) {
+	srv, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, 0, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer pc.Close()
+	spc := ciph.PacketConn(pc)
+	sent := make(map[string]bool)
+	start := time.Now()
+	for i := 0; i < udpEchoPackets; i++ {
+		b := make([]byte, 1000)
+		rand.Read(b)
+		sent[string(b)] = true
+		if _, err := spc.WriteTo(append(append([]byte(nil), tgt...), b...), srv); err != nil {
+			return 0, 0, err
+		}
+	}
+	var rtt time.Duration
+	got := 0
+	buf := make([]byte, udpBufSize)
+	spc.SetReadDeadline(time.Now().Add(echoTimeout))
+	for got < udpEchoPackets {
+		n, _, err := spc.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		src := socks.SplitAddr(buf[:n])
+		if src == nil || !sent[string(buf[len(src):n])] {
+			continue
+		}
+		delete(sent, string(buf[len(src):n]))
+		if got++; got == 1 {
+			rtt = time.Since(start)
+		}
+	}
+	if got == 0 {
+		return 0, 0, errors.New("no packet echoed")
+	}
+	return got, rtt, nil
+}
+
+// testUpload sends data for d and returns the rate the echo server
+// received it at.
+func testUpload(dial func() (net.Conn, error), d time.Duration) (float64, error) {
+	c, err := dial()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, echoSink); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 32*1024)
+	end := time.Now().Add(d)
+	c.SetWriteDeadline(end.Add(echoTimeout))
+	for time.Now().Before(end) {
+		if _, err := c.Write(buf); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := c.Write([]byte{1}); err != nil {
+		return 0, err
+	}
+	c.SetReadDeadline(time.Now().Add(echoTimeout))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	var ns time.Duration
+	if _, err := fmt.Sscanf(strings.TrimSpace(line), "%d %d", &n, &ns); err != nil || ns <= 0 {
+		return 0, fmt.Errorf("unexpected answer %q", line)
+	}
+	return float64(n) / ns.Seconds(), nil
+}
+
+// testDownload receives data for d and returns the rate it came at.
+func testDownload(dial func() (net.Conn, error), d time.Duration) (float64, error) {
+	c, err := dial()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, echoSource); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	c.SetReadDeadline(start.Add(d))
+	n, err := io.Copy(io.Discard, c)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, errors.New("no data received")
+	}
+	return float64(n) / time.Since(start).Seconds(), nil
+}
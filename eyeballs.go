@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// connectionAttemptDelay is the time a connection attempt to a server is
+// given before the next address is tried too, as recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// dialHappy connects to the TCP address addr with d. If its host resolves to
+// several addresses, attempts start in turn, alternating between IPv6 and
+// IPv4 beginning with IPv6, every connectionAttemptDelay or as soon as the
+// previous one fails, and the first to connect wins (Happy Eyeballs, RFC
+// 8305), so that a broken IPv6 path costs a fraction of a second.
+func dialHappy(ctx context.Context, d *net.Dialer, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	ips, err := hostResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return dialParallel(ctx, d, interleaveFamilies(ips), port)
+}
+
+// dialParallel connects to port of the first of ips to answer, starting an
+// attempt for each in order every connectionAttemptDelay or as soon as the
+// previous one fails.
+func dialParallel(ctx context.Context, d *net.Dialer, ips []netip.Addr, port string) (net.Conn, error) {
+	switch len(ips) {
+	case 0:
+		return nil, errors.New("no address to connect to")
+	case 1:
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(ips[0].String(), port))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type attempt struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan attempt, len(ips))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			c, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+			results <- attempt{c, err}
+		}()
+		delay = nil
+		if next < len(ips) {
+			delay = time.After(connectionAttemptDelay)
+		}
+	}
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) { // close the attempts connecting too late
+					for ; n > 0; n-- {
+						if r := <-results; r.c != nil {
+							r.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			}
+		case <-delay:
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// interleaveFamilies orders ips alternating between IPv6 and IPv4, beginning
+// with IPv6, keeping the order of the resolver within each family. With
+// -outbound-ip, only the addresses of its family are kept.
+func interleaveFamilies(ips []netip.Addr) []netip.Addr {
+	var v6, v4 []netip.Addr
+	for _, ip := range ips {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	if outboundIP != nil {
+		if outboundIP.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+	l := make([]netip.Addr, 0, len(v6)+len(v4))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			l = append(l, v6[i])
+		}
+		if i < len(v4) {
+			l = append(l, v4[i])
+		}
+	}
+	return l
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// fairQuantum is the most bytes a relay write is granted per turn with -fair.
+const fairQuantum = 16 << 10
+
+// fairScheduler hands out the bytes of a limiter shared by many relays in
+// turns rather than first come first served: users with bytes to relay take
+// turns, and so do the relays of each user, each granted up to fairQuantum
+// bytes per turn. A bulk download then gets the bandwidth left by the others
+// instead of delaying an interactive session by its whole backlog.
+type fairScheduler struct {
+	limiter *rate.Limiter
+	once    sync.Once
+	wake    chan struct{}
+
+	mu    sync.Mutex
+	queue map[string][]*fairTurn // turns waiting per user, in order
+	users []string               // users with turns waiting, next first
+}
+
+// fairTurn is a relay waiting for n bytes, until ready is closed.
+type fairTurn struct {
+	n     int
+	ready chan struct{}
+}
+
+func newFairScheduler(l *rate.Limiter) *fairScheduler {
+	return &fairScheduler{limiter: l, wake: make(chan struct{}, 1), queue: make(map[string][]*fairTurn)}
+}
+
+// waitN blocks until n bytes relayed for the user named name are allowed,
+// taking as many turns as needed.
+func (s *fairScheduler) waitN(name string, n int) {
+	s.once.Do(func() { go s.run() })
+	for n > 0 {
+		turn := &fairTurn{n: min(n, fairQuantum, s.limiter.Burst()), ready: make(chan struct{})}
+		s.mu.Lock()
+		if len(s.queue[name]) == 0 {
+			s.users = append(s.users, name)
+		}
+		s.queue[name] = append(s.queue[name], turn)
+		s.mu.Unlock()
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		<-turn.ready
+		n -= turn.n
+	}
+}
+
+// run grants turns in order until the program exits.
+func (s *fairScheduler) run() {
+	for {
+		turn := s.next()
+		if turn == nil {
+			<-s.wake
+			continue
+		}
+		s.limiter.WaitN(context.Background(), turn.n)
+		close(turn.ready)
+	}
+}
+
+// next dequeues the next turn: the first of the next user, who goes last.
+func (s *fairScheduler) next() *fairTurn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.users) == 0 {
+		return nil
+	}
+	name := s.users[0]
+	s.users = s.users[1:]
+	q := s.queue[name]
+	turn := q[0]
+	if len(q) == 1 {
+		delete(s.queue, name)
+	} else {
+		s.queue[name] = q[1:]
+		s.users = append(s.users, name)
+	}
+	return turn
+}
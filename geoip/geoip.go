@@ -0,0 +1,64 @@
+// Package geoip maps IP addresses to countries using databases in the
+// MaxMind DB format, such as GeoLite2-Country and the MMDB editions of
+// DB-IP and IP2Location.
+package geoip
+
+import (
+	"net/netip"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is an open country database.
+type DB struct {
+	r *maxminddb.Reader
+}
+
+// Open opens the database file at path.
+func Open(path string) (*DB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{r: r}, nil
+}
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country of ip, or ""
+// if unknown.
+func (db *DB) Country(ip netip.Addr) string {
+	var rec record
+	if err := db.r.Lookup(ip.Unmap().AsSlice(), &rec); err != nil {
+		return ""
+	}
+	if rec.Country.ISOCode != "" {
+		return rec.Country.ISOCode
+	}
+	return rec.RegisteredCountry.ISOCode
+}
+
+// Close closes the database.
+func (db *DB) Close() error { return db.r.Close() }
+
+// Set is a set of country codes.
+type Set map[string]bool
+
+// ParseSet parses a comma-separated list of country codes.
+func ParseSet(s string) Set {
+	set := make(Set)
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			set[c] = true
+		}
+	}
+	return set
+}
@@ -3,9 +3,23 @@ module github.com/Potterli20/go-shadowsocks2
 go 1.22
 
 require (
-	github.com/riobard/go-bloom v0.0.0-20200614022211-cdc8013cb5b3
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/quic-go/quic-go v0.48.2
+	github.com/xtaci/smux v1.5.56
 	github.com/zhigui-projects/gm-go v0.0.0-20200510034956-8e4ef670d055
-	golang.org/x/crypto v0.24.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/time v0.5.0
 )
 
-require golang.org/x/sys v0.21.0 // indirect
+require (
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
+)
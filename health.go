@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+	"github.com/Potterli20/go-shadowsocks2/speeddial"
+)
+
+// healthWindow is the number of last checks the loss of a server is over.
+const healthWindow = 10
+
+// serverHealth is what the checks of a client server found.
+type serverHealth struct {
+	server string // address of the server
+	dial   speeddial.Dial
+
+	mu      sync.Mutex
+	up      bool
+	rtt     time.Duration // of the last successful check
+	results []bool        // of the last healthWindow checks, oldest first
+	checked time.Time
+	err     error // of the last check
+}
+
+// clientDialer dials through the servers of the client, nil on the server.
+var clientDialer *dialer
+
+// parseHealthURL parses the URL of -health-check.
+func parseHealthURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("health check URL %q is not http:// or https://", s)
+	}
+	return u, nil
+}
+
+// newServerChecks returns the health checks of servers, dialed by dials.
+func newServerChecks(servers []string, dials []speeddial.Dial) []*serverHealth {
+	checks := make([]*serverHealth, len(servers))
+	for i, s := range servers {
+		checks[i] = &serverHealth{server: serverHost(s), dial: dials[i], up: true}
+	}
+	return checks
+}
+
+// checkServers checks every server of d by fetching u through it every
+// interval, reporting the results to its serverSet.
+func checkServers(d *dialer, u *url.URL, interval time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		s := d.set.Load()
+		for i, h := range s.checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rtt, err := h.check(u, min(interval, 10*time.Second))
+				s.Report(i, rtt, err == nil)
+			}()
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
+
+// check fetches u through the server within timeout and records the result.
+func (h *serverHealth) check(u *url.URL, timeout time.Duration) (time.Duration, error) {
+	t0 := time.Now()
+	err := fetchThrough(h.dial, u, t0.Add(timeout))
+	rtt := time.Since(t0)
+	if err != nil {
+		mainLog.With("server", h.server).Debugf("health check failed: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.up, h.checked, h.err = err == nil, t0, err
+	if err == nil {
+		h.rtt = rtt
+	}
+	h.results = append(h.results, err == nil)
+	if len(h.results) > healthWindow {
+		h.results = h.results[1:]
+	}
+	return rtt, err
+}
+
+// fetchThrough requests u through the server dialed by dial before deadline,
+// expecting any HTTP response.
+func fetchThrough(dial speeddial.Dial, u *url.URL, deadline time.Time) error {
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if _, err := c.Write(socks.ParseAddr(net.JoinHostPort(u.Hostname(), port))); err != nil {
+		return err
+	}
+	if u.Scheme == "https" {
+		c = tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+	if err := req.Write(c); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// serverState is the health of a client server as listed by the admin API
+// and expvar.
+type serverState struct {
+	Server  string    `json:"server"`
+	Up      bool      `json:"up"`
+	RTT     float64   `json:"rtt_ms,omitempty"`
+	Loss    float64   `json:"loss"` // of the last checks, from 0 to 1
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// serverStates returns the health of the client servers, found so far.
+func serverStates() []serverState {
+	if clientDialer == nil {
+		return []serverState{}
+	}
+	checks := clientDialer.set.Load().checks
+	states := make([]serverState, 0, len(checks))
+	for _, h := range checks {
+		h.mu.Lock()
+		s := serverState{Server: h.server, Up: h.up, RTT: float64(h.rtt.Microseconds()) / 1000, Checked: h.checked}
+		var lost int
+		for _, ok := range h.results {
+			if !ok {
+				lost++
+			}
+		}
+		if len(h.results) > 0 {
+			s.Loss = float64(lost) / float64(len(h.results))
+		}
+		if h.err != nil {
+			s.Error = h.err.Error()
+		}
+		h.mu.Unlock()
+		states = append(states, s)
+	}
+	return states
+}
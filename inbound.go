@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+// Client IPs the server accepts: those in clientAllow, or any if it is
+// empty, except those in clientDeny.
+var clientAllow, clientDeny []netip.Prefix
+
+// clientAllowed reports whether the server accepts connections and packets
+// from ip.
+func clientAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if contains(clientDeny, ip) || clientBans.isBanned(ip) {
+		return false
+	}
+	return clientAllow == nil || contains(clientAllow, ip)
+}
+
+// clientAllowedAddr reports whether the server accepts the client at addr.
+func clientAllowedAddr(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	return err != nil || clientAllowed(ap.Addr())
+}
@@ -1,10 +1,13 @@
 package internal
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
 	"hash/fnv"
+	"io"
+	"math"
 	"sync"
-
-	"github.com/riobard/go-bloom"
 )
 
 // simply use Double FNV here as our Bloom Filter hash
@@ -18,12 +21,52 @@ func doubleFNV(b []byte) (uint64, uint64) {
 	return x, y
 }
 
+// filter is a classic Bloom filter using double hashing, as that of
+// github.com/riobard/go-bloom, with its bits open to be saved.
+type filter struct {
+	b []byte
+	k int
+}
+
+// newFilter returns a filter optimal for n entries and a false positive
+// rate of p.
+func newFilter(n int, p float64) *filter {
+	k := -math.Log(p) * math.Log2E   // number of hashes
+	m := float64(n) * k * math.Log2E // number of bits
+	return &filter{b: make([]byte, int(m/8)), k: int(k)}
+}
+
+func (f *filter) offset(x, y uint64, i int) uint64 {
+	return (x + uint64(i)*y) % (8 * uint64(len(f.b)))
+}
+
+func (f *filter) Add(b []byte) {
+	x, y := doubleFNV(b)
+	for i := 0; i < f.k; i++ {
+		o := f.offset(x, y, i)
+		f.b[o/8] |= 1 << (o % 8)
+	}
+}
+
+func (f *filter) Test(b []byte) bool {
+	x, y := doubleFNV(b)
+	for i := 0; i < f.k; i++ {
+		o := f.offset(x, y, i)
+		if f.b[o/8]&(1<<(o%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *filter) Reset() { clear(f.b) }
+
 type BloomRing struct {
 	slotCapacity int
 	slotPosition int
 	slotCount    int
 	entryCounter int
-	slots        []bloom.Filter
+	slots        []*filter
 	mutex        sync.RWMutex
 }
 
@@ -32,10 +75,10 @@ func NewBloomRing(slot, capacity int, falsePositiveRate float64) *BloomRing {
 	r := &BloomRing{
 		slotCapacity: capacity / slot,
 		slotCount:    slot,
-		slots:        make([]bloom.Filter, slot),
+		slots:        make([]*filter, slot),
 	}
 	for i := 0; i < slot; i++ {
-		r.slots[i] = bloom.New(r.slotCapacity, falsePositiveRate, doubleFNV)
+		r.slots[i] = newFilter(r.slotCapacity, falsePositiveRate)
 	}
 	return r
 }
@@ -90,3 +133,61 @@ func (r *BloomRing) Check(b []byte) bool {
 	r.Add(b)
 	return false
 }
+
+// ringMagic starts the saved state of a BloomRing.
+const ringMagic = "SSBR1"
+
+// ErrRingMismatch is returned by Load when the saved ring was made with
+// other slot, capacity or false positive rate settings.
+var ErrRingMismatch = errors.New("saved salt filter has other settings")
+
+// Save writes the state of the ring to w, to Load it after a restart.
+func (r *BloomRing) Save(w io.Writer) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	bw := bufio.NewWriter(w)
+	bw.WriteString(ringMagic)
+	for _, v := range []int{r.slotCount, r.slotCapacity, r.slotPosition, r.entryCounter, r.slots[0].k, len(r.slots[0].b)} {
+		binary.Write(bw, binary.BigEndian, uint64(v))
+	}
+	for _, s := range r.slots {
+		bw.Write(s.b)
+	}
+	return bw.Flush()
+}
+
+// Load reads the state of the ring saved by Save from rd. The ring must have
+// been made with the same settings.
+func (r *BloomRing) Load(rd io.Reader) error {
+	br := bufio.NewReader(rd)
+	magic := make([]byte, len(ringMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != ringMagic {
+		return errors.New("not a saved salt filter")
+	}
+	var hdr [6]uint64
+	if err := binary.Read(br, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if hdr[0] != uint64(r.slotCount) || hdr[1] != uint64(r.slotCapacity) ||
+		hdr[4] != uint64(r.slots[0].k) || hdr[5] != uint64(len(r.slots[0].b)) ||
+		hdr[2] >= hdr[0] {
+		return ErrRingMismatch
+	}
+	slots := make([][]byte, r.slotCount)
+	for i := range slots {
+		slots[i] = make([]byte, hdr[5])
+		if _, err := io.ReadFull(br, slots[i]); err != nil {
+			return err
+		}
+	}
+	for i, s := range r.slots {
+		s.b = slots[i]
+	}
+	r.slotPosition, r.entryCounter = int(hdr[2]), int(hdr[3])
+	return nil
+}
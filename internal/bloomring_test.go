@@ -1,11 +1,12 @@
 package internal_test
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"testing"
 
-	"go-shadowsocks/internal"
+	"github.com/Potterli20/go-shadowsocks2/internal"
 )
 
 var (
@@ -83,3 +84,45 @@ func benchmarkBloomRing(samples, checkPoints [][]byte, slot int) func(*testing.B
 		}
 	}
 }
+
+func TestBloomRing_SaveLoad(t *testing.T) {
+	r := internal.NewBloomRing(4, 100, 1e-6)
+	for i := 0; i < 90; i++ {
+		r.Add([]byte(fmt.Sprint(i)))
+	}
+	var buf bytes.Buffer
+	if err := r.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	loaded := internal.NewBloomRing(4, 100, 1e-6)
+	if err := loaded.Load(bytes.NewReader(saved)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 90; i++ {
+		if !loaded.Test([]byte(fmt.Sprint(i))) {
+			t.Fatalf("entry %d missing after Load", i)
+		}
+	}
+	if loaded.Test([]byte("shadowsocks")) {
+		t.Fatal("Test should return false for an entry never added")
+	}
+	// the position in the ring is restored too: the oldest slot goes first
+	for i := 90; i < 120; i++ {
+		r.Add([]byte(fmt.Sprint(i)))
+		loaded.Add([]byte(fmt.Sprint(i)))
+	}
+	for i := 0; i < 120; i++ {
+		if b := []byte(fmt.Sprint(i)); r.Test(b) != loaded.Test(b) {
+			t.Fatalf("entry %d: loaded ring diverged", i)
+		}
+	}
+
+	if err := internal.NewBloomRing(5, 100, 1e-6).Load(bytes.NewReader(saved)); err != internal.ErrRingMismatch {
+		t.Fatalf("Load into another ring: %v, want %v", err, internal.ErrRingMismatch)
+	}
+	if err := internal.NewBloomRing(4, 100, 1e-6).Load(bytes.NewReader(saved[:len(saved)-1])); err == nil {
+		t.Fatal("Load of a truncated ring should fail")
+	}
+}
@@ -1,10 +1,14 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+
+	"github.com/Potterli20/go-shadowsocks2/metrics"
 )
 
 // Those suggest value are all set according to
@@ -80,6 +84,63 @@ func AddSalt(b []byte) {
 	getSaltFilterSingleton().Add(b)
 }
 
+// repeatedSalts counts the salts CheckSalt found repeated.
+var repeatedSalts atomic.Int64
+
+func init() {
+	metrics.Default.MustRegister(metrics.Metric{
+		Name: "shadowsocks_repeated_salts_total",
+		Help: "Salts seen before, from replayed traffic or a false positive of the salt filter.",
+		Read: func(emit func(float64, ...string)) { emit(float64(repeatedSalts.Load())) },
+	})
+}
+
 func CheckSalt(b []byte) bool {
-	return getSaltFilterSingleton().Test(b)
+	if getSaltFilterSingleton().Test(b) {
+		repeatedSalts.Add(1)
+		return true
+	}
+	return false
+}
+
+// SaveSalts writes the salt filter to path, so that a restarted server still
+// rejects the salts seen before, through LoadSalts.
+func SaveSalts(path string) error {
+	sf := getSaltFilterSingleton()
+	if sf == nil {
+		return nil
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := sf.Save(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadSalts restores the salt filter saved by SaveSalts to path. A missing
+// file is no error.
+func LoadSalts(path string) error {
+	sf := getSaltFilterSingleton()
+	if sf == nil {
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sf.Load(f)
 }
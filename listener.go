@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// serverListeners are the states of the listeners of the server by address,
+// shared by TCP and UDP.
+var serverListeners sync.Map // string -> *listenerState
+
+// listenerState is the state of a listening address. While it is paused, no
+// new TCP connections or UDP sessions are accepted, but those in progress go
+// on, e.g. to drain a node before maintenance.
+type listenerState struct {
+	addr     string
+	tcp, udp atomic.Bool
+	paused   atomic.Bool
+}
+
+// listenerInfo is a listener as listed by the admin API.
+type listenerInfo struct {
+	Addr   string `json:"addr"`
+	TCP    bool   `json:"tcp"`
+	UDP    bool   `json:"udp"`
+	Paused bool   `json:"paused"`
+}
+
+// listenerFor returns the state of the listener on addr.
+func listenerFor(addr string) *listenerState {
+	ls, _ := serverListeners.LoadOrStore(addr, &listenerState{addr: addr})
+	return ls.(*listenerState)
+}
+
+// findListener returns the state of the listener on addr, nil if there is none.
+func findListener(addr string) *listenerState {
+	if ls, ok := serverListeners.Load(addr); ok {
+		return ls.(*listenerState)
+	}
+	return nil
+}
+
+// listListeners returns the listeners sorted by address.
+func listListeners() []listenerInfo {
+	l := []listenerInfo{}
+	serverListeners.Range(func(_, v any) bool {
+		ls := v.(*listenerState)
+		l = append(l, listenerInfo{ls.addr, ls.tcp.Load(), ls.udp.Load(), ls.paused.Load()})
+		return true
+	})
+	sort.Slice(l, func(i, j int) bool { return l[i].Addr < l[j].Addr })
+	return l
+}
@@ -1,31 +1,234 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-var logger = log.New(os.Stderr, "", log.Lshortfile|log.LstdFlags)
+// Log records have a level and name the component they come from, so that
+// e.g. only the UDP relay can be looked at with a log shipper.
+var (
+	tcpLog    = component("tcp")
+	udpLog    = component("udp")
+	dnsLog    = component("dns")
+	socksLog  = component("socks")
+	muxLog    = component("mux")
+	pluginLog = component("plugin")
+	routeLog  = component("route")
+	mqttLog   = component("mqtt")
+	serverLog = component("server")
+	mainLog   = component("main")
+)
+
+// logLevel is the minimum level logged, set by -log-level.
+var logLevel = new(slog.LevelVar)
+
+// setupLogging logs records at level and above in format, text or json, to
+// output: stderr, syslog (the local daemon), syslog://host:port (a remote
+// one over UDP) or journald. It also takes over the output of the standard
+// log package.
+func setupLogging(level, format, output string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	var sink logSink
+	var err error
+	switch {
+	case output == "stderr":
+	case output == "syslog":
+		sink, err = openSyslog("")
+	case strings.HasPrefix(output, "syslog://"):
+		sink, err = openSyslog(strings.TrimPrefix(output, "syslog://"))
+	case output == "journald":
+		sink, err = openJournald()
+	default:
+		return fmt.Errorf("unknown log output %q", output)
+	}
+	if err != nil {
+		return err
+	}
 
-func logf(f string, v ...any) {
-	if config.Verbose {
-		logger.Output(2, fmt.Sprintf(f, v...))
+	opts := &slog.HandlerOptions{
+		AddSource:   true,
+		Level:       logLevel,
+		ReplaceAttr: shortSource,
 	}
+	var w io.Writer = os.Stderr
+	var lw *levelWriter
+	if sink != nil {
+		// the daemon records the time and priority
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return shortSource(groups, a)
+		}
+		lw = &levelWriter{sink: sink}
+		w = lw
+	}
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	if lw != nil {
+		h = &sinkHandler{h, lw}
+	}
+	slog.SetDefault(slog.New(h))
+	slog.SetLogLoggerLevel(slog.LevelError) // the standard log is left for fatal errors
+	return nil
 }
 
-type logHelper struct {
-	prefix string
+// shortSource logs the source of records as file:line.
+func shortSource(groups []string, a slog.Attr) slog.Attr {
+	if s, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey && len(groups) == 0 {
+		if s.File == "" { // from the standard log
+			return slog.Attr{}
+		}
+		a.Value = slog.StringValue(fmt.Sprintf("%s:%d", filepath.Base(s.File), s.Line))
+	}
+	return a
 }
 
-func (l *logHelper) Write(p []byte) (n int, err error) {
-	if config.Verbose {
-		logger.Printf("%s%s\n", l.prefix, p)
-		return len(p), nil
+// logSink sends a formatted record of level to a log daemon.
+type logSink func(level slog.Level, msg string) error
+
+// levelWriter passes what is written to it on to sink at the level of the
+// record being formatted.
+type levelWriter struct {
+	mu    sync.Mutex
+	level slog.Level
+	sink  logSink
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if err := w.sink(w.level, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
 	}
 	return len(p), nil
 }
 
-func newLogHelper(prefix string) *logHelper {
-	return &logHelper{prefix}
+// sinkHandler formats records with Handler, which writes to w, and tells w
+// their level.
+type sinkHandler struct {
+	slog.Handler
+	w *levelWriter
+}
+
+func (h *sinkHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.w.mu.Lock()
+	defer h.w.mu.Unlock()
+	h.w.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sinkHandler{h.Handler.WithAttrs(attrs), h.w}
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{h.Handler.WithGroup(name), h.w}
+}
+
+// openJournald returns a sink sending records to the systemd journal with
+// its native protocol.
+func openJournald() (logSink, error) {
+	c, err := net.Dial("unixgram", "/run/systemd/journal/socket")
+	if err != nil {
+		return nil, fmt.Errorf("journald: %v", err)
+	}
+	return func(level slog.Level, msg string) error {
+		var b []byte
+		b = journalField(b, "PRIORITY", strconv.Itoa(syslogPriority(level)))
+		b = journalField(b, "SYSLOG_IDENTIFIER", "go-shadowsocks2")
+		b = journalField(b, "MESSAGE", msg)
+		_, err := c.Write(b)
+		return err
+	}, nil
+}
+
+// journalField appends a field in the journal native protocol to b.
+func journalField(b []byte, name, value string) []byte {
+	if !strings.Contains(value, "\n") {
+		return append(b, name+"="+value+"\n"...)
+	}
+	b = append(b, name+"\n"...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	return append(b, value+"\n"...)
+}
+
+// syslogPriority returns the syslog severity of level.
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3 // err
+	case level >= slog.LevelWarn:
+		return 4 // warning
+	case level >= slog.LevelInfo:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// leveledLogger logs printf-style messages with the attributes it was made
+// with.
+type leveledLogger struct {
+	attrs []any
+}
+
+func component(name string) leveledLogger {
+	return leveledLogger{[]any{"component", name}}
+}
+
+// With returns a logger adding the key-value pairs in args to each record.
+func (l leveledLogger) With(args ...any) leveledLogger {
+	return leveledLogger{append(l.attrs[:len(l.attrs):len(l.attrs)], args...)}
+}
+
+func (l leveledLogger) Debugf(format string, v ...any) { l.logf(slog.LevelDebug, format, v...) }
+func (l leveledLogger) Infof(format string, v ...any)  { l.logf(slog.LevelInfo, format, v...) }
+func (l leveledLogger) Warnf(format string, v ...any)  { l.logf(slog.LevelWarn, format, v...) }
+func (l leveledLogger) Errorf(format string, v ...any) { l.logf(slog.LevelError, format, v...) }
+
+func (l leveledLogger) logf(level slog.Level, format string, v ...any) {
+	h := slog.Default().Handler()
+	if !h.Enabled(context.Background(), level) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, logf and the level method
+	r := slog.NewRecord(time.Now(), level, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), pcs[0])
+	r.Add(l.attrs...)
+	h.Handle(context.Background(), r)
+}
+
+// std returns a standard library logger logging at level.
+func (l leveledLogger) std(level slog.Level) *log.Logger {
+	return slog.NewLogLogger(slog.Default().With(l.attrs...).Handler(), level)
+}
+
+// logWriter logs each write as a debug record, e.g. the output of a plugin.
+type logWriter struct {
+	l leveledLogger
+}
+
+func (w logWriter) Write(p []byte) (n int, err error) {
+	w.l.Debugf("%s", p)
+	return len(p), nil
 }
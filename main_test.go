@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	config.UDPTimeout = time.Minute // the default of -udptimeout
+	config.Transport = transportTCP // the default of -transport
+	os.Exit(m.Run())
+}
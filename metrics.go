@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/Potterli20/go-shadowsocks2/metrics"
+)
+
+// The metrics of the proxy, in metrics.Default along with those of the
+// packages it uses, are served in the Prometheus text format under /metrics
+// by the debug endpoint.
+func init() {
+	metrics.Default.MustRegister(
+		metrics.Metric{
+			Name:   "shadowsocks_relays",
+			Help:   "Relays in progress, tracked with the admin API.",
+			Kind:   metrics.Gauge,
+			Labels: []string{"proto"},
+			Read: func(emit func(float64, ...string)) {
+				tcp, udp := activeRelays.count()
+				emit(float64(tcp), "tcp")
+				emit(float64(udp), "udp")
+			},
+		},
+		metrics.Metric{
+			Name: "shadowsocks_udp_dropped_total",
+			Help: "UDP packets dropped for lack of a socket to relay them.",
+			Read: func(emit func(float64, ...string)) { emit(float64(udpDropped.Load())) },
+		},
+		metrics.Metric{
+			Name: "shadowsocks_udp_evicted_total",
+			Help: "UDP NAT entries closed to make room for new ones.",
+			Read: func(emit func(float64, ...string)) { emit(float64(udpEvicted.Load())) },
+		},
+		metrics.Metric{
+			Name: "shadowsocks_tcp_rejected_total",
+			Help: "TCP connections closed as soon as accepted for lack of a slot.",
+			Read: func(emit func(float64, ...string)) { emit(float64(tcpRejected.Load())) },
+		},
+		metrics.Metric{
+			Name:   "shadowsocks_udp_nat_entries",
+			Help:   "UDP NAT entries of each server listener.",
+			Kind:   metrics.Gauge,
+			Labels: []string{"listener"},
+			Read: func(emit func(float64, ...string)) {
+				for l, n := range natEntries() {
+					emit(float64(n), l)
+				}
+			},
+		},
+		metrics.Metric{
+			Name: "shadowsocks_bans",
+			Help: "Client IPs banned.",
+			Kind: metrics.Gauge,
+			Read: func(emit func(float64, ...string)) { emit(float64(len(clientBans.bans()))) },
+		},
+		metrics.Metric{
+			Name:   "shadowsocks_server_up",
+			Help:   "Whether a client server passed its last health check.",
+			Kind:   metrics.Gauge,
+			Labels: []string{"server"},
+			Read: func(emit func(float64, ...string)) {
+				for _, s := range serverStates() {
+					up := 0.0
+					if s.Up {
+						up = 1
+					}
+					emit(up, s.Server)
+				}
+			},
+		},
+		metrics.Metric{
+			Name:   "shadowsocks_server_rtt_seconds",
+			Help:   "Round trip time of the last successful health check of a client server.",
+			Kind:   metrics.Gauge,
+			Labels: []string{"server"},
+			Read: func(emit func(float64, ...string)) {
+				for _, s := range serverStates() {
+					emit(s.RTT/1000, s.Server)
+				}
+			},
+		},
+		metrics.Metric{
+			Name:   "shadowsocks_server_loss_ratio",
+			Help:   "Share of the last health checks of a client server failing.",
+			Kind:   metrics.Gauge,
+			Labels: []string{"server"},
+			Read: func(emit func(float64, ...string)) {
+				for _, s := range serverStates() {
+					emit(s.Loss, s.Server)
+				}
+			},
+		},
+	)
+}
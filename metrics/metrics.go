@@ -0,0 +1,159 @@
+// Package metrics is the registry of the counters and gauges of the proxy,
+// for applications embedding it to export them along with their own, and
+// for the proxy to serve them in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kind is the kind of a metric.
+type Kind int
+
+const (
+	Counter Kind = iota // only goes up, such as packets dropped
+	Gauge               // goes up and down, such as connections open
+)
+
+// Metric describes a metric and how to read its current values.
+type Metric struct {
+	Name   string // such as shadowsocks_udp_dropped_total
+	Help   string // one line
+	Kind   Kind
+	Labels []string // names of the labels telling its values apart, if several
+
+	// Read calls emit with each value and the values of its labels, in the
+	// order of Labels.
+	Read func(emit func(value float64, labelValues ...string))
+}
+
+// Registerer is where metrics are registered, such as a Registry.
+type Registerer interface {
+	Register(Metric) error
+}
+
+// Source is a set of metrics to export, such as a Registry.
+type Source interface {
+	Each(func(Metric))
+}
+
+// Registry is a set of metrics, read on demand.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]Metric
+}
+
+// Default is the registry of the metrics of this module.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]Metric)}
+}
+
+// Register adds m to r, failing if r has one of the same name.
+func (r *Registry) Register(m Metric) error {
+	if m.Name == "" || m.Read == nil {
+		return fmt.Errorf("metric %q without name or Read", m.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.Name]; ok {
+		return fmt.Errorf("metric %s registered already", m.Name)
+	}
+	r.metrics[m.Name] = m
+	return nil
+}
+
+// MustRegister registers ms with r, panicking on error.
+func (r *Registry) MustRegister(ms ...Metric) {
+	for _, m := range ms {
+		if err := r.Register(m); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister removes the metric named name from r, reporting whether r had it.
+func (r *Registry) Unregister(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.metrics[name]
+	delete(r.metrics, name)
+	return ok
+}
+
+// Each calls f with every metric of r, in order of name.
+func (r *Registry) Each(f func(Metric)) {
+	r.mu.Lock()
+	ms := make([]Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		ms = append(ms, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+	for _, m := range ms {
+		f(m)
+	}
+}
+
+// WriteText writes the metrics of s to w in the Prometheus text format.
+func WriteText(w io.Writer, s Source) error {
+	var b strings.Builder
+	s.Each(func(m Metric) {
+		kind := "counter"
+		if m.Kind == Gauge {
+			kind = "gauge"
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.Name, escape(m.Help, false), m.Name, kind)
+		m.Read(func(v float64, lv ...string) {
+			b.WriteString(m.Name)
+			if len(m.Labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range m.Labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					var value string
+					if i < len(lv) {
+						value = lv[i]
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", l, escape(value, true))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(formatValue(v))
+			b.WriteByte('\n')
+		})
+	})
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// escape escapes s for a help text, or a label value if quoted.
+func escape(s string, quoted bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quoted {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,56 @@
+package metrics_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Potterli20/go-shadowsocks2/metrics"
+)
+
+func TestWriteText(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.MustRegister(
+		metrics.Metric{
+			Name: "test_dropped_total",
+			Help: "Packets dropped.",
+			Read: func(emit func(float64, ...string)) { emit(3) },
+		},
+		metrics.Metric{
+			Name:   "test_open",
+			Help:   "Open connections.",
+			Kind:   metrics.Gauge,
+			Labels: []string{"proto", "listener"},
+			Read: func(emit func(float64, ...string)) {
+				emit(1.5, "tcp", `:8488 "a"`)
+			},
+		},
+	)
+	var b strings.Builder
+	if err := metrics.WriteText(&b, r); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_dropped_total Packets dropped.
+# TYPE test_dropped_total counter
+test_dropped_total 3
+# HELP test_open Open connections.
+# TYPE test_open gauge
+test_open{proto="tcp",listener=":8488 \"a\""} 1.5
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := metrics.NewRegistry()
+	m := metrics.Metric{Name: "test_total", Read: func(emit func(float64, ...string)) { emit(0) }}
+	if err := r.Register(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(m); err == nil {
+		t.Error("registered the same name twice")
+	}
+	if !r.Unregister("test_total") || r.Register(m) != nil {
+		t.Error("could not register again after unregistering")
+	}
+}
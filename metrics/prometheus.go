@@ -0,0 +1,43 @@
+//go:build prometheus
+// +build prometheus
+
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Built with -tags prometheus, in a module requiring
+// github.com/prometheus/client_golang, the metrics of a registry can join
+// those of the application's own Prometheus registry:
+//
+//	metrics.RegisterPrometheus(prometheus.DefaultRegisterer, metrics.Default)
+
+// Collector returns a prometheus.Collector of the metrics of s. It is
+// unchecked, describing none of them, since metrics may be registered with s
+// later on.
+func Collector(s Source) prometheus.Collector { return collector{s} }
+
+// RegisterPrometheus registers the metrics of s with reg.
+func RegisterPrometheus(reg prometheus.Registerer, s Source) error {
+	return reg.Register(Collector(s))
+}
+
+type collector struct{ s Source }
+
+func (c collector) Describe(chan<- *prometheus.Desc) {}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	c.s.Each(func(m Metric) {
+		desc := prometheus.NewDesc(m.Name, m.Help, m.Labels, nil)
+		kind := prometheus.CounterValue
+		if m.Kind == Gauge {
+			kind = prometheus.GaugeValue
+		}
+		m.Read(func(v float64, labelValues ...string) {
+			pm, err := prometheus.NewConstMetric(desc, kind, v, labelValues...)
+			if err != nil {
+				pm = prometheus.NewInvalidMetric(desc, err)
+			}
+			ch <- pm
+		})
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	maxIPPacket   = 0xFFFF
+	udpIPOverhead = 40 + 8 // IPv6 and UDP headers, the larger of the address families
+)
+
+// errPacketTooLarge is returned when writing a packet the relay cannot carry.
+type errPacketTooLarge struct{ size, max int }
+
+func (e errPacketTooLarge) Error() string {
+	return fmt.Sprintf("packet of %d bytes exceeds the %d bytes the transport carries", e.size, e.max)
+}
+
+// udpPacketLimit returns the largest plaintext packet, target address
+// included, that shadow can send in one datagram within -udp-mtu.
+func udpPacketLimit(shadow func(net.PacketConn) net.PacketConn) int {
+	mtu := config.UDPMTU
+	if mtu <= 0 || mtu > maxIPPacket {
+		mtu = maxIPPacket
+	}
+	return mtu - udpIPOverhead - packetOverhead(shadow)
+}
+
+// packetOverhead measures the bytes shadow adds to every packet.
+func packetOverhead(shadow func(net.PacketConn) net.PacketConn) int {
+	c := &sizeConn{}
+	pc := shadow(c)
+	if o, ok := pc.(interface{ Overhead() int }); ok {
+		return o.Overhead()
+	}
+	pc.WriteTo(nil, nil)
+	return c.n
+}
+
+// sizeConn records the size of the last packet written instead of sending it.
+type sizeConn struct {
+	net.PacketConn
+	n int
+}
+
+func (c *sizeConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	c.n = len(b)
+	return len(b), nil
+}
+
+// mtuPacketConn rejects packets larger than max before they are encrypted,
+// rather than letting them fail in the cipher or the kernel.
+type mtuPacketConn struct {
+	net.PacketConn
+	max int
+}
+
+func (c *mtuPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > c.max {
+		return 0, errPacketTooLarge{len(b), c.max}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+	"github.com/xtaci/smux"
+)
+
+// muxMagicAddr is the target address requesting a multiplexed session.
+const muxMagicAddr = "sp.mux.arpa:0"
+
+// muxDialer opens streams over a fixed number of long-lived smux sessions,
+// each carried by one shadowsocks connection.
+type muxDialer struct {
+	d        Dialer
+	mu       sync.Mutex
+	sessions []*smux.Session
+	next     int
+}
+
+func newMuxDialer(d Dialer, n int) *muxDialer {
+	return &muxDialer{d: d, sessions: make([]*smux.Session, n)}
+}
+
+func (m *muxDialer) Dial(network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.New("only TCP network is supported")
+	}
+	s, err := m.session()
+	if err != nil {
+		return nil, err
+	}
+	st, err := s.OpenStream()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := st.Write(socks.ParseAddr(address)); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// session returns the next session in turn, reconnecting it if closed.
+func (m *muxDialer) session() (*smux.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := m.next
+	m.next = (m.next + 1) % len(m.sessions)
+	if s := m.sessions[i]; s != nil && !s.IsClosed() {
+		return s, nil
+	}
+	c, err := m.d.Dial("tcp", muxMagicAddr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := smux.Client(c, smux.DefaultConfig())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	m.sessions[i] = s
+	return s, nil
+}
+
+// muxRemote serves the streams of a multiplexed session carried by c, which
+// came through chain. The streams end with the session.
+func muxRemote(ctx context.Context, c net.Conn, listener string, chain transportChain, client net.Addr) {
+	s, err := smux.Server(c, smux.DefaultConfig())
+	if err != nil {
+		muxLog.Debugf("failed to start mux session: %v", err)
+		return
+	}
+	defer s.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { s.Close() })
+	defer stop()
+	for {
+		st, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer reportPanic()
+			defer st.Close()
+			tgt, err := socks.ReadAddr(st)
+			if err != nil {
+				muxLog.With("client", client.String()).Debugf("failed to get target address: %v", err)
+				return
+			}
+			chain := chain
+			chain.MuxStream = st.ID()
+			serveTarget(ctx, withUser(st, userOf(c)), listener, chain, client, tgt)
+		}()
+	}
+}
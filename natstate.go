@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// natEntry is a persisted UDP NAT mapping from a client to the local address
+// of the socket relaying its packets.
+type natEntry struct {
+	Peer  netip.AddrPort `json:"peer"`
+	Local string         `json:"local"`
+	User  string         `json:"user,omitempty"` // with -users
+}
+
+// UDP NAT tables of server listeners, keyed by listen address.
+var remoteNATs sync.Map
+
+// Entries returns the current mappings of m.
+func (m *natmap) Entries() []natEntry {
+	entries := make([]natEntry, 0, m.Len())
+	m.each(func(peer netip.AddrPort, pc net.PacketConn) {
+		entries = append(entries, natEntry{Peer: peer, Local: pc.LocalAddr().String(), User: serverUsers.packetUser(peer).name()})
+	})
+	return entries
+}
+
+// saveNATState writes the UDP NAT tables of all server listeners to path.
+func saveNATState(path string) error {
+	state := make(map[string][]natEntry)
+	remoteNATs.Range(func(k, v any) bool {
+		state[k.(string)] = v.(*natmap).Entries()
+		return true
+	})
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// restoreNATState rebinds the relay sockets saved for the listener on addr,
+// so that targets keep seeing the same source ports across a restart. The
+// sessions are opened as udpRemote opens them, for the user they were of.
+func restoreNATState(path, addr string, nm *natmap, dst UDPConn) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			udpLog.Warnf("failed to read UDP NAT state: %v", err)
+		}
+		return
+	}
+	var state map[string][]natEntry
+	if err := json.Unmarshal(b, &state); err != nil {
+		udpLog.Warnf("failed to parse UDP NAT state: %v", err)
+		return
+	}
+	restored := 0
+	for _, e := range state[addr] {
+		if e.User != "" {
+			u := serverUsers.named(e.User)
+			if u == nil {
+				udpLog.Debugf("not restoring UDP NAT entry %v -> %s of removed user %s", e.Peer, e.Local, e.User)
+				continue
+			}
+			serverUsers.seePeer(e.Peer, u, u.ciph)
+		}
+		open := func(string) (net.PacketConn, error) { return listenOutbound(e.Local) }
+		pc, err := openRemote(nm, e.Peer, addr, dst, open)
+		if err != nil {
+			udpLog.Warnf("failed to restore UDP NAT entry %v -> %s: %v", e.Peer, e.Local, err)
+			continue
+		}
+		if pc != nil {
+			restored++
+		}
+	}
+	udpLog.Infof("restored %d of %d UDP NAT entries on %s", restored, len(state[addr]), addr)
+}
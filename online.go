@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+	"github.com/Potterli20/go-shadowsocks2/speeddial"
+)
+
+// With -c set to an https:// or ssconf:// URL, the client takes its servers
+// from the online config document there (SIP008), such as
+//
+//	{"version": 1, "servers": [
+//	  {"server": "198.51.100.1", "server_port": 8388, "method": "chacha20-ietf-poly1305", "password": "..."}
+//	]}
+//
+// and fetches it again every -online-interval, so that operators rotate keys
+// and move servers without touching every device. -online-pin pins the
+// public key of the certificate of the web server.
+
+// onlineConfigSize bounds the size of the document.
+const onlineConfigSize = 1 << 20
+
+type sip008Config struct {
+	Version int            `json:"version"`
+	Servers []sip008Server `json:"servers"`
+}
+
+type sip008Server struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+}
+
+// isOnlineConfig reports whether the -c s is the URL of an online config.
+func isOnlineConfig(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "ssconf://")
+}
+
+type onlineConfig struct {
+	url    string
+	client *http.Client
+}
+
+// newOnlineConfig returns the online config at u, whose web server must
+// have a certificate for a public key of SHA-256 hash pin, base64-encoded
+// and optionally prefixed with sha256//, if pin is set.
+func newOnlineConfig(u, pin string) (*onlineConfig, error) {
+	u = strings.Replace(u, "ssconf://", "https://", 1)
+	if pu, err := url.Parse(u); err != nil || pu.Host == "" {
+		return nil, fmt.Errorf("invalid online config URL %q", u)
+	}
+	conf := &tls.Config{}
+	if pin != "" {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256//"))
+		if err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("invalid online config pin %q: the base64 SHA-256 hash of a public key is expected", pin)
+		}
+		conf.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if h := sha256.Sum256(cert.RawSubjectPublicKeyInfo); bytes.Equal(h[:], want) {
+						return nil
+					}
+				}
+			}
+			return errors.New("no certificate matches the pinned public key")
+		}
+	}
+	d := &net.Dialer{Resolver: hostResolver, Control: bindControl}
+	return &onlineConfig{url: u, client: &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         d.DialContext,
+			TLSClientConfig:     conf,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}}, nil
+}
+
+// fetch returns the servers of the online config as ss:// URLs, leaving out
+// those using plugins or unknown ciphers.
+func (o *onlineConfig) fetch() ([]string, error) {
+	resp, err := o.client.Get(o.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("online config: %s", resp.Status)
+	}
+	var conf sip008Config
+	if err := json.NewDecoder(io.LimitReader(resp.Body, onlineConfigSize)).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("online config: %v", err)
+	}
+	if conf.Version != 1 {
+		return nil, fmt.Errorf("online config: unsupported version %d", conf.Version)
+	}
+	var servers []string
+	for _, s := range conf.Servers {
+		name := s.Remarks
+		if name == "" {
+			name = net.JoinHostPort(s.Server, strconv.Itoa(s.ServerPort))
+		}
+		switch _, err := core.PickCipher(s.Method, nil, s.Password); {
+		case s.Plugin != "":
+			mainLog.Warnf("online config: server %s left out: plugins are not supported", name)
+		case s.Server == "" || s.ServerPort <= 0 || s.ServerPort > 65535:
+			mainLog.Warnf("online config: server %s left out: invalid address", name)
+		case err != nil:
+			mainLog.Warnf("online config: server %s left out: %v", name, err)
+		default:
+			u := url.URL{Scheme: "ss", User: url.UserPassword(s.Method, s.Password), Host: net.JoinHostPort(s.Server, strconv.Itoa(s.ServerPort))}
+			servers = append(servers, u.String())
+		}
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("online config: no usable servers")
+	}
+	return servers, nil
+}
+
+// refresh fetches the online config every interval, replacing the servers
+// of d when they change with those dialed as serverDial, picked with the
+// -balance strategy and checked if checked. udp, the cipher of the UDP
+// packets to udpAddr, takes the key of the first server if it is still there.
+func (o *onlineConfig) refresh(interval time.Duration, d *dialer, balance string, checked bool, udp *swapCipher, udpAddr string) {
+	for range time.Tick(interval) {
+		servers, err := o.fetch()
+		if err != nil {
+			mainLog.Warnf("failed to refresh the online config, keeping the servers: %v", err)
+			continue
+		}
+		if slices.Equal(servers, d.set.Load().servers) {
+			continue
+		}
+		if err := updateServers(d, servers, balance, checked, udp, udpAddr); err != nil {
+			mainLog.Warnf("failed to refresh the online config, keeping the servers: %v", err)
+			continue
+		}
+		mainLog.Infof("online config refreshed: %d servers", len(servers))
+	}
+}
+
+// updateServers replaces the servers of d and the key of udp as in refresh.
+func updateServers(d *dialer, servers []string, balance string, checked bool, udp *swapCipher, udpAddr string) error {
+	dials := make([]speeddial.Dial, len(servers))
+	for i, s := range servers {
+		dial, err := serverDial(s, "", "", nil)
+		if err != nil {
+			return err
+		}
+		dials[i] = dial
+	}
+	set, err := newServerSet(servers, dials, balance, checked)
+	if err != nil {
+		return err
+	}
+	addr, cipher, password, err := parseURL(servers[0])
+	if err != nil {
+		return err
+	}
+	if addr == udpAddr {
+		c, err := pickCipher(cipher, nil, password)
+		if err != nil {
+			return err
+		}
+		udp.swap(c)
+	} else {
+		mainLog.Warnf("online config: UDP goes on to %s, no longer the first server, until restarted", udpAddr)
+	}
+	d.set.Store(set)
+	return nil
+}
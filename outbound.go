@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/Potterli20/go-shadowsocks2/acl"
+	"github.com/Potterli20/go-shadowsocks2/geoip"
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// geoDB is the country database loaded with -geoip, if any.
+var geoDB *geoip.DB
+
+// geoBlock is the set of countries the server does not relay to.
+var geoBlock geoip.Set
+
+// privateNets are the local ranges the server does not relay to, so that
+// clients cannot reach services of the server's own network. Addresses in
+// outboundAllow are exempt.
+var (
+	privateNets   []netip.Prefix
+	outboundAllow []netip.Prefix
+)
+
+// blockPrivate makes the server refuse to relay to local ranges other than
+// those in allow.
+func blockPrivate(allow []netip.Prefix) {
+	privateNets = acl.LAN
+	outboundAllow = allow
+}
+
+// isPrivate reports whether ip is a local address the server does not relay to.
+func isPrivate(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if privateNets == nil || contains(outboundAllow, ip) {
+		return false
+	}
+	return ip.IsUnspecified() || contains(privateNets, ip)
+}
+
+func contains(ps []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefixes parses a comma-separated list of IPs and CIDR prefixes.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var ps []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(f); err == nil {
+			ps = append(ps, p.Masked())
+		} else if ip, err := netip.ParseAddr(f); err == nil {
+			ps = append(ps, netip.PrefixFrom(ip, ip.BitLen()))
+		} else {
+			return nil, fmt.Errorf("invalid address or prefix %q", f)
+		}
+	}
+	return ps, nil
+}
+
+// allowedPorts, if not nil, are the only destination ports the server relays
+// to, and blockedPorts those it does not relay to.
+var allowedPorts, blockedPorts []portRange
+
+// portRange is an inclusive range of ports.
+type portRange struct{ lo, hi uint16 }
+
+// parsePorts parses a comma-separated list of ports and port ranges such as
+// "25,465,6881-6889".
+func parsePorts(s string) ([]portRange, error) {
+	var rs []portRange
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(f, "-")
+		l, err := strconv.ParseUint(lo, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", f)
+		}
+		h := l
+		if isRange {
+			if h, err = strconv.ParseUint(hi, 10, 16); err != nil || h < l {
+				return nil, fmt.Errorf("invalid port range %q", f)
+			}
+		}
+		rs = append(rs, portRange{uint16(l), uint16(h)})
+	}
+	return rs, nil
+}
+
+// portBlocked reports whether the server does not relay to port for u.
+func portBlocked(u *user, port uint16) bool {
+	allow, block := u.portLists()
+	if allow != nil && !inRanges(allow, port) {
+		return true
+	}
+	return inRanges(block, port)
+}
+
+func inRanges(rs []portRange, port uint16) bool {
+	for _, r := range rs {
+		if r.lo <= port && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundFiltered reports whether relays of u need their destination
+// resolved to be checked.
+func outboundFiltered(u *user) bool {
+	return (u != nil && (u.policy != nil || u.BlockPorts != nil)) || privateNets != nil || allowedPorts != nil || blockedPorts != nil || len(geoBlock) > 0
+}
+
+// checkOutbound returns why the server may not relay to tgt of u, resolved
+// to ap, if it may not.
+func checkOutbound(u *user, tgt socks.Addr, ap netip.AddrPort) error {
+	if !u.permits(tgt, ap) {
+		return blocked("user %s may not relay to %s", u.Name, tgt)
+	}
+	if portBlocked(u, ap.Port()) {
+		return blocked("port %d of %s is blocked", ap.Port(), tgt)
+	}
+	if isPrivate(ap.Addr()) {
+		return blocked("%s is the local address %s", tgt, ap.Addr().Unmap())
+	}
+	if len(geoBlock) > 0 {
+		if c := geoDB.Country(ap.Addr()); geoBlock[c] {
+			return blocked("%s is in blocked country %s", tgt, c)
+		}
+	}
+	return nil
+}
+
+// resolveTCP returns the address to connect to for tgt of u, resolved and
+// checked if the destinations are filtered.
+func resolveTCP(u *user, tgt socks.Addr) (string, error) {
+	if !outboundFiltered(u) {
+		return tgt.String(), nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", tgt.String())
+	if err != nil {
+		return "", err
+	}
+	if err := checkOutbound(u, tgt, addr.AddrPort()); err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+)
+
+// With -outline-api, the server serves the subset of the REST API of the
+// Outline server used by Outline Manager, over HTTPS under a secret path,
+// so that the Manager administers it directly:
+//
+//	GET    /server                               name, hostname and settings
+//	PUT    /name                                 rename the server
+//	PUT    /server/hostname-for-access-keys      set the host of the access URLs
+//	PUT    /server/port-for-new-access-keys      only the port of the server is accepted
+//	PUT    /server/access-key-data-limit         set the data limit of keys without their own
+//	DELETE /server/access-key-data-limit         lift it
+//	GET    /metrics/enabled                      whether sharing metrics is enabled
+//	PUT    /metrics/enabled                      record it, nothing is ever shared
+//	GET    /metrics/transfer                     bytes relayed by key
+//	GET    /access-keys                          list the keys
+//	POST   /access-keys                          create a key
+//	GET    /access-keys/{id}                     show a key
+//	PUT    /access-keys/{id}                     create a key of that id
+//	DELETE /access-keys/{id}                     delete a key
+//	PUT    /access-keys/{id}/name                rename a key
+//	PUT    /access-keys/{id}/data-limit          set the data limit of a key
+//	DELETE /access-keys/{id}/data-limit          lift it
+//
+// Access keys are the users of -users, by name as id: keys created, renamed
+// or deleted are written to the users file, which is reloaded at once. Data
+// limits are quotas, counted in memory since start as in quota.go. The
+// secret path, the self-signed certificate and the settings of the server
+// are kept in -outline-dir, created on first start.
+
+// outlineState is the state of the Outline API kept in -outline-dir.
+type outlineState struct {
+	APIPrefix          string        `json:"apiPrefix"`
+	ServerID           string        `json:"serverId"`
+	Name               string        `json:"name"`
+	CreatedTimestampMs int64         `json:"createdTimestampMs"`
+	Hostname           string        `json:"hostname,omitempty"`
+	MetricsEnabled     bool          `json:"metricsEnabled"`
+	DataLimit          *outlineLimit `json:"accessKeyDataLimit,omitempty"`
+}
+
+type outlineLimit struct {
+	Bytes int64 `json:"bytes"`
+}
+
+// outlineKey is an access key as shown by the Outline API.
+type outlineKey struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Password  string        `json:"password"`
+	Port      int           `json:"port"`
+	Method    string        `json:"method"`
+	AccessURL string        `json:"accessUrl"`
+	DataLimit *outlineLimit `json:"dataLimit,omitempty"`
+}
+
+// outlineDefaultMethod is the cipher of the keys created without one.
+const outlineDefaultMethod = "chacha20-ietf-poly1305"
+
+type outlineAPI struct {
+	dir    string
+	users  string // path of the users file
+	cipher string // of the users without their own
+	port   int    // of the server
+
+	mu    sync.Mutex // serializes changes to the state and the users file
+	state outlineState
+}
+
+// serveOutline serves the Outline API on addr for the users of the file at
+// usersPath, whose default cipher is cipher, on a server listening on port.
+func serveOutline(addr, dir, usersPath, cipher string, port int) error {
+	if serverUsers == nil {
+		return errors.New("the Outline API requires -users")
+	}
+	o := &outlineAPI{dir: dir, users: usersPath, cipher: cipher, port: port}
+	if err := o.loadState(); err != nil {
+		return err
+	}
+	if o.state.DataLimit != nil {
+		defaultQuota.Store(o.state.DataLimit.Bytes)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := outlineCert(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	handle := func(pattern string, h http.HandlerFunc) {
+		method, path, _ := strings.Cut(pattern, " ")
+		mux.HandleFunc(method+" /"+o.state.APIPrefix+path, h)
+	}
+	handle("GET /server", o.server)
+	handle("PUT /name", setServer(o, func(s *outlineState, v struct{ Name string }) error {
+		if v.Name == "" || len(v.Name) > 100 {
+			return errors.New("name must be 1 to 100 characters long")
+		}
+		s.Name = v.Name
+		return nil
+	}))
+	handle("PUT /server/hostname-for-access-keys", setServer(o, func(s *outlineState, v struct{ Hostname string }) error {
+		if v.Hostname == "" {
+			return errors.New("hostname required")
+		}
+		s.Hostname = v.Hostname
+		return nil
+	}))
+	handle("PUT /server/port-for-new-access-keys", setServer(o, func(s *outlineState, v struct{ Port int }) error {
+		if v.Port != o.port {
+			return fmt.Errorf("keys share the port of the server, %d", o.port)
+		}
+		return nil
+	}))
+	handle("PUT /server/access-key-data-limit", setServer(o, func(s *outlineState, v struct{ Limit *outlineLimit }) error {
+		if v.Limit == nil || v.Limit.Bytes < 0 {
+			return errors.New("limit.bytes required")
+		}
+		s.DataLimit = v.Limit
+		defaultQuota.Store(v.Limit.Bytes)
+		return nil
+	}))
+	handle("DELETE /server/access-key-data-limit", setServer(o, func(s *outlineState, _ struct{}) error {
+		s.DataLimit = nil
+		defaultQuota.Store(0)
+		return nil
+	}))
+	handle("GET /metrics/enabled", func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		writeJSON(w, map[string]bool{"metricsEnabled": o.state.MetricsEnabled})
+	})
+	handle("PUT /metrics/enabled", setServer(o, func(s *outlineState, v struct{ MetricsEnabled *bool }) error {
+		if v.MetricsEnabled == nil {
+			return errors.New("metricsEnabled required")
+		}
+		s.MetricsEnabled = *v.MetricsEnabled
+		return nil
+	}))
+	handle("GET /metrics/transfer", o.transfer)
+	handle("GET /access-keys", o.listKeys)
+	handle("POST /access-keys", o.createKey)
+	handle("GET /access-keys/{id}", o.getKey)
+	handle("PUT /access-keys/{id}", o.createKey)
+	handle("DELETE /access-keys/{id}", o.deleteKey)
+	handle("PUT /access-keys/{id}/name", editKey(o, func(e userEntry, v struct{ Name *string }) error {
+		if v.Name == nil {
+			return errors.New("name required")
+		}
+		return e.set("label", *v.Name)
+	}))
+	handle("PUT /access-keys/{id}/data-limit", editKey(o, func(e userEntry, v struct{ Limit *outlineLimit }) error {
+		if v.Limit == nil || v.Limit.Bytes < 0 {
+			return errors.New("limit.bytes required")
+		}
+		return e.set("quota", v.Limit.Bytes)
+	}))
+	handle("DELETE /access-keys/{id}/data-limit", editKey(o, func(e userEntry, _ struct{}) error {
+		delete(e, "quota")
+		return nil
+	}))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	host, apiPort, _ := net.SplitHostPort(l.Addr().String())
+	if o.state.Hostname != "" {
+		host = o.state.Hostname
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	conf, _ := json.Marshal(map[string]string{
+		"apiUrl":     "https://" + net.JoinHostPort(host, apiPort) + "/" + o.state.APIPrefix,
+		"certSha256": hex.EncodeToString(sum[:]),
+	})
+	mainLog.Infof("Outline API on %s, added to Outline Manager with the line printed", l.Addr())
+	fmt.Printf("%s\n", conf)
+	srv := &http.Server{
+		Handler:   outlineCORS(mux),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		ErrorLog:  mainLog.std(slog.LevelDebug),
+	}
+	go srv.ServeTLS(l, "", "")
+	return nil
+}
+
+// outlineCORS lets the web builds of Outline Manager call h.
+func outlineCORS(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// outlineError replies with an error in the format of the Outline API.
+func outlineError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"code": code, "message": msg})
+}
+
+// decodeBody decodes the JSON body of r, if any, into v.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(v)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// loadState reads the state of -outline-dir, creating it on first start.
+func (o *outlineAPI) loadState() error {
+	if err := os.MkdirAll(o.dir, 0700); err != nil {
+		return err
+	}
+	b, err := os.ReadFile(filepath.Join(o.dir, "state.json"))
+	if err == nil {
+		if err := json.Unmarshal(b, &o.state); err != nil {
+			return fmt.Errorf("outline state: %v", err)
+		}
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	o.state = outlineState{
+		APIPrefix:          randomString(16),
+		ServerID:           randomString(16),
+		Name:               "go-shadowsocks2",
+		CreatedTimestampMs: time.Now().UnixMilli(),
+	}
+	return o.saveState()
+}
+
+// saveState writes the state to -outline-dir.
+func (o *outlineAPI) saveState() error {
+	b, err := json.MarshalIndent(o.state, "", " ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(o.dir, "state.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// randomString returns n random bytes encoded in base64 for URLs.
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// outlineCert loads the certificate of the API, generating a self-signed one
+// on first start: Outline Manager pins its hash rather than checking names.
+func outlineCert(certFile, keyFile string) (tls.Certificate, error) {
+	if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return cert, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "go-shadowsocks2"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
+
+// hostname returns the host of the access URLs: that set, or else the one
+// the request of the Manager reached.
+func (o *outlineAPI) hostname(r *http.Request) string {
+	if o.state.Hostname != "" {
+		return o.state.Hostname
+	}
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		return h
+	}
+	return r.Host
+}
+
+func (o *outlineAPI) server(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	version := "(devel)"
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+	}
+	writeJSON(w, map[string]any{
+		"name":                  o.state.Name,
+		"serverId":              o.state.ServerID,
+		"metricsEnabled":        o.state.MetricsEnabled,
+		"createdTimestampMs":    o.state.CreatedTimestampMs,
+		"version":               version,
+		"portForNewAccessKeys":  o.port,
+		"hostnameForAccessKeys": o.hostname(r),
+		"accessKeyDataLimit":    o.state.DataLimit,
+	})
+}
+
+// setServer changes the state with set, given the body of the request.
+func setServer[T any](o *outlineAPI, set func(*outlineState, T) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var v T
+		if err := decodeBody(w, r, &v); err != nil {
+			outlineError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		s := o.state
+		if err := set(&s, v); err != nil {
+			outlineError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+			return
+		}
+		o.state = s
+		if err := o.saveState(); err != nil {
+			outlineError(w, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (o *outlineAPI) transfer(w http.ResponseWriter, r *http.Request) {
+	bytes := make(map[string]int64)
+	for _, u := range serverUsers.set.Load().users {
+		bytes[u.Name] = usageOf(&userUsage, u.Name).Load()
+	}
+	writeJSON(w, map[string]any{"bytesTransferredByUserId": bytes})
+}
+
+// key returns u as an access key.
+func (o *outlineAPI) key(u *user, r *http.Request) outlineKey {
+	method := sipMethod(u.Cipher)
+	k := outlineKey{ID: u.Name, Name: u.Label, Password: u.Password, Port: o.port, Method: method}
+	k.AccessURL, _ = sip002URI(net.JoinHostPort(o.hostname(r), strconv.Itoa(o.port)), method, u.Password, "", "", u.Label)
+	if u.Quota > 0 {
+		k.DataLimit = &outlineLimit{u.Quota}
+	}
+	return k
+}
+
+// findUser returns the user named id, nil if there is none.
+func findUser(id string) *user {
+	for _, u := range serverUsers.set.Load().users {
+		if u.Name == id {
+			return u
+		}
+	}
+	return nil
+}
+
+func (o *outlineAPI) listKeys(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	keys := []outlineKey{}
+	for _, u := range serverUsers.set.Load().users {
+		keys = append(keys, o.key(u, r))
+	}
+	writeJSON(w, map[string]any{"accessKeys": keys})
+}
+
+func (o *outlineAPI) getKey(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	u := findUser(r.PathValue("id"))
+	if u == nil {
+		outlineError(w, http.StatusNotFound, "NotFound", "access key not found")
+		return
+	}
+	writeJSON(w, o.key(u, r))
+}
+
+// createKey creates a key of the id of the path, if any, or else the next
+// free number.
+func (o *outlineAPI) createKey(w http.ResponseWriter, r *http.Request) {
+	var v struct {
+		Name     string
+		Method   string
+		Password string
+		Port     int
+		Limit    *outlineLimit
+	}
+	if err := decodeBody(w, r, &v); err != nil {
+		outlineError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	if v.Method == "" {
+		v.Method = outlineDefaultMethod
+	}
+	if v.Password == "" {
+		v.Password = randomString(16)
+	}
+	if c, err := core.PickCipher(v.Method, nil, v.Password); err != nil {
+		outlineError(w, http.StatusBadRequest, "InvalidCipher", err.Error())
+		return
+	} else if _, ok := c.(*core.AeadCipher); !ok {
+		outlineError(w, http.StatusBadRequest, "InvalidCipher", "an AEAD cipher is required")
+		return
+	}
+	if v.Port != 0 && v.Port != o.port {
+		outlineError(w, http.StatusBadRequest, "InvalidPort", fmt.Sprintf("keys share the port of the server, %d", o.port))
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	id := r.PathValue("id")
+	if id == "" {
+		next := 0
+		for _, u := range serverUsers.set.Load().users {
+			if n, err := strconv.Atoi(u.Name); err == nil && n >= next {
+				next = n + 1
+			}
+		}
+		id = strconv.Itoa(next)
+	} else if findUser(id) != nil {
+		outlineError(w, http.StatusConflict, "Conflict", "access key "+id+" exists")
+		return
+	}
+	e := userEntry{}
+	e.set("name", id)
+	e.set("cipher", v.Method)
+	e.set("password", v.Password)
+	if v.Name != "" {
+		e.set("label", v.Name)
+	}
+	if v.Limit != nil && v.Limit.Bytes > 0 {
+		e.set("quota", v.Limit.Bytes)
+	}
+	err := o.editUsers(func(entries []userEntry) ([]userEntry, error) {
+		return append(entries, e), nil
+	})
+	if err != nil {
+		outlineError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	mainLog.Infof("access key %s created through the Outline API", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o.key(findUser(id), r))
+}
+
+func (o *outlineAPI) deleteKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if findUser(id) == nil {
+		outlineError(w, http.StatusNotFound, "NotFound", "access key not found")
+		return
+	}
+	err := o.editUsers(func(entries []userEntry) ([]userEntry, error) {
+		return slices.DeleteFunc(entries, func(e userEntry) bool { return e.name() == id }), nil
+	})
+	if err != nil {
+		outlineError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	activeRelays.endMatching(func(e accessEntry) bool { return e.User == id })
+	mainLog.Infof("access key %s deleted through the Outline API", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// editKey changes the entry of the key of the path with edit, given the body
+// of the request.
+func editKey[T any](o *outlineAPI, edit func(userEntry, T) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var v T
+		if err := decodeBody(w, r, &v); err != nil {
+			outlineError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		id := r.PathValue("id")
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if findUser(id) == nil {
+			outlineError(w, http.StatusNotFound, "NotFound", "access key not found")
+			return
+		}
+		var invalid error
+		err := o.editUsers(func(entries []userEntry) ([]userEntry, error) {
+			for _, e := range entries {
+				if e.name() == id {
+					invalid = edit(e, v)
+					return entries, invalid
+				}
+			}
+			return nil, errors.New("access key not found in the users file")
+		})
+		switch {
+		case invalid != nil:
+			outlineError(w, http.StatusBadRequest, "InvalidArgument", invalid.Error())
+		case err != nil:
+			outlineError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// userEntry is an entry of the users file, kept as is but for the fields
+// changed through the Outline API.
+type userEntry map[string]json.RawMessage
+
+func (e userEntry) set(field string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e[field] = b
+	return nil
+}
+
+func (e userEntry) name() string {
+	var s string
+	json.Unmarshal(e["name"], &s)
+	return s
+}
+
+// editUsers changes the entries of the users file with edit, writes them
+// back and reloads the users, restoring the file if they are invalid.
+func (o *outlineAPI) editUsers(edit func([]userEntry) ([]userEntry, error)) error {
+	old, err := os.ReadFile(o.users)
+	if err != nil {
+		return err
+	}
+	var entries []userEntry
+	if err := json.Unmarshal(old, &entries); err != nil {
+		return fmt.Errorf("users %s: %v", o.users, err)
+	}
+	if entries, err = edit(entries); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeUsersFile(o.users, b); err != nil {
+		return err
+	}
+	if err := serverUsers.reload(o.users, o.cipher); err != nil {
+		if werr := writeUsersFile(o.users, old); werr != nil {
+			mainLog.Errorf("failed to restore %s: %v", o.users, werr)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeUsersFile replaces the users file at path with b, keeping its mode.
+func writeUsersFile(path string, b []byte) error {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/Potterli20/go-shadowsocks2/acl"
+)
+
+// servePAC serves on addr a proxy auto-config file pointing browsers and
+// systems at the SOCKS proxy on socksAddr, generated from the current routing
+// tables so that they connect directly to the destinations routed around the
+// server. The SOCKS proxy routes the other destinations itself.
+func servePAC(addr, socksAddr string) error {
+	if _, ok := unixSocketPath(socksAddr); ok {
+		return errors.New("the SOCKS proxy is on a unix socket")
+	}
+	socksHost, socksPort, err := net.SplitHostPort(socksAddr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mainLog.Infof("PAC file on http://%s/proxy.pac", l.Addr())
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := socksHost
+		if ip, err := netip.ParseAddr(host); host == "" || err == nil && ip.IsUnspecified() {
+			host = pacRequestHost(r)
+		}
+		socks := net.JoinHostPort(host, socksPort)
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		io.WriteString(w, acl.PAC(clientACL.Load(), clientRules.Load(), "SOCKS5 "+socks+"; SOCKS "+socks))
+	}))
+	return nil
+}
+
+// pacRequestHost returns the host r was sent to, for a SOCKS proxy listening
+// on all addresses to be reached the same way as the PAC file.
+func pacRequestHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		return host
+	}
+	if r.Host != "" {
+		return r.Host
+	}
+	return "127.0.0.1"
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+)
+
+// With -padding, on both ends, the plaintext is framed and padded with random
+// bytes before encryption, so that the sizes of the encrypted chunks and
+// packets no longer give away those of the requests and replies, the target
+// address first. Each stream write goes out as frames of
+//
+//	[data length][padding length][data][padding]
+//
+// the lengths in 2 bytes big-endian, one AEAD chunk per frame. Frames shorter
+// than padMinFrame, as the handshake and keystrokes, are padded beyond it.
+// Each UDP packet is [data length][data][padding], with up to padPacketMax
+// bytes of padding, which -udp-mtu accounts for.
+
+const (
+	padFrameHeader = 4
+	padFrameMax    = 0x3FFF // the largest AEAD chunk
+	padStreamMax   = 255    // random padding on top of that to padMinFrame
+	padMinFrame    = 256
+	padPacketMax   = 64
+)
+
+// padCipher pads the streams and packets of the cipher it wraps.
+type padCipher struct {
+	core.Cipher
+	overhead int // of the packets, padding included
+}
+
+func newPadCipher(c core.Cipher) *padCipher {
+	return &padCipher{Cipher: c, overhead: packetOverhead(c.PacketConn) + 2 + padPacketMax}
+}
+
+// StreamConn pads the stream of c, keeping the user it authenticated as.
+func (p *padCipher) StreamConn(c net.Conn) net.Conn {
+	sc := p.Cipher.StreamConn(c)
+	return withUser(&padConn{Conn: sc}, userOf(sc))
+}
+
+func (p *padCipher) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &padPacketConn{PacketConn: p.Cipher.PacketConn(pc), overhead: p.overhead}
+}
+
+// padded wraps ciph in a padCipher if -padding is set.
+func padded(ciph core.Cipher) core.Cipher {
+	if !config.Padding {
+		return ciph
+	}
+	return newPadCipher(ciph)
+}
+
+var errPadFrame = errors.New("invalid padding frame")
+
+// padConn frames and pads the plaintext of the stream it wraps.
+type padConn struct {
+	net.Conn
+	wmu  sync.Mutex
+	wbuf []byte
+
+	data, pad int // left to read of the current frame
+	hdr       [padFrameHeader]byte
+}
+
+// padding returns the length of the padding of a frame carrying n bytes.
+func padding(n int) int {
+	pad := rand.Intn(padStreamMax + 1)
+	if n < padMinFrame {
+		pad += padMinFrame - n
+	}
+	return pad
+}
+
+func (c *padConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wbuf == nil {
+		c.wbuf = make([]byte, padFrameMax)
+	}
+	written := 0
+	for {
+		n := min(len(b), padFrameMax-padFrameHeader-padStreamMax)
+		pad := padding(n)
+		frame := c.wbuf[:padFrameHeader+n+pad]
+		binary.BigEndian.PutUint16(frame, uint16(n))
+		binary.BigEndian.PutUint16(frame[2:], uint16(pad))
+		copy(frame[padFrameHeader:], b[:n])
+		clear(frame[padFrameHeader+n:])
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += n
+		if b = b[n:]; len(b) == 0 {
+			return written, nil
+		}
+	}
+}
+
+func (c *padConn) Read(b []byte) (int, error) {
+	for c.data == 0 {
+		if c.pad > 0 {
+			if _, err := io.CopyN(io.Discard, c.Conn, int64(c.pad)); err != nil {
+				return 0, unexpected(err)
+			}
+			c.pad = 0
+		}
+		if _, err := io.ReadFull(c.Conn, c.hdr[:]); err != nil {
+			return 0, err
+		}
+		c.data = int(binary.BigEndian.Uint16(c.hdr[:]))
+		c.pad = int(binary.BigEndian.Uint16(c.hdr[2:]))
+		if c.data+c.pad > padFrameMax-padFrameHeader {
+			return 0, errPadFrame
+		}
+	}
+	n, err := c.Conn.Read(b[:min(len(b), c.data)])
+	c.data -= n
+	if err == io.EOF && c.data > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF, the stream ending within
+// a frame.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// padPacketConn pads the plaintext of the packets of the PacketConn it wraps.
+type padPacketConn struct {
+	net.PacketConn
+	overhead int
+	rmu      sync.Mutex
+	rbuf     []byte
+	wmu      sync.Mutex
+	wbuf     []byte
+}
+
+func (c *padPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, udpBufSize)
+	}
+	n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+	if err != nil {
+		return n, addr, err
+	}
+	if n < 2 || 2+int(binary.BigEndian.Uint16(c.rbuf)) > n {
+		return 0, addr, errPadFrame
+	}
+	m := int(binary.BigEndian.Uint16(c.rbuf))
+	if m > len(b) {
+		return 0, addr, io.ErrShortBuffer
+	}
+	return copy(b, c.rbuf[2:2+m]), addr, nil
+}
+
+func (c *padPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.wbuf == nil {
+		c.wbuf = make([]byte, udpBufSize)
+	}
+	if 2+len(b) > len(c.wbuf) {
+		return 0, io.ErrShortBuffer
+	}
+	pad := min(rand.Intn(padPacketMax+1), len(c.wbuf)-2-len(b))
+	pkt := c.wbuf[:2+len(b)+pad]
+	binary.BigEndian.PutUint16(pkt, uint16(len(b)))
+	copy(pkt[2:], b)
+	clear(pkt[2+len(b):])
+	if _, err := c.PacketConn.WriteTo(pkt, addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Overhead returns the number of bytes added to a packet, at most.
+func (c *padPacketConn) Overhead() int { return c.overhead }
@@ -13,7 +13,7 @@ import (
 var pluginCmd *exec.Cmd
 
 func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr string, err error) {
-	logf("starting plugin (%s) with option (%s)....", plugin, pluginOpts)
+	pluginLog.Infof("starting plugin (%s) with option (%s)", plugin, pluginOpts)
 	freePort, err := getFreePort()
 	if err != nil {
 		return "", fmt.Errorf("failed to fetch an unused port for plugin (%v)", err)
@@ -28,9 +28,9 @@ func startPlugin(plugin, pluginOpts, ssAddr string, isServer bool) (newAddr stri
 		if ssHost == "" {
 			ssHost = "0.0.0.0"
 		}
-		logf("plugin (%s) will listen on %s:%s", plugin, ssHost, ssPort)
+		pluginLog.Debugf("plugin (%s) will listen on %s:%s", plugin, ssHost, ssPort)
 	} else {
-		logf("plugin (%s) will listen on %s:%s", plugin, localHost, freePort)
+		pluginLog.Debugf("plugin (%s) will listen on %s:%s", plugin, localHost, freePort)
 	}
 	err = execPlugin(plugin, pluginOpts, ssHost, ssPort, localHost, freePort)
 	return
@@ -65,7 +65,7 @@ func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort
 			return err
 		}
 	}
-	logH := newLogHelper("[" + plugin + "]: ")
+	logH := logWriter{pluginLog.With("plugin", plugin)}
 	env := append(os.Environ(),
 		"SS_REMOTE_HOST="+remoteHost,
 		"SS_REMOTE_PORT="+remotePort,
@@ -85,10 +85,10 @@ func execPlugin(plugin, pluginOpts, remoteHost, remotePort, localHost, localPort
 	pluginCmd = cmd
 	go func() {
 		if err := cmd.Wait(); err != nil {
-			logf("plugin exited (%v)\n", err)
+			pluginLog.Errorf("plugin exited (%v)", err)
 			os.Exit(2)
 		}
-		logf("plugin exited\n")
+		pluginLog.Infof("plugin exited")
 		os.Exit(0)
 	}()
 	return nil
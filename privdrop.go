@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	osuser "os/user"
+	"strconv"
+)
+
+// With -user or -group, the process binds its listeners as root, e.g. to
+// ports below 1024, then takes the IDs of that user and group, so that a
+// compromise of the relays does not yield root. What happens later with
+// those IDs must be allowed to them: reading reloaded files, writing state
+// and usage files, binding the outbound sockets to an interface or marking
+// them.
+
+// lookupIDs returns the user and group IDs of the names, or numeric IDs,
+// usr and grp. The group defaults to the primary group of the user.
+func lookupIDs(usr, grp string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if usr != "" {
+		u, err := osuser.Lookup(usr)
+		if err != nil {
+			if u, err = osuser.LookupId(usr); err != nil {
+				return 0, 0, fmt.Errorf("user %s: %v", usr, err)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if grp != "" {
+		g, err := osuser.LookupGroup(grp)
+		if err != nil {
+			if g, err = osuser.LookupGroupId(grp); err != nil {
+				return 0, 0, fmt.Errorf("group %s: %v", grp, err)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// dropPrivileges switches the process to the user usr and the group grp.
+func dropPrivileges(usr, grp string) error {
+	uid, gid, err := lookupIDs(usr, grp)
+	if err != nil {
+		return err
+	}
+	if err := setIDs(uid, gid); err != nil {
+		return fmt.Errorf("failed to drop privileges: %v", err)
+	}
+	mainLog.Infof("running as user %d, group %d", uid, gid)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+func setIDs(uid, gid int) error {
+	return errors.New("-user and -group are not supported on this system")
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import "syscall"
+
+// setIDs sets the group, alone as supplementary group too, then the user of
+// the process, those negative left as they are.
+func setIDs(uid, gid int) error {
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return err
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return err
+		}
+	}
+	if uid >= 0 {
+		return syscall.Setuid(uid)
+	}
+	return nil
+}
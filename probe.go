@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+)
+
+// absorbProbe reads and discards what c sends after a failed handshake, as
+// a service waiting for a valid request would, until the client closes or
+// stays idle for about config.ProbeTimeout. Closing as soon as a handshake
+// fails, after a fixed number of bytes, would tell active probes what the
+// server is; see
+// https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
+func absorbProbe(ctx context.Context, c net.Conn) error {
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	timeout := probeTimeout()
+	buf := make([]byte, 4096)
+	for {
+		if timeout > 0 {
+			c.SetReadDeadline(time.Now().Add(timeout))
+		}
+		if _, err := c.Read(buf); err != nil {
+			if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// probeTimeout returns the idle timeout of a connection which failed the
+// handshake, varied so that it is no fixed signature, or 0 for none.
+func probeTimeout() time.Duration {
+	t := config.ProbeTimeout
+	if t <= 0 {
+		return 0
+	}
+	return t/2 + time.Duration(rand.Int63n(int64(t)))
+}
+
+// tapConn records what is read from it until stopped, so that a
+// connection failing the handshake can be handed over to the fallback
+// server from its first byte.
+type tapConn struct {
+	net.Conn
+	head    []byte
+	stopped bool
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stopped {
+		c.head = append(c.head, b[:n]...)
+	}
+	return n, err
+}
+
+func (c *tapConn) stop() {
+	c.stopped = true
+	c.head = nil
+}
+
+// fallback proxies c, whose first bytes head were already read, to
+// config.Fallback, so that probes see whatever is served there.
+func fallback(ctx context.Context, c net.Conn, head []byte) error {
+	var d net.Dialer
+	fc, err := d.DialContext(ctx, "tcp", config.Fallback)
+	if err != nil {
+		return err
+	}
+	defer fc.Close()
+	if _, err := fc.Write(head); err != nil {
+		return err
+	}
+	return relay(ctx, c, fc)
+}
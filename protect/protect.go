@@ -0,0 +1,25 @@
+// Package protect lets the outbound sockets of the proxy, to its servers
+// and targets, be excluded from a VPN before they connect, as Android's
+// VpnService requires of apps whose own traffic would otherwise loop through
+// the VPN they provide (VpnService.protect).
+package protect
+
+import "syscall"
+
+// Func, if set, is called with the descriptor of each outbound socket before
+// it connects. An error fails the connection.
+var Func func(fd int) error
+
+// Control calls Func with the socket of c, for the Control of a net.Dialer
+// or net.ListenConfig.
+func Control(network, address string, c syscall.RawConn) error {
+	f := Func
+	if f == nil {
+		return nil
+	}
+	var err error
+	if cerr := c.Control(func(fd uintptr) { err = f(int(fd)) }); cerr != nil {
+		return cerr
+	}
+	return err
+}
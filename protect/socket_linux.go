@@ -0,0 +1,38 @@
+package protect
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// timeout bounds the exchange with the protecting socket.
+const timeout = 3 * time.Second
+
+// Socket returns a Func sending each descriptor over the Unix socket at path,
+// as to the protect_path of shadowsocks-android, which answers with a byte
+// once it is protected, 0 on success.
+func Socket(path string) func(fd int) error {
+	return func(fd int) error {
+		c, err := net.DialTimeout("unix", path, timeout)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		uc := c.(*net.UnixConn)
+		uc.SetDeadline(time.Now().Add(timeout))
+		if _, _, err := uc.WriteMsgUnix([]byte{1}, syscall.UnixRights(fd), nil); err != nil {
+			return err
+		}
+		var ret [1]byte
+		if _, err := io.ReadFull(uc, ret[:]); err != nil {
+			return err
+		}
+		if ret[0] != 0 {
+			return errors.New("protect: socket not protected")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package protect
+
+import "errors"
+
+// Socket returns a Func failing, since passing descriptors to protect them is
+// only supported on Linux and Android.
+func Socket(path string) func(fd int) error {
+	return func(int) error { return errors.New("protect: not supported on this system") }
+}
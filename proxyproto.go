@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Behind haproxy, nginx stream or a cloud load balancer, -proxy-protocol
+// takes the address of clients from the PROXY protocol header, version 1 or
+// 2, the load balancer sends ahead of each connection, for the client
+// filters, connection limits, bans and logs to see the real client rather
+// than the load balancer. Connections without a valid header are dropped.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const proxyV1MaxLen = 107 // of the header line, CRLF included
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyListener hands over the connections it accepts once their PROXY
+// protocol header is read.
+type proxyListener struct {
+	*connListener
+	l net.Listener
+}
+
+func newProxyListener(l net.Listener) *proxyListener {
+	pl := &proxyListener{connListener: newConnListener(l.Addr()), l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				pl.connListener.Close()
+				return
+			}
+			go pl.readHeader(c)
+		}
+	}()
+	return pl
+}
+
+func (l *proxyListener) Close() error {
+	l.connListener.Close()
+	return l.l.Close()
+}
+
+// readHeader hands c over to Accept with the client address of its header,
+// within the time allowed to the handshake.
+func (l *proxyListener) readHeader(c net.Conn) {
+	handshaken := awaitHandshake(c)
+	remote, err := readProxyHeader(c)
+	handshaken()
+	if err != nil {
+		tcpLog.Debugf("failed to read PROXY protocol header from %v: %v", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	l.put(&proxyConn{Conn: c, remote: remote})
+}
+
+// readProxyHeader reads the PROXY protocol header off r, no further, and
+// returns the client address it gives, nil for connections of the load
+// balancer itself such as health checks.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	sig := make([]byte, len(proxyV1Sig))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(sig, proxyV1Sig):
+		return readProxyV1(r)
+	case bytes.Equal(sig, proxyV2Sig[:len(sig)]):
+		return readProxyV2(r)
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 reads the rest of a text header, as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyV1(r io.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen-len(proxyV1Sig))
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 5 || fields[0] != "TCP4" && fields[0] != "TCP6" {
+		return nil, errProxyHeader
+	}
+	ip, err := netip.ParseAddr(fields[1])
+	if err != nil || ip.Is4() != (fields[0] == "TCP4") {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 reads the rest of a binary header, whose signature starts with
+// the bytes already read.
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Sig)+4-len(proxyV1Sig))
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	rest := len(proxyV2Sig) - len(proxyV1Sig)
+	if !bytes.Equal(hdr[:rest], proxyV2Sig[len(proxyV1Sig):]) {
+		return nil, errProxyHeader
+	}
+	verCmd, family := hdr[rest], hdr[rest+1]
+	if verCmd>>4 != 2 || verCmd&0xF > 1 {
+		return nil, fmt.Errorf("%w: version and command %#x", errProxyHeader, verCmd)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[rest+2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if verCmd&0xF == 0 { // LOCAL
+		return nil, nil
+	}
+	var ip netip.Addr
+	var port []byte
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[:4])), body[8:10]
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[:16])).Unmap(), body[32:34]
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))), nil
+}
+
+// proxyConn reports the client address of its PROXY protocol header as its
+// remote address.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) Unwrap() net.Conn { return c.Conn }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Potterli20/go-shadowsocks2/qrcode"
+)
+
+// The qr command prints the ss:// URIs (SIP002) of a configuration with
+// their QR codes, drawn in the terminal, to onboard mobile devices straight
+// from it.
+
+// sipMethods maps the names of the AEAD ciphers to those of SIP002, which
+// other implementations know.
+var sipMethods = map[string]string{
+	"AEAD_AES_128_GCM":        "aes-128-gcm",
+	"AEAD_AES_192_GCM":        "aes-192-gcm",
+	"AEAD_AES_256_GCM":        "aes-256-gcm",
+	"AEAD_CHACHA20_POLY1305":  "chacha20-ietf-poly1305",
+	"AEAD_XCHACHA20_POLY1305": "xchacha20-ietf-poly1305",
+	"SM4_128_GCM":             "sm4-128-gcm",
+	"DUMMY":                   "none",
+	"PLAIN":                   "none",
+}
+
+// sipMethod returns the SIP002 name of cipher.
+func sipMethod(cipher string) string {
+	if m, ok := sipMethods[strings.ToUpper(cipher)]; ok {
+		return m
+	}
+	return strings.ToLower(cipher)
+}
+
+// sip002URI returns the ss:// URI of a server at addr, named name if set.
+func sip002URI(addr, cipher, password, plugin, pluginOpts, name string) (string, error) {
+	if strings.EqualFold(cipher, autoCipher) {
+		return "", errors.New("cipher auto cannot be shared, pick one")
+	}
+	u := url.URL{
+		Scheme:   "ss",
+		User:     url.User(base64.RawURLEncoding.EncodeToString([]byte(sipMethod(cipher) + ":" + password))),
+		Host:     addr,
+		Fragment: name,
+	}
+	if plugin != "" {
+		p := plugin
+		if pluginOpts != "" {
+			p += ";" + pluginOpts
+		}
+		u.RawQuery = "plugin=" + url.QueryEscape(p)
+	}
+	return u.String(), nil
+}
+
+// writeQR draws c in w with half blocks, two rows of modules per line, dark
+// on light whatever the colors of the terminal.
+func writeQR(w io.Writer, c *qrcode.Code) {
+	const quiet = 4 // modules of light border
+	var b strings.Builder
+	for y := -quiet; y < c.Size+quiet; y += 2 {
+		b.WriteString("\x1b[30;47m")
+		for x := -quiet; x < c.Size+quiet; x++ {
+			switch top, bottom := c.Black(x, y), c.Black(x, y+1); {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString("\x1b[0m\n")
+	}
+	io.WriteString(w, b.String())
+}
+
+// qrCommand runs the qr command, as in
+//
+//	go-shadowsocks2 qr -c client.json
+//	go-shadowsocks2 qr -c server.json -host 198.51.100.1 -name home
+//	go-shadowsocks2 qr -c ss://AEAD_CHACHA20_POLY1305:your-password@198.51.100.1:8488
+func qrCommand(args []string) error {
+	fs := flag.NewFlagSet("qr", flag.ExitOnError)
+	conf := fs.String("c", "", "config file of a client or server, as read with -config, or ss:// URLs of the servers")
+	host := fs.String("host", "", "host name or IP address the devices reach the server at, instead of that of the config")
+	name := fs.String("name", "", "name of the server shown by the devices")
+	level := fs.String("level", "M", "error correction level of the QR codes: L, M, Q or H")
+	noQR := fs.Bool("uri", false, "print the URIs only")
+	fs.Parse(args)
+	if *conf == "" {
+		return errors.New("qr: -c is required")
+	}
+	lvl := strings.Index("LMQH", strings.ToUpper(*level))
+	if len(*level) != 1 || lvl < 0 {
+		return fmt.Errorf("qr: invalid level %q", *level)
+	}
+
+	list, cipher, password, plugin, pluginOpts := *conf, "", "", "", ""
+	if !strings.HasPrefix(*conf, "ss://") {
+		if err := loadConfigFile(*conf); err != nil {
+			return err
+		}
+		option := func(name string) string { return flag.Lookup(name).Value.String() }
+		plugin, pluginOpts = option("plugin"), option("plugin-opts")
+		if list = option("c"); list == "" {
+			list = option("s")
+			// the devices run the plugin as clients
+			opts := strings.Split(pluginOpts, ";")
+			pluginOpts = strings.Join(slices.DeleteFunc(opts, func(o string) bool { return o == "server" }), ";")
+		}
+		if list == "" {
+			return fmt.Errorf("qr: config %s has no servers in \"c\" or \"s\"", *conf)
+		}
+		if isOnlineConfig(list) {
+			return fmt.Errorf("qr: config %s takes its servers from an online config", *conf)
+		}
+		if option("key") != "" || option("key-file") != "" {
+			return errors.New("qr: keys cannot be shared in ss:// URIs, use a password")
+		}
+		if option("users") != "" {
+			return errors.New("qr: the servers of -users have no single password, share ss:// URIs made of those of the users")
+		}
+		if t := option("transport"); t != transportTCP {
+			fmt.Fprintf(os.Stderr, "the devices must use the %s transport too, which ss:// URIs do not carry\n", t)
+		}
+		cipher, password = option("cipher"), option("password")
+	}
+
+	for i, s := range strings.Split(list, ",") {
+		addr, ciph, pass := s, cipher, password
+		if strings.HasPrefix(s, "ss://") {
+			var err error
+			if addr, ciph, pass, err = parseURL(s); err != nil {
+				return err
+			}
+		}
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("qr: %v", err)
+		}
+		if *host != "" {
+			h = *host
+		} else if ip, err := netip.ParseAddr(h); h == "" || err == nil && ip.IsUnspecified() {
+			return fmt.Errorf("qr: %s listens on all addresses, set -host to the one devices reach it at", addr)
+		}
+		uri, err := sip002URI(net.JoinHostPort(h, port), ciph, pass, plugin, pluginOpts, *name)
+		if err != nil {
+			return fmt.Errorf("qr: %v", err)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(uri)
+		if *noQR {
+			continue
+		}
+		c, err := qrcode.Encode([]byte(uri), qrcode.Level(lvl))
+		if err != nil {
+			return err
+		}
+		writeQR(os.Stdout, c)
+	}
+	return nil
+}
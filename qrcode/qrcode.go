@@ -0,0 +1,477 @@
+// Package qrcode encodes data in QR codes (ISO/IEC 18004), in byte mode, to
+// show ss:// URIs to the cameras of mobile devices.
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Level is the error correction level of a code, the share of it which may
+// be lost and still read: about 7% for L, 15% for M, 25% for Q and 30% for H.
+type Level int
+
+const (
+	L Level = iota
+	M
+	Q
+	H
+)
+
+// ErrTooLong occurs when the data does not fit in a code of version 40.
+var ErrTooLong = errors.New("qrcode: data too long")
+
+// Code is an encoded QR code.
+type Code struct {
+	Version int // 1 to 40
+	Size    int // modules per side, 17 + 4*Version
+	Level   Level
+	Mask    int
+
+	modules    [][]bool // dark modules by row then column
+	isFunction [][]bool // modules of function patterns, never masked
+}
+
+// Black reports whether the module at column x and row y is dark.
+func (c *Code) Black(x, y int) bool {
+	return x >= 0 && x < c.Size && y >= 0 && y < c.Size && c.modules[y][x]
+}
+
+// Encode returns the smallest code holding data at level, or a higher level
+// if it fits in the same version, with the mask of the lowest penalty.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < L || level > H {
+		return nil, fmt.Errorf("qrcode: invalid level %d", level)
+	}
+	version := 1
+	for ; ; version++ {
+		if version > 40 {
+			return nil, ErrTooLong
+		}
+		if dataBits(version, len(data)) <= dataCodewords(version, level)*8 {
+			break
+		}
+	}
+	for level < H && dataBits(version, len(data)) <= dataCodewords(version, level+1)*8 {
+		level++
+	}
+
+	// Byte mode segment, terminator and padding.
+	var bb bitBuffer
+	bb.append(0b0100, 4)
+	bb.append(len(data), countBits(version))
+	for _, b := range data {
+		bb.append(int(b), 8)
+	}
+	capacity := dataCodewords(version, level) * 8
+	bb.append(0, min(4, capacity-len(bb)))
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := 0xEC; len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+	codewords := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	c := &Code{Version: version, Size: 17 + 4*version, Level: level}
+	c.modules = make([][]bool, c.Size)
+	c.isFunction = make([][]bool, c.Size)
+	for i := range c.modules {
+		c.modules[i] = make([]bool, c.Size)
+		c.isFunction[i] = make([]bool, c.Size)
+	}
+	c.drawFunctionPatterns()
+	c.drawCodewords(addECCAndInterleave(codewords, version, level))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // undone by XOR
+	}
+	c.Mask = best
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return c, nil
+}
+
+// countBits returns the length of the character count of byte mode.
+func countBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// dataBits returns the bits of n bytes in a single byte mode segment.
+func dataBits(version, n int) int {
+	if n >= 1<<countBits(version) {
+		return 1 << 30
+	}
+	return 4 + countBits(version) + 8*n
+}
+
+// Error correction codewords per block and number of blocks, by level and
+// version.
+var (
+	eccPerBlock = [4][41]int{
+		{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+		{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	}
+	eccBlocks = [4][41]int{
+		{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+		{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+		{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+		{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+	}
+)
+
+// rawDataModules returns the modules of a version left for codewords and
+// remainder bits once the function patterns are drawn.
+func rawDataModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// dataCodewords returns the data codewords of a version at level.
+func dataCodewords(version int, level Level) int {
+	return rawDataModules(version)/8 - eccPerBlock[level][version]*eccBlocks[level][version]
+}
+
+// addECCAndInterleave splits data in blocks, appends their error correction
+// codewords and interleaves them.
+func addECCAndInterleave(data []byte, version int, level Level) []byte {
+	numBlocks := eccBlocks[level][version]
+	eccLen := eccPerBlock[level][version]
+	raw := rawDataModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		dat := data[k : k+n]
+		k += n
+		block := append([]byte(nil), dat...)
+		if i < numShort {
+			block = append(block, 0) // skipped when interleaving
+		}
+		blocks[i] = append(block, rsRemainder(dat, divisor)...)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of degree n,
+// highest coefficients first, leaving out the leading 1.
+func rsDivisor(n int) []byte {
+	result := make([]byte, n)
+	result[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < n {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMul(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// alignmentPositions returns the centers of the alignment patterns of a
+// version along either axis.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	n := version/7 + 2
+	step := (version*8 + n*3 + 5) / (n*4 - 4) * 2
+	result := make([]int, n)
+	result[0] = 6
+	for i, pos := n-1, 17+4*version-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.isFunction[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns() {
+	for i := 0; i < c.Size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	pos := alignmentPositions(c.Version)
+	last := len(pos) - 1
+	for i := range pos {
+		for j := range pos {
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue // the finders are there
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	c.drawFormatBits(0) // reserved until masked
+	if c.Version >= 7 {
+		bits := versionBits(c.Version)
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 != 0
+			a, b := c.Size-11+i%3, i/3
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+}
+
+// drawFinder draws a finder pattern centered at x, y with its separator.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < c.Size && yy >= 0 && yy < c.Size {
+				d := max(abs(dx), abs(dy))
+				c.set(xx, yy, d != 2 && d != 4)
+			}
+		}
+	}
+}
+
+// formatBits returns the 15 bits of the format information of level and
+// mask, with their BCH code, masked.
+func formatBits(level Level, mask int) int {
+	data := [4]int{1, 0, 3, 2}[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionBits returns the 18 bits of the version information of a version
+// from 7, with their BCH code.
+func versionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatBits(c.Level, mask)
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.set(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, c.Size-15+i, bit(i))
+	}
+	c.set(8, c.Size-8, true) // the dark module
+}
+
+// drawCodewords places data in the zigzag order of the non-function modules,
+// leaving the remainder bits light.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skips the vertical timing pattern
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert // upward
+				}
+				if !c.isFunction[y][x] && i < len(data)*8 {
+					c.modules[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the non-function modules selected by mask.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.isFunction[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the current modules by the rules of the standard, lower
+// being easier to read.
+func (c *Code) penalty() int {
+	n := c.Size
+	p := 0
+	line := make([]bool, n)
+	for axis := 0; axis < 2; axis++ {
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if axis == 0 {
+					line[j] = c.modules[i][j]
+				} else {
+					line[j] = c.modules[j][i]
+				}
+			}
+			run := 1
+			for j := 1; j <= n; j++ {
+				if j < n && line[j] == line[j-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					p += run - 2
+				}
+				run = 1
+			}
+			for j := 0; j+7 <= n; j++ {
+				if line[j] && !line[j+1] && line[j+2] && line[j+3] && line[j+4] && !line[j+5] && line[j+6] &&
+					(light(line, j-4, j) || light(line, j+7, j+11)) {
+					p += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				v := c.modules[y][x]
+				if v == c.modules[y][x+1] && v == c.modules[y+1][x] && v == c.modules[y+1][x+1] {
+					p += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return p + k*10
+}
+
+// light reports whether the modules of line from i to j are light, those
+// outside being so.
+func light(line []bool, i, j int) bool {
+	for ; i < j; i++ {
+		if i >= 0 && i < len(line) && line[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+type bitBuffer []bool
+
+func (bb *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, v>>i&1 != 0)
+	}
+}
@@ -0,0 +1,197 @@
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRemainder(t *testing.T) {
+	// HELLO WORLD at 1-M, from the tutorial at thonky.com.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("rsRemainder = %v, want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	for _, tt := range []struct {
+		level Level
+		mask  int
+		want  int
+	}{
+		{L, 0, 0b111011111000100},
+		{M, 0, 0b101010000010010},
+		{Q, 0, 0b011010101011111},
+		{H, 0, 0b001011010001001},
+		{M, 5, 0b100000011001110},
+	} {
+		if got := formatBits(tt.level, tt.mask); got != tt.want {
+			t.Errorf("formatBits(%d, %d) = %015b, want %015b", tt.level, tt.mask, got, tt.want)
+		}
+	}
+	if got := versionBits(7); got != 0b000111110010010100 {
+		t.Errorf("versionBits(7) = %018b", got)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	for _, tt := range []struct {
+		version int
+		level   Level
+		bytes   int
+	}{
+		{1, L, 17}, {1, M, 14}, {1, Q, 11}, {1, H, 7},
+		{7, M, 122}, {10, M, 213}, {40, L, 2953}, {40, H, 1273},
+	} {
+		capacity := dataCodewords(tt.version, tt.level) * 8
+		if dataBits(tt.version, tt.bytes) > capacity || dataBits(tt.version, tt.bytes+1) <= capacity {
+			t.Errorf("%d-%d does not hold %d bytes", tt.version, tt.level, tt.bytes)
+		}
+	}
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	for version, want := range map[int][]int{
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		32: {6, 34, 60, 86, 112, 138},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	} {
+		got := alignmentPositions(version)
+		if len(got) != len(want) {
+			t.Errorf("alignmentPositions(%d) = %v, want %v", version, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("alignmentPositions(%d) = %v, want %v", version, got, want)
+				break
+			}
+		}
+	}
+}
+
+// TestRoundTrip reads the codes back: format information, codewords,
+// error correction and data.
+func TestRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNzd29yZA@198.51.100.1:8388#example",
+		strings.Repeat("0123456789abcdef", 30),
+	} {
+		for level := L; level <= H; level++ {
+			c, err := Encode([]byte(s), level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Level < level {
+				t.Errorf("level %d lowered to %d", level, c.Level)
+			}
+			if got := readBack(t, c); got != s {
+				t.Errorf("read back %q from %d-%d, want %q", got, c.Version, c.Level, s)
+			}
+		}
+	}
+	if _, err := Encode(make([]byte, 2954), L); err != ErrTooLong {
+		t.Errorf("Encode of 2954 bytes: %v, want %v", err, ErrTooLong)
+	}
+}
+
+func readBack(t *testing.T, c *Code) string {
+	t.Helper()
+	format := 0
+	for i := 14; i >= 9; i-- {
+		format = format<<1 | b(c.Black(14-i, 8))
+	}
+	format = format<<1 | b(c.Black(7, 8))
+	format = format<<1 | b(c.Black(8, 8))
+	format = format<<1 | b(c.Black(8, 7))
+	for i := 5; i >= 0; i-- {
+		format = format<<1 | b(c.Black(8, i))
+	}
+	if format != formatBits(c.Level, c.Mask) {
+		t.Fatalf("format bits %015b, want %015b", format, formatBits(c.Level, c.Mask))
+	}
+	for x := 0; x < 7; x++ {
+		if !c.Black(x, 0) || !c.Black(c.Size-1-x, 0) || !c.Black(0, c.Size-1-x) {
+			t.Fatal("finder patterns missing")
+		}
+	}
+
+	u := *c
+	u.modules = make([][]bool, c.Size)
+	for i := range u.modules {
+		u.modules[i] = append([]bool(nil), c.modules[i]...)
+	}
+	u.applyMask(c.Mask)
+	raw := make([]byte, rawDataModules(c.Version)/8)
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if !c.isFunction[y][x] && i < len(raw)*8 {
+					raw[i>>3] |= byte(b(u.modules[y][x])) << (7 - i&7)
+					i++
+				}
+			}
+		}
+	}
+
+	numBlocks := eccBlocks[c.Level][c.Version]
+	eccLen := eccPerBlock[c.Level][c.Version]
+	short := len(raw)/numBlocks - eccLen // data codewords of the short blocks
+	numShort := numBlocks - len(raw)%numBlocks
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; k < len(raw); i++ {
+		for j := range blocks {
+			if i == short && j < numShort {
+				continue
+			}
+			blocks[j] = append(blocks[j], raw[k])
+			k++
+		}
+	}
+	var data []byte
+	for _, block := range blocks {
+		n := len(block) - eccLen
+		if !bytes.Equal(rsRemainder(block[:n], rsDivisor(eccLen)), block[n:]) {
+			t.Fatalf("block %v fails error correction", block)
+		}
+		data = append(data, block[:n]...)
+	}
+
+	bit := 0
+	read := func(n int) int {
+		v := 0
+		for ; n > 0; n-- {
+			v = v<<1 | int(data[bit>>3]>>(7-bit&7)&1)
+			bit++
+		}
+		return v
+	}
+	if mode := read(4); mode != 0b0100 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	out := make([]byte, read(countBits(c.Version)))
+	for i := range out {
+		out[i] = byte(read(8))
+	}
+	return string(out)
+}
+
+func b(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicALPN is the application protocol negotiated by the QUIC transport.
+const quicALPN = "shadowsocks"
+
+var quicConfig = &quic.Config{
+	Allow0RTT:       true,
+	KeepAlivePeriod: 15 * time.Second,
+	MaxIdleTimeout:  time.Minute,
+}
+
+// quicListener accepts every stream of every QUIC connection as a net.Conn.
+type quicListener struct {
+	*connListener
+	l *quic.EarlyListener
+}
+
+func listenQUIC(addr string) (net.Listener, error) {
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{quicALPN}
+	l, err := quic.ListenAddrEarly(addr, tlsConfig, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	ql := &quicListener{connListener: newConnListener(l.Addr()), l: l}
+	go ql.serve()
+	return ql, nil
+}
+
+func (l *quicListener) serve() {
+	for {
+		qc, err := l.l.Accept(context.Background())
+		if err != nil {
+			l.connListener.Close()
+			return
+		}
+		go func() {
+			for {
+				st, err := qc.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				l.put(&quicConn{Stream: st, conn: qc})
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.connListener.Close()
+	return l.l.Close()
+}
+
+// quicConn is a QUIC stream as a net.Conn.
+type quicConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close closes both directions of the stream, unlike quic.Stream.Close.
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// QUIC connections to servers shared by all streams, keyed by address.
+var (
+	quicMu      sync.Mutex
+	quicPools   = make(map[string]*quicPool)
+	quicTickets = tls.NewLRUClientSessionCache(16)
+)
+
+// quicPool holds the connections to one server. A connection whose streams
+// are all in use is kept for when they close, and another is dialed beside it.
+type quicPool struct {
+	mu      sync.Mutex
+	conns   []quic.EarlyConnection
+	dialing *quicDial // the connection being established, if any
+}
+
+// quicDial is a QUIC handshake in flight, shared by the streams waiting on it.
+type quicDial struct {
+	done chan struct{}
+	qc   quic.EarlyConnection
+	err  error
+}
+
+func quicPoolFor(addr string) *quicPool {
+	quicMu.Lock()
+	defer quicMu.Unlock()
+	p := quicPools[addr]
+	if p == nil {
+		p = new(quicPool)
+		quicPools[addr] = p
+	}
+	return p
+}
+
+// dialContext bounds an outbound dial by -dial-timeout.
+func dialContext() (context.Context, context.CancelFunc) {
+	if config.DialTimeout > 0 {
+		return context.WithTimeout(context.Background(), config.DialTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// dialQUICConn establishes a QUIC connection to addr, from the outbound
+// address and interface if bound.
+func dialQUICConn(ctx context.Context, addr string, tlsConfig *tls.Config) (quic.EarlyConnection, error) {
+	ua, err := resolveUDPAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !outboundBound() {
+		return quic.DialAddrEarly(ctx, ua.String(), tlsConfig, quicConfig)
+	}
+	pc, err := listenOutbound("")
+	if err != nil {
+		return nil, err
+	}
+	qc, err := quic.DialEarly(ctx, pc, ua, tlsConfig, quicConfig)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	context.AfterFunc(qc.Context(), func() { pc.Close() })
+	return qc, nil
+}
+
+// dialQUIC opens a stream on a QUIC connection to addr, establishing one
+// first if none has a stream to spare. Resumed connections send their first
+// data in 0-RTT.
+func dialQUIC(addr string) (net.Conn, error) {
+	p := quicPoolFor(addr)
+	p.mu.Lock()
+	live := p.conns[:0]
+	for _, qc := range p.conns {
+		if qc.Context().Err() == nil {
+			live = append(live, qc)
+		}
+	}
+	clear(p.conns[len(live):])
+	p.conns = live
+	for _, qc := range p.conns {
+		// fails with a quic.StreamLimitReachedError while the server
+		// allows no more streams; those in use go on undisturbed
+		if st, err := qc.OpenStream(); err == nil {
+			p.mu.Unlock()
+			return &quicConn{Stream: st, conn: qc}, nil
+		}
+	}
+	d := p.dialing
+	if d == nil {
+		d = &quicDial{done: make(chan struct{})}
+		p.dialing = d
+		p.mu.Unlock()
+		p.dial(addr, d)
+	} else {
+		p.mu.Unlock()
+	}
+	<-d.done
+	if d.err != nil {
+		return nil, d.err
+	}
+	ctx, cancel := dialContext()
+	defer cancel()
+	// before the handshake ends, the stream limit is the one the server
+	// last sent, or none at all
+	st, err := d.qc.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: st, conn: d.qc}, nil
+}
+
+// dial establishes the connection d waits for, without holding any lock
+// during the handshake.
+func (p *quicPool) dial(addr string, d *quicDial) {
+	tlsConfig := clientTLSConfig(addr)
+	tlsConfig.NextProtos = []string{quicALPN}
+	tlsConfig.ClientSessionCache = quicTickets
+	ctx, cancel := dialContext()
+	d.qc, d.err = dialQUICConn(ctx, addr, tlsConfig)
+	cancel()
+	p.mu.Lock()
+	p.dialing = nil
+	if d.err == nil {
+		p.conns = append(p.conns, d.qc)
+	}
+	p.mu.Unlock()
+	close(d.done)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A user of -users with "quota" set may relay that many bytes, sent and
+// received together, and one with "expires" set may relay until then. Past
+// either, the server refuses the new sessions of the user and ends those in
+// progress. -listener-quota does the same for each listening address and
+// -expires for the whole server, for those handing out a port or a process
+// per customer. Usage is counted in memory since start, by user name across
+// reloads of -users, and reset through the admin API.
+
+var (
+	errUserQuota     = errors.New("user quota exceeded")
+	errUserExpired   = errors.New("user expired")
+	errListenerQuota = errors.New("listener quota exceeded")
+	errServerExpired = errors.New("server expired")
+)
+
+// userUsage and listenerUsage count the bytes relayed by user name and by
+// listening address.
+var userUsage, listenerUsage sync.Map // string -> *atomic.Int64
+
+// serverExpires is the time of -expires, zero if unset.
+var serverExpires time.Time
+
+// defaultQuota is the quota of the users without their own, set through the
+// Outline API.
+var defaultQuota atomic.Int64
+
+// quota returns the quota of u, 0 if unlimited.
+func (u *user) quota() int64 {
+	if u.Quota > 0 {
+		return u.Quota
+	}
+	return defaultQuota.Load()
+}
+
+// usageOf returns the counter of key in m.
+func usageOf(m *sync.Map, key string) *atomic.Int64 {
+	if v, ok := m.Load(key); ok {
+		return v.(*atomic.Int64)
+	}
+	v, _ := m.LoadOrStore(key, new(atomic.Int64))
+	return v.(*atomic.Int64)
+}
+
+// resetUsage sets the counter of key in m back to zero.
+func resetUsage(m *sync.Map, key string) {
+	if v, ok := m.Load(key); ok {
+		v.(*atomic.Int64).Store(0)
+	}
+}
+
+// parseExpiry parses the time of -expires or "expires" of a user: RFC 3339,
+// as 2026-12-31T18:00:00+01:00, or a date, as 2026-12-31, meaning its start
+// in local time.
+func parseExpiry(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q: a date or RFC 3339 time is expected", s)
+	}
+	return t, nil
+}
+
+// setExpiry sets serverExpires to the time of -expires.
+func setExpiry(s string) (err error) {
+	serverExpires, err = parseExpiry(s)
+	return err
+}
+
+// checkQuota returns why new sessions of u on listener are refused, nil if
+// they are not.
+func checkQuota(u *user, listener string) error {
+	if err := listenerQuota(listener); err != nil {
+		return err
+	}
+	return userQuota(u)
+}
+
+// listenerQuota returns why new sessions on listener are refused, if they are.
+func listenerQuota(listener string) error {
+	if !serverExpires.IsZero() && !time.Now().Before(serverExpires) {
+		return errServerExpired
+	}
+	if config.ListenerQuota > 0 && usageOf(&listenerUsage, listener).Load() >= config.ListenerQuota {
+		return errListenerQuota
+	}
+	return nil
+}
+
+// userQuota returns why new sessions of u are refused, if they are. A nil
+// user, as in single-user mode, has no quota.
+func userQuota(u *user) error {
+	if u == nil {
+		return nil
+	}
+	if !u.expires.IsZero() && !time.Now().Before(u.expires) {
+		return errUserExpired
+	}
+	if q := u.quota(); q > 0 && usageOf(&userUsage, u.Name).Load() >= q {
+		return errUserQuota
+	}
+	return nil
+}
+
+// quotaMeter counts the bytes of a session of u on listener.
+type quotaMeter struct {
+	u        *user
+	listener string
+	counters []*atomic.Int64
+}
+
+// newMeter returns the meter of a session of u on listener, nil if there is
+// nothing to count.
+func newMeter(u *user, listener string) *quotaMeter {
+	m := &quotaMeter{u: u, listener: listener}
+	if u != nil {
+		m.counters = append(m.counters, usageOf(&userUsage, u.Name))
+	}
+	if config.ListenerQuota > 0 {
+		m.counters = append(m.counters, usageOf(&listenerUsage, listener))
+	}
+	if len(m.counters) == 0 && serverExpires.IsZero() {
+		return nil
+	}
+	return m
+}
+
+// add counts n bytes, returning why the session is to end, if it is.
+func (m *quotaMeter) add(n int) error {
+	for _, c := range m.counters {
+		c.Add(int64(n))
+	}
+	return checkQuota(m.u, m.listener)
+}
+
+// meterConn counts the bytes read from and written to c, a session of u on
+// listener, failing once past the quotas.
+func meterConn(c net.Conn, u *user, listener string) net.Conn {
+	m := newMeter(u, listener)
+	if m == nil {
+		return c
+	}
+	return &meteredConn{Conn: c, m: m}
+}
+
+type meteredConn struct {
+	net.Conn
+	m   *quotaMeter
+	err atomic.Pointer[error] // why the session ends, once past the quotas
+}
+
+// count counts n bytes, closing c once past the quotas so that both
+// directions of the relay end at once.
+func (c *meteredConn) count(n int) {
+	if err := c.m.add(n); err != nil && c.err.CompareAndSwap(nil, &err) {
+		c.Conn.Close()
+	}
+}
+
+// reason returns why the session ended past the quotas, if it did, instead
+// of err, the failure of the closed connection.
+func (c *meteredConn) reason(err error) error {
+	if qerr := c.err.Load(); qerr != nil {
+		return *qerr
+	}
+	return err
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.count(n)
+	return n, c.reason(err)
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.count(n)
+	return n, c.reason(err)
+}
+
+func (c *meteredConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.Conn, countReader{r, c.count})
+	return n, c.reason(err)
+}
+
+func (c *meteredConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(countWriter{w, c.count}, c.Conn)
+	return n, c.reason(err)
+}
+
+// meterPacketConn counts the bytes of the packets read from and written to
+// pc, a UDP session of u on listener, dropping them once past the quotas.
+func meterPacketConn(pc net.PacketConn, u *user, listener string) net.PacketConn {
+	m := newMeter(u, listener)
+	if m == nil {
+		return pc
+	}
+	return &meteredPacketConn{PacketConn: pc, m: m}
+}
+
+type meteredPacketConn struct {
+	net.PacketConn
+	m *quotaMeter
+}
+
+func (c *meteredPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || c.m.add(n) == nil {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *meteredPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if checkQuota(c.m.u, c.m.listener) != nil {
+		return len(b), nil // dropped
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.m.add(n)
+	return n, err
+}
+
+// quotaInfo is the state of a quota as reported by the admin API.
+type quotaInfo struct {
+	User     string     `json:"user,omitempty"`
+	Listener string     `json:"listener,omitempty"`
+	Used     int64      `json:"used"`
+	Quota    int64      `json:"quota,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	State    string     `json:"state"` // "active" or why new sessions are refused
+}
+
+// quotaStates returns the state of the users with a quota or expiry, of the
+// listeners with -listener-quota and of the server with -expires.
+func quotaStates() []quotaInfo {
+	state := func(err error) string {
+		if err != nil {
+			return err.Error()
+		}
+		return "active"
+	}
+	l := []quotaInfo{}
+	if !serverExpires.IsZero() {
+		s := "active"
+		if !time.Now().Before(serverExpires) {
+			s = errServerExpired.Error()
+		}
+		l = append(l, quotaInfo{Expires: &serverExpires, State: s})
+	}
+	if config.ListenerQuota > 0 {
+		for _, ls := range listListeners() {
+			used := usageOf(&listenerUsage, ls.Addr).Load()
+			l = append(l, quotaInfo{Listener: ls.Addr, Used: used, Quota: config.ListenerQuota, State: state(listenerQuota(ls.Addr))})
+		}
+	}
+	if serverUsers != nil {
+		users := append([]*user(nil), serverUsers.set.Load().users...)
+		sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+		for _, u := range users {
+			if u.quota() <= 0 && u.expires.IsZero() {
+				continue
+			}
+			q := quotaInfo{User: u.Name, Used: usageOf(&userUsage, u.Name).Load(), Quota: u.quota()}
+			if !u.expires.IsZero() {
+				q.Expires = &u.expires
+			}
+			q.State = state(userQuota(u))
+			l = append(l, q)
+		}
+	}
+	return l
+}
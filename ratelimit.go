@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// globalLimiter is shared by all relays; nil means unlimited.
+var globalLimiter atomic.Pointer[rate.Limiter]
+
+// userLimiters and listenerLimiters hold the limiters shared by all the
+// relays and UDP sessions of a user, by name, and of a listener, by address.
+// Limiters are adjusted in place, through the users file and the admin API,
+// so that the relays in progress follow; a limit set where there was none
+// applies to those started after.
+var userLimiters, listenerLimiters sync.Map // string -> *rate.Limiter
+
+// globalFair, if not nil, shares globalLimiter fairly among TCP relays.
+var globalFair *fairScheduler
+
+// newLimiter returns a token bucket refilled at bytesPerSec and holding up to
+// burst bytes, defaulting to one second worth of traffic. It returns nil if
+// bytesPerSec is not positive.
+func newLimiter(bytesPerSec, burst int) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+}
+
+// setLimit limits l to bytesPerSec and burst as newLimiter, or lifts the
+// limit if bytesPerSec is not positive.
+func setLimit(l *rate.Limiter, bytesPerSec, burst int) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	l.SetBurst(burst)
+	l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// setLimiter sets the limit of the limiter of key in m, creating it if need
+// be.
+func setLimiter(m *sync.Map, key string, bytesPerSec, burst int) {
+	v, ok := m.Load(key)
+	if !ok {
+		if bytesPerSec <= 0 {
+			return
+		}
+		if v, ok = m.LoadOrStore(key, newLimiter(bytesPerSec, burst)); !ok {
+			return
+		}
+	}
+	setLimit(v.(*rate.Limiter), bytesPerSec, burst)
+}
+
+// setGlobalLimit sets the limit of globalLimiter, creating it if need be.
+func setGlobalLimit(bytesPerSec, burst int) {
+	if l := globalLimiter.Load(); l != nil {
+		setLimit(l, bytesPerSec, burst)
+	} else if l := newLimiter(bytesPerSec, burst); l != nil {
+		globalLimiter.CompareAndSwap(nil, l)
+	}
+}
+
+// listenerLimiter returns the limiter of the listener on addr, nil if none,
+// limited to -listener-rate at first.
+func listenerLimiter(addr string) *rate.Limiter {
+	v, ok := listenerLimiters.Load(addr)
+	if !ok {
+		if config.ListenerRate <= 0 || findListener(addr) == nil {
+			return nil
+		}
+		v, _ = listenerLimiters.LoadOrStore(addr, newLimiter(config.ListenerRate, config.ListenerBurst))
+	}
+	return v.(*rate.Limiter)
+}
+
+// sessionLimiters returns the limiters applying to a new relay session of u
+// on listener, but globalLimiter if shared fairly and fair.
+func sessionLimiters(fair bool, u *user, listener string) []*rate.Limiter {
+	var ls []*rate.Limiter
+	if l := globalLimiter.Load(); l != nil && !(fair && globalFair != nil) {
+		ls = append(ls, l)
+	}
+	if l := newLimiter(config.SessionRate, config.SessionBurst); l != nil {
+		ls = append(ls, l)
+	}
+	if u != nil {
+		if v, ok := userLimiters.Load(u.Name); ok {
+			ls = append(ls, v.(*rate.Limiter))
+		}
+	}
+	if l := listenerLimiter(listener); l != nil {
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+// waitN blocks until n bytes are allowed by all limiters.
+func waitN(ls []*rate.Limiter, n int) {
+	for _, l := range ls {
+		if l.Limit() == rate.Inf {
+			continue
+		}
+		for m := n; m > 0; {
+			k := min(m, l.Burst())
+			l.WaitN(context.Background(), k)
+			m -= k
+		}
+	}
+}
+
+// limitConn throttles bytes read from and written to c, accepted on
+// listener.
+func limitConn(c net.Conn, listener string) net.Conn {
+	ls := sessionLimiters(true, userOf(c), listener)
+	if len(ls) == 0 && globalFair == nil {
+		return c
+	}
+	return &limitedConn{Conn: c, limiters: ls, user: userOf(c).name()}
+}
+
+type limitedConn struct {
+	net.Conn
+	limiters []*rate.Limiter
+	user     string // whose turns to take with globalFair
+}
+
+// waitN blocks until n bytes are allowed by globalFair and the limiters.
+func (c *limitedConn) waitN(n int) {
+	if globalFair != nil {
+		globalFair.waitN(c.user, n)
+	}
+	waitN(c.limiters, n)
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.waitN(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.waitN(len(b))
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, countReader{r, c.waitN})
+}
+
+func (c *limitedConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(countWriter{w, c.waitN}, c.Conn)
+}
+
+// allowN reports whether n bytes are allowed now by all limiters.
+func allowN(ls []*rate.Limiter, n int) bool {
+	for _, l := range ls {
+		if !l.AllowN(time.Now(), n) {
+			return false
+		}
+	}
+	return true
+}
+
+// limitPacketConn drops packets read from and written to pc, relaying a
+// session of u on listener, beyond the limits, since waiting would stall
+// other sessions sharing the read loop.
+func limitPacketConn(pc net.PacketConn, u *user, listener string) net.PacketConn {
+	ls := sessionLimiters(false, u, listener)
+	if len(ls) == 0 {
+		return pc
+	}
+	return &limitedPacketConn{PacketConn: pc, limiters: ls}
+}
+
+type limitedPacketConn struct {
+	net.PacketConn
+	limiters []*rate.Limiter
+}
+
+func (c *limitedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || allowN(c.limiters, n) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *limitedPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !allowN(c.limiters, len(b)) {
+		return len(b), nil // dropped
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// checkBurst fails unless l lets through burst bytes at once, and no more.
+func checkBurst(t *testing.T, name string, l *rate.Limiter, burst int) {
+	t.Helper()
+	if l == nil {
+		t.Fatalf("%s: no limiter", name)
+	}
+	now := time.Now()
+	if !l.AllowN(now, burst) || l.AllowN(now, burst/2) {
+		t.Errorf("%s: burst %d, want %d", name, l.Burst(), burst)
+	}
+}
+
+func TestUserBurst(t *testing.T) {
+	s := &userSet{users: []*user{
+		{Name: "burst-test-set", Rate: 1000, Burst: 5000},
+		{Name: "burst-test-default", Rate: 1000},
+	}}
+	s.setRates()
+	for _, tt := range []struct {
+		name  string
+		burst int
+	}{{"burst-test-set", 5000}, {"burst-test-default", 1000}} {
+		v, _ := userLimiters.Load(tt.name)
+		l, _ := v.(*rate.Limiter)
+		checkBurst(t, tt.name, l, tt.burst)
+		userLimiters.Delete(tt.name)
+	}
+}
+
+func TestListenerBurst(t *testing.T) {
+	defer func(r, b int) { config.ListenerRate, config.ListenerBurst = r, b }(config.ListenerRate, config.ListenerBurst)
+	config.ListenerRate, config.ListenerBurst = 1000, 5000
+	const addr = "192.0.2.1:8488"
+	listenerFor(addr)
+	defer serverListeners.Delete(addr)
+	defer listenerLimiters.Delete(addr)
+	checkBurst(t, addr, listenerLimiter(addr), 5000)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+)
+
+// Configuration read from files (-key-file, -users, -acl and -rules) is
+// loaded again on SIGHUP and, with -watch, whenever one of the files
+// changes, as when configuration management tools replace them. A file
+// failing to load, e.g. one half written, leaves the configuration in use
+// unchanged; the new one is swapped in at once otherwise.
+
+// reloadable is configuration read from paths by load.
+type reloadable struct {
+	what    string // for the logs
+	paths   []string
+	load    func() error
+	pending chan struct{}
+}
+
+var reloadables []*reloadable
+
+// addReloadable registers load to read again the configuration what from
+// paths, ignoring the empty ones.
+func addReloadable(what string, load func() error, paths ...string) {
+	r := &reloadable{what: what, load: load, pending: make(chan struct{}, 1)}
+	for _, p := range paths {
+		if p != "" {
+			r.paths = append(r.paths, p)
+		}
+	}
+	if len(r.paths) > 0 {
+		reloadables = append(reloadables, r)
+	}
+}
+
+// serveReloads reloads the configuration on SIGHUP and, if watch, when its
+// files change.
+func serveReloads(watch bool) {
+	if len(reloadables) == 0 {
+		return
+	}
+	for _, r := range reloadables {
+		go func() {
+			for range r.pending {
+				r.reload()
+			}
+		}()
+		if watch {
+			if err := watchFiles(r.paths, r.trigger); err != nil {
+				mainLog.Errorf("failed to watch %s: %v", r.what, err)
+			}
+		}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		for _, r := range reloadables {
+			r.trigger()
+		}
+	}
+}
+
+// trigger asks for r to be reloaded, unless it is to be already.
+func (r *reloadable) trigger() {
+	select {
+	case r.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (r *reloadable) reload() {
+	if err := r.load(); err != nil {
+		mainLog.Errorf("failed to reload %s: %v", r.what, err)
+		return
+	}
+	mainLog.Infof("%s reloaded", r.what)
+}
+
+// fileState tells whether a file changed: its identity, size and
+// modification time, if it exists.
+type fileState struct {
+	info os.FileInfo
+}
+
+func statFile(path string) fileState {
+	fi, _ := os.Stat(path) // following symbolic links, swapped by some tools
+	return fileState{fi}
+}
+
+func (s fileState) same(o fileState) bool {
+	if s.info == nil || o.info == nil {
+		return s.info == o.info
+	}
+	return os.SameFile(s.info, o.info) && s.info.Size() == o.info.Size() && s.info.ModTime().Equal(o.info.ModTime())
+}
+
+// watchSettle is how long a file has to stay unchanged after an event for
+// the change to be taken as complete, as writers may write in steps.
+const watchSettle = 200 * time.Millisecond
+
+// changeWatch calls changed when the state of one of paths differs from
+// the last one seen, checked after every event.
+type changeWatch struct {
+	paths   []string
+	changed func()
+	mu      sync.Mutex
+	last    []fileState
+	timer   *time.Timer
+}
+
+func newChangeWatch(paths []string, changed func()) *changeWatch {
+	w := &changeWatch{paths: paths, changed: changed, last: make([]fileState, len(paths))}
+	for i, p := range paths {
+		w.last[i] = statFile(p)
+	}
+	return w
+}
+
+// event checks the files once they have settled.
+func (w *changeWatch) event() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Reset(watchSettle)
+		return
+	}
+	w.timer = time.AfterFunc(watchSettle, w.check)
+}
+
+func (w *changeWatch) check() {
+	w.mu.Lock()
+	changed := false
+	for i, p := range w.paths {
+		if s := statFile(p); !s.same(w.last[i]) {
+			w.last[i] = s
+			changed = true
+		}
+	}
+	w.mu.Unlock()
+	if changed {
+		w.changed()
+	}
+}
+
+// keyFile is the -key-file to reload keys from, unless -key overrides it.
+var keyFile string
+
+// pickCipher is core.PickCipher, keeping the cipher's key that of keyFile
+// as it is reloaded.
+func pickCipher(cipher string, key []byte, password string) (core.Cipher, error) {
+	c, err := core.PickCipher(cipher, key, password)
+	if errors.Is(err, core.ErrLegacyCipher) {
+		return nil, fmt.Errorf("cipher %s: %w; use -allow-legacy to confirm", cipher, err)
+	}
+	if err != nil || keyFile == "" || core.IsPlain(c) {
+		return c, err
+	}
+	s := newSwapCipher(c)
+	addReloadable("key", func() error {
+		key, err := readKeyFile(keyFile)
+		if err != nil {
+			return err
+		}
+		c, err := core.PickCipher(cipher, key, password)
+		if err != nil {
+			return err
+		}
+		s.swap(c)
+		return nil
+	}, keyFile)
+	return s, nil
+}
+
+// readKeyFile reads the base64url-encoded key in the file at path.
+func readKeyFile(path string) ([]byte, error) {
+	e, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return base64.URLEncoding.DecodeString(string(e))
+}
+
+// swapCipher is a cipher whose key can be replaced while in use. Streams
+// use the key current when they start, and packets that when they are read
+// or written.
+type swapCipher struct {
+	cur atomic.Pointer[keyedCipher]
+}
+
+type keyedCipher struct {
+	core.Cipher
+}
+
+func newSwapCipher(c core.Cipher) *swapCipher {
+	s := &swapCipher{}
+	s.swap(c)
+	return s
+}
+
+func (s *swapCipher) swap(c core.Cipher) { s.cur.Store(&keyedCipher{c}) }
+
+func (s *swapCipher) StreamConn(c net.Conn) net.Conn { return s.cur.Load().StreamConn(c) }
+
+func (s *swapCipher) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &swapPacketConn{PacketConn: pc, s: s}
+}
+
+// swapPacketConn encrypts packets with the current key of a swapCipher,
+// wrapping the embedded PacketConn again when it changes.
+type swapPacketConn struct {
+	net.PacketConn
+	s   *swapCipher
+	rmu sync.Mutex
+	r   keyedConn
+	wmu sync.Mutex
+	w   keyedConn
+}
+
+type keyedConn struct {
+	ciph *keyedCipher
+	pc   net.PacketConn
+}
+
+// conn returns the embedded PacketConn wrapped with the current key.
+func (c *swapPacketConn) conn(k *keyedConn) net.PacketConn {
+	if cur := c.s.cur.Load(); k.ciph != cur {
+		*k = keyedConn{cur, cur.PacketConn(c.PacketConn)}
+	}
+	return k.pc
+}
+
+func (c *swapPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return c.conn(&c.r).ReadFrom(b)
+}
+
+func (c *swapPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.conn(&c.w).WriteTo(b, addr)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestReportDedup(t *testing.T) {
+	r := &errorReporter{reports: make(map[string]*errorReport)}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		err := &net.OpError{Op: "dial", Net: "tcp", Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 443}, Err: errors.New("refused")}
+		r.add("relay", "*net.OpError", err.Error(), "h", "")
+	}
+	r.add("relay", "*errors.errorString", "EOF", "h", "")
+	if len(r.reports) != 2 {
+		t.Fatalf("%d reports, want 2: one per error type", len(r.reports))
+	}
+	for _, e := range r.reports {
+		if e.Type == "*net.OpError" && e.Count != 2 {
+			t.Errorf("%d dial errors counted, want 2", e.Count)
+		}
+	}
+}
+
+func TestCheckReportURL(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"":                          true,
+		"https://errors.example/in": true,
+		"http://errors.example/in":  false,
+		"errors.example/in":         false,
+		"https:///in":               false,
+	} {
+		if err := checkReportURL(s); (err == nil) != ok {
+			t.Errorf("checkReportURL(%q) = %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// How the server resolves the host names of targets, set with -dns-strategy.
+// By default, TCP connections try the addresses in the order of the system
+// and UDP packets go to the first IPv4 address, as the standard library does.
+const (
+	dnsPreferIPv4 = "prefer-ipv4" // IPv4 addresses first, then IPv6
+	dnsPreferIPv6 = "prefer-ipv6" // IPv6 addresses first, then IPv4
+	dnsIPv4Only   = "ipv4-only"
+	dnsIPv6Only   = "ipv6-only"
+)
+
+func checkDNSStrategy(s string) error {
+	switch s {
+	case "", dnsPreferIPv4, dnsPreferIPv6, dnsIPv4Only, dnsIPv6Only:
+		return nil
+	}
+	return fmt.Errorf("unknown DNS strategy %q", s)
+}
+
+// hostResolver resolves host names: those of targets on the server, and of
+// servers and of the destinations of rules on the client. It is the system
+// resolver unless set with -dns.
+var hostResolver = net.DefaultResolver
+
+// setResolver resolves host names with the DNS server at server, instead of
+// those of resolv.conf, querying it through outbound sockets: over UDP and
+// TCP as 1.1.1.1 or [2606:4700:4700::1111]:53, over TLS as tls://1.1.1.1,
+// or over HTTPS as https://1.1.1.1/dns-query, out of reach of poisoned
+// answers.
+func setResolver(server string) error {
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+	switch {
+	case strings.HasPrefix(server, "tls://"):
+		dial = dotDial(strings.TrimPrefix(server, "tls://"))
+	case strings.HasPrefix(server, "https://"):
+		u, err := url.Parse(server)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid DNS over HTTPS URL %q", server)
+		}
+		dial = dohDial(server)
+	default:
+		if ip, err := netip.ParseAddr(server); err == nil {
+			server = netip.AddrPortFrom(ip, 53).String()
+		}
+		if _, err := netip.ParseAddrPort(server); err != nil {
+			return fmt.Errorf("invalid DNS server %q: an IP address and port, tls:// or https:// URL are expected", server)
+		}
+		dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Control: bindControl}
+			if outboundIP != nil {
+				if network == "tcp" {
+					d.LocalAddr = &net.TCPAddr{IP: outboundIP}
+				} else {
+					d.LocalAddr = &net.UDPAddr{IP: outboundIP}
+				}
+			}
+			return d.DialContext(ctx, network, server)
+		}
+	}
+	hostResolver = &net.Resolver{PreferGo: true, Dial: dial}
+	return nil
+}
+
+// resolveUDPAddr is net.ResolveUDPAddr("udp", addr) with hostResolver.
+func resolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	if hostResolver == net.DefaultResolver {
+		return net.ResolveUDPAddr("udp", addr)
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+	}
+	ips, err := hostResolver.LookupNetIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address of %s", host)
+	}
+	ip := ips[0]
+	for _, a := range ips {
+		if a.Unmap().Is4() {
+			ip = a
+			break
+		}
+	}
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port))), nil
+}
+
+// customResolution reports whether targets are resolved otherwise than by
+// the standard library.
+func customResolution() bool {
+	return config.DNSStrategy != "" || hostResolver != net.DefaultResolver || targetCache != nil
+}
+
+// lookupTarget returns the addresses of host, in the order of -dns-strategy.
+func lookupTarget(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+	network := "ip"
+	switch config.DNSStrategy {
+	case dnsIPv4Only:
+		network = "ip4"
+	case dnsIPv6Only:
+		network = "ip6"
+	}
+	var ips []netip.Addr
+	var err error
+	if targetCache != nil {
+		ips, err = targetCache.lookup(ctx, network, host)
+	} else {
+		ips, err = hostResolver.LookupNetIP(ctx, network, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range ips {
+		ips[i] = ips[i].Unmap()
+	}
+	switch config.DNSStrategy {
+	case dnsPreferIPv4:
+		sort.SliceStable(ips, func(i, j int) bool { return ips[i].Is4() && !ips[j].Is4() })
+	case dnsPreferIPv6:
+		sort.SliceStable(ips, func(i, j int) bool { return ips[i].Is6() && !ips[j].Is6() })
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no address of %s", host)
+	}
+	return ips, nil
+}
+
+// resolveTarget returns the address of tgt, the first of lookupTarget, or its
+// first IPv4 address without -dns-strategy.
+func resolveTarget(ctx context.Context, tgt socks.Addr) (netip.AddrPort, error) {
+	host, port, err := splitTarget(tgt)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ips, err := lookupTarget(ctx, host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip := ips[0]
+	if config.DNSStrategy == "" {
+		for _, a := range ips {
+			if a.Is4() {
+				ip = a
+				break
+			}
+		}
+	}
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// splitTarget returns the host and port of tgt.
+func splitTarget(tgt socks.Addr) (string, uint16, error) {
+	host, p, err := net.SplitHostPort(tgt.String())
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	return host, uint16(port), err
+}
+
+// resolveUDP returns the UDP address of tgt.
+func resolveUDP(tgt socks.Addr) (*net.UDPAddr, error) {
+	if !customResolution() {
+		return net.ResolveUDPAddr("udp", tgt.String())
+	}
+	ap, err := resolveTarget(context.Background(), tgt)
+	if err != nil {
+		return nil, err
+	}
+	return net.UDPAddrFromAddrPort(ap), nil
+}
+
+// dialTarget connects to tgt of u through an outbound socket. With -dns,
+// -dns-strategy or the cache of targets, the addresses of its host are tried in order as in
+// dialParallel, leaving out those u may not relay to.
+func dialTarget(ctx context.Context, u *user, tgt socks.Addr) (net.Conn, error) {
+	d := outboundDialer()
+	if !customResolution() {
+		addr, err := resolveTCP(u, tgt)
+		if err != nil {
+			return nil, err
+		}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+	host, port, err := splitTarget(tgt)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := lookupTarget(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if outboundFiltered(u) {
+		allowed := ips[:0]
+		for _, ip := range ips {
+			if err = checkOutbound(u, tgt, netip.AddrPortFrom(ip, port)); err == nil {
+				allowed = append(allowed, ip)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, err
+		}
+		ips = allowed
+	}
+	return dialParallel(ctx, d, ips, strconv.Itoa(int(port)))
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+	"github.com/Potterli20/go-shadowsocks2/shadowaead"
+)
+
+// To rotate the password of a server without cutting off the clients not yet
+// moved to the new one, the server accepts the old password as well for a
+// while: -old-password until -old-password-until for a single-user server,
+// or "old_password" until "old_until" for a user of -users. Streams and
+// packets decrypt with the first key authenticating them, and replies to a
+// client use the key it uses. Past the deadline, only the new password is
+// accepted. Clients switch by taking the new password, at once with an
+// online config.
+
+// keyRing is the cipher of a single-user server accepting an old key.
+type keyRing struct {
+	cur, old *core.AeadCipher
+	until    time.Time
+
+	peers     sync.Map // netip.AddrPort -> *ringPeer of the UDP clients using the old key
+	lastPrune atomic.Int64
+}
+
+type ringPeer struct {
+	seen atomic.Int64
+}
+
+// newKeyRing returns the cipher of cur accepting the key of old, of the same
+// cipher, until until.
+func newKeyRing(cur, old core.Cipher, until time.Time) (*keyRing, error) {
+	c, ok := cur.(*core.AeadCipher)
+	o, oldOK := old.(*core.AeadCipher)
+	if !ok || !oldOK {
+		return nil, errors.New("rotating passwords requires an AEAD cipher")
+	}
+	return &keyRing{cur: c, old: o, until: until}, nil
+}
+
+// oldValid reports whether the old key is still accepted.
+func (r *keyRing) oldValid() bool { return time.Now().Before(r.until) }
+
+// StreamConn decrypts c with the old key if it authenticates its first
+// length chunk, and with the current one otherwise.
+func (r *keyRing) StreamConn(c net.Conn) net.Conn {
+	if !r.oldValid() {
+		return r.cur.StreamConn(c)
+	}
+	hdr := make([]byte, r.cur.SaltSize()+2+aeadOverhead)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return &failedConn{Conn: c, err: err}
+	}
+	bc := &bufferedConn{Conn: c, r: bufio.NewReader(io.MultiReader(bytes.NewReader(hdr), c))}
+	if !authenticates(hdr, r.cur) && authenticates(hdr, r.old) {
+		tcpLog.Debugf("client %v uses the old password", c.RemoteAddr())
+		return r.old.StreamConn(bc)
+	}
+	return r.cur.StreamConn(bc)
+}
+
+func (r *keyRing) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &ringPacketConn{PacketConn: pc, r: r, rbuf: make([]byte, udpBufSize), wbuf: make([]byte, udpBufSize)}
+}
+
+// seeOld records that the client at addr uses the old key, or not.
+func (r *keyRing) seeOld(addr netip.AddrPort, old bool) {
+	addr = natKey(addr)
+	now := time.Now().UnixNano()
+	if !old {
+		r.peers.Delete(addr)
+		return
+	}
+	if p, ok := r.peers.Load(addr); ok {
+		p.(*ringPeer).seen.Store(now)
+	} else {
+		p := &ringPeer{}
+		p.seen.Store(now)
+		r.peers.Store(addr, p)
+	}
+	// forget peers idle for longer than their NAT entries live
+	timeout := config.UDPTimeout.Nanoseconds()
+	if last := r.lastPrune.Load(); now-last > timeout && r.lastPrune.CompareAndSwap(last, now) {
+		r.peers.Range(func(k, v any) bool {
+			if now-v.(*ringPeer).seen.Load() > timeout {
+				r.peers.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// usesOld reports whether the client at addr was last seen using the old key.
+func (r *keyRing) usesOld(addr net.Addr) bool {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok || !r.oldValid() {
+		return false
+	}
+	_, ok = r.peers.Load(natKey(ua.AddrPort()))
+	return ok
+}
+
+type ringPacketConn struct {
+	net.PacketConn
+	r    *keyRing
+	rmu  sync.Mutex
+	rbuf []byte
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+func (c *ringPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+	if err != nil {
+		return n, addr, err
+	}
+	pt, err := shadowaead.Unpack(b, c.rbuf[:n], c.r.cur)
+	old := false
+	if err != nil && c.r.oldValid() {
+		if pt, err = shadowaead.Unpack(b, c.rbuf[:n], c.r.old); err == nil {
+			old = true
+		}
+	}
+	if err != nil {
+		return 0, addr, err
+	}
+	if ua, ok := addr.(*net.UDPAddr); ok && (old || c.r.oldValid()) {
+		c.r.seeOld(ua.AddrPort(), old)
+	}
+	return len(pt), addr, nil
+}
+
+func (c *ringPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ciph := c.r.cur
+	if c.r.usesOld(addr) {
+		ciph = c.r.old
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	pkt, err := shadowaead.Pack(c.wbuf, b, ciph)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(pkt, addr)
+	return len(b), err
+}
+
+// Overhead returns the number of bytes added to a packet.
+func (c *ringPacketConn) Overhead() int { return c.r.cur.SaltSize() + aeadOverhead }
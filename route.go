@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Potterli20/go-shadowsocks2/acl"
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// Routing tables of the client, replaced when reloaded.
+var (
+	clientACL   atomic.Pointer[acl.ACL]
+	clientRules atomic.Pointer[acl.Rules]
+)
+
+var errBlocked = blockedError{errors.New("destination blocked by rules")}
+
+// loadRoutes loads the ACL and rules files given. The current tables are
+// kept if either fails to load.
+func loadRoutes(aclPath, rulesPath string) error {
+	var a *acl.ACL
+	var rs *acl.Rules
+	var err error
+	if aclPath != "" {
+		if a, err = acl.Load(aclPath); err != nil {
+			return err
+		}
+	}
+	if rulesPath != "" {
+		if rs, err = acl.LoadRules(rulesPath); err != nil {
+			return err
+		}
+		if rs.HasGeoIP() && geoDB == nil {
+			return errors.New("GEOIP rules require -geoip")
+		}
+	}
+	clientACL.Store(a)
+	clientRules.Store(rs)
+	return nil
+}
+
+// routeAddr decides how to reach address, a host:port: through the server,
+// directly at the returned address, or not at all. Host names are matched
+// against the rules first, then resolved locally to be matched against the
+// IP rules and the ACL; those failing to resolve are left for the server.
+// Literal IPs skip straight to the IP rules and the ACL, without allocating.
+// The rule deciding is returned as TYPE,VALUE, "ACL" for the ACL, or empty
+// if none did.
+func routeAddr(address string) (action acl.Action, addr, rule string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return acl.Proxy, address, ""
+	}
+	rs := clientRules.Load()
+	a := clientACL.Load()
+	if ip, err := netip.ParseAddr(host); err == nil {
+		action, rule, _ := routeIP(ip, rs, a)
+		return action, address, rule
+	}
+	if rs != nil {
+		if action, rule, ok := rs.MatchRule(host); ok {
+			return action, address, rule
+		}
+	}
+	if a == nil && (rs == nil || !rs.HasIPRules()) {
+		return acl.Proxy, address, ""
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return acl.Proxy, address, ""
+	}
+	ips, err := hostResolver.LookupNetIP(context.Background(), "ip", host)
+	if err != nil || len(ips) == 0 {
+		return acl.Proxy, address, ""
+	}
+	action, rule, ok := routeIP(ips[0], rs, a)
+	if !ok {
+		return acl.Proxy, address, ""
+	}
+	return action, netip.AddrPortFrom(ips[0].Unmap(), uint16(p)).String(), rule
+}
+
+// routeTarget is routeAddr for the target of a SOCKS UDP packet, for which
+// the direct address is not needed. Literal IPs are routed without
+// formatting tgt.
+func routeTarget(tgt socks.Addr) (action acl.Action, rule string) {
+	var ip netip.Addr
+	switch tgt[0] {
+	case socks.AtypIPv4:
+		ip = netip.AddrFrom4([4]byte(tgt[1 : 1+net.IPv4len]))
+	case socks.AtypIPv6:
+		ip = netip.AddrFrom16([16]byte(tgt[1 : 1+net.IPv6len]))
+	default:
+		action, _, rule = routeAddr(tgt.String())
+		return action, rule
+	}
+	action, rule, _ = routeIP(ip, clientRules.Load(), clientACL.Load())
+	return action, rule
+}
+
+// routeIP matches ip against the IP rules of rs, then a, either of which may
+// be nil, reporting whether either decided.
+func routeIP(ip netip.Addr, rs *acl.Rules, a *acl.ACL) (acl.Action, string, bool) {
+	if rs != nil && rs.HasIPRules() {
+		if action, rule, ok := rs.MatchIPRule(ip, func() string { return geoDB.Country(ip) }); ok {
+			return action, rule, true
+		}
+	}
+	if a != nil && a.Match(ip) == acl.Bypass {
+		return acl.Bypass, "ACL", true
+	}
+	return acl.Proxy, "", false
+}
+
+// routeDialer connects directly to destinations routed around the server,
+// refuses blocked ones, and dials the rest through the embedded Dialer.
+type routeDialer struct {
+	Dialer
+}
+
+func (d routeDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialOpts(network, address, dialOpts{})
+}
+
+// DialOpts tags the traffic with the rule routing it.
+func (d routeDialer) DialOpts(network, address string, o dialOpts) (net.Conn, error) {
+	action, addr, rule := routeAddr(address)
+	o.tags.Rule = rule
+	switch action {
+	case acl.Block:
+		routeLog.Debugf("blocked connection to %s", address)
+		if config.BlockMode != blockReject {
+			return blockedConn(address, o.early), nil
+		}
+		return nil, errBlocked
+	case acl.Bypass:
+		routeLog.Debugf("direct connection to %s", address)
+		d := outboundDialer()
+		d.Resolver = hostResolver
+		c, err := d.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tuneTCP(c)
+		c = clientUsage.conn(c, "", routeDirect, o.tags)
+		if len(o.early) > 0 {
+			if _, err := c.Write(o.early); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+	return dialWith(d.Dialer, network, address, o)
+}
+
+// listenDirect returns a packet connection sending client UDP packets
+// straight to their targets instead of through the server, bound to laddr
+// if not empty, with its usage tagged with tags.
+func listenDirect(laddr string, tags usageTags) (net.PacketConn, error) {
+	pc, err := listenOutbound(laddr)
+	if err != nil {
+		return nil, err
+	}
+	return directPacketConn{clientUsage.packetConn(pc, routeDirect, tags)}, nil
+}
+
+// directPacketConn exchanges packets formed as [target address][payload],
+// like those relayed by the server, directly with the targets.
+type directPacketConn struct {
+	net.PacketConn
+}
+
+func (c directPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	tgt := socks.SplitAddr(b)
+	if tgt == nil {
+		return 0, socks.ErrAddressNotSupported
+	}
+	addr, err := resolveUDPAddr(tgt.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.PacketConn.WriteTo(b[len(tgt):], addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c directPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	src := socks.ParseAddr(addr.String())
+	if len(src)+n > len(b) {
+		return 0, addr, io.ErrShortBuffer
+	}
+	copy(b[len(src):], b[:n])
+	copy(b, src)
+	return len(src) + n, addr, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/internal"
+)
+
+// The salt filter rejecting replayed streams and packets lives in memory, so
+// a restarted server would accept again everything recorded before it. With
+// -salt-state, the filter is saved on shutdown and every saltSaveInterval, in
+// case the server is killed, and restored on start.
+
+const saltSaveInterval = 5 * time.Minute
+
+// saltMu serializes the periodic saves with that on shutdown.
+var saltMu sync.Mutex
+
+// restoreSalts restores the salt filter saved to path, if any, and starts
+// saving it periodically. It is called once.
+func restoreSalts(path string) {
+	if err := internal.LoadSalts(path); err != nil {
+		mainLog.Warnf("failed to restore salt filter from %s, starting empty: %v", path, err)
+	} else {
+		mainLog.Debugf("restored salt filter from %s", path)
+	}
+	go func() {
+		for range time.Tick(saltSaveInterval) {
+			if err := saveSalts(path); err != nil {
+				mainLog.Errorf("failed to save salt filter: %v", err)
+			}
+		}
+	}()
+}
+
+// saveSalts saves the salt filter to path.
+func saveSalts(path string) error {
+	saltMu.Lock()
+	defer saltMu.Unlock()
+	return internal.SaveSalts(path)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Under systemd with Type=notify, the service tells systemd it is ready once
+// the listeners started by main are all bound, rather than being taken as
+// ready when started, and pings the watchdog of WatchdogSec=. A listener
+// failing to bind keeps the service from being ready, so that systemd fails
+// and restarts it after TimeoutStartSec=.
+
+// startingListeners counts the listeners main started which are neither
+// bound nor failed yet.
+var startingListeners sync.WaitGroup
+
+// listenerFailures is set if a listener main started failed to bind.
+var listenerFailures atomic.Bool
+
+// goListener runs serve, a listener reporting through listenerStarting, in a
+// goroutine.
+func goListener(serve func()) {
+	startingListeners.Add(1)
+	go serve()
+}
+
+// listenerStart reports whether a listener bound.
+type listenerStart struct{ once sync.Once }
+
+// listenerStarting returns the report of the listener calling it, to be
+// ended once it returns, failed unless bound by then.
+func listenerStarting() *listenerStart { return &listenerStart{} }
+
+func (s *listenerStart) bound() { s.once.Do(startingListeners.Done) }
+func (s *listenerStart) end()   { s.once.Do(listenerFailed) }
+
+// listenerFailed reports a listener of goListener failing before it starts
+// one of listenerStarting.
+func listenerFailed() {
+	listenerFailures.Store(true)
+	startingListeners.Done()
+}
+
+// notifyReady tells systemd the service is ready, and pings its watchdog if
+// enabled.
+func notifyReady() {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	if listenerFailures.Load() {
+		mainLog.Errorf("not ready: some listeners failed")
+		return
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		mainLog.Warnf("failed to notify systemd: %v", err)
+		return
+	}
+	mainLog.Debugf("notified systemd of readiness")
+	if interval := watchdogInterval(); interval > 0 {
+		for range time.Tick(interval / 2) {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// watchdogInterval returns the interval of the watchdog systemd set for this
+// process, 0 if none.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdNotify sends state to systemd, if the process runs under it.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	c, err := net.Dial("unixgram", path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// The resolver of -dns can be reached over TLS (RFC 7858) or HTTPS (RFC
+// 8484). Both carry the queries of the Go resolver as over TCP: a stream of
+// messages prefixed with their length.
+
+// dotDial returns the Dial of a resolver connecting over TLS to addr,
+// host[:port] with port 853 by default, checking its certificate for host.
+func dotDial(addr string) func(context.Context, string, string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "853")
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	conf := &tls.Config{ServerName: host, ClientSessionCache: tls.NewLRUClientSessionCache(4)}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		c, err := outboundDialer().DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(c, conf)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+// dohDial returns the Dial of a resolver sending queries to the URL u with
+// POST requests, over connections kept open between lookups.
+func dohDial(u string) func(context.Context, string, string) (net.Conn, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:         outboundDialer().DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}}
+	return func(context.Context, string, string) (net.Conn, error) {
+		return &dohConn{url: u, client: client}, nil
+	}
+}
+
+// dohConn exchanges the queries written to it for the answers read from it
+// with HTTPS requests, as a stream of messages prefixed with their length.
+type dohConn struct {
+	url      string
+	client   *http.Client
+	deadline time.Time
+	answers  bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return 0, errors.New("DNS over HTTPS: a single query is expected")
+	}
+	ctx := context.Background()
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("DNS over HTTPS: %s", resp.Status)
+	}
+	a, err := io.ReadAll(io.LimitReader(resp.Body, 0xffff))
+	if err != nil {
+		return 0, err
+	}
+	c.answers.Write(binary.BigEndian.AppendUint16(nil, uint16(len(a))))
+	c.answers.Write(a)
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) { return c.answers.Read(b) }
+func (c *dohConn) Close() error               { return nil }
+func (c *dohConn) LocalAddr() net.Addr        { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr       { return &net.TCPAddr{} }
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
@@ -0,0 +1,117 @@
+package shadowaead
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+// legacyChacha is the original ChaCha20-Poly1305 construction of
+// draft-agl-tls-chacha20poly1305, crypto_aead_chacha20poly1305 in
+// libsodium, as used by some old deployments: an 8-byte nonce, and a MAC over
+// the unpadded additional data and ciphertext each followed by its length.
+type legacyChacha struct {
+	key [chacha20poly1305.KeySize]byte
+}
+
+const legacyNonceSize = 8
+
+var errOpen = errors.New("chacha20poly1305: message authentication failed")
+
+func newLegacyChacha(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, KeySizeError(chacha20poly1305.KeySize)
+	}
+	a := new(legacyChacha)
+	copy(a.key[:], key)
+	return a, nil
+}
+
+func (a *legacyChacha) NonceSize() int { return legacyNonceSize }
+func (a *legacyChacha) Overhead() int  { return poly1305.TagSize }
+
+// stream returns the cipher of nonce and the MAC keyed with its first block.
+// With the 64-bit block counter of the original ChaCha20 staying below 2^32,
+// its keystream is that of the IETF variant with the nonce prefixed by zeros.
+func (a *legacyChacha) stream(nonce []byte) (*chacha20.Cipher, *poly1305.MAC) {
+	var n [chacha20.NonceSize]byte
+	copy(n[4:], nonce)
+	s, err := chacha20.NewUnauthenticatedCipher(a.key[:], n[:])
+	if err != nil {
+		panic(err) // sizes are fixed
+	}
+	var macKey [32]byte
+	s.XORKeyStream(macKey[:], macKey[:])
+	s.SetCounter(1)
+	return s, poly1305.New(&macKey)
+}
+
+func writeWithLength(m *poly1305.MAC, b []byte) {
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(b)))
+	m.Write(b)
+	m.Write(l[:])
+}
+
+func (a *legacyChacha) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != legacyNonceSize {
+		panic("chacha20poly1305: bad nonce length passed to Seal")
+	}
+	s, m := a.stream(nonce)
+	ret, out := sliceForAppend(dst, len(plaintext)+poly1305.TagSize)
+	ct := out[:len(plaintext)]
+	s.XORKeyStream(ct, plaintext)
+	writeWithLength(m, additionalData)
+	writeWithLength(m, ct)
+	m.Sum(out[len(plaintext):len(plaintext)])
+	return ret
+}
+
+func (a *legacyChacha) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != legacyNonceSize {
+		panic("chacha20poly1305: bad nonce length passed to Open")
+	}
+	if len(ciphertext) < poly1305.TagSize {
+		return nil, errOpen
+	}
+	tag := ciphertext[len(ciphertext)-poly1305.TagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-poly1305.TagSize]
+	s, m := a.stream(nonce)
+	writeWithLength(m, additionalData)
+	writeWithLength(m, ciphertext)
+	var sum [poly1305.TagSize]byte
+	if subtle.ConstantTimeCompare(m.Sum(sum[:0]), tag) != 1 {
+		return nil, errOpen
+	}
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	s.XORKeyStream(out, ciphertext)
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the
+// extension.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// Chacha20Poly1305Legacy creates a new Cipher with a pre-shared key using
+// the original ChaCha20-Poly1305 with an 8-byte nonce, for interoperating
+// with old deployments only. len(psk) must be 32.
+func Chacha20Poly1305Legacy(psk []byte) (Cipher, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, KeySizeError(chacha20poly1305.KeySize)
+	}
+	return &metaCipher{psk: psk, makeAEAD: newLegacyChacha}, nil
+}
@@ -0,0 +1,41 @@
+package shadowaead
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// TestLegacyChachaVector checks the output of crypto_aead_chacha20poly1305_encrypt
+// of libsodium.
+func TestLegacyChachaVector(t *testing.T) {
+	h := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	key := h("4290bcb154173531f314af57f3be3b5006da371ece272afa1b5dbdd1100a1007")
+	nonce := h("cd7cf67be39c794a")
+	ad := h("87e229d4500845a079c0")
+	msg := h("86d09974840bed1276f14dbf4a")
+	want := h("e3e446f7ede9925bb19f8764d50f1ac50045b3de5707b4f10efb074862")
+
+	a, err := newLegacyChacha(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := a.Seal(nil, nonce, msg, ad)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Seal = %x, want %x", got, want)
+	}
+	opened, err := a.Open(nil, nonce, got, ad)
+	if err != nil || !bytes.Equal(opened, msg) {
+		t.Fatalf("Open = %x, %v", opened, err)
+	}
+	got[0] ^= 1
+	if _, err := a.Open(nil, nonce, got, ad); err == nil {
+		t.Fatal("Open accepted a tampered ciphertext")
+	}
+}
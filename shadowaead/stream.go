@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/Potterli20/go-shadowsocks2/internal"
 )
@@ -17,16 +18,68 @@ const (
 	bufSize         = 17 * 1024 // >= 2+aead.Overhead()+payloadSizeMask+aead.Overhead()
 )
 
+// idleChunk is the payload size of the small buffer a Writer waits with.
+const idleChunk = 1024
+
 var (
 	ErrZeroChunk = errors.New("zero chunk")
 
 	bufPool = sync.Pool{New: func() any { return make([]byte, bufSize) }}
 )
 
+// IdleRelease, if positive, is how long ReadFrom and WriteTo of a stream may
+// wait for data before returning their buffer to the pool, to save memory
+// with many mostly idle streams. They take one again once data comes.
+var IdleRelease time.Duration
+
+// parkedBuf is a buffer of the pool set aside during a wait for data, and
+// returned to the pool if the wait lasts IdleRelease.
+type parkedBuf struct {
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+}
+
+// park sets b aside.
+func (pb *parkedBuf) park(b []byte) {
+	pb.mu.Lock()
+	pb.buf = b
+	pb.mu.Unlock()
+	if pb.timer == nil {
+		pb.timer = time.AfterFunc(IdleRelease, pb.release)
+	} else {
+		pb.timer.Reset(IdleRelease)
+	}
+}
+
+func (pb *parkedBuf) release() {
+	pb.mu.Lock()
+	if pb.buf != nil {
+		bufPool.Put(pb.buf)
+		pb.buf = nil
+	}
+	pb.mu.Unlock()
+}
+
+// unpark returns the buffer set aside, or another of the pool if released.
+func (pb *parkedBuf) unpark() []byte {
+	pb.timer.Stop()
+	pb.mu.Lock()
+	b := pb.buf
+	pb.buf = nil
+	pb.mu.Unlock()
+	if b == nil {
+		b = bufPool.Get().([]byte)
+	}
+	return b
+}
+
 type Writer struct {
 	io.Writer
 	cipher.AEAD
 	nonce [32]byte // should be sufficient for most nonce sizes
+	idle  []byte   // small buffer to wait for data with, with IdleRelease
+	spare parkedBuf
 }
 
 // NewWriter wraps an io.Writer with authenticated encryption.
@@ -71,19 +124,34 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 // any error encountered.
 func (w *Writer) ReadFrom(r io.Reader) (n int64, err error) {
 	buf := bufPool.Get().([]byte)
-	defer bufPool.Put(buf)
+	defer func() { bufPool.Put(buf) }()
 	nonce := w.nonce[:w.NonceSize()]
 	tag := w.Overhead()
 	off := 2 + tag
+	drained := false
 	for {
-		nr, er := r.Read(buf[off : off+payloadSizeMask])
+		p := buf
+		if drained { // likely to wait: do so with a small buffer
+			if w.idle == nil {
+				w.idle = make([]byte, off+idleChunk+tag)
+			}
+			p = w.idle
+			w.spare.park(buf)
+			buf = nil
+		}
+		room := min(payloadSizeMask, len(p)-off-tag)
+		nr, er := r.Read(p[off : off+room])
+		if drained {
+			buf = w.spare.unpark()
+		}
+		drained = IdleRelease > 0 && nr < room
 		n += int64(nr)
-		buf[0], buf[1] = byte(nr>>8), byte(nr)
-		w.Seal(buf[:0], nonce, buf[:2], nil)
+		p[0], p[1] = byte(nr>>8), byte(nr)
+		w.Seal(p[:0], nonce, p[:2], nil)
 		increment(nonce)
-		w.Seal(buf[:off], nonce, buf[off:off+nr], nil)
+		w.Seal(p[:off], nonce, p[off:off+nr], nil)
 		increment(nonce)
-		if _, ew := w.Writer.Write(buf[:off+nr+tag]); ew != nil {
+		if _, ew := w.Writer.Write(p[:off+nr+tag]); ew != nil {
 			err = ew
 			return
 		}
@@ -102,6 +170,8 @@ type Reader struct {
 	nonce [32]byte // should be sufficient for most nonce sizes
 	buf   []byte   // to be put back into bufPool
 	off   int      // offset to unconsumed part of buf
+	hdr   [32]byte // encrypted payload size, read while buf is spare
+	spare parkedBuf
 }
 
 // NewReader wraps an io.Reader with authenticated decryption.
@@ -109,11 +179,17 @@ func NewReader(r io.Reader, aead cipher.AEAD) *Reader { return &Reader{Reader: r
 
 // Read and decrypt a record into p. len(p) >= max payload size + AEAD overhead.
 func (r *Reader) read(p []byte) (int, error) {
-	nonce := r.nonce[:r.NonceSize()]
-	tag := r.Overhead()
+	size, err := r.readSize(p)
+	if err != nil {
+		return 0, err
+	}
+	return r.readPayload(p, size)
+}
 
-	// decrypt payload size
-	p = p[:2+tag]
+// readSize reads and decrypts the size of the next payload into p.
+func (r *Reader) readSize(p []byte) (int, error) {
+	nonce := r.nonce[:r.NonceSize()]
+	p = p[:2+r.Overhead()]
 	if _, err := io.ReadFull(r.Reader, p); err != nil {
 		return 0, err
 	}
@@ -122,18 +198,21 @@ func (r *Reader) read(p []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-
-	// decrypt payload
 	size := (int(p[0])<<8 + int(p[1])) & payloadSizeMask
 	if size == 0 {
 		return 0, ErrZeroChunk
 	}
+	return size, nil
+}
 
-	p = p[:size+tag]
+// readPayload reads and decrypts a payload of size bytes into p.
+func (r *Reader) readPayload(p []byte, size int) (int, error) {
+	nonce := r.nonce[:r.NonceSize()]
+	p = p[:size+r.Overhead()]
 	if _, err := io.ReadFull(r.Reader, p); err != nil {
 		return 0, err
 	}
-	_, err = r.Open(p[:0], nonce, p, nil)
+	_, err := r.Open(p[:0], nonce, p, nil)
 	increment(nonce)
 	if err != nil {
 		return 0, err
@@ -189,14 +268,25 @@ func (r *Reader) WriteTo(w io.Writer) (n int64, err error) {
 			}
 		}
 
-		nr, er := r.read(r.buf)
+		if IdleRelease > 0 {
+			r.spare.park(r.buf[:cap(r.buf)])
+			r.buf = nil
+		}
+		size, er := r.readSize(r.hdr[:])
+		if IdleRelease > 0 {
+			r.buf = r.spare.unpark()
+		}
+		if er == nil {
+			_, er = r.readPayload(r.buf, size)
+		}
 		if er != nil {
+			r.off = len(r.buf)
 			if er != io.EOF {
 				err = er
 			}
 			return
 		}
-		r.buf = r.buf[:nr]
+		r.buf = r.buf[:size]
 		r.off = 0
 	}
 }
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The shadowtls transport performs a genuine TLS handshake with a cover
+// server, relayed by the shadowsocks server, then carries the shadowsocks
+// stream in TLS application data records. The first record in each direction
+// starts with an HMAC of the ServerHello keyed by -shadowtls-password, which
+// is how the server tells its clients apart from probes. Connections never
+// presenting it keep talking to the cover server.
+
+const (
+	recordHeaderLen  = 5
+	recordMaxPayload = 16384
+	recordAppData    = 0x17
+	shadowTLSTagLen  = 8
+)
+
+// shadowTLSTags derives the client and server tags for a session.
+func shadowTLSTags(serverHello []byte) (client, server []byte) {
+	tag := func(label string) []byte {
+		h := hmac.New(sha256.New, []byte(config.ShadowTLSPassword))
+		h.Write([]byte(label))
+		h.Write(serverHello)
+		return h.Sum(nil)[:shadowTLSTagLen]
+	}
+	return tag("client"), tag("server")
+}
+
+// readRecord reads one TLS record into buf and returns the whole record.
+func readRecord(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:recordHeaderLen]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(buf[3:recordHeaderLen]))
+	if recordHeaderLen+n > len(buf) {
+		return nil, errors.New("TLS record too large")
+	}
+	_, err := io.ReadFull(r, buf[recordHeaderLen:recordHeaderLen+n])
+	return buf[:recordHeaderLen+n], err
+}
+
+func newRecordBuf() []byte { return make([]byte, recordHeaderLen+recordMaxPayload+2048) }
+
+// recordConn reads at most up to the end of the current TLS record, so that
+// the TLS client never consumes bytes beyond the handshake. It captures the
+// first record, which carries the ServerHello.
+type recordConn struct {
+	net.Conn
+	left  int
+	hdr   []byte
+	first []byte
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	if c.left == 0 {
+		hdr := make([]byte, recordHeaderLen)
+		if _, err := io.ReadFull(c.Conn, hdr); err != nil {
+			return 0, err
+		}
+		c.left = int(binary.BigEndian.Uint16(hdr[3:]))
+		if c.first == nil {
+			c.hdr = hdr
+		}
+		n := copy(b, hdr)
+		if n < len(hdr) {
+			return 0, io.ErrShortBuffer
+		}
+		return n, nil
+	}
+	n, err := c.Conn.Read(b[:min(len(b), c.left)])
+	c.left -= n
+	if c.hdr != nil {
+		c.first = append(c.first, b[:n]...)
+		if c.left == 0 {
+			c.first = append(c.hdr, c.first...)
+			c.hdr = nil
+		}
+	}
+	return n, err
+}
+
+// dialShadowTLS handshakes with the cover server through the server at addr.
+func dialShadowTLS(d *net.Dialer, addr string) (net.Conn, error) {
+	c, err := dialTCP(d, addr)
+	if err != nil {
+		return nil, err
+	}
+	rc := &recordConn{Conn: c}
+	tc := tls.Client(rc, clientTLSConfig(addr))
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	if rc.hdr != nil || rc.left != 0 {
+		c.Close()
+		return nil, errors.New("shadowtls: handshake ended inside a record")
+	}
+	clientTag, serverTag := shadowTLSTags(rc.first)
+	return &shadowTLSConn{Conn: c, wtag: clientTag, rtag: serverTag, wmu: new(sync.Mutex)}, nil
+}
+
+// shadowTLSConn carries a stream in TLS application data records. The first
+// record written is prefixed with wtag; records read before one prefixed
+// with rtag are discarded.
+type shadowTLSConn struct {
+	net.Conn
+	wtag []byte
+	rtag []byte
+	rbuf []byte
+	rec  []byte
+	wmu  *sync.Mutex
+}
+
+func (c *shadowTLSConn) Read(b []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		if c.rec == nil {
+			c.rec = newRecordBuf()
+		}
+		r, err := readRecord(c.Conn, c.rec)
+		if err != nil {
+			return 0, err
+		}
+		if r[0] != recordAppData {
+			continue
+		}
+		payload := r[recordHeaderLen:]
+		if c.rtag != nil {
+			if !bytes.HasPrefix(payload, c.rtag) {
+				continue // stray record from the cover server
+			}
+			payload = payload[len(c.rtag):]
+			c.rtag = nil
+		}
+		c.rbuf = payload
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *shadowTLSConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, 0, recordHeaderLen+recordMaxPayload)
+	for n := 0; n < len(b); {
+		buf = append(buf[:0], recordAppData, 3, 3, 0, 0)
+		if c.wtag != nil {
+			buf = append(buf, c.wtag...)
+		}
+		m := min(len(b)-n, recordMaxPayload-(len(buf)-recordHeaderLen))
+		buf = append(buf, b[n:n+m]...)
+		binary.BigEndian.PutUint16(buf[3:], uint16(len(buf)-recordHeaderLen))
+		if _, err := c.Conn.Write(buf); err != nil {
+			return n, err
+		}
+		c.wtag = nil
+		n += m
+	}
+	return len(b), nil
+}
+
+// shadowTLSListener returns connections that authenticated after relaying
+// their handshake to the cover server.
+type shadowTLSListener struct {
+	*connListener
+	l net.Listener
+}
+
+func newShadowTLSListener(l net.Listener) *shadowTLSListener {
+	sl := &shadowTLSListener{connListener: newConnListener(l.Addr()), l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					continue
+				}
+				sl.connListener.Close()
+				return
+			}
+			go sl.handshake(c)
+		}
+	}()
+	return sl
+}
+
+func (l *shadowTLSListener) Close() error {
+	l.connListener.Close()
+	return l.l.Close()
+}
+
+// handshake relays c to the cover server until c sends an authenticated
+// record, then hands it over to Accept.
+func (l *shadowTLSListener) handshake(c net.Conn) {
+	hc, err := dialOutbound(config.ShadowTLSHandshake, 10*time.Second)
+	if err != nil {
+		tcpLog.Warnf("shadowtls: failed to connect to handshake server: %v", err)
+		c.Close()
+		return
+	}
+
+	var (
+		wmu         sync.Mutex // serializes writes to c
+		switched    bool
+		serverHello = make(chan []byte, 1)
+	)
+	go func() { // cover server -> client
+		buf := newRecordBuf()
+		first := true
+		for {
+			r, err := readRecord(hc, buf)
+			if err != nil {
+				break
+			}
+			if first {
+				serverHello <- append([]byte(nil), r...)
+				first = false
+			}
+			wmu.Lock()
+			if switched {
+				wmu.Unlock()
+				return
+			}
+			_, err = c.Write(r)
+			wmu.Unlock()
+			if err != nil {
+				break
+			}
+		}
+		if first {
+			close(serverHello)
+		}
+		wmu.Lock()
+		if !switched {
+			c.Close()
+		}
+		wmu.Unlock()
+	}()
+
+	var clientTag, serverTag []byte
+	buf := newRecordBuf()
+	for { // client -> cover server
+		r, err := readRecord(c, buf)
+		if err != nil {
+			hc.Close()
+			c.Close()
+			return
+		}
+		if r[0] == recordAppData && clientTag == nil {
+			select {
+			case hello, ok := <-serverHello:
+				if ok {
+					clientTag, serverTag = shadowTLSTags(hello)
+				}
+			default:
+			}
+		}
+		if clientTag != nil && r[0] == recordAppData && bytes.HasPrefix(r[recordHeaderLen:], clientTag) {
+			wmu.Lock()
+			switched = true
+			wmu.Unlock()
+			hc.Close()
+			payload := append([]byte(nil), r[recordHeaderLen+len(clientTag):]...)
+			l.put(&shadowTLSConn{Conn: c, wtag: serverTag, rbuf: payload, wmu: &wmu})
+			return
+		}
+		if _, err := hc.Write(r); err != nil {
+			hc.Close()
+			c.Close()
+			return
+		}
+	}
+}
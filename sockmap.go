@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// With -sockmap, relays between two TCP connections carrying the same bytes,
+// those spliced otherwise, have the kernel redirect the bytes received on
+// either to the other with an eBPF sockmap once the request is handled: the
+// payload then received never reaches userspace, nor a pipe. The relay only
+// waits for the connections to end, and reports the bytes relayed to the
+// wrappers bypassed then. It is experimental and needs Linux 5.10 or later with the privilege
+// to load eBPF programs (CAP_BPF or CAP_NET_ADMIN); relays splice without it.
+
+var errNoSockmap = errors.New("sockmap is Linux only, on amd64 and arm64")
+
+var sockmapFallback sync.Once
+
+// sockmapFailed logs once that the sockmap is unavailable.
+func sockmapFailed(err error) {
+	sockmapFallback.Do(func() { mainLog.Warnf("sockmap unavailable, splicing relays instead: %v", err) })
+}
+
+// relayCopier returns how relay copies between left and right: relayCopy,
+// or with -sockmap, waiting for the kernel to relay them.
+func relayCopier(left, right net.Conn) func(dst, src net.Conn) (int64, error) {
+	if !config.Sockmap {
+		return relayCopy
+	}
+	conns := [2]net.Conn{left, right}
+	var tcs [2]*net.TCPConn
+	var read, written [2]func(int64)
+	for i, c := range conns {
+		tcs[i], read[i] = spliceEnd(c, true)
+		_, written[i] = spliceEnd(c, false)
+		if tcs[i] == nil {
+			return relayCopy
+		}
+	}
+	m, err := sharedSockmap()
+	if err != nil {
+		sockmapFailed(err)
+		return relayCopy
+	}
+	moved := func(i int, n int64) {
+		read[i](n)
+		written[1-i](n)
+	}
+	p, err := m.pair(tcs[0], tcs[1], moved)
+	if err != nil { // e.g. a connection closed already
+		tcpLog.Debugf("relaying without sockmap: %v", err)
+		return relayCopy
+	}
+	return func(dst, src net.Conn) (int64, error) {
+		i := 0
+		if src != left {
+			i = 1
+		}
+		// Only bytes left over when pairing reach the relay, read through
+		// the wrappers: no splicing, which would bypass them.
+		n, err := io.Copy(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+		k := p.relayed(i, n, err == nil)
+		moved(i, k)
+		return n + k, err
+	}
+}
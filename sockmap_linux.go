@@ -0,0 +1,438 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// bpf system call, commands and constants, missing from package syscall.
+var sysBPF = map[string]uintptr{"amd64": 321, "arm64": 280}[runtime.GOARCH]
+
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfProgLoad      = 5
+	bpfProgAttach    = 8
+
+	bpfMapTypeSockhash    = 18
+	bpfProgTypeSKSKB      = 14
+	bpfSKSKBStreamParser  = 4
+	bpfSKSKBStreamVerdict = 5
+	bpfNoExist            = 1
+	bpfPseudoMapFD        = 1
+
+	bpfFuncGetSocketCookie = 46
+	bpfFuncSKRedirectHash  = 72
+
+	soCookie = 57 // SO_COOKIE
+
+	tcpInfoState         = 0
+	tcpInfoBytesAcked    = 120
+	tcpInfoBytesReceived = 128
+	tcpEstablished       = 1
+	tcpCloseWait         = 8
+
+	siocInQ  = 0x541b // SIOCINQ
+	siocOutQ = 0x5411 // SIOCOUTQ
+)
+
+// sockmapEntries is the size of the sockhashes, two entries a relay.
+const sockmapEntries = 1 << 16
+
+// bpfInsn is an eBPF instruction.
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low bits, src in the high ones
+	off  int16
+	imm  int32
+}
+
+func insn(code, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code, src<<4 | dst, off, imm}
+}
+
+// sockmap is the pair of sockhashes relaying the connections paired. Both
+// map the socket cookie of a connection: peers to the connection its bytes
+// are redirected to, and members to itself, running the programs redirecting
+// them. A connection is added to peers first, so that its bytes can be
+// redirected as soon as the programs run on it.
+type sockmap struct {
+	peers, members int
+}
+
+// sharedMaps are the sockhashes of the relays, set up on first use.
+var sharedMaps struct {
+	once sync.Once
+	m    *sockmap
+	err  error
+}
+
+func sharedSockmap() (*sockmap, error) {
+	sharedMaps.once.Do(func() { sharedMaps.m, sharedMaps.err = newSockmap() })
+	return sharedMaps.m, sharedMaps.err
+}
+
+func newSockmap() (*sockmap, error) {
+	if sysBPF == 0 {
+		return nil, errNoSockmap
+	}
+	peers, err := bpfSockhash()
+	if err != nil {
+		return nil, err
+	}
+	members, err := bpfSockhash()
+	if err != nil {
+		syscall.Close(peers)
+		return nil, err
+	}
+	m := &sockmap{peers, members}
+	if err := m.attach(); err != nil {
+		syscall.Close(peers)
+		syscall.Close(members)
+		return nil, err
+	}
+	return m, nil
+}
+
+// attach loads the programs and attaches them to the members: the parser
+// passing the bytes received as they come, and the verdict redirecting them
+// to the peer, or leaving them for the relay to read if there is none.
+func (m *sockmap) attach() error {
+	parser := []bpfInsn{
+		insn(0x61, 0, 1, 0, 0), // r0 = skb->len
+		insn(0x95, 0, 0, 0, 0), // exit
+	}
+	verdict := []bpfInsn{
+		insn(0xbf, 6, 1, 0, 0),                           // r6 = skb
+		insn(0x85, 0, 0, 0, bpfFuncGetSocketCookie),      // r0 = bpf_get_socket_cookie(skb)
+		insn(0x7b, 10, 0, -8, 0),                         // *(u64 *)(r10 - 8) = r0
+		insn(0xbf, 1, 6, 0, 0),                           // r1 = skb
+		insn(0x18, 2, bpfPseudoMapFD, 0, int32(m.peers)), // r2 = peers
+		insn(0, 0, 0, 0, 0),
+		insn(0xbf, 3, 10, 0, 0),                    // r3 = r10
+		insn(0x07, 3, 0, 0, -8),                    // r3 += -8
+		insn(0xb7, 4, 0, 0, 0),                     // r4 = 0 (egress)
+		insn(0x85, 0, 0, 0, bpfFuncSKRedirectHash), // r0 = bpf_sk_redirect_hash(skb, peers, &cookie, 0)
+		insn(0x55, 0, 0, 1, 0),                     // if r0 != SK_DROP goto exit
+		insn(0xb7, 0, 0, 0, 1),                     // r0 = SK_PASS
+		insn(0x95, 0, 0, 0, 0),                     // exit
+	}
+	for _, p := range []struct {
+		insns  []bpfInsn
+		attach uint32
+	}{{parser, bpfSKSKBStreamParser}, {verdict, bpfSKSKBStreamVerdict}} {
+		fd, err := bpfLoad(p.insns)
+		if err != nil {
+			return err
+		}
+		attr := struct{ target, prog, typ, flags uint32 }{uint32(m.members), uint32(fd), p.attach, 0}
+		_, err = bpf(bpfProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		syscall.Close(fd) // held by the map once attached
+		if err != nil {
+			return os.NewSyscallError("bpf", err)
+		}
+	}
+	return nil
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	r, _, e := syscall.Syscall(sysBPF, cmd, uintptr(attr), size)
+	if e != 0 {
+		return 0, e
+	}
+	return r, nil
+}
+
+func bpfSockhash() (int, error) {
+	attr := struct{ typ, keySize, valueSize, maxEntries, flags uint32 }{bpfMapTypeSockhash, 8, 4, sockmapEntries, 0}
+	fd, err := bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, os.NewSyscallError("bpf", err)
+	}
+	return int(fd), nil
+}
+
+func bpfLoad(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	attr := struct {
+		typ, insnCnt uint32
+		insns        uint64
+		license      uint64
+	}{bpfProgTypeSKSKB, uint32(len(insns)), uint64(uintptr(unsafe.Pointer(&insns[0]))), uint64(uintptr(unsafe.Pointer(&license[0])))}
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return -1, os.NewSyscallError("bpf", err)
+	}
+	return int(fd), nil
+}
+
+// add maps key to the socket of c in the sockhash fd. Only established
+// connections can be added.
+func (m *sockmap) add(fd int, key uint64, c *net.TCPConn) error {
+	return sockControl(c, func(s uintptr) error {
+		v := uint32(s)
+		attr := struct {
+			fd         uint32
+			_          uint32
+			key, value uint64
+			flags      uint64
+		}{fd: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&v))), flags: bpfNoExist}
+		_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(&key)
+		runtime.KeepAlive(&v)
+		if err != nil {
+			return os.NewSyscallError("bpf", err)
+		}
+		return nil
+	})
+}
+
+// remove deletes key from the sockhash fd.
+func (m *sockmap) remove(fd int, key uint64) {
+	attr := struct {
+		fd  uint32
+		_   uint32
+		key uint64
+	}{fd: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key)))}
+	bpf(bpfMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+}
+
+// sockPair is two TCP connections the kernel relays to each other. The
+// sockets leave the sockhashes when closed.
+type sockPair struct {
+	conns   [2]*net.TCPConn
+	in      [2]uint64 // bytes received from each and read before pairing
+	out     [2]uint64 // bytes written to each before pairing
+	drained [2]int64  // bytes relayed from each while pairing
+}
+
+// pair has the kernel relay a and b to each other, reporting to moved the
+// bytes relayed from either meanwhile. Neither may be read from while they
+// are paired.
+func (m *sockmap) pair(a, b *net.TCPConn, moved func(i int, n int64)) (*sockPair, error) {
+	p := &sockPair{conns: [2]*net.TCPConn{a, b}}
+	var cookies [2]uint64
+	for i, c := range p.conns {
+		var err error
+		if cookies[i], err = sockCookie(c); err != nil {
+			return nil, err
+		}
+		if p.in[i], err = readBytes(c); err != nil {
+			return nil, err
+		}
+		if p.out[i], err = writtenBytes(c); err != nil {
+			return nil, err
+		}
+	}
+	// The programs take the bytes of a packet partly read for unread: those
+	// received are read here until none is left, so that they run on whole
+	// packets only.
+	for i, c := range p.conns {
+		n, err := drainTo(p.conns[1-i], c)
+		if n > 0 {
+			p.drained[i] = n
+			moved(i, n)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, c := range p.conns {
+		if err := m.add(m.peers, cookies[1-i], c); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.add(m.members, cookies[0], a); err != nil {
+		return nil, err
+	}
+	if err := m.add(m.members, cookies[1], b); err != nil {
+		m.remove(m.members, cookies[0]) // stops redirecting a
+		return nil, err
+	}
+	// The programs run as bytes arrive: setting the low watermark has them
+	// run on those received since drained too.
+	for _, c := range p.conns {
+		sockControl(c, func(fd uintptr) error {
+			return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVLOWAT, 1)
+		})
+	}
+	return p, nil
+}
+
+// relayed returns how many bytes the kernel relayed from connection i to
+// the other, given n bytes the relay read from it and wrote itself. If i has
+// been read until EOF, it waits for them to be written first, unless the
+// other fails or is closed meanwhile.
+func (p *sockPair) relayed(i int, n int64, eof bool) int64 {
+	src, dst := p.conns[i], p.conns[1-i]
+	received, err := tcpInfo64(src, tcpInfoBytesReceived)
+	if err != nil {
+		return 0
+	}
+	if eof {
+		received-- // the FIN
+	}
+	total := received - p.in[i]
+	if eof {
+		for d := time.Millisecond; ; d = min(2*d, 50*time.Millisecond) {
+			w, err := writtenBytes(dst)
+			if err != nil || w-p.out[1-i] >= total {
+				break
+			}
+			if st, err := tcpState(dst); err != nil || st != tcpEstablished && st != tcpCloseWait {
+				break
+			}
+			time.Sleep(d)
+		}
+	}
+	return max(int64(total)-n-p.drained[i], 0)
+}
+
+// drainTries is how many times drainTo reads before giving up on a
+// connection receiving bytes faster.
+const drainTries = 16
+
+// drainTo writes to dst what src has received until none is left unread.
+// Sockets in a sockhash do not tell how much is.
+func drainTo(dst, src *net.TCPConn) (int64, error) {
+	var total int64
+	var buf []byte
+	for try := 0; try < drainTries; try++ {
+		q, err := sockIoctl(src, siocInQ)
+		if err != nil || q == 0 {
+			return total, err
+		}
+		if buf == nil {
+			buf = make([]byte, 64<<10)
+		}
+		for q > 0 {
+			var n int
+			err := sockControl(src, func(fd uintptr) error {
+				var err error
+				n, err = syscall.Read(int(fd), buf[:min(q, uint64(len(buf)))])
+				return err
+			})
+			if err != nil || n <= 0 {
+				break // EAGAIN, or EOF, which fails pairing
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return total, err
+			}
+			total += int64(n)
+			q -= uint64(n)
+		}
+	}
+	return total, errors.New("connection too busy to pair")
+}
+
+// readBytes returns how many bytes were received from c and read.
+func readBytes(c *net.TCPConn) (uint64, error) {
+	for {
+		r, err := tcpInfo64(c, tcpInfoBytesReceived)
+		if err != nil {
+			return 0, err
+		}
+		q, err := sockIoctl(c, siocInQ)
+		if err != nil {
+			return 0, err
+		}
+		if r2, err := tcpInfo64(c, tcpInfoBytesReceived); err != nil || r2 == r {
+			return r - q, err
+		}
+	}
+}
+
+// writtenBytes returns how many bytes were written to c, sent or not.
+func writtenBytes(c *net.TCPConn) (uint64, error) {
+	for {
+		a, err := tcpInfo64(c, tcpInfoBytesAcked)
+		if err != nil {
+			return 0, err
+		}
+		q, err := sockIoctl(c, siocOutQ)
+		if err != nil {
+			return 0, err
+		}
+		if a2, err := tcpInfo64(c, tcpInfoBytesAcked); err != nil || a2 == a {
+			return a + q, err
+		}
+	}
+}
+
+func sockControl(c *net.TCPConn, f func(fd uintptr) error) error {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(fd) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
+func getsockopt(c *net.TCPConn, level, opt int, b []byte) (int, error) {
+	n := uint32(len(b))
+	err := sockControl(c, func(fd uintptr) error {
+		_, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt), uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&n)), 0)
+		if e != 0 {
+			return os.NewSyscallError("getsockopt", e)
+		}
+		return nil
+	})
+	return int(n), err
+}
+
+func sockCookie(c *net.TCPConn) (uint64, error) {
+	var b [8]byte
+	if _, err := getsockopt(c, syscall.SOL_SOCKET, soCookie, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.NativeEndian.Uint64(b[:]), nil
+}
+
+// tcpInfo64 returns the counter at off in the TCP_INFO of c.
+func tcpInfo64(c *net.TCPConn, off int) (uint64, error) {
+	var b [232]byte
+	n, err := getsockopt(c, syscall.IPPROTO_TCP, syscall.TCP_INFO, b[:])
+	if err != nil {
+		return 0, err
+	}
+	if n < off+8 {
+		return 0, errors.New("TCP_INFO lacks byte counters (Linux 4.1 or later required)")
+	}
+	return binary.NativeEndian.Uint64(b[off:]), nil
+}
+
+func tcpState(c *net.TCPConn) (uint8, error) {
+	var b [232]byte
+	_, err := getsockopt(c, syscall.IPPROTO_TCP, syscall.TCP_INFO, b[:])
+	return b[tcpInfoState], err
+}
+
+func sockIoctl(c *net.TCPConn, req uintptr) (uint64, error) {
+	var v int32
+	err := sockControl(c, func(fd uintptr) error {
+		_, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&v)))
+		if e != 0 {
+			return os.NewSyscallError("ioctl", e)
+		}
+		return nil
+	})
+	return uint64(v), err
+}
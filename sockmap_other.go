@@ -0,0 +1,18 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import "net"
+
+type sockmap struct{}
+
+type sockPair struct{}
+
+func sharedSockmap() (*sockmap, error) { return nil, errNoSockmap }
+
+func (m *sockmap) pair(a, b *net.TCPConn, moved func(i int, n int64)) (*sockPair, error) {
+	return nil, errNoSockmap
+}
+
+func (p *sockPair) relayed(i int, n int64, eof bool) int64 { return 0 }
@@ -10,6 +10,10 @@ import (
 // UDPEnabled is the toggle for UDP support
 var UDPEnabled = false
 
+// BindIP, if set, is reported as BND.ADDR in replies instead of the address
+// the client connected to.
+var BindIP net.IP
+
 // SOCKS request commands as defined in RFC 1928 section 4.
 const (
 	CmdConnect      = 1
@@ -169,6 +173,9 @@ func ParseAddr(s string) Addr {
 }
 
 // Handshake fast-tracks SOCKS initialization to get target address to connect.
+//
+// Deprecated: use socks5.Server, which supports authentication and lets the
+// caller reply once it knows whether the destination is reachable.
 func Handshake(rw io.ReadWriter) (Addr, error) {
 	// Read RFC 1928 for request and reply structure and sizes.
 	buf := make([]byte, MaxAddrLen)
@@ -195,13 +202,12 @@ func Handshake(rw io.ReadWriter) (Addr, error) {
 	}
 	switch cmd {
 	case CmdConnect:
-		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
+		_, err = rw.Write(append([]byte{5, 0, 0}, bindAddr(rw, false)...)) // SOCKS v5, reply succeeded
 	case CmdUDPAssociate:
 		if !UDPEnabled {
 			return nil, ErrCommandNotSupported
 		}
-		listenAddr := ParseAddr(rw.(net.Conn).LocalAddr().String())
-		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr...)) // SOCKS v5, reply succeeded
+		_, err = rw.Write(append([]byte{5, 0, 0}, bindAddr(rw, true)...)) // SOCKS v5, reply succeeded
 		if err != nil {
 			return nil, ErrCommandNotSupported
 		}
@@ -212,3 +218,22 @@ func Handshake(rw io.ReadWriter) (Addr, error) {
 
 	return addr, err // skip VER, CMD, RSV fields
 }
+
+// bindAddr returns BND.ADDR to reply on rw, in the address family the client
+// connected over. The port of the connection is included if withPort is set.
+func bindAddr(rw io.ReadWriter, withPort bool) Addr {
+	ip, port := net.IPv4zero, 0
+	if c, ok := rw.(net.Conn); ok {
+		if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
+			if withPort {
+				ip, port = a.IP, a.Port
+			} else if a.IP.To4() == nil {
+				ip = net.IPv6zero
+			}
+		}
+	}
+	if BindIP != nil {
+		ip = BindIP
+	}
+	return ParseAddr(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
@@ -0,0 +1,7 @@
+package socks5
+
+import "github.com/Potterli20/go-shadowsocks2/socks"
+
+// errnoCode returns the reply code of the system error in err, if any: none
+// on Plan 9, whose errors are strings.
+func errnoCode(err error) (socks.Error, bool) { return 0, false }
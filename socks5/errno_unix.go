@@ -0,0 +1,24 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package socks5
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// errnoCode returns the reply code of the system error in err, if any.
+func errnoCode(err error) (socks.Error, bool) {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.ErrConnectionRefused, true
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.ErrNetworkUnreachable, true
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks.ErrHostUnreachable, true
+	}
+	return 0, false
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package socks5
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+func TestReplyCodeErrno(t *testing.T) {
+	err := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	if got := ReplyCode(err); got != socks.ErrConnectionRefused {
+		t.Errorf("ReplyCode(%v) = %d, want %d", err, got, socks.ErrConnectionRefused)
+	}
+}
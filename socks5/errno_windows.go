@@ -0,0 +1,28 @@
+package socks5
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// Winsock errors, which syscall does not name.
+const (
+	wsaENETUNREACH  = syscall.Errno(10051)
+	wsaECONNREFUSED = syscall.Errno(10061)
+	wsaEHOSTUNREACH = syscall.Errno(10065)
+)
+
+// errnoCode returns the reply code of the system error in err, if any.
+func errnoCode(err error) (socks.Error, bool) {
+	switch {
+	case errors.Is(err, wsaECONNREFUSED):
+		return socks.ErrConnectionRefused, true
+	case errors.Is(err, wsaENETUNREACH):
+		return socks.ErrNetworkUnreachable, true
+	case errors.Is(err, wsaEHOSTUNREACH):
+		return socks.ErrHostUnreachable, true
+	}
+	return 0, false
+}
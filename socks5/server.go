@@ -0,0 +1,214 @@
+// Package socks5 implements the server side of SOCKS 5 (RFC 1928), with
+// optional username/password authentication (RFC 1929), for programs
+// accepting SOCKS clients. Unlike socks.Handshake, requests are answered by
+// the caller, once it knows how connecting to the destination went, and
+// clients get a reply code for every failure instead of a closed connection:
+// see ReplyCode.
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+const version = 5
+
+// Authentication methods, RFC 1928 section 3.
+const (
+	methodNoAuth       = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xFF
+)
+
+// Version of the username/password subnegotiation, RFC 1929.
+const passwordVersion = 1
+
+var (
+	ErrVersion    = errors.New("socks5: unsupported protocol version")
+	ErrNoMethod   = errors.New("socks5: no acceptable authentication method")
+	ErrAuthFailed = errors.New("socks5: authentication failed")
+	ErrReplied    = errors.New("socks5: request already replied to")
+)
+
+// Server negotiates with SOCKS 5 clients. The zero value accepts CONNECT
+// requests without authentication.
+type Server struct {
+	// Authenticate, if set, requires clients to log in with a username and
+	// password it accepts.
+	Authenticate func(user, password string) bool
+
+	// UDP enables UDP ASSOCIATE requests.
+	UDP bool
+
+	// BindIP, if set, is reported as BND.ADDR in replies instead of the
+	// address the client connected to.
+	BindIP net.IP
+}
+
+// Request is a request read from a client, to be answered with Succeed or
+// Fail.
+type Request struct {
+	Cmd  byte       // socks.CmdConnect or socks.CmdUDPAssociate
+	Addr socks.Addr // the destination
+	User string     // the username the client logged in with, if any
+
+	conn    net.Conn
+	bindIP  net.IP
+	replied bool
+}
+
+// ReadRequest negotiates the authentication method with the client on c and
+// reads its request. Requests for unsupported commands or address types are
+// answered with the matching failure, and returned as the error.
+func (s *Server) ReadRequest(c net.Conn) (*Request, error) {
+	buf := make([]byte, socks.MaxAddrLen)
+	// read VER, NMETHODS, METHODS
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != version {
+		return nil, ErrVersion
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return nil, err
+	}
+	want := byte(methodNoAuth)
+	if s.Authenticate != nil {
+		want = methodPassword
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		c.Write([]byte{version, methodNoAcceptable})
+		return nil, ErrNoMethod
+	}
+	if _, err := c.Write([]byte{version, want}); err != nil {
+		return nil, err
+	}
+	r := &Request{conn: c, bindIP: s.BindIP}
+	if want == methodPassword {
+		user, err := s.login(c, buf)
+		if err != nil {
+			return nil, err
+		}
+		r.User = user
+	}
+
+	// read VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(c, buf[:3]); err != nil {
+		return nil, err
+	}
+	if buf[0] != version {
+		return nil, ErrVersion
+	}
+	r.Cmd = buf[1]
+	addr, err := socks.ReadAddr(c)
+	if err == socks.ErrAddressNotSupported {
+		r.Fail(socks.ErrAddressNotSupported)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.Addr = addr
+	if r.Cmd != socks.CmdConnect && (r.Cmd != socks.CmdUDPAssociate || !s.UDP) {
+		r.Fail(socks.ErrCommandNotSupported)
+		return nil, socks.ErrCommandNotSupported
+	}
+	return r, nil
+}
+
+// login runs the username/password subnegotiation on c, using buf, and
+// returns the username.
+func (s *Server) login(c net.Conn, buf []byte) (string, error) {
+	// read VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != passwordVersion {
+		return "", ErrVersion
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(c, buf[:1]); err != nil {
+		return "", err
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(c, password); err != nil {
+		return "", err
+	}
+	if !s.Authenticate(string(user), string(password)) {
+		c.Write([]byte{passwordVersion, 1})
+		return "", ErrAuthFailed
+	}
+	_, err := c.Write([]byte{passwordVersion, 0})
+	return string(user), err
+}
+
+// Succeed tells the client its request is granted. The reply to UDP
+// ASSOCIATE gives the address of the connection, for the client to send its
+// packets to the same port over UDP.
+func (r *Request) Succeed() error {
+	return r.reply(0, r.bindAddr(r.Cmd == socks.CmdUDPAssociate))
+}
+
+// Fail tells the client its request failed with code.
+func (r *Request) Fail(code socks.Error) error {
+	return r.reply(byte(code), r.bindAddr(false))
+}
+
+func (r *Request) reply(rep byte, bnd socks.Addr) error {
+	if r.replied {
+		return ErrReplied
+	}
+	r.replied = true
+	_, err := r.conn.Write(append([]byte{version, rep, 0}, bnd...))
+	return err
+}
+
+// ReplyCode returns the reply code telling a client why connecting to its
+// destination failed with err: refused, unreachable network or host, timed
+// out (as TTL expired), or a general failure. A socks.Error is its own code.
+func ReplyCode(err error) socks.Error {
+	var code socks.Error
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &code):
+		return code
+	}
+	if code, ok := errnoCode(err); ok {
+		return code
+	}
+	switch {
+	case errors.As(err, &dnsErr) && !dnsErr.IsTimeout:
+		return socks.ErrHostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return socks.ErrTTLExpired
+	}
+	return socks.ErrGeneralFailure
+}
+
+// bindAddr returns BND.ADDR, in the address family the client connected
+// over. The port of the connection is included if withPort is set.
+func (r *Request) bindAddr(withPort bool) socks.Addr {
+	ip, port := net.IPv4zero, 0
+	if a, ok := r.conn.LocalAddr().(*net.TCPAddr); ok {
+		if withPort {
+			ip, port = a.IP, a.Port
+		} else if a.IP.To4() == nil {
+			ip = net.IPv6zero
+		}
+	}
+	if r.bindIP != nil {
+		ip = r.bindIP
+	}
+	return socks.ParseAddr(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
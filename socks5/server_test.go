@@ -0,0 +1,116 @@
+package socks5
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// exchange sends req to s over a pipe and returns what s replied and its
+// result.
+func exchange(s *Server, req []byte, answer func(*Request)) ([]byte, *Request, error) {
+	c, sc := net.Pipe()
+	type result struct {
+		r   *Request
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer sc.Close()
+		r, err := s.ReadRequest(sc)
+		if err == nil && answer != nil {
+			answer(r)
+		}
+		done <- result{r, err}
+	}()
+	go func() {
+		c.Write(req)
+	}()
+	reply, _ := io.ReadAll(c)
+	res := <-done
+	return reply, res.r, res.err
+}
+
+var connectReq = []byte{5, 1, 0, 1, 192, 0, 2, 1, 0, 80} // CONNECT 192.0.2.1:80
+
+func TestConnect(t *testing.T) {
+	req := append([]byte{5, 1, 0}, connectReq...)
+	reply, r, err := exchange(&Server{}, req, func(r *Request) { r.Succeed() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Cmd != socks.CmdConnect || r.Addr.String() != "192.0.2.1:80" {
+		t.Errorf("request %d %v", r.Cmd, r.Addr)
+	}
+	want := []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(reply, want) {
+		t.Errorf("reply %v, want %v", reply, want)
+	}
+	if err := r.Fail(socks.ErrGeneralFailure); err != ErrReplied {
+		t.Errorf("second reply: %v", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		s     *Server
+		req   []byte
+		reply []byte
+		err   error
+	}{
+		{"bind", &Server{}, []byte{5, 1, 0, 5, 2, 0, 1, 192, 0, 2, 1, 0, 80},
+			[]byte{5, 0, 5, byte(socks.ErrCommandNotSupported), 0, 1, 0, 0, 0, 0, 0, 0}, socks.ErrCommandNotSupported},
+		{"udp disabled", &Server{}, []byte{5, 1, 0, 5, 3, 0, 1, 0, 0, 0, 0, 0, 0},
+			[]byte{5, 0, 5, byte(socks.ErrCommandNotSupported), 0, 1, 0, 0, 0, 0, 0, 0}, socks.ErrCommandNotSupported},
+		{"address type", &Server{}, []byte{5, 1, 0, 5, 1, 0, 9},
+			[]byte{5, 0, 5, byte(socks.ErrAddressNotSupported), 0, 1, 0, 0, 0, 0, 0, 0}, socks.ErrAddressNotSupported},
+		{"no password offered", &Server{Authenticate: func(string, string) bool { return true }}, []byte{5, 1, 0},
+			[]byte{5, 0xFF}, ErrNoMethod},
+		{"wrong password", &Server{Authenticate: func(u, p string) bool { return u == "u" && p == "p" }},
+			[]byte{5, 1, 2, 1, 1, 'u', 1, 'x'}, []byte{5, 2, 1, 1}, ErrAuthFailed},
+		{"socks4", &Server{}, []byte{4, 1, 0, 80}, nil, ErrVersion},
+	} {
+		reply, _, err := exchange(tt.s, tt.req, nil)
+		if err != tt.err || !bytes.Equal(reply, tt.reply) {
+			t.Errorf("%s: replied %v with %v, want %v with %v", tt.name, reply, err, tt.reply, tt.err)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	s := &Server{Authenticate: func(u, p string) bool { return u == "user" && p == "secret" }}
+	req := append([]byte{5, 2, 0, 2, 1, 4, 'u', 's', 'e', 'r', 6, 's', 'e', 'c', 'r', 'e', 't'}, connectReq...)
+	reply, r, err := exchange(s, req, func(r *Request) { r.Fail(socks.ErrConnectionRefused) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.User != "user" {
+		t.Errorf("user %q", r.User)
+	}
+	want := []byte{5, 2, 1, 0, 5, byte(socks.ErrConnectionRefused), 0, 1, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(reply, want) {
+		t.Errorf("reply %v, want %v", reply, want)
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want socks.Error
+	}{
+		{&net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, socks.ErrTTLExpired},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, socks.ErrHostUnreachable},
+		{fmt.Errorf("route: %w", socks.ErrConnectionNotAllowed), socks.ErrConnectionNotAllowed},
+		{io.ErrUnexpectedEOF, socks.ErrGeneralFailure},
+	} {
+		if got := ReplyCode(tt.err); got != tt.want {
+			t.Errorf("ReplyCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,8 +1,14 @@
 package speeddial
 
 import (
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -27,6 +33,11 @@ type target struct {
 	last     int64 // last dial since epoch
 	latency  int64 // exponetially smoothed
 	inflight int32 // number of inflight dial
+	active   int32 // number of open connections
+	weight   int32
+	priority int32 // lower first, with Failover
+	down     int32 // whether dials failed since the last success, with Failover
+	probing  int32 // whether a goroutine probes it until it is up again
 }
 
 func (t *target) Dial() (net.Conn, error) {
@@ -46,26 +57,328 @@ func (t *target) Dial() (net.Conn, error) {
 		latency = (weight*old + latency) / (weight + 1) // exponentially weighted moving average
 	}
 	atomic.CompareAndSwapInt64(&t.latency, old, latency)
-	return c, err
+	if err != nil {
+		return c, err
+	}
+	atomic.AddInt32(&t.active, 1)
+	return &trackedConn{Conn: c, t: t}, nil
+}
+
+// trackedConn counts as active on its target until closed.
+type trackedConn struct {
+	net.Conn
+	t    *target
+	once sync.Once
 }
 
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.t.active, -1) })
+	return c.Conn.Close()
+}
+
+// Unwrap returns the dialed connection.
+func (c *trackedConn) Unwrap() net.Conn { return c.Conn }
+
+// ReadFrom and WriteTo let io.Copy reach those of the dialed connection.
+func (c *trackedConn) ReadFrom(r io.Reader) (int64, error) { return io.Copy(c.Conn, r) }
+func (c *trackedConn) WriteTo(w io.Writer) (int64, error)  { return io.Copy(w, c.Conn) }
+
+// Strategy is how a Dialer picks the target to dial.
+type Strategy int
+
+const (
+	Fastest        Strategy = iota // lowest latency, probing the others
+	WeightedRandom                 // at random in proportion to the weights
+	LeastConn                      // fewest open connections relative to the weights
+	Failover                       // first up by priority, then index, trying the next on failure
+	RoundRobin                     // in turn, each as many times in a row as its weight
+	ConsistentHash                 // by the key dialed, most keys keeping their target when targets change
+)
+
 type Dialer struct {
 	targets  []target
-	Cooldown time.Duration // default 10 seconds
+	turn     atomic.Uint64 // of RoundRobin
+	Cooldown time.Duration // default 10 seconds; with Failover, how often targets down are probed
+	Strategy Strategy
+
+	// Changed, if not nil, is called when the i-th target goes down or up
+	// again with Failover.
+	Changed func(i int, up bool)
 }
 
 func New(ds ...Dial) *Dialer {
 	tgts := make([]target, len(ds))
 	for i := range ds {
 		tgts[i].dial = ds[i]
+		tgts[i].weight = 1
 	}
 	return &Dialer{targets: tgts, Cooldown: 10 * time.Second}
 }
 
+// SetWeight sets the weight of the i-th target, 1 by default.
+func (d *Dialer) SetWeight(i, w int) {
+	atomic.StoreInt32(&d.targets[i].weight, int32(max(w, 1)))
+}
+
+// SetPriority sets the priority of the i-th target, 0 by default. Failover
+// dials targets of lower priorities first.
+func (d *Dialer) SetPriority(i, p int) {
+	atomic.StoreInt32(&d.targets[i].priority, int32(p))
+}
+
+// Up reports whether the i-th target is up, as far as Failover knows.
+func (d *Dialer) Up(i int) bool {
+	return atomic.LoadInt32(&d.targets[i].down) == 0
+}
+
+// Active returns the number of open connections to the i-th target.
+func (d *Dialer) Active(i int) int {
+	return int(atomic.LoadInt32(&d.targets[i].active))
+}
+
 func (d *Dialer) Dial() (net.Conn, error) {
-	min := int64(1<<63 - 1)
+	return d.DialKey("")
+}
+
+// DialKey dials a target picked by the strategy; with ConsistentHash, one
+// picked by key, such as the destination to reach through the target.
+func (d *Dialer) DialKey(key string) (net.Conn, error) {
+	switch d.Strategy {
+	case WeightedRandom:
+		return d.targets[d.random()].Dial()
+	case LeastConn:
+		return d.targets[d.leastConn()].Dial()
+	case Failover:
+		return d.failover()
+	case RoundRobin:
+		return d.targets[d.roundRobin()].Dial()
+	case ConsistentHash:
+		return d.targets[d.hash(key)].Dial()
+	}
+	return d.fastest()
+}
+
+// failover dials the targets up in order of priority until one succeeds,
+// marking those failing down, or those down if none is up. Targets down are
+// probed every Cooldown until up again.
+func (d *Dialer) failover() (net.Conn, error) {
+	order := make([]int, len(d.targets))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return atomic.LoadInt32(&d.targets[order[a]].priority) < atomic.LoadInt32(&d.targets[order[b]].priority)
+	})
+	var err error
+	for _, down := range []int32{0, 1} {
+		for _, i := range order {
+			tgt := &d.targets[i]
+			if atomic.LoadInt32(&tgt.down) != down {
+				continue
+			}
+			var c net.Conn
+			if c, err = tgt.Dial(); err == nil {
+				d.setDown(i, false)
+				return c, nil
+			}
+			logf("Failed #%d: %v", i, err)
+			d.setDown(i, true)
+		}
+	}
+	return nil, err
+}
+
+func (d *Dialer) setDown(i int, down bool) {
+	if d.mark(i, down) && down && atomic.CompareAndSwapInt32(&d.targets[i].probing, 0, 1) {
+		go d.probe(i)
+	}
+}
+
+// mark marks the i-th target down or up, reporting whether it changed.
+func (d *Dialer) mark(i int, down bool) bool {
+	var v int32
+	if down {
+		v = 1
+	}
+	if atomic.SwapInt32(&d.targets[i].down, v) == v {
+		return false
+	}
+	if d.Changed != nil {
+		d.Changed(i, !down)
+	}
+	return true
+}
+
+// Report records a health check of the i-th target made elsewhere: its
+// latency if ok, or a failure, marking it down until a check succeeds. The
+// strategies avoid targets down while others are up.
+func (d *Dialer) Report(i int, latency time.Duration, ok bool) {
+	tgt := &d.targets[i]
+	l := latency.Nanoseconds()
+	if !ok {
+		l = int64(penalty)
+	}
+	old := atomic.LoadInt64(&tgt.latency)
+	if old > 0 {
+		l = (weight*old + l) / (weight + 1)
+	}
+	atomic.CompareAndSwapInt64(&tgt.latency, old, l)
+	d.mark(i, !ok)
+}
+
+// pickUp reports whether any target is up, for the strategies to pick among
+// those.
+func (d *Dialer) pickUp() bool {
+	for i := range d.targets {
+		if atomic.LoadInt32(&d.targets[i].down) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// first returns the first target not to skip.
+func (d *Dialer) first(upOnly bool) int {
+	i := 0
+	for i < len(d.targets)-1 && d.skip(i, upOnly) {
+		i++
+	}
+	return i
+}
+
+// skip reports whether to leave out the i-th target, down, if upOnly.
+func (d *Dialer) skip(i int, upOnly bool) bool {
+	return upOnly && atomic.LoadInt32(&d.targets[i].down) != 0
+}
+
+// probe dials the i-th target every Cooldown until it is up.
+func (d *Dialer) probe(i int) {
+	tgt := &d.targets[i]
+	for {
+		for atomic.LoadInt32(&tgt.down) == 1 {
+			time.Sleep(d.Cooldown)
+			c, err := tgt.Dial()
+			if err != nil {
+				logf("Probe #%d: %v", i, err)
+				continue
+			}
+			c.Close()
+			d.setDown(i, false)
+		}
+		atomic.StoreInt32(&tgt.probing, 0)
+		// down again meanwhile, without starting another probe
+		if atomic.LoadInt32(&tgt.down) == 0 || !atomic.CompareAndSwapInt32(&tgt.probing, 0, 1) {
+			return
+		}
+	}
+}
+
+func (d *Dialer) random() int {
+	up := d.pickUp()
+	var total int64
+	for i := range d.targets {
+		if !d.skip(i, up) {
+			total += int64(atomic.LoadInt32(&d.targets[i].weight))
+		}
+	}
+	if total == 0 { // all went down meanwhile
+		return 0
+	}
+	n := rand.Int63n(total)
+	for i := range d.targets {
+		if d.skip(i, up) {
+			continue
+		}
+		if n -= int64(atomic.LoadInt32(&d.targets[i].weight)); n < 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+func (d *Dialer) roundRobin() int {
+	up := d.pickUp()
+	var total uint64
+	for i := range d.targets {
+		if !d.skip(i, up) {
+			total += uint64(atomic.LoadInt32(&d.targets[i].weight))
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	n := (d.turn.Add(1) - 1) % total
+	for i := range d.targets {
+		if d.skip(i, up) {
+			continue
+		}
+		if w := uint64(atomic.LoadInt32(&d.targets[i].weight)); n >= w {
+			n -= w
+		} else {
+			return i
+		}
+	}
+	return 0
+}
+
+// hash picks the target of key by weighted rendezvous hashing: each target
+// scores key, in proportion to its weight, and the highest wins. Changing a
+// target only moves the keys it wins or would win.
+func (d *Dialer) hash(key string) int {
+	up := d.pickUp()
 	var best int
+	bestScore := math.Inf(-1)
 	for i := range d.targets {
+		if d.skip(i, up) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte{byte(i), byte(i >> 8)})
+		h.Write([]byte(key))
+		x := mix(h.Sum64())
+		u := (float64(x>>11) + 0.5) / (1 << 53) // uniform in (0, 1)
+		if s := float64(atomic.LoadInt32(&d.targets[i].weight)) / -math.Log(u); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+// mix scrambles the bits of x, FNV spreading short keys poorly.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (d *Dialer) leastConn() int {
+	up := d.pickUp()
+	best := d.first(up)
+	for i := best + 1; i < len(d.targets); i++ {
+		if d.skip(i, up) {
+			continue
+		}
+		a, b := &d.targets[i], &d.targets[best]
+		// compare active/weight without dividing
+		if int64(atomic.LoadInt32(&a.active))*int64(atomic.LoadInt32(&b.weight)) <
+			int64(atomic.LoadInt32(&b.active))*int64(atomic.LoadInt32(&a.weight)) {
+			best = i
+		}
+	}
+	return best
+}
+
+func (d *Dialer) fastest() (net.Conn, error) {
+	up := d.pickUp()
+	min := int64(1<<63 - 1)
+	best := d.first(up)
+	for i := range d.targets {
+		if d.skip(i, up) {
+			continue
+		}
 		if l := atomic.LoadInt64(&d.targets[i].latency); 0 < l && l < min {
 			best, min = i, l
 		}
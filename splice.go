@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// Relays between two TCP connections carrying the same bytes, as for
+// destinations routed around the server or with the none cipher, splice
+// them: on Linux, TCPConn.ReadFrom moves the data from socket to socket
+// within the kernel. Wrappers which only count bytes are bypassed, told of
+// the bytes spliced a chunk at a time. Other relays keep the copy
+// optimizations of the cipher, which the wrappers pass on.
+
+// spliceChunk is how many bytes are spliced between reports to the wrappers
+// bypassed: their counts lag behind by less than that.
+const spliceChunk = 256 << 10
+
+// splicer is a connection wrapper only observing the bytes passing through
+// it, which relays may bypass to splice the connection it wraps.
+type splicer interface {
+	spliceTo() net.Conn         // the wrapped connection
+	spliced(n int64, read bool) // n bytes were read from, or written to, it bypassing it
+}
+
+// relayCopy copies from src to dst until EOF or an error, splicing if both
+// are TCP connections under their splicers.
+func relayCopy(dst, src net.Conn) (int64, error) {
+	d, written := spliceEnd(dst, false)
+	s, read := spliceEnd(src, true)
+	if d == nil || s == nil {
+		return io.Copy(dst, src)
+	}
+	var total int64
+	for {
+		n, err := d.ReadFrom(&io.LimitedReader{R: s, N: spliceChunk})
+		total += n
+		written(n)
+		read(n)
+		if err != nil || n == 0 {
+			return total, err
+		}
+	}
+}
+
+// spliceEnd returns the TCP connection under c and a function reporting the
+// bytes spliced to the splicers in between, or nil if c is not one. Wrappers
+// with an Unwrap method are taken to pass bytes on unchanged.
+func spliceEnd(c net.Conn, read bool) (*net.TCPConn, func(int64)) {
+	var through []splicer
+	for {
+		switch t := c.(type) {
+		case *net.TCPConn:
+			return t, func(n int64) {
+				for _, s := range through {
+					s.spliced(n, read)
+				}
+			}
+		case splicer:
+			through = append(through, t)
+			c = t.spliceTo()
+		case interface{ Unwrap() net.Conn }:
+			c = t.Unwrap()
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// countReader and countWriter report the bytes passing through them. The
+// connection wrappers counting, limiting or timing bytes implement ReadFrom
+// and WriteTo as an io.Copy between the wrapped connection and the other end
+// wrapped in one of these, so that io.Copy in a relay still reaches the
+// ReadFrom and WriteTo of the wrapped connection, splice and sendfile
+// included, instead of copying through the wrapper's Read and Write.
+type countReader struct {
+	io.Reader
+	count func(int)
+}
+
+func (r countReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.count(n)
+	return n, err
+}
+
+type countWriter struct {
+	io.Writer
+	count func(int)
+}
+
+func (w countWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.count(n)
+	return n, err
+}
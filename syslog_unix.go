@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"log/syslog"
+)
+
+// openSyslog returns a sink sending records to the syslog daemon at addr
+// over UDP, or to the local one if addr is empty.
+func openSyslog(addr string) (logSink, error) {
+	network := ""
+	if addr != "" {
+		network = "udp"
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, "go-shadowsocks2")
+	if err != nil {
+		return nil, fmt.Errorf("syslog: %v", err)
+	}
+	return func(level slog.Level, msg string) error {
+		switch syslogPriority(level) {
+		case 3:
+			return w.Err(msg)
+		case 4:
+			return w.Warning(msg)
+		case 6:
+			return w.Info(msg)
+		}
+		return w.Debug(msg)
+	}, nil
+}
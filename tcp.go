@@ -2,61 +2,93 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"io"
-	"io/ioutil"
 	"net"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/Potterli20/go-shadowsocks2/socks"
+	"github.com/Potterli20/go-shadowsocks2/socks5"
 )
 
-func tcpKeepAlive(c net.Conn) {
-	if tcp, ok := c.(*net.TCPConn); ok {
-		tcp.SetKeepAlive(true)
-		tcp.SetKeepAlivePeriod(3 * time.Minute)
-	}
-}
-
 // Create a SOCKS server listening on addr and proxy to server.
-func socksLocal(addr string, d Dialer) {
-	logf("SOCKS proxy %s", addr)
-	tcpLocal(addr, d, func(c net.Conn) (socks.Addr, error) { return socks.Handshake(c) })
+func socksLocal(addr string, d Dialer, srv *socks5.Server) {
+	socksLog.Infof("SOCKS proxy %s", addr)
+	replyLocal(addr, d, func(c net.Conn) (socks.Addr, func(error) error, error) {
+		req, err := srv.ReadRequest(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if req.Cmd == socks.CmdUDPAssociate {
+			if err := req.Succeed(); err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, socks.InfoUDPAssociate
+		}
+		return req.Addr, func(err error) error {
+			if err == nil {
+				return req.Succeed()
+			}
+			if isBlocked(err) {
+				return req.Fail(socks.ErrConnectionNotAllowed)
+			}
+			return req.Fail(socks5.ReplyCode(err))
+		}, nil
+	})
 }
 
 // Create a TCP tunnel from addr to target via server.
 func tcpTun(addr, target string, d Dialer) {
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
-		logf("invalid target address %q", target)
+		tcpLog.Errorf("invalid target address %q", target)
+		listenerFailed()
 		return
 	}
-	logf("TCP tunnel %s <-> %s", addr, target)
+	tcpLog.Infof("TCP tunnel %s <-> %s", addr, target)
 	tcpLocal(addr, d, func(net.Conn) (socks.Addr, error) { return tgt, nil })
 }
 
 // Listen on addr and proxy to server to reach target from getAddr.
 func tcpLocal(addr string, d Dialer, getAddr func(net.Conn) (socks.Addr, error)) {
-	l, err := net.Listen("tcp", addr)
+	replyLocal(addr, d, func(c net.Conn) (socks.Addr, func(error) error, error) {
+		tgt, err := getAddr(c)
+		return tgt, nil, err
+	})
+}
+
+// replyLocal is tcpLocal for protocols replying to the client, such as
+// SOCKS, with the function getAddr returns, once connecting to the target
+// succeeded or failed. With -early-data, clients are told of success at once,
+// since they send nothing before.
+func replyLocal(addr string, d Dialer, getAddr func(net.Conn) (socks.Addr, func(error) error, error)) {
+	start := listenerStarting()
+	defer start.end()
+	l, err := listenStream(&net.ListenConfig{}, addr)
 	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
+		tcpLog.Errorf("failed to listen on %s: %v", addr, err)
 		return
 	}
+	start.bound()
 
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %s", err)
+			tcpLog.Warnf("failed to accept: %v", err)
 			continue
 		}
 
 		go func() {
+			defer reportPanic()
 			defer c.Close()
-			tcpKeepAlive(c)
+			tuneTCP(c)
+			l := tcpLog.With("client", c.RemoteAddr().String())
 
-			tgt, err := getAddr(c)
+			handshaken := awaitHandshake(c)
+			tgt, reply, err := getAddr(c)
+			handshaken()
 			if err != nil {
 
 				// UDP: keep the connection until disconnect then free the UDP socket
@@ -68,103 +100,263 @@ func tcpLocal(addr string, d Dialer, getAddr func(net.Conn) (socks.Addr, error))
 						if err, ok := err.(net.Error); ok && err.Timeout() {
 							continue
 						}
-						logf("UDP Associate End.")
+						socksLog.With("client", c.RemoteAddr().String()).Debugf("UDP associate ended")
 						return
 					}
 				}
 
-				logf("failed to get target address: %v", err)
+				l.Debugf("failed to get target address: %v", err)
 				return
 			}
 
-			rc, err := d.Dial("tcp", tgt.String())
-			if err != nil {
-				logf("failed to connect: %v", err)
-				return
+			l = l.With("target", tgt.String())
+			lc := limitConn(tcpSocket(c), addr)
+			var early []byte
+			if config.EarlyData > 0 {
+				if reply != nil {
+					if err := reply(nil); err != nil {
+						l.Debugf("failed to reply: %v", err)
+						return
+					}
+					reply = nil
+				}
+				early = readEarly(lc, config.EarlyData, coalesceBufSize-len(tgt))
 			}
-			defer rc.Close()
-			if config.TCPCork {
-				rc = timedCork(rc, 10*time.Millisecond, 1280)
+			rc, err := dialWith(d, "tcp", tgt.String(), dialOpts{early: early, tags: usageTags{Listener: addr}})
+			if reply != nil {
+				if err := reply(err); err != nil {
+					l.Debugf("failed to reply: %v", err)
+				}
 			}
-			rc = shadow(rc)
-
-			if _, err = rc.Write(tgt); err != nil {
-				logf("failed to send target address: %v", err)
+			if err != nil {
+				l.Debugf("failed to connect: %v", err)
 				return
 			}
+			if config.TCPCoalesce > 0 {
+				rc = coalesce(rc, config.TCPCoalesce, coalesceBufSize)
+			}
+			defer rc.Close() // flushing what is left coalescing
 
-			logf("proxy %s <-> %s <-> %s", c.RemoteAddr(), server, tgt)
-			if err = relay(rc, c); err != nil {
-				logf("relay error: %v", err)
+			l.Debugf("proxy with %d bytes of early data", len(early))
+			if err = relay(sessions, rc, lc); err == errRelayIdle {
+				l.Debugf("relay idle for %v", config.TCPIdleTimeout)
+			} else if err != nil {
+				l.Debugf("relay error: %v", err)
+				reportError("relay", err)
 			}
 		}()
 	}
 }
 
+// readEarly returns up to n bytes c sends within wait, for protocols whose
+// clients speak first (HTTP, TLS) to have their first request carried along
+// with the target address.
+func readEarly(c net.Conn, wait time.Duration, n int) []byte {
+	buf := make([]byte, n)
+	c.SetReadDeadline(time.Now().Add(wait))
+	n, _ = c.Read(buf)
+	c.SetReadDeadline(time.Time{})
+	return buf[:n]
+}
+
 // Listen on addr for incoming connections.
 func tcpRemote(addr string, shadow func(net.Conn) net.Conn) {
-	l, err := net.Listen("tcp", addr)
+	start := listenerStarting()
+	defer start.end()
+	l, err := listen(addr)
 	if err != nil {
-		logf("failed to listen on %s: %v", addr, err)
+		tcpLog.Errorf("failed to listen on %s: %v", addr, err)
 		return
 	}
+	start.bound()
 
-	logf("listening TCP on %s", addr)
+	tcpLog.Infof("listening TCP on %s", addr)
+	ls := listenerFor(addr)
+	ls.tcp.Store(true)
+	chain := streamChain()
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			logf("failed to accept: %v", err)
+			tcpLog.Warnf("failed to accept: %v", err)
 			continue
 		}
 
+		if !clientAllowedAddr(c.RemoteAddr()) || ls.paused.Load() {
+			c.Close()
+			continue
+		}
+		ip := addrIP(c.RemoteAddr())
+		if !tcpSlots.acquire(ip) {
+			rejectConn(c)
+			continue
+		}
+		c = tcpSocket(c)
+
 		go func() {
+			defer reportPanic()
+			defer tcpSlots.release(ip)
 			defer c.Close()
+			raw := c
+			var rec *tapConn
+			if config.Fallback != "" {
+				rec = &tapConn{Conn: c}
+				c = rec
+			}
 			if config.TCPCork {
 				c = timedCork(c, 10*time.Millisecond, 1280)
 			}
+			// before shadow, which may read the first bytes to pick the key
+			handshaken := awaitHandshake(c)
 			sc := shadow(c)
+			if config.TCPCoalesce > 0 {
+				sc = coalesce(sc, config.TCPCoalesce, coalesceBufSize)
+				defer sc.Close() // flushing what is left coalescing
+			}
 
 			tgt, err := socks.ReadAddr(sc)
+			handshaken()
 			if err != nil {
-				logf("failed to get target address from %v: %v", c.RemoteAddr(), err)
-				// drain c to avoid leaking server behavioral features
-				// see https://www.ndss-symposium.org/ndss-paper/detecting-probe-resistant-proxies/
-				_, err = io.Copy(ioutil.Discard, c)
-				if err != nil {
-					logf("discard error: %v", err)
+				l := tcpLog.With("client", c.RemoteAddr().String())
+				l.Debugf("failed to get target address: %v", err)
+				if errors.Is(err, os.ErrDeadlineExceeded) && rec == nil {
+					return // too slow, not to be held any longer
+				}
+				clientBans.failAddr(c.RemoteAddr())
+				if rec != nil {
+					if err := fallback(sessions, raw, rec.head); err != nil {
+						l.Debugf("fallback error: %v", err)
+					}
+					return
+				}
+				if err := absorbProbe(sessions, c); err != nil {
+					l.Debugf("discard error: %v", err)
 				}
 				return
 			}
-
-			rc, err := net.Dial("tcp", tgt.String())
-			if err != nil {
-				logf("failed to connect to target: %v", err)
-				return
+			if rec != nil {
+				rec.stop()
 			}
-			defer rc.Close()
 
-			logf("proxy %s <-> %s", c.RemoteAddr(), tgt)
-			if err = relay(sc, rc); err != nil {
-				logf("relay error: %v", err)
-			}
+			serveTarget(sessions, sc, addr, chain, c.RemoteAddr(), tgt)
 		}()
 	}
 }
 
-// relay copies between left and right bidirectionally
-func relay(left, right net.Conn) error {
+// serveTarget relays the decrypted client stream sc from client, accepted on
+// listener through chain, to tgt until either side closes or ctx is done.
+func serveTarget(ctx context.Context, sc net.Conn, listener string, chain transportChain, client net.Addr, tgt socks.Addr) {
+	l := tcpLog.With("client", client.String())
+	u := userOf(sc)
+	switch tgt.String() {
+	case uotMagicAddr:
+		if config.UDPOverTCP && !u.drained() && checkQuota(u, listener) == nil {
+			l.Debugf("UDP-over-TCP session")
+			uotRemote(ctx, sc, listener, chain, client)
+			return
+		}
+	case muxMagicAddr:
+		if config.Mux > 0 && !u.drained() && checkQuota(u, listener) == nil {
+			muxLog.With("client", client.String()).Debugf("mux session")
+			muxRemote(ctx, sc, listener, chain, client)
+			return
+		}
+	}
+
+	l = l.With("target", tgt.String())
+	entry := accessEntry{Time: time.Now(), Proto: "tcp", Listener: listener, Client: client.String(), User: u.name(), Target: tgt.String(), Chain: chain}
+	if u.drained() {
+		l.Debugf("user %s drained", u.Name)
+		entry.Close = "user drained"
+		accessLog.log(entry)
+		return
+	}
+	if err := checkQuota(u, listener); err != nil {
+		l.Debugf("%v", err)
+		entry.Close = err.Error()
+		accessLog.log(entry)
+		return
+	}
+	rc, err := dialTarget(ctx, u, tgt)
+	if err != nil {
+		l.Debugf("failed to connect to target: %v", err)
+		entry.Close = err.Error()
+		if isBlocked(err) {
+			serveBlocked(ctx, sc, targetPort(tgt))
+			entry.Close = "blocked: " + entry.Close
+		}
+		accessLog.log(entry)
+		return
+	}
+	tuneTCP(rc)
+	rc = tcpSocket(rc)
+	defer rc.Close()
+	if accessLog != nil || activeRelays != nil {
+		cc := &countConn{Conn: rc}
+		update := func(e *accessEntry) { e.Sent, e.Received = cc.written.Load(), cc.read.Load() }
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		remove := activeRelays.add(entry, update, func() { cancel(errRelayEnded) })
+		defer func() {
+			remove()
+			update(&entry)
+			accessLog.log(entry)
+		}()
+		rc = cc
+	}
+
+	l.Debugf("proxy")
+	err = relay(ctx, meterConn(limitConn(sc, listener), u, listener), rc)
+	if err == errRelayIdle {
+		l.Debugf("relay idle for %v", config.TCPIdleTimeout)
+	} else if err != nil {
+		l.Debugf("relay error: %v", err)
+		reportError("relay", err)
+	}
+	entry.Close = closeReason(ctx, err)
+}
+
+// sessions is the parent context of every relay. Cancelling it, or the
+// context of a single session, tears down both legs at once instead of
+// waiting for them to idle out.
+var sessions, endSessions = context.WithCancel(context.Background())
+
+// relay copies between left and right bidirectionally until both directions
+// end or ctx is done.
+func relay(ctx context.Context, left, right net.Conn) error {
 	var err, err1 error
 	var wg sync.WaitGroup
 	var wait = 5 * time.Second
+	var idle *idleTimer
+	if config.TCPIdleTimeout > 0 {
+		idle = newIdleTimer(config.TCPIdleTimeout, func() {
+			left.Close()
+			right.Close()
+		})
+		defer idle.stop()
+		left, right = idle.conn(left), idle.conn(right)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		left.Close()
+		right.Close()
+	})
+	defer stop()
+	cp := relayCopier(left, right)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		_, err1 = io.Copy(right, left)
+		_, err1 = cp(right, left)
 		right.SetReadDeadline(time.Now().Add(wait)) // unblock read on right
 	}()
-	_, err = io.Copy(left, right)
+	_, err = cp(left, right)
 	left.SetReadDeadline(time.Now().Add(wait)) // unblock read on left
 	wg.Wait()
+	if ctx.Err() != nil { // torn down on purpose
+		return nil
+	}
+	if idle != nil && idle.fired.Load() {
+		return errRelayIdle
+	}
 	if err1 != nil && !errors.Is(err1, os.ErrDeadlineExceeded) { // requires Go 1.15+
 		return err1
 	}
@@ -212,3 +404,84 @@ func (w *corkedConn) Write(p []byte) (int, error) {
 	}
 	return w.Conn.Write(p)
 }
+
+// coalesceBufSize is the largest payload fitting in a single AEAD chunk.
+const coalesceBufSize = 0x3FFF
+
+// coalescedConn merges small writes arriving within delay into one write to
+// the embedded Conn, so that a chatty peer does not produce one encrypted
+// chunk per tiny write.
+type coalescedConn struct {
+	net.Conn
+	buf     []byte
+	delay   time.Duration
+	timer   *time.Timer
+	pending bool
+	err     error
+	lock    sync.Mutex
+}
+
+// coalesce merges the small writes to c, keeping the user it authenticated
+// as.
+func coalesce(c net.Conn, d time.Duration, bufSize int) net.Conn {
+	return withUser(&coalescedConn{
+		Conn:  c,
+		buf:   make([]byte, 0, bufSize),
+		delay: d,
+	}, userOf(c))
+}
+
+func (w *coalescedConn) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(w.buf)+len(p) > cap(w.buf) {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+		if len(p) >= cap(w.buf) { // too large to benefit from coalescing
+			n, err := w.Conn.Write(p)
+			w.err = err
+			return n, err
+		}
+	}
+	w.buf = append(w.buf, p...)
+	if !w.pending {
+		w.pending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.delay, w.timedFlush)
+		} else {
+			w.timer.Reset(w.delay)
+		}
+	}
+	return len(p), nil
+}
+
+func (w *coalescedConn) timedFlush() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.flush()
+}
+
+// flush writes out buffered bytes. Caller must hold w.lock.
+func (w *coalescedConn) flush() error {
+	w.pending = false
+	if w.err != nil || len(w.buf) == 0 {
+		return w.err
+	}
+	_, w.err = w.Conn.Write(w.buf)
+	w.buf = w.buf[:0]
+	return w.err
+}
+
+func (w *coalescedConn) Close() error {
+	w.lock.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.flush()
+	w.lock.Unlock()
+	return w.Conn.Close()
+}
@@ -1,16 +1,16 @@
-//go:build !linux && !darwin
-// +build !linux,!darwin
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
 
 package main
 
-import (
-	"net"
-)
-
-func redirLocal(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP redirect not supported")
+func redirLocal(addr string, d Dialer) {
+	tcpLog.Errorf("TCP redirect not supported")
+	listenerFailed()
 }
 
-func redir6Local(addr, server string, shadow func(net.Conn) net.Conn) {
-	logf("TCP6 redirect not supported")
+func redir6Local(addr string, d Dialer) {
+	tcpLog.Errorf("TCP6 redirect not supported")
+	listenerFailed()
 }
+
+func tproxyTCP(addr string, d Dialer) { tcpLog.Errorf("TPROXY TCP not supported") }
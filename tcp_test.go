@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+func TestCoalesceKeepsUser(t *testing.T) {
+	p, err := newPolicy([]string{"192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user{Name: "restricted", policy: p}
+	c, peer := net.Pipe()
+	defer peer.Close()
+	sc := coalesce(withUser(c, u), time.Millisecond, coalesceBufSize)
+	defer sc.Close()
+	if userOf(sc) != u {
+		t.Fatalf("user lost through coalescing: %v", userOf(sc))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rc, err := dialTarget(ctx, userOf(sc), socks.ParseAddr("1.1.1.1:443"))
+	if err == nil {
+		rc.Close()
+	}
+	if !isBlocked(err) {
+		t.Errorf("restricted user dialed 1.1.1.1:443: %v", err)
+	}
+}
+
+// pipeDialer connects to c.
+type pipeDialer struct{ c net.Conn }
+
+func (d pipeDialer) Dial(network, address string) (net.Conn, error) { return d.c, nil }
+
+func TestCoalesceFlushesOnClose(t *testing.T) {
+	config.TCPCoalesce = time.Hour // flushed only by closing; the listener outlives the test
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	rc, target := net.Pipe()
+	defer target.Close()
+	getAddr := func(net.Conn) (socks.Addr, func(error) error, error) {
+		return socks.ParseAddr("192.0.2.1:80"), nil, nil
+	}
+	goListener(func() { replyLocal(addr, pipeDialer{rc}, getAddr) })
+	startingListeners.Wait()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	target.SetReadDeadline(time.Now().Add(10 * time.Second))
+	b, err := io.ReadAll(target)
+	if string(b) != "bye" {
+		t.Errorf("target got %q (%v), want %q", b, err, "bye")
+	}
+}
+
+func TestSilentClientOfUsers(t *testing.T) {
+	config.HandshakeTimeout = 200 * time.Millisecond // the listener outlives the test
+	db, err := loadUsers(writeUsers(t, `[{"name": "alice", "password": "alice-pw"}]`), "AEAD_CHACHA20_POLY1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	goListener(func() { tcpRemote(addr, db.StreamConn) })
+	startingListeners.Wait()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("connection of a silent client left open past the handshake timeout")
+	}
+}
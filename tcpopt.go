@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// TCP options of both legs of the relays: the connections accepted from
+// clients and those made to servers and targets. -tcp-keepalive sets the
+// idle time before keepalive probes, -tcp-keepalive-interval and
+// -tcp-keepalive-count how often and how many are sent before giving up, on
+// Linux, for NATs dropping quiet flows early. -tcp-nodelay=false enables
+// Nagle's algorithm, fewer packets for bulk transfers at the cost of latency
+// for interactive ones. -tcp-congestion picks the congestion control, such as
+// bbr, of the relays only, on Linux. -mptcp uses Multipath TCP between client
+// and server, for devices to move between or combine networks without
+// dropping the connections, falling back to TCP where either end or a
+// middlebox does not support it.
+
+// checkTCPOptions reports options unsupported on this system.
+func checkTCPOptions() error {
+	if (config.TCPKeepAliveInterval > 0 || config.TCPKeepAliveCount > 0) && !canTuneTCP {
+		return errors.New("-tcp-keepalive-interval and -tcp-keepalive-count are not supported on this system")
+	}
+	if config.TCPCongestion != "" {
+		if !canTuneTCP {
+			return errors.New("-tcp-congestion is not supported on this system")
+		}
+		if err := checkCongestion(config.TCPCongestion); err != nil {
+			return fmt.Errorf("-tcp-congestion %s: %v", config.TCPCongestion, err)
+		}
+	}
+	return nil
+}
+
+// tuneTCP applies the TCP options to c if it is a TCP connection.
+func tuneTCP(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(config.TCPNoDelay)
+	tc.SetKeepAlive(config.TCPKeepAlive >= 0)
+	if config.TCPKeepAlive > 0 {
+		tc.SetKeepAlivePeriod(config.TCPKeepAlive)
+	}
+	probes := config.TCPKeepAlive >= 0 && (config.TCPKeepAliveInterval > 0 || config.TCPKeepAliveCount > 0)
+	if !probes && config.TCPCongestion == "" {
+		return
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(func(fd uintptr) {
+		if probes {
+			if err := setKeepAliveProbes(fd, config.TCPKeepAliveInterval, config.TCPKeepAliveCount); err != nil {
+				tcpLog.Debugf("failed to set keepalive probes: %v", err)
+			}
+		}
+		if config.TCPCongestion != "" {
+			if err := setCongestion(fd, config.TCPCongestion); err != nil {
+				tcpLog.Debugf("failed to set congestion control: %v", err)
+			}
+		}
+	})
+}
+
+// tunedListener applies the TCP options to the connections it accepts.
+type tunedListener struct {
+	net.Listener
+}
+
+func (l tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		tuneTCP(c)
+	}
+	return c, err
+}
+
+var mptcpFallback sync.Once
+
+// checkMPTCP warns once if c to the server at addr fell back to TCP.
+func checkMPTCP(c net.Conn, addr string) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if used, err := tc.MultipathTCP(); err == nil && !used {
+		mptcpFallback.Do(func() {
+			mainLog.Warnf("connection to %s uses plain TCP: MPTCP is unsupported by this system, the server or the network between", addr)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// canTuneTCP reports whether the keepalive probes and the congestion control
+// can be set.
+const canTuneTCP = true
+
+// setKeepAliveProbes sets the interval between keepalive probes and their
+// number, those not positive left as they are.
+func setKeepAliveProbes(fd uintptr, interval time.Duration, count int) error {
+	if interval > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, keepAliveSeconds(interval)); err != nil {
+			return err
+		}
+	}
+	if count > 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+	}
+	return nil
+}
+
+// keepAliveSeconds rounds d up to whole seconds, the unit of the socket
+// options.
+func keepAliveSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func setCongestion(fd uintptr, name string) error {
+	return syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, name)
+}
+
+// checkCongestion reports whether the congestion control name can be set on
+// the sockets of this process: available, and allowed without CAP_NET_ADMIN
+// or with it.
+func checkCongestion(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	switch err := setCongestion(uintptr(fd), name); err {
+	case syscall.ENOENT:
+		return errors.New("not available, see /proc/sys/net/ipv4/tcp_available_congestion_control")
+	case syscall.EPERM:
+		return errors.New("not allowed, add it to the sysctl net.ipv4.tcp_allowed_congestion_control or grant CAP_NET_ADMIN")
+	default:
+		return err
+	}
+}
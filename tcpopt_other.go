@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+// canTuneTCP reports whether the keepalive probes and the congestion control
+// can be set.
+const canTuneTCP = false
+
+func setKeepAliveProbes(fd uintptr, interval time.Duration, count int) error { return errSockopt }
+func setCongestion(fd uintptr, name string) error                            { return errSockopt }
+func checkCongestion(name string) error                                      { return errSockopt }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// TCP timeouts: -dial-timeout bounds the outbound connections of the
+// outboundDialer, -handshake-timeout the time clients take to send the target
+// address, and -tcp-idle-timeout the time relays go on without a byte in
+// either direction.
+
+// handshakeTimeout returns the time allowed to a client to send the target
+// address, varied like probeTimeout, or 0 for no limit.
+func handshakeTimeout() time.Duration {
+	t := config.HandshakeTimeout
+	if t <= 0 {
+		return 0
+	}
+	return t/2 + time.Duration(rand.Int63n(int64(t)))
+}
+
+// awaitHandshake sets the deadline of the handshake on c, to be lifted with
+// the returned function once the target address is read.
+func awaitHandshake(c net.Conn) (done func()) {
+	t := handshakeTimeout()
+	if t <= 0 {
+		return func() {}
+	}
+	c.SetReadDeadline(time.Now().Add(t))
+	return func() { c.SetReadDeadline(time.Time{}) }
+}
+
+// errRelayIdle ends the relays idle for -tcp-idle-timeout; closeReason
+// reports it as idle.
+var errRelayIdle = fmt.Errorf("relay idle: %w", os.ErrDeadlineExceeded)
+
+// idleTimer fires when the conns it wraps read nothing for timeout.
+type idleTimer struct {
+	timeout time.Duration
+	last    atomic.Int64
+	fired   atomic.Bool
+	timer   *time.Timer
+}
+
+// newIdleTimer calls idle once the conns it wraps are idle for timeout.
+func newIdleTimer(timeout time.Duration, idle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.touch()
+	var check func()
+	check = func() {
+		if left := t.timeout - time.Duration(time.Now().UnixNano()-t.last.Load()); left > 0 {
+			t.timer.Reset(left)
+			return
+		}
+		t.fired.Store(true)
+		idle()
+	}
+	t.timer = time.AfterFunc(timeout, check)
+	return t
+}
+
+func (t *idleTimer) touch() { t.last.Store(time.Now().UnixNano()) }
+
+func (t *idleTimer) stop() { t.timer.Stop() }
+
+// conn returns c recording its reads on t. It hides c from relayCopy, whose
+// splices would report the bytes too late.
+func (t *idleTimer) conn(c net.Conn) net.Conn { return &idleConn{Conn: c, t: t} }
+
+type idleConn struct {
+	net.Conn
+	t *idleTimer
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.t.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+func (c *idleConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(countWriter{w, func(int) { c.t.touch() }}, c.Conn)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Stream transports carrying the shadowsocks TCP protocol.
+const (
+	transportTCP       = "tcp"
+	transportTLS       = "tls"
+	transportWS        = "ws"
+	transportWSS       = "wss"
+	transportQUIC      = "quic"
+	transportShadowTLS = "shadowtls"
+)
+
+// transportChain is the stack a server session came in through, as listed by
+// the admin API and the access log, outermost first.
+type transportChain struct {
+	Plugin    string `json:"plugin,omitempty"`     // SIP003 plugin in front of the listener
+	PluginPID int    `json:"plugin_pid,omitempty"` // of the plugin process
+	Transport string `json:"transport"`            // tcp, tls, ws, ws+tls, quic, shadowtls, or udp
+	MuxStream uint32 `json:"mux_stream,omitempty"` // ID of the stream of a multiplexed session
+	UoT       bool   `json:"uot,omitempty"`        // UDP over TCP
+}
+
+// streamChain returns the stack of the sessions accepted by the stream
+// listener of the server.
+func streamChain() transportChain {
+	ch := transportChain{Transport: config.Transport}
+	if config.Transport == transportWSS {
+		ch.Transport = "ws+tls"
+	}
+	if pluginCmd != nil {
+		ch.Plugin = filepath.Base(pluginCmd.Path)
+		ch.PluginPID = pluginCmd.Process.Pid
+	}
+	return ch
+}
+
+// udpChain is the stack of UDP sessions, which do not go through plugins.
+var udpChain = transportChain{Transport: "udp"}
+
+// listen creates the server-side stream listener on addr for config.Transport.
+func listen(addr string) (net.Listener, error) {
+	if config.Transport == transportQUIC {
+		if _, ok := unixSocketPath(addr); ok {
+			return nil, errors.New("the quic transport cannot listen on a unix socket")
+		}
+		if config.ProxyProtocol {
+			return nil, errors.New("the quic transport does not take -proxy-protocol")
+		}
+		return listenQUIC(addr)
+	}
+	var lc net.ListenConfig
+	if config.MPTCP {
+		lc.SetMultipathTCP(true)
+	}
+	l, err := listenStream(&lc, addr)
+	if err != nil {
+		return nil, err
+	}
+	l = tunedListener{l}
+	if config.ProxyProtocol {
+		l = newProxyListener(l)
+	}
+
+	switch config.Transport {
+	case transportTCP:
+		return l, nil
+	case transportTLS:
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return newDecoyListener(tls.NewListener(l, tlsConfig), decoyHandler(config.Decoy)), nil
+	case transportWS:
+		return newWSListener(l, config.WSPath, decoyHandler(config.Decoy)), nil
+	case transportWSS:
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		return newWSListener(tls.NewListener(l, tlsConfig), config.WSPath, decoyHandler(config.Decoy)), nil
+	case transportShadowTLS:
+		if config.ShadowTLSHandshake == "" || config.ShadowTLSPassword == "" {
+			l.Close()
+			return nil, errors.New("shadowtls transport requires -shadowtls-handshake and -shadowtls-password")
+		}
+		return newShadowTLSListener(l), nil
+	}
+	l.Close()
+	return nil, fmt.Errorf("unknown transport %q", config.Transport)
+}
+
+// dial connects to the server at addr over config.Transport.
+func dial(addr string) (net.Conn, error) {
+	d := outboundDialer()
+	if config.MPTCP {
+		d.SetMultipathTCP(true)
+	}
+	switch config.Transport {
+	case transportTCP:
+		return dialTCP(d, addr)
+	case transportTLS:
+		return dialTLS(d, addr)
+	case transportWS, transportWSS:
+		return dialWS(d, addr, config.Transport == transportWSS)
+	case transportQUIC:
+		return dialQUIC(addr)
+	case transportShadowTLS:
+		return dialShadowTLS(d, addr)
+	}
+	return nil, fmt.Errorf("unknown transport %q", config.Transport)
+}
+
+// dialTLS connects to the server at addr over TLS.
+func dialTLS(d *net.Dialer, addr string) (net.Conn, error) {
+	c, err := dialTCP(d, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(c, clientTLSConfig(addr))
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+func clientTLSConfig(addr string) *tls.Config {
+	sni := config.TLSServerName
+	if sni == "" {
+		sni, _, _ = net.SplitHostPort(addr)
+	}
+	return &tls.Config{ServerName: sni, InsecureSkipVerify: config.TLSInsecure}
+}
+
+// serverTLSConfig loads the certificate from files or, if domains are given,
+// obtains it from Let's Encrypt via TLS-ALPN challenges on the same port.
+func serverTLSConfig() (*tls.Config, error) {
+	if config.TLSACME != "" {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(config.TLSACME, ",")...),
+			Cache:      autocert.DirCache(config.TLSACMECache),
+		}
+		// HTTP/2 is not offered since the decoy server only sees the decrypted stream.
+		return &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{"http/1.1", acme.ALPNProto}}, nil
+	}
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, errors.New("TLS transport requires -tls-cert and -tls-key, or -tls-acme")
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}, nil
+}
+
+// decoyHandler serves non-tunnel HTTP requests: reverse proxied to target if
+// it is an http(s) URL, served from the directory target otherwise, or 404.
+func decoyHandler(target string) http.Handler {
+	if target == "" {
+		return http.NotFoundHandler()
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err == nil {
+			return httputil.NewSingleHostReverseProxy(u)
+		}
+		tcpLog.Errorf("invalid decoy URL %q: %v", target, err)
+		return http.NotFoundHandler()
+	}
+	return http.FileServer(http.Dir(target))
+}
+
+// decoyListener hands connections starting with an HTTP request to an HTTP
+// server running handler, and returns the rest from Accept.
+type decoyListener struct {
+	net.Listener
+	conns chan net.Conn
+	http  *connListener
+	done  chan struct{}
+	err   error
+}
+
+func newDecoyListener(l net.Listener, handler http.Handler) *decoyListener {
+	dl := &decoyListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		http:     newConnListener(l.Addr()),
+		done:     make(chan struct{}),
+	}
+	go (&http.Server{Handler: handler, ErrorLog: tcpLog.std(slog.LevelWarn)}).Serve(dl.http)
+	go dl.serve()
+	return dl
+}
+
+func (l *decoyListener) serve() {
+	defer close(l.done)
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			l.err = err
+			return
+		}
+		go l.classify(c)
+	}
+}
+
+// classify peeks at the first bytes sent by the client to tell HTTP requests apart.
+func (l *decoyListener) classify(c net.Conn) {
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	head, err := br.Peek(8)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.Close()
+		return
+	}
+	bc := &bufferedConn{Conn: c, r: br}
+	if isHTTPRequest(head) {
+		l.http.put(bc)
+		return
+	}
+	select {
+	case l.conns <- bc:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *decoyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *decoyListener) Close() error {
+	l.http.Close()
+	return l.Listener.Close()
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+func isHTTPRequest(head []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(head, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferedConn is a net.Conn whose first bytes have been peeked into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// connListener is a net.Listener fed with connections by put.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) put(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listFlag is a string flag accumulating the values it is given repeatedly,
+// separated by commas, so that -tcptun :80=a:80 -tcptun :443=a:443 is
+// -tcptun :80=a:80,:443=a:443.
+type listFlag struct {
+	p *string
+}
+
+func (f listFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return *f.p
+}
+
+func (f listFlag) Set(s string) error {
+	if *f.p != "" {
+		*f.p += ","
+	}
+	*f.p += s
+	return nil
+}
+
+func (f listFlag) Get() any { return *f.p }
+
+// tunnel maps a local address to a target reached through the server.
+type tunnel struct {
+	laddr, target string
+}
+
+// parseTunnels returns the tunnels of the mappings of -tcptun, -udptun or
+// -dnstun, laddr=target separated by commas. The local port may be a range,
+// as :5000-5009=host:6000-6009 mapping each to the port of the target range
+// of the same length, or as :5000-5009=host:6000 mapping them all to one.
+// The local address of -tcptun may also be a unix socket, as
+// unix:/run/tunnel.sock=host:80.
+func parseTunnels(s string) ([]tunnel, error) {
+	var tunnels []tunnel
+	for _, m := range strings.Split(s, ",") {
+		laddr, target, ok := strings.Cut(m, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tunnel %q, laddr=target expected", m)
+		}
+		if _, ok := unixSocketPath(laddr); ok {
+			if _, _, err := net.SplitHostPort(target); err != nil {
+				return nil, fmt.Errorf("tunnel %q: %v", m, err)
+			}
+			tunnels = append(tunnels, tunnel{laddr: laddr, target: target})
+			continue
+		}
+		lhost, lport, err := net.SplitHostPort(laddr)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %v", m, err)
+		}
+		thost, tport, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %v", m, err)
+		}
+		llo, lhi, err := parsePortRange(lport)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %v", m, err)
+		}
+		tlo, thi, err := parsePortRange(tport)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %v", m, err)
+		}
+		if tlo != thi && thi-tlo != lhi-llo {
+			return nil, fmt.Errorf("tunnel %q: port ranges of different lengths", m)
+		}
+		for p := llo; p <= lhi; p++ {
+			tp := tlo
+			if tlo != thi {
+				tp += p - llo
+			}
+			tunnels = append(tunnels, tunnel{
+				laddr:  net.JoinHostPort(lhost, strconv.Itoa(p)),
+				target: net.JoinHostPort(thost, strconv.Itoa(tp)),
+			})
+		}
+	}
+	return tunnels, nil
+}
+
+// parsePortRange parses a port, or a range of ports as 5000-5009.
+func parsePortRange(s string) (lo, hi int, err error) {
+	l, h, isRange := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(l); err != nil || lo < 0 || lo > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %q", s)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	if hi, err = strconv.Atoi(h); err != nil || hi < lo || hi > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return lo, hi, nil
+}
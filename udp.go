@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Potterli20/go-shadowsocks2/acl"
 	"github.com/Potterli20/go-shadowsocks2/socks"
 )
 
@@ -24,138 +28,156 @@ var bufPool = sync.Pool{New: func() any { return make([]byte, udpBufSize) }}
 
 // Listen on laddr for UDP packets, encrypt and send to server to reach target.
 func udpLocal(laddr, server, target string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
+	start := listenerStarting()
+	defer start.end()
+	srvAddr, err := resolveUDPAddr(server)
 	if err != nil {
-		logf("UDP server address error: %v", err)
+		udpLog.Errorf("UDP server address error: %v", err)
 		return
 	}
 
 	tgt := socks.ParseAddr(target)
 	if tgt == nil {
 		err = fmt.Errorf("invalid target address: %q", target)
-		logf("UDP target address error: %v", err)
+		udpLog.Errorf("UDP target address error: %v", err)
 		return
 	}
 
 	lnAddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
-		logf("UDP listen address error: %v", err)
+		udpLog.Errorf("UDP listen address error: %v", err)
 		return
 	}
 
-	c, err := net.ListenUDP("udp", lnAddr)
+	uc, err := net.ListenUDP("udp", lnAddr)
 	if err != nil {
-		logf("UDP local listen error: %v", err)
+		udpLog.Errorf("UDP local listen error: %v", err)
 		return
 	}
+	start.bound()
+	c := udpSocket(uc)
 	defer c.Close()
 
-	m := make(map[string]chan []byte)
-	var lock sync.Mutex
+	nm := newNATmap(config.UDPTimeout)
+	buf := make([]byte, udpBufSize)
+	copy(buf, tgt)
+
+	dns, err := newDNSRetrier(tgt, srvAddr, func(b []byte, client netip.AddrPort) { c.WriteToUDPAddrPort(b, client) })
+	if err != nil {
+		udpLog.Errorf("UDP tunnel to %s: %v", target, err)
+		return
+	}
+
+	action, _, rule := routeAddr(target)
+	tags := usageTags{Listener: laddr, Rule: rule}
+	relay := func(laddr string) (net.PacketConn, error) { return listenRelay(shadow, laddr, tags) }
+	switch action {
+	case acl.Block:
+		udpLog.Warnf("UDP tunnel to %s blocked by rules", target)
+		return
+	case acl.Bypass:
+		relay = func(laddr string) (net.PacketConn, error) { return listenDirect(laddr, tags) }
+		server = "direct"
+	}
 
-	logf("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
+	udpLog.Infof("UDP tunnel %s <-> %s <-> %s", laddr, server, target)
 	for {
 		n, raddr, err := c.ReadFromUDPAddrPort(buf[len(tgt):])
 		if err != nil {
-			logf("UDP local read error: %v", err)
+			udpLog.Debugf("UDP local read error: %v", err)
 			continue
 		}
 
 		pc := nm.Get(raddr)
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = nm.listen(raddr, relay)
 			if err != nil {
-				logf("failed to create UDP socket: %v", err)
-				goto Unlock
+				dropPacket("UDP local listen error", err)
+				continue
 			}
-			pc = shadow(pc)
-			ch = make(chan []byte, 1) // must use buffered chan
-			m[k] = ch
-
-			go func() { // recv from user and send to udpRemote
-				for buf := range ch {
-					pc.SetReadDeadline(time.Now().Add(config.UDPTimeout)) // extend read timeout
-					if _, err := pc.WriteTo(buf, srvAddr); err != nil {
-						logf("UDP local write error: %v", err)
-					}
-					bufPool.Put(buf[:cap(buf)])
-				}
-			}()
-
-			go func() { // recv from udpRemote and send to user
-				if err := timedCopy(raddr, c, pc, config.UDPTimeout, false); err != nil {
-					if err, ok := err.(net.Error); ok && err.Timeout() {
-						// ignore i/o timeout
-					} else {
-						logf("timedCopy error: %v", err)
-					}
-				}
-				pc.Close()
-				lock.Lock()
-				if ch := m[k]; ch != nil {
-					close(ch)
-				}
-				delete(m, k)
-				lock.Unlock()
-			}()
+
+			pc = nm.Add(sessions, raddr, c, dns.conn(pc, raddr), relayClient)
 		}
-	Unlock:
-		lock.Unlock()
 
-		select {
-		case ch <- buf[:len(tgt)+n]: // send
-		default: // drop
-			bufPool.Put(buf)
+		_, err = pc.WriteTo(buf[:len(tgt)+n], srvAddr)
+		if err != nil {
+			udpLog.Debugf("UDP local write error: %v", err)
+			continue
 		}
+		dns.sent(raddr, pc, buf[len(tgt):len(tgt)+n])
 	}
 }
 
 // Listen on laddr for Socks5 UDP packets, encrypt and send to server to reach target.
 func udpSocksLocal(laddr, server string, shadow func(net.PacketConn) net.PacketConn) {
-	srvAddr, err := net.ResolveUDPAddr("udp", server)
+	start := listenerStarting()
+	defer start.end()
+	srvAddr, err := resolveUDPAddr(server)
 	if err != nil {
-		logf("UDP server address error: %v", err)
+		udpLog.Errorf("UDP server address error: %v", err)
 		return
 	}
 
 	lnAddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
-		logf("UDP listen address error: %v", err)
+		udpLog.Errorf("UDP listen address error: %v", err)
 		return
 	}
 
-	c, err := net.ListenUDP("udp", lnAddr)
+	uc, err := net.ListenUDP("udp", lnAddr)
 	if err != nil {
-		logf("UDP local listen error: %v", err)
+		udpLog.Errorf("UDP local listen error: %v", err)
 		return
 	}
+	start.bound()
+	c := udpSocket(uc)
 	defer c.Close()
 
 	nm := newNATmap(config.UDPTimeout)
+	direct := newNATmap(config.UDPTimeout) // sessions to targets bypassed by the ACL
 	buf := make([]byte, udpBufSize)
+	relay := func(laddr string, tags usageTags) (net.PacketConn, error) { return listenRelay(shadow, laddr, tags) }
 
 	for {
 		n, raddr, err := c.ReadFromUDPAddrPort(buf)
 		if err != nil {
-			logf("UDP local read error: %v", err)
+			udpLog.Debugf("UDP local read error: %v", err)
+			continue
+		}
+		if n < 3 { // no room for RSV and FRAG
+			udpLog.Debugf("short SOCKS UDP packet from %v", raddr)
 			continue
 		}
 
-		pc := nm.Get(raddr)
+		// sessions are tagged with the rule routing the packet opening them
+		m, via, open, tags := nm, server, relay, usageTags{Listener: laddr}
+		if tgt := socks.SplitAddr(buf[3:n]); tgt != nil {
+			var action acl.Action
+			switch action, tags.Rule = routeTarget(tgt); action {
+			case acl.Block:
+				if r := fakeReply(targetPort(tgt), buf[3+len(tgt):n]); r != nil {
+					c.WriteToUDPAddrPort(append(append([]byte{0, 0, 0}, tgt...), r...), raddr)
+				}
+				continue
+			case acl.Bypass:
+				m, via, open = direct, "direct", listenDirect
+			}
+		}
+
+		pc := m.Get(raddr)
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = m.listen(raddr, func(laddr string) (net.PacketConn, error) { return open(laddr, tags) })
 			if err != nil {
-				logf("UDP local listen error: %v", err)
+				dropPacket("UDP local listen error", err)
 				continue
 			}
-			logf("UDP socks tunnel %s <-> %s <-> %s", laddr, server, socks.Addr(buf[3:]))
-			pc = shadow(pc)
-			nm.Add(raddr, c, pc, socksClient)
+			socksLog.Debugf("UDP socks tunnel %s <-> %s <-> %s", laddr, via, socks.Addr(buf[3:]))
+			pc = m.Add(sessions, raddr, c, pc, socksClient)
 		}
 
 		_, err = pc.WriteTo(buf[3:n], srvAddr)
 		if err != nil {
-			logf("UDP local write error: %v", err)
+			udpLog.Debugf("UDP local write error: %v", err)
 			continue
 		}
 	}
@@ -167,157 +189,476 @@ type UDPConn interface {
 	WriteToUDPAddrPort([]byte, netip.AddrPort) (int, error)
 }
 
+// udpConn adapts a net.PacketConn (e.g. one wrapped by a cipher) to UDPConn.
+type udpConn struct {
+	net.PacketConn
+}
+
+func (c udpConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	n, addr, err := c.ReadFrom(b)
+	var ap netip.AddrPort
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		ap = ua.AddrPort() // also of packets failing to decrypt
+	}
+	return n, ap, err
+}
+
+func (c udpConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	return c.WriteTo(b, net.UDPAddrFromAddrPort(addr))
+}
+
+// remotePool is the pool of outbound sockets of the server if -udp-pool is set.
+var remotePool *udpPool
+
 // Listen on addr for encrypted packets and basically do UDP NAT.
 func udpRemote(addr string, shadow func(net.PacketConn) net.PacketConn) {
+	start := listenerStarting()
+	defer start.end()
 	nAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
-		logf("UDP server address error: %v", err)
+		udpLog.Errorf("UDP server address error: %v", err)
 		return
 	}
 	cc, err := net.ListenUDP("udp", nAddr)
 	if err != nil {
-		logf("UDP remote listen error: %v", err)
+		udpLog.Errorf("UDP remote listen error: %v", err)
 		return
 	}
-	defer cc.Close()
-	c := shadow(cc).(UDPConn)
+	start.bound()
+	bc := udpSocket(cc)
+	defer bc.Close()
+	c := udpConn{&mtuPacketConn{shadow(bc), udpPacketLimit(shadow)}}
 
-	m := make(map[string]chan []byte)
-	var lock sync.Mutex
+	nm := newNATmap(config.UDPTimeout)
+	nm.listener = addr
+	buf := make([]byte, udpBufSize)
+	open := listenOutbound
+	if remotePool != nil {
+		open = func(string) (net.PacketConn, error) { return remotePool.open() }
+	}
+	if config.UDPState != "" {
+		restoreNATState(config.UDPState, addr, nm, c)
+	}
+	remoteNATs.Store(addr, nm)
 
-	logf("listening UDP on %s", addr)
+	udpLog.Infof("listening UDP on %s", addr)
+	ls := listenerFor(addr)
+	ls.udp.Store(true)
 	for {
 		n, raddr, err := c.ReadFromUDPAddrPort(buf)
 		if err != nil {
-			logf("UDP remote read error: %v", err)
+			udpLog.Debugf("UDP remote read error: %v", err)
+			continue
+		}
+		if !clientAllowed(raddr.Addr()) {
 			continue
 		}
 
 		tgtAddr := socks.SplitAddr(buf[:n])
 		if tgtAddr == nil {
-			logf("failed to split target address from packet: %q", buf[:n])
+			udpLog.Debugf("failed to split target address from packet: %q", buf[:n])
 			continue
 		}
 
-		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+		tgtUDPAddr, err := resolveUDP(tgtAddr)
 		if err != nil {
-			logf("failed to resolve target UDP address: %v", err)
+			udpLog.Debugf("failed to resolve target UDP address: %v", err)
 			continue
 		}
 
 		payload := buf[len(tgtAddr):n]
 
+		if err := checkOutbound(serverUsers.packetUser(raddr), tgtAddr, tgtUDPAddr.AddrPort()); err != nil {
+			udpLog.Debugf("UDP remote write error: %v", err)
+			if r := fakeReply(targetPort(tgtAddr), payload); r != nil {
+				c.WriteToUDPAddrPort(append(tgtAddr, r...), raddr)
+			}
+			continue
+		}
+
 		pc := nm.Get(raddr)
 		if pc == nil {
-			pc, err = net.ListenPacket("udp", "")
+			pc, err = openRemote(nm, raddr, addr, c, open)
 			if err != nil {
-				logf("failed to create UDP socket: %v", err)
-				goto Unlock
+				dropPacket("UDP remote listen error", err)
+				continue
+			}
+			if pc == nil {
+				continue
 			}
-			ch = make(chan []byte, 1) // must use buffered chan
-			m[k] = ch
-
-			go func() { // receive from udpLocal and send to target
-				var tgtUDPAddr *net.UDPAddr
-				var err error
-
-				for buf := range ch {
-					tgtAddr := socks.SplitAddr(buf)
-					if tgtAddr == nil {
-						logf("failed to split target address from packet: %q", buf)
-						goto End
-					}
-					tgtUDPAddr, err = net.ResolveUDPAddr("udp", tgtAddr.String())
-					if err != nil {
-						logf("failed to resolve target UDP address: %v", err)
-						goto End
-					}
-					pc.SetReadDeadline(time.Now().Add(config.UDPTimeout))
-					if _, err = pc.WriteTo(buf[len(tgtAddr):], tgtUDPAddr); err != nil {
-						logf("UDP remote write error: %v", err)
-						goto End
-					}
-				End:
-					bufPool.Put(buf[:cap(buf)])
-				}
-			}()
-
-			go func() { // receive from udpLocal and send to client
-				if err := timedCopy(raddr, c, pc, config.UDPTimeout, true); err != nil {
-					if err, ok := err.(net.Error); ok && err.Timeout() {
-						// ignore i/o timeout
-					} else {
-						logf("timedCopy error: %v", err)
-					}
-				}
-				pc.Close()
-				lock.Lock()
-				if ch := m[k]; ch != nil {
-					close(ch)
-				}
-				delete(m, k)
-				lock.Unlock()
-			}()
 		}
-	Unlock:
-		lock.Unlock()
 
-		select {
-		case ch <- buf[:n]: // sent
-		default: // drop
-			bufPool.Put(buf)
+		_, err = pc.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+		if err != nil {
+			udpLog.Debugf("UDP remote write error: %v", err)
+			reportError("udp", err)
+			continue
 		}
 	}
 }
 
-// Packet NAT table
+// openRemote opens with open the socket relaying the packets of raddr to the
+// server listener on addr, replying through c, and adds it to nm: counted
+// against -udp-slots, and rate limited and metered as a session of the user
+// of raddr. It returns nil and no error if raddr may not relay at the moment.
+func openRemote(nm *natmap, raddr netip.AddrPort, addr string, c UDPConn, open func(laddr string) (net.PacketConn, error)) (net.PacketConn, error) {
+	u := serverUsers.packetUser(raddr)
+	if listenerFor(addr).paused.Load() || u.drained() || checkQuota(u, addr) != nil {
+		return nil, nil
+	}
+	if !udpSlots.acquire(raddr.Addr()) {
+		return nil, errTooManySessions
+	}
+	pc, err := nm.listen(raddr, open)
+	if err != nil {
+		udpSlots.release(raddr.Addr())
+		return nil, err
+	}
+	if udpSlots != nil {
+		ip := raddr.Addr()
+		pc = &slotPacketConn{PacketConn: pc, release: func() { udpSlots.release(ip) }}
+	}
+	return nm.Add(sessions, raddr, c, meterPacketConn(limitPacketConn(pc, u, addr), u, addr), remoteServer), nil
+}
+
+// udpDropped counts the packets dropped for lack of a socket to relay them,
+// udpEvicted the NAT entries closed to make room for new ones.
+var (
+	udpDropped   atomic.Int64
+	lastDropLog  atomic.Int64
+	udpEvicted   atomic.Int64
+	lastEvictLog atomic.Int64
+)
+
+// dropPacket counts a packet dropped because of err, logging at most once a
+// second so that a flood of packets does not flood the log as well.
+func dropPacket(what string, err error) {
+	n := udpDropped.Add(1)
+	now := time.Now().UnixNano()
+	if last := lastDropLog.Load(); now-last >= int64(time.Second) && lastDropLog.CompareAndSwap(last, now) {
+		udpLog.Debugf("%s: %v (%d packets dropped so far)", what, err, n)
+	}
+}
+
+// Packet NAT table, split into shards by peer so that packets of different
+// peers look up their entries without contending for a single lock.
 type natmap struct {
-	sync.RWMutex
-	m       map[netip.AddrPort]net.PacketConn
+	shards  [natShards]natShard
+	n       atomic.Int64 // entries
 	timeout time.Duration
+	max     int                                 // entries, 0 for unlimited
+	key     func(netip.AddrPort) netip.AddrPort // of the entry of a peer
+
+	listener string // address of the server listener, tagging its sessions
+
+	fullCone  bool
+	portsMu   sync.Mutex
+	ports     map[netip.AddrPort]lastPort // of the ended entries of peers in full-cone mode
+	lastPrune time.Time
+}
+
+// lastPort is the local address of an ended entry, to be reused by the next
+// entry of the peer until expiry.
+type lastPort struct {
+	laddr  string
+	expiry time.Time
+}
+
+// natPortMemory is how long the local address of an ended entry is
+// remembered in full-cone mode.
+const natPortMemory = time.Hour
+
+const (
+	natShardBits = 5
+	natShards    = 1 << natShardBits
+)
+
+type natShard struct {
+	sync.RWMutex
+	m map[netip.AddrPort]net.PacketConn
 }
 
 func newNATmap(timeout time.Duration) *natmap {
 	m := &natmap{}
-	m.m = make(map[netip.AddrPort]net.PacketConn)
+	for i := range m.shards {
+		m.shards[i].m = make(map[netip.AddrPort]net.PacketConn)
+	}
 	m.timeout = timeout
+	m.max = config.UDPMaxSessions
+	m.key = natKey
+	if config.UDPFullCone {
+		m.fullCone = true
+		m.ports = make(map[netip.AddrPort]lastPort)
+	}
 	return m
 }
 
-func (m *natmap) Get(key netip.AddrPort) net.PacketConn {
-	m.RLock()
-	defer m.RUnlock()
-	return m.m[key]
+// shard returns the shard holding the entry of key.
+func (m *natmap) shard(key netip.AddrPort) *natShard {
+	a := key.Addr().As16()
+	h := binary.LittleEndian.Uint64(a[:8]) ^ binary.LittleEndian.Uint64(a[8:]) ^ uint64(key.Port())
+	h *= 0x9E3779B97F4A7C15 // spread the bits of ports and addresses alike
+	return &m.shards[h>>(64-natShardBits)]
+}
+
+// natKey returns peer with an IPv4-mapped IPv6 address unmapped, so that a
+// dual-stack client seen both as ::ffff:a.b.c.d and a.b.c.d has one entry.
+// The key remains an address replies can be sent to.
+func natKey(peer netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port())
 }
 
-func (m *natmap) Set(key netip.AddrPort, pc net.PacketConn) {
-	m.Lock()
-	defer m.Unlock()
+// Len returns the number of entries.
+func (m *natmap) Len() int {
+	return int(m.n.Load())
+}
 
-	m.m[key] = pc
+func (m *natmap) Get(peer netip.AddrPort) net.PacketConn {
+	key := m.key(peer)
+	s := m.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	return s.m[key]
 }
 
-func (m *natmap) Del(key netip.AddrPort) net.PacketConn {
-	m.Lock()
-	defer m.Unlock()
+func (m *natmap) Set(peer netip.AddrPort, pc net.PacketConn) {
+	key := m.key(peer)
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
 
-	pc, ok := m.m[key]
-	if ok {
-		delete(m.m, key)
-		return pc
+	if _, ok := s.m[key]; !ok {
+		m.n.Add(1)
 	}
-	return nil
+	s.m[key] = pc
 }
 
-func (m *natmap) Add(peer netip.AddrPort, dst UDPConn, src net.PacketConn, role mode) {
-	m.Set(peer, src)
+// delIf removes the entry of peer if it still maps to pc.
+func (m *natmap) delIf(peer netip.AddrPort, pc net.PacketConn) bool {
+	key := m.key(peer)
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if s.m[key] != pc {
+		return false
+	}
+	delete(s.m, key)
+	m.n.Add(-1)
+	return true
+}
+
+// each calls f with every entry, holding the lock of its shard.
+func (m *natmap) each(f func(peer netip.AddrPort, pc net.PacketConn)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for peer, pc := range s.m {
+			f(peer, pc)
+		}
+		s.RUnlock()
+	}
+}
+
+// listen opens the socket of a new entry of peer with open, given the local
+// address to bind to, empty for any. The least recently active entry is
+// evicted to make room first if the map is full, or when open fails, e.g.
+// for lack of ephemeral ports or file descriptors, before retrying once.
+// Evicting an entry closes its socket, which in turn stops its goroutine, so
+// a flood of sources costs no more than max entries.
+//
+// In full-cone mode, the socket is bound to the address of the last entry of
+// peer if possible, so that peer keeps its external port across sessions.
+func (m *natmap) listen(peer netip.AddrPort, open func(laddr string) (net.PacketConn, error)) (net.PacketConn, error) {
+	if m.max > 0 && m.Len() >= m.max {
+		m.evictOldest()
+	}
+	if laddr := m.lastAddr(peer); laddr != "" {
+		if pc, err := open(laddr); err == nil {
+			return pc, nil
+		}
+	}
+	pc, err := open("")
+	if err != nil && m.evictOldest() {
+		pc, err = open("")
+	}
+	return pc, err
+}
+
+// lastAddr returns the local address of the last entry of peer in
+// full-cone mode, if ended within natPortMemory.
+func (m *natmap) lastAddr(peer netip.AddrPort) string {
+	if !m.fullCone {
+		return ""
+	}
+	m.portsMu.Lock()
+	defer m.portsMu.Unlock()
+	p, ok := m.ports[m.key(peer)]
+	if !ok || time.Now().After(p.expiry) {
+		return ""
+	}
+	return p.laddr
+}
+
+// remember notes laddr as the local address of the ended entry of peer in
+// full-cone mode.
+func (m *natmap) remember(peer netip.AddrPort, laddr net.Addr) {
+	if !m.fullCone {
+		return
+	}
+	now := time.Now()
+	m.portsMu.Lock()
+	defer m.portsMu.Unlock()
+	m.ports[m.key(peer)] = lastPort{laddr.String(), now.Add(natPortMemory)}
+	if now.Sub(m.lastPrune) > m.timeout {
+		m.lastPrune = now
+		for k, p := range m.ports {
+			if now.After(p.expiry) {
+				delete(m.ports, k)
+			}
+		}
+	}
+}
+
+// evictOldest closes and removes the least recently active entry.
+func (m *natmap) evictOldest() bool {
+	var oldest netip.AddrPort
+	var nc *natConn
+	m.each(func(k netip.AddrPort, pc net.PacketConn) {
+		if c, ok := pc.(*natConn); ok && (nc == nil || c.seen.Load() < nc.seen.Load()) {
+			oldest, nc = k, c
+		}
+	})
+	if nc == nil || !m.delIf(oldest, nc) {
+		return false
+	}
+	nc.evicted.Store(true)
+	n := udpEvicted.Add(1)
+	now := time.Now().UnixNano()
+	if last := lastEvictLog.Load(); now-last >= int64(time.Second) && lastEvictLog.CompareAndSwap(last, now) {
+		udpLog.Warnf("UDP NAT entry of %v evicted to make room (%d evicted so far)", oldest, n)
+	}
+	nc.Close()
+	return true
+}
+
+// natConn is the socket of a NAT entry, noting when it was last active, the
+// class of its traffic and its traffic for the access log.
+type natConn struct {
+	net.PacketConn
+	role    mode // remoteServer sockets are written payloads, others packets with a target address
+	seen    atomic.Int64
+	evicted atomic.Bool
+	class   atomic.Int32 // natUnknown until written to
+
+	sent, received atomic.Int64
+	target         atomic.Pointer[string] // the first one written to
+}
+
+func (c *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.seen.Store(time.Now().UnixNano())
+	c.received.Add(int64(n))
+	return n, addr, err
+}
+
+// Traffic classes of NAT entries, which idle out after different timeouts.
+const (
+	natUnknown int32 = iota
+	natDNS           // only sent to port 53 so far
+	natOther
+)
+
+func (c *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.seen.Store(time.Now().UnixNano())
+	if class := c.class.Load(); class != natOther {
+		c.class.CompareAndSwap(class, c.classify(b, addr))
+	}
+	if c.target.Load() == nil {
+		s := addr.String()
+		c.target.CompareAndSwap(nil, &s)
+	}
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+// classify returns the class of the traffic of c, now writing b to addr.
+func (c *natConn) classify(b []byte, addr net.Addr) int32 {
+	var port int
+	if c.role == remoteServer {
+		if a, ok := addr.(*net.UDPAddr); ok {
+			port = a.Port
+		}
+	} else if tgt := socks.SplitAddr(b); tgt != nil {
+		port = int(targetPort(tgt))
+	}
+	if port == 53 {
+		return natDNS
+	}
+	return natOther
+}
+
+// idleTimeout returns how long c may idle before its entry is removed:
+// -udp-dns-timeout if set and c carries only DNS, or else timeout.
+func (c *natConn) idleTimeout(timeout time.Duration) time.Duration {
+	if config.UDPDNSTimeout > 0 && c.class.Load() == natDNS {
+		return config.UDPDNSTimeout
+	}
+	return timeout
+}
+
+// Add maps peer to src, relaying packets from src to peer on dst until src
+// idles out or ctx is done, then removes the entry. It returns src as
+// stored in the entry, for packets from peer to be written to.
+func (m *natmap) Add(ctx context.Context, peer netip.AddrPort, dst UDPConn, src net.PacketConn, role mode) net.PacketConn {
+	nc := &natConn{PacketConn: src, role: role}
+	nc.seen.Store(time.Now().UnixNano())
+	m.Set(peer, nc)
 
 	go func() {
-		timedCopy(dst, peer, src, m.timeout, role)
-		if pc := m.Del(peer); pc != nil {
-			pc.Close()
+		defer reportPanic()
+		done := func(error) {}
+		if role == remoteServer && (accessLog != nil || activeRelays != nil) {
+			ctx, done = nc.track(ctx, "udp", m.listener, udpChain, peer.String(), serverUsers.packetUser(peer))
 		}
+		stop := context.AfterFunc(ctx, func() { nc.Close() })
+		defer stop()
+		err := timedCopy(dst, peer, nc, m.timeout, role)
+		m.delIf(peer, nc)
+		nc.Close()
+		m.remember(peer, nc.LocalAddr())
+		done(err)
 	}()
+	return nc
+}
+
+// track records the session of client on listener through c, starting now,
+// for the admin API and the access log, along with the chain it came
+// through. The session is to end when the returned context is done, and done
+// to be called with the error ending it.
+func (c *natConn) track(ctx context.Context, proto, listener string, chain transportChain, client string, u *user) (_ context.Context, done func(error)) {
+	e := accessEntry{Time: time.Now(), Proto: proto, Listener: listener, Client: client, User: u.name(), Chain: chain}
+	ctx, cancel := context.WithCancelCause(ctx)
+	remove := activeRelays.add(e, c.fill, func() { cancel(errRelayEnded) })
+	return ctx, func(err error) {
+		remove()
+		c.fill(&e)
+		e.Close = closeReason(ctx, err)
+		if c.evicted.Load() {
+			e.Close = "evicted"
+		}
+		accessLog.log(e)
+		cancel(nil)
+	}
+}
+
+// fill fills in the traffic of c so far.
+func (c *natConn) fill(e *accessEntry) {
+	e.Sent, e.Received = c.sent.Load(), c.received.Load()
+	if t := c.target.Load(); t != nil {
+		e.Target = *t
+	}
 }
 
 // copy from src to dst at target with read timeout
@@ -325,7 +666,11 @@ func timedCopy(dst UDPConn, target netip.AddrPort, src net.PacketConn, timeout t
 	buf := make([]byte, udpBufSize)
 
 	for {
-		src.SetReadDeadline(time.Now().Add(timeout))
+		if nc, ok := src.(*natConn); ok {
+			src.SetReadDeadline(time.Now().Add(nc.idleTimeout(timeout)))
+		} else {
+			src.SetReadDeadline(time.Now().Add(timeout))
+		}
 		n, raddr, err := src.ReadFrom(buf)
 		if err != nil {
 			return err
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+func TestSocksUDPShortPacket(t *testing.T) {
+
+	srv, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	laddr := l.LocalAddr().String()
+	l.Close()
+	goListener(func() {
+		udpSocksLocal(laddr, srv.LocalAddr().String(), func(pc net.PacketConn) net.PacketConn { return pc })
+	})
+	startingListeners.Wait()
+
+	c, err := net.Dial("udp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req := append([]byte{0, 0, 0}, socks.ParseAddr("192.0.2.1:53")...)
+	req = append(req, "ping"...)
+	for _, p := range [][]byte{{}, {0}, {0, 0}, req} {
+		if _, err := c.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := make([]byte, udpBufSize)
+	srv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := srv.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], req[3:]) {
+		t.Errorf("relayed %q, want %q", buf[:n], req[3:])
+	}
+}
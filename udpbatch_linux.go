@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+)
+
+// batchUDP returns c reading and writing up to n packets per system call
+// with recvmmsg and sendmmsg, or c itself if n < 2. At high packet rates, as
+// with QUIC, the per-packet system calls otherwise dominate the CPU time.
+//
+// Where the kernel supports it, runs of packets of the same size to the same
+// peer are sent as one with UDP segmentation offload (UDP_SEGMENT), and
+// packets received coalesced by GRO (UDP_GRO) are split again.
+func batchUDP(c *net.UDPConn, n int) UDPConn {
+	if n < 2 {
+		return c
+	}
+	bc := &batchConn{
+		UDPConn: c,
+		pc:      ipv4.NewPacketConn(c), // works with IPv6 sockets as well
+		rmsgs:   make([]ipv4.Message, n),
+		wmsgs:   make([]ipv4.Message, n),
+		wpkts:   make([]batchPacket, 0, n),
+		out:     make(chan batchPacket, n),
+		done:    make(chan struct{}),
+	}
+	gso, gro := udpOffload(c)
+	bc.gso.Store(gso)
+	for i := range bc.rmsgs {
+		bc.rmsgs[i].Buffers = [][]byte{make([]byte, udpBufSize)}
+		if gro {
+			bc.rmsgs[i].OOB = make([]byte, syscall.CmsgSpace(4))
+		}
+	}
+	for i := range bc.wmsgs {
+		bc.wmsgs[i].Buffers = make([][]byte, 0, 1)
+	}
+	go bc.writeLoop()
+	return bc
+}
+
+// Socket options of UDP segmentation offload, missing from package syscall.
+const (
+	solUDP     = 17  // SOL_UDP
+	udpSegment = 103 // UDP_SEGMENT
+	udpGRO     = 104 // UDP_GRO
+
+	gsoMaxSegments = 64 // UDP_MAX_SEGMENTS
+)
+
+// udpOffload reports whether c can send with GSO, and enables GRO on it.
+func udpOffload(c *net.UDPConn) (gso, gro bool) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	rc.Control(func(fd uintptr) {
+		_, err := syscall.GetsockoptInt(int(fd), solUDP, udpSegment)
+		gso = err == nil
+		gro = syscall.SetsockoptInt(int(fd), solUDP, udpGRO, 1) == nil
+	})
+	udpLog.Debugf("UDP offload on %v: GSO %v, GRO %v", c.LocalAddr(), gso, gro)
+	return gso, gro
+}
+
+// batchConn is a listening socket read in batches of packets, handed out
+// one at a time, and written asynchronously in batches of the packets queued
+// meanwhile, so that writing adds no delay.
+type batchConn struct {
+	*net.UDPConn
+	pc *ipv4.PacketConn
+
+	rmu         sync.Mutex
+	rmsgs       []ipv4.Message
+	next, count int // the next message to hand out, and those read
+	off, seg    int // of the next packet in a message coalesced by GRO
+
+	gso   atomic.Bool
+	wmsgs []ipv4.Message
+	wpkts []batchPacket
+	out   chan batchPacket
+	done  chan struct{}
+	once  sync.Once
+}
+
+type batchPacket struct {
+	b    []byte // from bufPool
+	addr net.Addr
+}
+
+func (c *batchConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.next == c.count {
+		n, err := c.pc.ReadBatch(c.rmsgs, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.next, c.count, c.off = 0, n, 0
+	}
+	m := &c.rmsgs[c.next]
+	if c.off == 0 {
+		c.seg = groSegment(m.OOB[:m.NN])
+	}
+	p := m.Buffers[0][c.off:m.N]
+	if c.seg > 0 && c.seg < len(p) {
+		p = p[:c.seg]
+		c.off += c.seg
+	} else {
+		c.next++
+		c.off = 0
+	}
+	return copy(b, p), m.Addr, nil
+}
+
+// groSegment returns the size of the packets coalesced by GRO into a message
+// with the control messages oob, 0 if none.
+func groSegment(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	cms, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cm := range cms {
+		if cm.Header.Level == solUDP && cm.Header.Type == udpGRO && len(cm.Data) >= 4 {
+			return int(binary.NativeEndian.Uint32(cm.Data))
+		}
+	}
+	return 0
+}
+
+func (c *batchConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	n, addr, err := c.ReadFrom(b)
+	var ap netip.AddrPort
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		ap = ua.AddrPort()
+	}
+	return n, ap, err
+}
+
+// WriteTo queues b to be sent to addr, failing only once c is closed.
+func (c *batchConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := batchPacket{append(bufPool.Get().([]byte)[:0], b...), addr}
+	select {
+	case c.out <- p:
+		return len(b), nil
+	case <-c.done:
+		bufPool.Put(p.b[:cap(p.b)])
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *batchConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	return c.WriteTo(b, net.UDPAddrFromAddrPort(addr))
+}
+
+// writeLoop sends the queued packets, as many at once as are queued.
+func (c *batchConn) writeLoop() {
+	for {
+		var p batchPacket
+		select {
+		case p = <-c.out:
+		case <-c.done:
+			return
+		}
+		pkts := append(c.wpkts[:0], p)
+	queued:
+		for len(pkts) < cap(pkts) {
+			select {
+			case p = <-c.out:
+				pkts = append(pkts, p)
+			default:
+				break queued
+			}
+		}
+		c.send(pkts)
+		for i := range pkts {
+			bufPool.Put(pkts[i].b[:udpBufSize])
+			pkts[i] = batchPacket{}
+		}
+	}
+}
+
+// send writes pkts, skipping those failing. A message of packets coalesced
+// for GSO failing is sent again packet by packet, and GSO turned off if the
+// kernel or the device cannot offload it.
+func (c *batchConn) send(pkts []batchPacket) {
+	ms := c.wmsgs[:0]
+	for rest := pkts; len(rest) > 0; {
+		n := 1
+		if c.gso.Load() {
+			n = gsoRun(rest)
+		}
+		ms = ms[:len(ms)+1]
+		m := &ms[len(ms)-1]
+		m.Buffers, m.Addr, m.OOB = m.Buffers[:0], rest[0].addr, nil
+		for _, p := range rest[:n] {
+			m.Buffers = append(m.Buffers, p.b)
+		}
+		if n > 1 {
+			m.OOB = gsoControl(len(rest[0].b))
+		}
+		rest = rest[n:]
+	}
+	for rest := ms; len(rest) > 0; {
+		n, err := c.pc.WriteBatch(rest, 0)
+		if err == nil && n > 0 {
+			rest = rest[n:]
+			continue
+		}
+		n = max(n, 0) // sent before the failing message
+		if n < len(rest) && len(rest[n].Buffers) > 1 {
+			if errors.Is(err, syscall.EIO) && c.gso.CompareAndSwap(true, false) {
+				udpLog.Infof("UDP segmentation offload unsupported on %v, turned off: %v", c.LocalAddr(), err)
+			}
+			c.sendEach(rest[n])
+		} else {
+			udpLog.Debugf("UDP batch write error: %v", err)
+		}
+		rest = rest[n+1:]
+	}
+	for i := range ms {
+		clear(ms[i].Buffers)
+		ms[i].Addr, ms[i].OOB = nil, nil
+	}
+}
+
+// sendEach writes the packets coalesced in m one by one.
+func (c *batchConn) sendEach(m ipv4.Message) {
+	for _, b := range m.Buffers {
+		if _, err := c.UDPConn.WriteTo(b, m.Addr); err != nil {
+			udpLog.Debugf("UDP batch write error: %v", err)
+		}
+	}
+}
+
+// gsoRun returns how many packets at the start of pkts can be sent as one
+// with GSO: those to the same peer of the size of the first, which fits in a
+// datagram within -udp-mtu, but for the last which may be smaller.
+func gsoRun(pkts []batchPacket) int {
+	first, ok := pkts[0].addr.(*net.UDPAddr)
+	size := len(pkts[0].b)
+	mtu := config.UDPMTU
+	if mtu <= 0 {
+		mtu = 1500
+	}
+	if !ok || size == 0 || size > mtu-udpIPOverhead {
+		return 1
+	}
+	n, total := 1, size
+	for n < len(pkts) && n < gsoMaxSegments {
+		p := pkts[n]
+		a, ok := p.addr.(*net.UDPAddr)
+		if !ok || a.Port != first.Port || !a.IP.Equal(first.IP) || a.Zone != first.Zone ||
+			len(p.b) > size || len(p.b) == 0 || total+len(p.b) > maxIPPacket-udpIPOverhead {
+			break
+		}
+		n++
+		total += len(p.b)
+		if len(p.b) < size { // a smaller packet ends the run
+			break
+		}
+	}
+	return n
+}
+
+// gsoControl returns the control message sending a message as packets of
+// size bytes.
+func gsoControl(size int) []byte {
+	b := make([]byte, syscall.CmsgSpace(2))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = solUDP
+	h.Type = udpSegment
+	h.SetLen(syscall.CmsgLen(2))
+	binary.NativeEndian.PutUint16(b[syscall.CmsgLen(0):], uint16(size))
+	return b
+}
+
+func (c *batchConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// batchUDP returns c: recvmmsg and sendmmsg are Linux only.
+func batchUDP(c *net.UDPConn, n int) UDPConn { return c }
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"hash/maphash"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpPool relays the UDP sessions of the server through a fixed set of
+// shared sockets instead of one socket per session. Replies are told apart
+// by their source, so a socket carries at most one session per target; a
+// session whose target is taken on every socket gets a socket of its own for
+// that target.
+type udpPool struct {
+	socks []*pooledSocket
+	seed  maphash.Seed
+	queue int // packets queued per session at first
+}
+
+type pooledSocket struct {
+	pc     net.PacketConn
+	mu     sync.Mutex
+	routes map[netip.AddrPort]*poolSession // by target
+}
+
+// newUDPPool opens n shared sockets, queueing up to queue packets per
+// session at first.
+func newUDPPool(n, queue int) (*udpPool, error) {
+	p := &udpPool{seed: maphash.MakeSeed(), queue: max(queue, 1)}
+	for i := 0; i < n; i++ {
+		pc, err := listenOutbound("")
+		if err != nil {
+			return nil, err
+		}
+		s := &pooledSocket{pc: pc, routes: make(map[netip.AddrPort]*poolSession)}
+		p.socks = append(p.socks, s)
+		go s.serve()
+	}
+	return p, nil
+}
+
+// serve hands the packets received by s to the sessions they reply to.
+func (s *pooledSocket) serve() {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		from := addr.(*net.UDPAddr).AddrPort()
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		s.mu.Lock()
+		ps := s.routes[from]
+		s.mu.Unlock()
+		if ps != nil {
+			ps.deliver(buf[:n], addr)
+		}
+	}
+}
+
+// open returns a session relaying packets through the pool.
+func (p *udpPool) open() (net.PacketConn, error) {
+	ps := &poolSession{
+		pool:   p,
+		socks:  make(map[netip.AddrPort]*pooledSocket),
+		in:     make(chan poolPacket, p.queue*queueGrowth),
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	ps.depth.init(p.queue, p.queue*queueGrowth)
+	return ps, nil
+}
+
+type poolPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+// poolSession is a NAT session relayed through the pool.
+type poolSession struct {
+	pool  *udpPool
+	in    chan poolPacket
+	depth queueDepth // of in, up to its capacity
+
+	mu       sync.Mutex
+	socks    map[netip.AddrPort]*pooledSocket // by target
+	own      net.PacketConn                   // for targets taken on every pooled socket
+	deadline time.Time
+	wake     chan struct{}
+	closed   chan struct{}
+	once     sync.Once
+}
+
+var errQueueFull = errors.New("session queue full")
+
+func (ps *poolSession) deliver(b []byte, from net.Addr) {
+	if len(ps.in) < ps.depth.get() {
+		select {
+		case ps.in <- poolPacket{append([]byte(nil), b...), from}:
+			return
+		default:
+		}
+	}
+	// drop when the session falls behind, as a socket buffer would, and let
+	// it queue more of the next burst
+	ps.depth.dropped()
+	dropPacket("UDP pool delivery error", errQueueFull)
+}
+
+// queueGrowth is how many times its initial depth a session queue grows to
+// while packets are dropped.
+const queueGrowth = 8
+
+// queueShrinkAfter is how long a queue must go without drops for its depth
+// to be halved back towards the initial one.
+const queueShrinkAfter = 10 * time.Second
+
+// queueDepth is the depth of a packet queue adapting to bursts: doubled, up
+// to max, whenever a packet is dropped, and halved, down to min, after
+// queueShrinkAfter without drops. A bursty sender then loses a packet or so
+// per burst size doubling, rather than every burst, while a quiet session
+// does not keep a deep queue.
+type queueDepth struct {
+	min, max int32
+	n        atomic.Int32
+	changed  atomic.Int64 // when n last grew or shrank, or a packet was dropped
+}
+
+func (d *queueDepth) init(lo, hi int) {
+	d.min, d.max = int32(lo), int32(hi)
+	d.n.Store(d.min)
+	d.changed.Store(time.Now().UnixNano())
+}
+
+// get returns the current depth.
+func (d *queueDepth) get() int {
+	n := d.n.Load()
+	if n > d.min {
+		now := time.Now().UnixNano()
+		if last := d.changed.Load(); now-last > int64(queueShrinkAfter) && d.changed.CompareAndSwap(last, now) {
+			d.n.CompareAndSwap(n, max(n/2, d.min))
+		}
+	}
+	return int(d.n.Load())
+}
+
+// dropped notes a packet dropped for lack of room in the queue.
+func (d *queueDepth) dropped() {
+	d.changed.Store(time.Now().UnixNano())
+	if n := d.n.Load(); n < d.max {
+		d.n.CompareAndSwap(n, min(n*2, d.max))
+	}
+}
+
+func (ps *poolSession) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		if p, ok, err := ps.wait(); ok || err != nil {
+			return copy(b, p.b), p.from, err
+		}
+	}
+}
+
+// wait waits for a packet until the read deadline, or until it changes.
+func (ps *poolSession) wait() (poolPacket, bool, error) {
+	ps.mu.Lock()
+	deadline := ps.deadline
+	ps.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-ps.in:
+		return p, true, nil
+	case <-ps.closed:
+		return poolPacket{}, false, net.ErrClosed
+	case <-timeout:
+		return poolPacket{}, false, os.ErrDeadlineExceeded
+	case <-ps.wake:
+		return poolPacket{}, false, nil
+	}
+}
+
+func (ps *poolSession) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("not a UDP address")
+	}
+	tgt := ua.AddrPort()
+	tgt = netip.AddrPortFrom(tgt.Addr().Unmap(), tgt.Port())
+	pc, err := ps.socketFor(tgt)
+	if err != nil {
+		return 0, err
+	}
+	return pc.WriteTo(b, addr)
+}
+
+// socketFor returns the socket relaying packets of ps to tgt, claiming tgt
+// on a pooled socket if possible.
+func (ps *poolSession) socketFor(tgt netip.AddrPort) (net.PacketConn, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	select {
+	case <-ps.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	if s := ps.socks[tgt]; s != nil {
+		return s.pc, nil
+	}
+	if ps.own != nil {
+		return ps.own, nil
+	}
+	// start at a socket picked by the target to spread the load
+	socks := ps.pool.socks
+	b, _ := tgt.MarshalBinary()
+	start := int(maphash.Bytes(ps.pool.seed, b) % uint64(len(socks)))
+	for i := range socks {
+		s := socks[(start+i)%len(socks)]
+		s.mu.Lock()
+		if s.routes[tgt] == nil {
+			s.routes[tgt] = ps
+			s.mu.Unlock()
+			ps.socks[tgt] = s
+			return s.pc, nil
+		}
+		s.mu.Unlock()
+	}
+	pc, err := listenOutbound("")
+	if err != nil {
+		return nil, err
+	}
+	ps.own = pc
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ps.deliver(buf[:n], addr)
+		}
+	}()
+	return pc, nil
+}
+
+func (ps *poolSession) Close() error {
+	ps.once.Do(func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		close(ps.closed)
+		for tgt, s := range ps.socks {
+			s.mu.Lock()
+			if s.routes[tgt] == ps {
+				delete(s.routes, tgt)
+			}
+			s.mu.Unlock()
+		}
+		if ps.own != nil {
+			ps.own.Close()
+		}
+	})
+	return nil
+}
+
+func (ps *poolSession) LocalAddr() net.Addr { return ps.pool.socks[0].pc.LocalAddr() }
+
+func (ps *poolSession) SetDeadline(t time.Time) error { return ps.SetReadDeadline(t) }
+
+func (ps *poolSession) SetReadDeadline(t time.Time) error {
+	ps.mu.Lock()
+	ps.deadline = t
+	ps.mu.Unlock()
+	select {
+	case ps.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (ps *poolSession) SetWriteDeadline(time.Time) error { return nil }
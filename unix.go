@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Stream listeners given as unix:PATH, the SOCKS proxy and TCP tunnels of the
+// client and the server behind a reverse proxy, bind a unix domain socket
+// instead of a TCP port, reachable only from the host and by the users
+// -unix-mode lets in. The client reaches a server given as unix:PATH, such
+// as a socket forwarded by SSH, through it as well.
+
+const unixPrefix = "unix:"
+
+// unixSocketPath returns the path of addr if it is a unix:PATH address.
+func unixSocketPath(addr string) (string, bool) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	return path, ok && path != ""
+}
+
+// listenStream listens with lc on addr, a TCP address or unix:PATH.
+func listenStream(lc *net.ListenConfig, addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return lc.Listen(context.Background(), "tcp", addr)
+	}
+	removeStaleSocket(path)
+	l, err := lc.Listen(context.Background(), "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, config.UnixMode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing listens on it
+// anymore, left behind by a process which did not exit cleanly.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return
+	}
+	if os.Remove(path) == nil {
+		mainLog.Debugf("removed stale socket %s", path)
+	}
+}
+
+// dialUnix connects to the unix socket at path within the timeout of d. The
+// other settings of d, such as the outbound address, only apply to TCP.
+func dialUnix(d *net.Dialer, path string) (net.Conn, error) {
+	return net.DialTimeout("unix", path, d.Timeout)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// uotMagicAddr is the target address requesting UDP-over-TCP, as in sing-box.
+const uotMagicAddr = "sp.udp-over-tcp.arpa:0"
+
+// uotDialer, if set, carries client UDP sessions over TCP streams to the server.
+var uotDialer Dialer
+
+// listenRelay returns a packet connection carrying one client UDP session to
+// the server, encrypted with shadow unless UDP-over-TCP is in use, bound to
+// laddr if not empty, with its usage tagged with tags.
+func listenRelay(shadow func(net.PacketConn) net.PacketConn, laddr string, tags usageTags) (net.PacketConn, error) {
+	if uotDialer != nil {
+		c, err := dialWith(uotDialer, "tcp", uotMagicAddr, dialOpts{tags: tags})
+		if err != nil {
+			return nil, err
+		}
+		return limitPacketConn(newUoTConn(c), nil, ""), nil
+	}
+	pc, err := listenOutbound(laddr)
+	if err != nil {
+		return nil, err
+	}
+	pc = clientUsage.packetConn(pc, routeProxy, tags)
+	return limitPacketConn(&mtuPacketConn{shadow(pc), udpPacketLimit(shadow)}, nil, ""), nil
+}
+
+// uotConn frames shadowsocks UDP packets over a stream. Each packet is sent as
+//
+//	[target address][payload length][payload]
+//
+// with a 2-byte big-endian length. Destination addresses of WriteTo are
+// ignored since the stream has a single peer.
+type uotConn struct {
+	net.Conn
+	r    *bufio.Reader
+	wbuf []byte
+	wmu  sync.Mutex
+}
+
+func newUoTConn(c net.Conn) *uotConn {
+	return &uotConn{Conn: c, r: bufio.NewReader(c), wbuf: make([]byte, udpBufSize+2)}
+}
+
+// ReadFrom reads a packet into b as [target address][payload].
+func (c *uotConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	tgt, err := socks.ReadAddr(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if len(b) < len(tgt)+n {
+		return 0, nil, io.ErrShortBuffer
+	}
+	copy(b, tgt)
+	if _, err := io.ReadFull(c.r, b[len(tgt):len(tgt)+n]); err != nil {
+		return 0, nil, err
+	}
+	return len(tgt) + n, c.RemoteAddr(), nil
+}
+
+// WriteTo writes the packet b formed as [target address][payload].
+func (c *uotConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	tgt := socks.SplitAddr(b)
+	if tgt == nil {
+		return 0, socks.ErrAddressNotSupported
+	}
+	payload := b[len(tgt):]
+	if len(payload) > 0xFFFF {
+		return 0, errPacketTooLarge{len(b), len(tgt) + 0xFFFF}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := append(c.wbuf[:0], tgt...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	buf = append(buf, payload...)
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *uotConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, netip.AddrPort{}, err
+}
+
+func (c *uotConn) WriteToUDPAddrPort(b []byte, _ netip.AddrPort) (int, error) {
+	return c.WriteTo(b, nil)
+}
+
+// uotRemote does UDP NAT for packets framed over the stream c from client,
+// accepted on listener through chain, until it closes or ctx is done.
+func uotRemote(ctx context.Context, c net.Conn, listener string, chain transportChain, client net.Addr) {
+	uc := newUoTConn(c)
+	u := userOf(c)
+	pc, err := listenOutbound("")
+	if err != nil {
+		udpLog.Warnf("UDP remote listen error: %v", err)
+		return
+	}
+	nc := &natConn{PacketConn: meterPacketConn(limitPacketConn(pc, u, listener), u, listener)}
+	pc = nc
+	defer pc.Close()
+	done := func(error) {}
+	if accessLog != nil || activeRelays != nil {
+		chain.UoT = true
+		ctx, done = nc.track(ctx, "uot", listener, chain, client.String(), u)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		pc.Close()
+		c.Close()
+	})
+	defer stop()
+
+	go func() {
+		timedCopy(uc, netip.AddrPort{}, pc, config.UDPTimeout, remoteServer)
+		c.SetReadDeadline(time.Now()) // unblock reading from the stream
+	}()
+
+	buf := make([]byte, udpBufSize)
+	for {
+		n, _, err := uc.ReadFrom(buf)
+		if err != nil {
+			done(err)
+			return
+		}
+		tgtAddr := socks.SplitAddr(buf[:n])
+		tgtUDPAddr, err := resolveUDP(tgtAddr)
+		if err != nil {
+			udpLog.Debugf("failed to resolve target UDP address: %v", err)
+			continue
+		}
+		if err := checkOutbound(u, tgtAddr, tgtUDPAddr.AddrPort()); err != nil {
+			udpLog.Debugf("UDP remote write error: %v", err)
+			if r := fakeReply(targetPort(tgtAddr), buf[len(tgtAddr):n]); r != nil {
+				uc.WriteTo(append(tgtAddr, r...), nil)
+			}
+			continue
+		}
+		if _, err := pc.WriteTo(buf[len(tgtAddr):n], tgtUDPAddr); err != nil {
+			udpLog.Debugf("UDP remote write error: %v", err)
+		}
+	}
+}
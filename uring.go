@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// With -io-uring, relays read and write their sockets through io_uring on
+// Linux: the listening UDP sockets keep receives in flight and submit the
+// packets queued in batches, and TCP connections submit their reads and
+// writes to a ring shared with them, whose completions a single thread
+// waits for, instead of each going through the poller. It is experimental;
+// where io_uring is missing, the portable implementation is used.
+
+// uringDepth is the number of receives kept in flight on a UDP socket, or
+// -udp-batch if larger.
+const uringDepth = 64
+
+var uringFallback sync.Once
+
+// uringFailed logs once that io_uring is unavailable.
+func uringFailed(err error) {
+	uringFallback.Do(func() { mainLog.Warnf("io_uring unavailable, relaying without it: %v", err) })
+}
+
+// udpSocket returns the listening UDP socket c as relays read and write it.
+func udpSocket(c *net.UDPConn) UDPConn {
+	if config.IOUring {
+		uc, err := uringUDP(c, max(uringDepth, config.UDPBatch))
+		if err == nil {
+			return uc
+		}
+		uringFailed(err)
+	}
+	return batchUDP(c, config.UDPBatch)
+}
+
+// tcpSocket returns the TCP connection c as relays read and write it.
+func tcpSocket(c net.Conn) net.Conn {
+	if pc, ok := c.(*proxyConn); ok {
+		pc.Conn = tcpSocket(pc.Conn)
+		return pc
+	}
+	tc, ok := c.(*net.TCPConn)
+	if !config.IOUring || !ok {
+		return c
+	}
+	uc, err := uringTCP(tc)
+	if err != nil {
+		uringFailed(err)
+		return c
+	}
+	return uc
+}
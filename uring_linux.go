@@ -0,0 +1,733 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// io_uring system calls and constants, missing from package syscall.
+const (
+	sysIOURingSetup = 425
+	sysIOURingEnter = 426
+
+	ioringOffSQRing = 0
+	ioringOffCQRing = 0x8000000
+	ioringOffSQEs   = 0x10000000
+
+	ioringSetupCQSize    = 1 << 3
+	ioringFeatNoDrop     = 1 << 1
+	ioringFeatFastPoll   = 1 << 5
+	ioringEnterGetEvents = 1
+
+	ioringOpSendmsg     = 9
+	ioringOpRecvmsg     = 10
+	ioringOpAsyncCancel = 14
+	ioringOpSend        = 26
+	ioringOpRecv        = 27
+
+	msgNoSignal = 0x4000 // MSG_NOSIGNAL
+)
+
+// Sizes of the ring shared by the relays: operations are submitted in
+// batches of up to uringEntries, and up to uringCQEntries complete before
+// the kernel buffers the excess (IORING_FEAT_NODROP).
+const (
+	uringEntries   = 256
+	uringCQEntries = 16384
+)
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring instance. Operations are submitted under smu, which
+// keeps the kernel consuming every submission queue entry at once, and
+// their completions are reaped by a single goroutine, which calls complete.
+type uring struct {
+	fd int
+
+	smu     sync.Mutex
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []uringSQE
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []uringCQE
+
+	mu     sync.Mutex
+	ops    map[uint64]*uringOp
+	nextID uint64
+}
+
+// uringOp is an operation in flight. Whatever its entry points to must stay
+// referenced by it until complete is called with the result.
+type uringOp struct {
+	sqe      uringSQE
+	id       atomic.Uint64
+	complete func(res int32)
+	keep     any // memory the kernel uses
+}
+
+var shared struct {
+	once sync.Once
+	r    *uring
+	err  error
+}
+
+// sharedRing returns the ring of the relays, set up on first use.
+func sharedRing() (*uring, error) {
+	shared.once.Do(func() { shared.r, shared.err = newURing() })
+	return shared.r, shared.err
+}
+
+func newURing() (*uring, error) {
+	p := uringParams{flags: ioringSetupCQSize, cqEntries: uringCQEntries}
+	fd, _, e := syscall.Syscall(sysIOURingSetup, uringEntries, uintptr(unsafe.Pointer(&p)), 0)
+	if e != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", e)
+	}
+	r := &uring{fd: int(fd), ops: make(map[uint64]*uringOp)}
+	if p.features&(ioringFeatNoDrop|ioringFeatFastPoll) != ioringFeatNoDrop|ioringFeatFastPoll {
+		syscall.Close(r.fd)
+		return nil, errors.New("io_uring lacks fast poll (Linux 5.7 or later required)")
+	}
+	mmap := func(off int64, size uint32) ([]byte, error) {
+		b, err := syscall.Mmap(r.fd, off, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+		return b, os.NewSyscallError("mmap", err)
+	}
+	sq, err := mmap(ioringOffSQRing, p.sqOff.array+p.sqEntries*4)
+	if err != nil {
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	cq, err := mmap(ioringOffCQRing, p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if err != nil {
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	sqes, err := mmap(ioringOffSQEs, p.sqEntries*uint32(unsafe.Sizeof(uringSQE{})))
+	if err != nil {
+		syscall.Close(r.fd)
+		return nil, err
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&sq[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&sq[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&sq[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&sqes[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&cq[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&cq[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&cq[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&cq[p.cqOff.cqes])), p.cqEntries)
+	go r.reap()
+	mainLog.Infof("io_uring ready, %d entries", p.sqEntries)
+	return r, nil
+}
+
+func (r *uring) enter(submit, wait uint, flags uintptr) (int, syscall.Errno) {
+	n, _, e := syscall.Syscall6(sysIOURingEnter, uintptr(r.fd), uintptr(submit), uintptr(wait), flags, 0, 0)
+	return int(n), e
+}
+
+// submit starts ops, with one system call per uringEntries of them. It
+// returns how many were started: those after are not, and will not
+// complete, if it fails.
+func (r *uring) submit(ops ...*uringOp) (int, error) {
+	r.mu.Lock()
+	for _, op := range ops {
+		r.nextID++
+		op.id.Store(r.nextID)
+		r.ops[r.nextID] = op
+	}
+	r.mu.Unlock()
+
+	r.smu.Lock()
+	defer r.smu.Unlock()
+	started := 0
+	for started < len(ops) {
+		n := min(len(ops)-started, len(r.sqes))
+		tail := *r.sqTail
+		for _, op := range ops[started : started+n] {
+			i := tail & r.sqMask
+			r.sqes[i] = op.sqe
+			r.sqes[i].userData = op.id.Load()
+			r.sqArray[i] = i
+			tail++
+		}
+		atomic.StoreUint32(r.sqTail, tail)
+		for left := n; left > 0; {
+			done, e := r.enter(uint(left), 0, 0)
+			switch e {
+			case 0:
+				left -= done
+				started += done
+			case syscall.EINTR:
+			case syscall.EAGAIN, syscall.EBUSY:
+				time.Sleep(time.Millisecond) // completions to reap first
+			default:
+				// take back the entries the kernel did not consume
+				atomic.StoreUint32(r.sqTail, tail-uint32(left))
+				r.mu.Lock()
+				for _, op := range ops[started:] {
+					delete(r.ops, op.id.Load())
+				}
+				r.mu.Unlock()
+				return started, os.NewSyscallError("io_uring_enter", e)
+			}
+		}
+	}
+	return started, nil
+}
+
+// cancel asks for op to complete early, with -ECANCELED unless it is done.
+func (r *uring) cancel(op *uringOp) {
+	r.submit(&uringOp{sqe: uringSQE{opcode: ioringOpAsyncCancel, fd: -1, addr: op.id.Load()}, complete: func(int32) {}})
+}
+
+// reap waits for completions and hands them out, for good.
+func (r *uring) reap() {
+	for {
+		if _, e := r.enter(0, 1, ioringEnterGetEvents); e != 0 && e != syscall.EINTR {
+			mainLog.Debugf("io_uring wait error: %v", e)
+		}
+		head, tail := *r.cqHead, atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			r.mu.Lock()
+			op := r.ops[cqe.userData]
+			delete(r.ops, cqe.userData)
+			r.mu.Unlock()
+			if op != nil {
+				op.complete(cqe.res)
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+// uringError returns the error of the negative result res.
+func uringError(call string, res int32) error {
+	return os.NewSyscallError(call, syscall.Errno(-res))
+}
+
+// submitOn is submit for ops on the socket of rc, which cannot be closed,
+// and its descriptor reused, meanwhile.
+func (r *uring) submitOn(rc syscall.RawConn, ops ...*uringOp) (started int, err error) {
+	if cerr := rc.Control(func(fd uintptr) {
+		for _, op := range ops {
+			op.sqe.fd = int32(fd)
+		}
+		started, err = r.submit(ops...)
+	}); cerr != nil {
+		return 0, cerr
+	}
+	return started, err
+}
+
+// uringTCP returns c reading and writing through the shared ring.
+func uringTCP(c *net.TCPConn) (net.Conn, error) {
+	r, err := sharedRing()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	uc := &uringConn{TCPConn: c, r: r, rc: rc, closed: make(chan struct{})}
+	uc.rd.init()
+	uc.wd.init()
+	return uc, nil
+}
+
+// uringConn is a TCP connection read and written through io_uring. Its
+// deadlines cancel the operations in flight; they apply to the embedded
+// connection as well, for relays splicing it.
+type uringConn struct {
+	*net.TCPConn
+	r  *uring
+	rc syscall.RawConn
+
+	rmu, wmu sync.Mutex
+	rd, wd   uringDeadline
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (c *uringConn) Unwrap() net.Conn { return c.TCPConn }
+
+func (c *uringConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	n, err := c.do(ioringOpRecv, 0, b, &c.rd)
+	if err != nil {
+		return 0, c.opError("read", "recv", err)
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (c *uringConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for written < len(b) {
+		n, err := c.do(ioringOpSend, msgNoSignal, b[written:], &c.wd)
+		if err != nil {
+			return written, c.opError("write", "send", err)
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// do runs the operation opcode on b until it completes, the deadline d
+// passes or c is closed.
+func (c *uringConn) do(opcode uint8, flags uint32, b []byte, d *uringDeadline) (int, error) {
+	deadline := d.wait()
+	select {
+	case <-deadline:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	res := make(chan int32, 1)
+	op := &uringOp{
+		sqe:      uringSQE{opcode: opcode, addr: uint64(uintptr(unsafe.Pointer(&b[0]))), len: uint32(len(b)), opFlags: flags},
+		complete: func(n int32) { res <- n },
+		keep:     b,
+	}
+	if _, err := c.r.submitOn(c.rc, op); err != nil {
+		return 0, err
+	}
+	var n int32
+	var stopped error
+	select {
+	case n = <-res:
+	case <-deadline:
+		stopped = os.ErrDeadlineExceeded
+	case <-c.closed:
+		stopped = net.ErrClosed
+	}
+	if stopped != nil {
+		c.r.cancel(op)
+		if n = <-res; n == -int32(syscall.ECANCELED) || n == -int32(syscall.EINTR) {
+			return 0, stopped
+		}
+	}
+	if n < 0 {
+		return 0, syscall.Errno(-n)
+	}
+	return int(n), nil
+}
+
+func (c *uringConn) opError(op, call string, err error) error {
+	if errno, ok := err.(syscall.Errno); ok {
+		err = os.NewSyscallError(call, errno)
+	}
+	return &net.OpError{Op: op, Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+func (c *uringConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return c.TCPConn.SetDeadline(t)
+}
+
+func (c *uringConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return c.TCPConn.SetReadDeadline(t)
+}
+
+func (c *uringConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return c.TCPConn.SetWriteDeadline(t)
+}
+
+func (c *uringConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.TCPConn.Close()
+}
+
+// uringDeadline is a deadline of a uringConn, as that of net.Pipe.
+type uringDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{} // closed when the deadline passes
+}
+
+func (d *uringDeadline) init() { d.expired = make(chan struct{}) }
+
+func (d *uringDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.expired // the timer is closing it
+	}
+	d.timer = nil
+	closed := false
+	select {
+	case <-d.expired:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(dur, func() { close(expired) })
+		return
+	}
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *uringDeadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.expired
+}
+
+// uringUDP returns c reading and writing through the shared ring, with n
+// receives in flight at all times.
+func uringUDP(c *net.UDPConn, n int) (UDPConn, error) {
+	r, err := sharedRing()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sa syscall.Sockaddr
+	if cerr := rc.Control(func(fd uintptr) { sa, err = syscall.Getsockname(int(fd)) }); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	_, v6 := sa.(*syscall.SockaddrInet6)
+	uc := &uringUDPConn{
+		UDPConn: c,
+		r:       r,
+		rc:      rc,
+		v6:      v6,
+		in:      make(chan *uringMsg, n),
+		out:     make(chan batchPacket, n),
+		sends:   make(chan struct{}, 4*n),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		m := newUringMsg(make([]byte, udpBufSize))
+		m.complete = func(res int32) {
+			m.res = res
+			uc.in <- m
+		}
+		uc.recvs = append(uc.recvs, m)
+	}
+	uc.again = append(uc.again, uc.recvs...)
+	if err := uc.resubmit(); err != nil {
+		return nil, err
+	}
+	go uc.writeLoop()
+	return uc, nil
+}
+
+// uringUDPConn is a listening UDP socket with receives kept in flight on
+// the ring, handed out in the order they complete, and sends submitted in
+// batches of the packets queued meanwhile, like batchConn.
+type uringUDPConn struct {
+	*net.UDPConn
+	r  *uring
+	rc syscall.RawConn
+	v6 bool // whether the socket is IPv6, taking IPv4 addresses mapped
+
+	rmu   sync.Mutex
+	recvs []*uringMsg
+	in    chan *uringMsg // completed receives
+	again []*uringMsg    // receives handed out, to submit again
+
+	out   chan batchPacket
+	sends chan struct{} // sends in flight
+
+	cmu    sync.Mutex // held submitting receives and closing
+	closed bool
+	done   chan struct{}
+}
+
+// uringMsg is a sendmsg or recvmsg operation with the memory it uses.
+type uringMsg struct {
+	uringOp
+	buf []byte
+	res int32
+	sa  syscall.RawSockaddrInet6 // large enough for IPv4 too
+	iov syscall.Iovec
+	hdr syscall.Msghdr
+}
+
+func newUringMsg(b []byte) *uringMsg {
+	m := &uringMsg{buf: b}
+	m.iov.Base = &b[0]
+	m.iov.SetLen(len(b))
+	m.hdr.Name = (*byte)(unsafe.Pointer(&m.sa))
+	m.hdr.Namelen = uint32(unsafe.Sizeof(m.sa))
+	m.hdr.Iov = &m.iov
+	m.hdr.Iovlen = 1
+	m.sqe = uringSQE{opcode: ioringOpRecvmsg, addr: uint64(uintptr(unsafe.Pointer(&m.hdr))), len: 1}
+	return m
+}
+
+// resubmit submits again the receives handed out, unless c is closed.
+func (c *uringUDPConn) resubmit() error {
+	c.cmu.Lock()
+	defer c.cmu.Unlock()
+	if len(c.again) == 0 || c.closed {
+		return nil
+	}
+	ops := make([]*uringOp, len(c.again))
+	for i, m := range c.again {
+		m.hdr.Namelen = uint32(unsafe.Sizeof(m.sa))
+		ops[i] = &m.uringOp
+	}
+	n, err := c.r.submitOn(c.rc, ops...)
+	c.again = append(c.again[:0], c.again[n:]...)
+	return err
+}
+
+func (c *uringUDPConn) ReadFromUDPAddrPort(b []byte) (int, netip.AddrPort, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	var m *uringMsg
+	select {
+	case m = <-c.in:
+	default:
+		if err := c.resubmit(); err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+		select {
+		case m = <-c.in:
+		case <-c.done:
+			return 0, netip.AddrPort{}, net.ErrClosed
+		}
+	}
+	c.again = append(c.again, m)
+	if len(c.again) >= cap(c.in)/2 {
+		if err := c.resubmit(); err != nil {
+			return 0, netip.AddrPort{}, err
+		}
+	}
+	select {
+	case <-c.done:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	default:
+	}
+	if m.res < 0 {
+		return 0, netip.AddrPort{}, &net.OpError{Op: "read", Net: "udp", Addr: c.LocalAddr(), Err: uringError("recvmsg", m.res)}
+	}
+	return copy(b, m.buf[:m.res]), sockaddrPort(&m.sa), nil
+}
+
+func (c *uringUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, ap, err := c.ReadFromUDPAddrPort(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, net.UDPAddrFromAddrPort(ap), nil
+}
+
+// sockaddrPort returns the address in sa, an IPv4 or IPv6 socket address.
+func sockaddrPort(sa *syscall.RawSockaddrInet6) netip.AddrPort {
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p := uint16(port[0])<<8 | uint16(port[1])
+	if sa.Family == syscall.AF_INET {
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), p)
+	}
+	ip := netip.AddrFrom16(sa.Addr)
+	if sa.Scope_id != 0 {
+		ip = ip.WithZone(strconv.FormatUint(uint64(sa.Scope_id), 10))
+	}
+	return netip.AddrPortFrom(ip, p)
+}
+
+// setSockaddr sets sa to addr for a socket of IPv6 if v6, else IPv4, and
+// returns its length.
+func setSockaddr(sa *syscall.RawSockaddrInet6, addr netip.AddrPort, v6 bool) (uint32, error) {
+	ip := addr.Addr()
+	var port *[2]byte
+	var size uintptr
+	if v6 {
+		*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Addr: ip.As16()}
+		if z := ip.Zone(); z != "" {
+			if id, err := strconv.ParseUint(z, 10, 32); err == nil {
+				sa.Scope_id = uint32(id)
+			} else if ifi, err := net.InterfaceByName(z); err == nil {
+				sa.Scope_id = uint32(ifi.Index)
+			} else {
+				return 0, err
+			}
+		}
+		port, size = (*[2]byte)(unsafe.Pointer(&sa.Port)), unsafe.Sizeof(*sa)
+	} else {
+		if !ip.Unmap().Is4() {
+			return 0, syscall.EAFNOSUPPORT
+		}
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		*sa4 = syscall.RawSockaddrInet4{Family: syscall.AF_INET, Addr: ip.Unmap().As4()}
+		port, size = (*[2]byte)(unsafe.Pointer(&sa4.Port)), unsafe.Sizeof(*sa4)
+	}
+	port[0], port[1] = byte(addr.Port()>>8), byte(addr.Port())
+	return uint32(size), nil
+}
+
+// WriteTo queues b to be sent to addr, failing only once c is closed.
+func (c *uringUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := batchPacket{append(bufPool.Get().([]byte)[:0], b...), addr}
+	select {
+	case c.out <- p:
+		return len(b), nil
+	case <-c.done:
+		bufPool.Put(p.b[:cap(p.b)])
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *uringUDPConn) WriteToUDPAddrPort(b []byte, addr netip.AddrPort) (int, error) {
+	return c.WriteTo(b, net.UDPAddrFromAddrPort(addr))
+}
+
+// writeLoop submits the queued packets, as many at once as are queued and
+// may be in flight.
+func (c *uringUDPConn) writeLoop() {
+	var ops []*uringOp
+	for {
+		var p batchPacket
+		select {
+		case p = <-c.out:
+		case <-c.done:
+			return
+		}
+		ops = c.appendSend(ops[:0], p)
+	queued:
+		for len(ops) < cap(c.sends) {
+			select {
+			case p = <-c.out:
+				ops = c.appendSend(ops, p)
+			default:
+				break queued
+			}
+		}
+		for range ops {
+			c.sends <- struct{}{} // released on completion
+		}
+		n, err := c.r.submitOn(c.rc, ops...)
+		if err != nil {
+			udpLog.Debugf("UDP io_uring write error: %v", err)
+		}
+		for _, op := range ops[n:] {
+			op.complete(-int32(syscall.ECANCELED))
+		}
+	}
+}
+
+// appendSend appends the operation sending p to ops, unless its address is
+// invalid.
+func (c *uringUDPConn) appendSend(ops []*uringOp, p batchPacket) []*uringOp {
+	ua, ok := p.addr.(*net.UDPAddr)
+	if !ok || len(p.b) == 0 {
+		bufPool.Put(p.b[:cap(p.b)])
+		return ops
+	}
+	m := newUringMsg(p.b)
+	size, err := setSockaddr(&m.sa, ua.AddrPort(), c.v6)
+	if err != nil {
+		udpLog.Debugf("UDP io_uring write error: %v", err)
+		bufPool.Put(p.b[:cap(p.b)])
+		return ops
+	}
+	m.hdr.Namelen = size
+	m.sqe.opcode, m.sqe.opFlags = ioringOpSendmsg, msgNoSignal
+	m.complete = func(res int32) {
+		if res < 0 && res != -int32(syscall.ECANCELED) {
+			udpLog.Debugf("UDP io_uring write error: %v", uringError("sendmsg", res))
+		}
+		bufPool.Put(m.buf[:cap(m.buf)])
+		<-c.sends
+	}
+	return append(ops, &m.uringOp)
+}
+
+// Close cancels the receives in flight, which would otherwise keep the
+// socket open.
+func (c *uringUDPConn) Close() error {
+	c.cmu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+		for _, m := range c.recvs {
+			c.r.cancel(&m.uringOp)
+		}
+	}
+	c.cmu.Unlock()
+	return c.UDPConn.Close()
+}
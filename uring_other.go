@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoURing = errors.New("io_uring is Linux only")
+
+func uringTCP(c *net.TCPConn) (net.Conn, error)       { return nil, errNoURing }
+func uringUDP(c *net.UDPConn, n int) (UDPConn, error) { return nil, errNoURing }
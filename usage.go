@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Client usage is counted per day, server, route (proxied through the
+// server or direct under the ACL), listener and routing rule, and kept in a
+// local file. Nothing leaves the machine; the stats command prints it.
+
+const (
+	routeProxy  = "proxy"
+	routeDirect = "direct"
+
+	usageDays         = 400 // days of usage kept in the file
+	usageSaveInterval = time.Minute
+)
+
+type usageKey struct {
+	Day    string `json:"day"`
+	Server string `json:"server,omitempty"`
+	Route  string `json:"route"`
+	usageTags
+}
+
+// usageTags tell apart the traffic of a route.
+type usageTags struct {
+	Listener string `json:"listener,omitempty"` // the local address applications connected to
+	Rule     string `json:"rule,omitempty"`     // the routing rule choosing the route, as TYPE,VALUE
+}
+
+type usageRecord struct {
+	usageKey
+	Up   int64 `json:"up"`
+	Down int64 `json:"down"`
+}
+
+// clientUsage records the client traffic, nil unless -usage-file is set.
+var clientUsage *usageRecorder
+
+type usageRecorder struct {
+	path string
+	mu   sync.Mutex
+	m    map[usageKey]*usageRecord
+}
+
+// newUsageRecorder loads the usage saved in path and saves it back periodically.
+func newUsageRecorder(path string) (*usageRecorder, error) {
+	records, err := readUsage(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	r := &usageRecorder{path: path, m: make(map[usageKey]*usageRecord)}
+	for _, rec := range records {
+		r.m[rec.usageKey] = &rec
+	}
+	go func() {
+		for range time.Tick(usageSaveInterval) {
+			if err := r.save(); err != nil {
+				mainLog.Warnf("failed to save usage: %v", err)
+			}
+		}
+	}()
+	return r, nil
+}
+
+func readUsage(path string) ([]usageRecord, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []usageRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("usage %s: %v", path, err)
+	}
+	return records, nil
+}
+
+func (r *usageRecorder) add(server, route string, tags usageTags, up, down int) {
+	if r == nil || up+down == 0 {
+		return
+	}
+	k := usageKey{Day: time.Now().Format(time.DateOnly), Server: server, Route: route, usageTags: tags}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := r.m[k]
+	if rec == nil {
+		rec = &usageRecord{usageKey: k}
+		r.m[k] = rec
+	}
+	rec.Up += int64(up)
+	rec.Down += int64(down)
+}
+
+// save writes the usage of the last usageDays days to the file.
+func (r *usageRecorder) save() error {
+	if r == nil {
+		return nil
+	}
+	oldest := time.Now().AddDate(0, 0, -usageDays).Format(time.DateOnly)
+	r.mu.Lock()
+	records := make([]usageRecord, 0, len(r.m))
+	for k, rec := range r.m {
+		if k.Day < oldest {
+			delete(r.m, k)
+			continue
+		}
+		records = append(records, *rec)
+	}
+	r.mu.Unlock()
+	sortUsage(records)
+
+	b, err := json.MarshalIndent(records, "", " ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func sortUsage(records []usageRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Server != b.Server {
+			return a.Server < b.Server
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Listener != b.Listener {
+			return a.Listener < b.Listener
+		}
+		return a.Rule < b.Rule
+	})
+}
+
+// conn counts the traffic of c to server via route with tags.
+func (r *usageRecorder) conn(c net.Conn, server, route string, tags usageTags) net.Conn {
+	if r == nil {
+		return c
+	}
+	return &usageConn{Conn: c, r: r, server: server, route: route, tags: tags}
+}
+
+// packetConn counts the traffic of pc via route with tags, to the server it
+// exchanges packets with when proxied.
+func (r *usageRecorder) packetConn(pc net.PacketConn, route string, tags usageTags) net.PacketConn {
+	if r == nil {
+		return pc
+	}
+	return &usagePacketConn{PacketConn: pc, r: r, route: route, tags: tags}
+}
+
+type usageConn struct {
+	net.Conn
+	r      *usageRecorder
+	server string
+	route  string
+	tags   usageTags
+}
+
+func (c *usageConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.r.add(c.server, c.route, c.tags, 0, n)
+	return n, err
+}
+
+func (c *usageConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.r.add(c.server, c.route, c.tags, n, 0)
+	return n, err
+}
+
+func (c *usageConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, countReader{r, func(n int) { c.r.add(c.server, c.route, c.tags, n, 0) }})
+}
+
+func (c *usageConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(countWriter{w, func(n int) { c.r.add(c.server, c.route, c.tags, 0, n) }}, c.Conn)
+}
+
+func (c *usageConn) spliceTo() net.Conn { return c.Conn }
+
+func (c *usageConn) spliced(n int64, read bool) {
+	if read {
+		c.r.add(c.server, c.route, c.tags, 0, int(n))
+	} else {
+		c.r.add(c.server, c.route, c.tags, int(n), 0)
+	}
+}
+
+// taggableConn is a connection to the server carried over a usageConn, whose
+// tags are only known once it is dialed.
+type taggableConn struct {
+	net.Conn
+	u *usageConn
+}
+
+// taggable returns c, carried over uc, as a connection tagUsage can tag if
+// uc counts usage.
+func taggable(c, uc net.Conn) net.Conn {
+	if u, ok := uc.(*usageConn); ok {
+		return &taggableConn{Conn: c, u: u}
+	}
+	return c
+}
+
+// Unwrap returns the connection to the server.
+func (c *taggableConn) Unwrap() net.Conn { return c.Conn }
+
+// tagUsage tags the traffic of c, or of the connection it wraps, from now
+// on, before any is relayed.
+func tagUsage(c net.Conn, tags usageTags) {
+	for {
+		switch t := c.(type) {
+		case *taggableConn:
+			t.u.tags = tags
+			return
+		case interface{ Unwrap() net.Conn }:
+			c = t.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+type usagePacketConn struct {
+	net.PacketConn
+	r     *usageRecorder
+	route string
+	tags  usageTags
+}
+
+func (c *usagePacketConn) server(addr net.Addr) string {
+	if c.route == routeProxy && addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func (c *usagePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.r.add(c.server(addr), c.route, c.tags, 0, n)
+	return n, addr, err
+}
+
+func (c *usagePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.r.add(c.server(addr), c.route, c.tags, n, 0)
+	return n, err
+}
+
+// usageFields are the fields of usage keys the stats command filters and
+// sums usage by.
+var usageFields = map[string]func(*usageKey) *string{
+	"server":   func(k *usageKey) *string { return &k.Server },
+	"route":    func(k *usageKey) *string { return &k.Route },
+	"listener": func(k *usageKey) *string { return &k.Listener },
+	"rule":     func(k *usageKey) *string { return &k.Rule },
+}
+
+// statsCommand prints the usage saved by a client, as in
+//
+//	go-shadowsocks2 stats -usage-file usage.json [-weekly] [-by server,rule] [-day today] [-rule DOMAIN-SUFFIX,example.com]
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	path := fs.String("usage-file", "", "usage file written by the client")
+	weekly := fs.Bool("weekly", false, "sum usage per ISO week instead of per day")
+	day := fs.String("day", "", "only count usage of this day, YYYY-MM-DD or today")
+	by := fs.String("by", "server,route", "comma-separated fields to sum usage by: server, route, listener, rule")
+	only := make(map[string]*string)
+	for _, name := range []string{"server", "route", "listener", "rule"} {
+		only[name] = fs.String(name, "", "only count usage with this "+name+", - for none")
+	}
+	fs.Parse(args)
+	if *path == "" {
+		return fmt.Errorf("stats: -usage-file is required")
+	}
+	columns := strings.Split(*by, ",")
+	for _, c := range columns {
+		if usageFields[c] == nil {
+			return fmt.Errorf("stats: unknown field %q in -by", c)
+		}
+	}
+	if *day == "today" {
+		*day = time.Now().Format(time.DateOnly)
+	}
+	records, err := readUsage(*path)
+	if err != nil {
+		return err
+	}
+	filtered := records[:0]
+	for _, rec := range records {
+		if usageMatches(rec.usageKey, *day, only) {
+			filtered = append(filtered, rec)
+		}
+	}
+	records = sumUsage(filtered, columns, *weekly)
+	sortUsage(records)
+	return printUsage(os.Stdout, records, columns, *weekly)
+}
+
+// usageMatches reports whether k is of day, if set, and has the values of
+// the fields set in only.
+func usageMatches(k usageKey, day string, only map[string]*string) bool {
+	if day != "" && k.Day != day {
+		return false
+	}
+	for name, v := range only {
+		want := *v
+		if want == "-" {
+			want = ""
+		} else if want == "" {
+			continue
+		}
+		if *usageFields[name](&k) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// sumUsage sums records by period, per ISO week if weekly, and columns.
+func sumUsage(records []usageRecord, columns []string, weekly bool) []usageRecord {
+	m := make(map[usageKey]*usageRecord)
+	for _, rec := range records {
+		var k usageKey
+		for _, c := range columns {
+			*usageFields[c](&k) = *usageFields[c](&rec.usageKey)
+		}
+		k.Day = rec.Day
+		if weekly {
+			t, err := time.Parse(time.DateOnly, rec.Day)
+			if err != nil {
+				continue
+			}
+			y, w := t.ISOWeek()
+			k.Day = fmt.Sprintf("%d-W%02d", y, w)
+		}
+		if m[k] == nil {
+			m[k] = &usageRecord{usageKey: k}
+		}
+		m[k].Up += rec.Up
+		m[k].Down += rec.Down
+	}
+	sums := make([]usageRecord, 0, len(m))
+	for _, rec := range m {
+		sums = append(sums, *rec)
+	}
+	return sums
+}
+
+func printUsage(w io.Writer, records []usageRecord, columns []string, weekly bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	period := "DAY"
+	if weekly {
+		period = "WEEK"
+	}
+	fmt.Fprint(tw, period)
+	for _, c := range columns {
+		fmt.Fprintf(tw, "\t%s", strings.ToUpper(c))
+	}
+	fmt.Fprint(tw, "\tUP\tDOWN\n")
+	for _, rec := range records {
+		fmt.Fprint(tw, rec.Day)
+		for _, c := range columns {
+			v := *usageFields[c](&rec.usageKey)
+			if v == "" {
+				v = "-"
+			}
+			fmt.Fprintf(tw, "\t%s", v)
+		}
+		fmt.Fprintf(tw, "\t%s\t%s\n", formatBytes(rec.Up), formatBytes(rec.Down))
+	}
+	return tw.Flush()
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+	"github.com/Potterli20/go-shadowsocks2/shadowaead"
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// The users file of a multi-user server is a JSON array such as
+//
+//	[
+//	  {"name": "alice", "password": "..."},
+//	  {"name": "phone-dns", "cipher": "AES-256-GCM", "password": "...",
+//	   "allow": ["1.1.1.1", "9.9.9.0/24", "dns.google"], "ports": [53, 853]},
+//	  {"name": "mail", "password": "...", "block_ports": []},
+//	  {"name": "guest", "password": "...", "rate": 1000000, "burst": 4000000},
+//	  {"name": "trial", "password": "...", "quota": 10000000000, "expires": "2026-12-31"},
+//	  {"name": "bob", "password": "new...", "old_password": "...", "old_until": "2026-11-01"}
+//	]
+//
+// Clients are told apart by the key their traffic decrypts with, so every
+// user needs a distinct password and an AEAD cipher.
+
+var errUnknownUser = errors.New("no user key matches")
+
+// user is a user of a multi-user server.
+type user struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label,omitempty"` // display name, as of an Outline access key
+	Cipher   string   `json:"cipher,omitempty"`
+	Password string   `json:"password"`
+	Allow    []string `json:"allow,omitempty"`
+	Ports    []uint16 `json:"ports,omitempty"`
+
+	// Ports, if set, replaces -allow-ports and -block-ports for the user, and
+	// BlockPorts, if set, even empty, -block-ports.
+	BlockPorts []uint16 `json:"block_ports,omitempty"`
+
+	// Rate limits the relays and UDP sessions of the user together to that
+	// many bytes per second, if positive, letting through Burst bytes at
+	// once, one second worth if not positive.
+	Rate  int `json:"rate,omitempty"`
+	Burst int `json:"burst,omitempty"`
+
+	// Quota, if positive, is the number of bytes the user may relay, and
+	// Expires, if set, when the user may relay until, as in quota.go.
+	Quota   int64  `json:"quota,omitempty"`
+	Expires string `json:"expires,omitempty"`
+
+	// OldPassword, if set, is accepted as well until OldUntil, to rotate the
+	// password of the user as in rotate.go.
+	OldPassword string `json:"old_password,omitempty"`
+	OldUntil    string `json:"old_until,omitempty"`
+
+	ciph     *core.AeadCipher
+	oldCiph  *core.AeadCipher
+	oldUntil time.Time
+	policy   *policy
+	expires  time.Time
+}
+
+// keys returns the ciphers of the keys u is accepted with: that of its
+// password, then that of its old password until it expires.
+func (u *user) keys() []*core.AeadCipher {
+	if u.oldCiph != nil && time.Now().Before(u.oldUntil) {
+		return []*core.AeadCipher{u.ciph, u.oldCiph}
+	}
+	return []*core.AeadCipher{u.ciph}
+}
+
+// accepts reports whether k is one of the keys of u.
+func (u *user) accepts(k *core.AeadCipher) bool {
+	return k == u.ciph || k == u.oldCiph && time.Now().Before(u.oldUntil)
+}
+
+// permits reports whether u may relay to tgt, resolved to ap. A nil user,
+// as in single-user mode, may relay anywhere.
+func (u *user) permits(tgt socks.Addr, ap netip.AddrPort) bool {
+	return u == nil || u.policy.permits(tgt, ap)
+}
+
+// portLists returns the destination ports u may relay to, all if nil, and
+// those u may not: the lists of the server unless u has its own.
+func (u *user) portLists() (allow, block []portRange) {
+	allow, block = allowedPorts, blockedPorts
+	if u == nil {
+		return allow, block
+	}
+	if u.Ports != nil { // checked by the policy
+		allow, block = nil, nil
+	}
+	if u.BlockPorts != nil {
+		block = make([]portRange, len(u.BlockPorts))
+		for i, p := range u.BlockPorts {
+			block[i] = portRange{p, p}
+		}
+	}
+	return allow, block
+}
+
+// name returns the name of u, empty for a nil user.
+func (u *user) name() string {
+	if u == nil {
+		return ""
+	}
+	return u.Name
+}
+
+// serverUsers holds the users of a multi-user server, nil otherwise.
+var serverUsers *userDB
+
+// userDB identifies the users of incoming connections and packets.
+type userDB struct {
+	set atomic.Pointer[userSet] // replaced when reloaded
+
+	peers     sync.Map // netip.AddrPort -> *peer of UDP clients
+	lastPrune atomic.Int64
+
+	// recent holds the key last matched by the streams of each client IP,
+	// tried first so that a returning client is not identified by trying
+	// the key of every user.
+	recent          sync.Map // netip.Addr -> *recentKey
+	lastRecentPrune atomic.Int64
+}
+
+type recentKey struct {
+	set  *userSet // the key is tried only while the users are those of set
+	user *user
+	ciph *core.AeadCipher
+	seen atomic.Int64
+}
+
+// recentTimeout is how long the key of a client IP is remembered.
+const recentTimeout = 10 * time.Minute
+
+type userSet struct {
+	users    []*user
+	overhead int // largest per-packet overhead of the user ciphers
+	minSalt  int // smallest salt size of the user ciphers
+	maxSalt  int // largest salt size of the user ciphers
+}
+
+type peer struct {
+	user *user
+	ciph *core.AeadCipher // of the key the peer uses
+	seen atomic.Int64
+}
+
+// loadUsers reads the users file at path. Users without a cipher get ciph.
+func loadUsers(path, ciph string) (*userDB, error) {
+	s, err := readUsers(path, ciph)
+	if err != nil {
+		return nil, err
+	}
+	db := &userDB{}
+	db.set.Store(s)
+	s.setRates()
+	return db, nil
+}
+
+// setRates sets the limiters of the users of s to their rates, replacing
+// those set through the admin API.
+func (s *userSet) setRates() {
+	for _, u := range s.users {
+		setLimiter(&userLimiters, u.Name, u.Rate, u.Burst)
+	}
+}
+
+// reload reads the users file at path again, replacing the users if it is
+// valid. Sessions in progress go on as their users, and UDP clients are
+// taken for the user of the same name, if any is left.
+func (db *userDB) reload(path, ciph string) error {
+	s, err := readUsers(path, ciph)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]*user, len(s.users))
+	for _, u := range s.users {
+		byName[u.Name] = u
+	}
+	db.set.Store(s)
+	s.setRates()
+	db.peers.Range(func(k, v any) bool {
+		if u := byName[v.(*peer).user.Name]; u != nil {
+			p := &peer{user: u, ciph: u.ciph}
+			for _, k := range u.keys() {
+				if bytes.Equal(k.Key, v.(*peer).ciph.Key) {
+					p.ciph = k
+				}
+			}
+			p.seen.Store(v.(*peer).seen.Load())
+			db.peers.CompareAndSwap(k, v, p)
+		} else {
+			db.peers.CompareAndDelete(k, v)
+		}
+		return true
+	})
+	return nil
+}
+
+// readUsers reads and validates the users file at path.
+func readUsers(path, ciph string) (*userSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &userSet{}
+	if err := json.Unmarshal(b, &s.users); err != nil {
+		return nil, fmt.Errorf("users %s: %v", path, err)
+	}
+	if len(s.users) == 0 {
+		mainLog.Warnf("users %s: no users, every client is refused", path)
+	}
+	names := make(map[string]bool)
+	passwords := make(map[string]string) // to the name of the user with it
+	for i, u := range s.users {
+		if u.Name == "" {
+			u.Name = fmt.Sprintf("user%d", i+1)
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("users %s: duplicate user %q", path, u.Name)
+		}
+		names[u.Name] = true
+		// a stream or packet would authenticate as whichever user came first
+		for _, pw := range []string{u.Password, u.OldPassword} {
+			if other, ok := passwords[pw]; ok && other != u.Name {
+				return nil, fmt.Errorf("users %s: users %s and %s have the same password", path, other, u.Name)
+			}
+			if pw != "" {
+				passwords[pw] = u.Name
+			}
+		}
+		if u.Cipher == "" {
+			u.Cipher = ciph
+		}
+		c, err := core.PickCipher(u.Cipher, nil, u.Password)
+		if err != nil {
+			return nil, fmt.Errorf("users %s: user %s: %v", path, u.Name, err)
+		}
+		var ok bool
+		if u.ciph, ok = c.(*core.AeadCipher); !ok {
+			return nil, fmt.Errorf("users %s: user %s: multi-user mode requires an AEAD cipher", path, u.Name)
+		}
+		if u.OldPassword != "" {
+			if u.OldUntil == "" {
+				return nil, fmt.Errorf("users %s: user %s: old_password requires old_until", path, u.Name)
+			}
+			if u.oldUntil, err = parseExpiry(u.OldUntil); err != nil {
+				return nil, fmt.Errorf("users %s: user %s: %v", path, u.Name, err)
+			}
+			c, _ := core.PickCipher(u.Cipher, nil, u.OldPassword)
+			u.oldCiph = c.(*core.AeadCipher)
+		}
+		if u.policy, err = newPolicy(u.Allow, u.Ports); err != nil {
+			return nil, fmt.Errorf("users %s: user %s: %v", path, u.Name, err)
+		}
+		if u.expires, err = parseExpiry(u.Expires); err != nil {
+			return nil, fmt.Errorf("users %s: user %s: %v", path, u.Name, err)
+		}
+		s.overhead = max(s.overhead, u.ciph.SaltSize()+aeadOverhead)
+		if i == 0 || u.ciph.SaltSize() < s.minSalt {
+			s.minSalt = u.ciph.SaltSize()
+		}
+		s.maxSalt = max(s.maxSalt, u.ciph.SaltSize())
+	}
+	return s, nil
+}
+
+// aeadOverhead is the tag size of every supported AEAD.
+const aeadOverhead = 16
+
+var zeroNonce [32]byte
+
+// StreamConn decrypts c with the key of the user whose key authenticates its
+// first length chunk. Reads fail if there is none.
+func (db *userDB) StreamConn(c net.Conn) net.Conn {
+	s := db.set.Load()
+	// wait for the shortest header only, so that a client of a short salt is
+	// not kept waiting for bytes it has not sent; keys of longer salts are
+	// tried as more arrives
+	hdr := make([]byte, s.maxSalt+2+aeadOverhead)
+	n, err := io.ReadAtLeast(c, hdr, s.minSalt+2+aeadOverhead)
+	if err != nil {
+		return &failedConn{Conn: c, err: err}
+	}
+	ip := addrIP(c.RemoteAddr()).Unmap()
+	matched := func(u *user, k *core.AeadCipher) net.Conn {
+		db.remember(ip, s, u, k)
+		pc := &bufferedConn{Conn: c, r: bufio.NewReader(io.MultiReader(bytes.NewReader(hdr[:n]), c))}
+		return &userConn{Conn: k.StreamConn(pc), user: u}
+	}
+	tried := 0 // keys whose header is no longer than this have been tried
+	for {
+		fits := func(k *core.AeadCipher) bool {
+			want := k.SaltSize() + 2 + aeadOverhead
+			return tried < want && want <= n && authenticates(hdr[:want], k)
+		}
+		if v, ok := db.recent.Load(ip); ok {
+			if r := v.(*recentKey); r.set == s && r.user.accepts(r.ciph) && fits(r.ciph) {
+				return matched(r.user, r.ciph)
+			}
+		}
+		for _, u := range s.users {
+			for _, k := range u.keys() {
+				if fits(k) {
+					return matched(u, k)
+				}
+			}
+		}
+		if n == len(hdr) {
+			return &failedConn{Conn: c, err: errUnknownUser}
+		}
+		if err != nil {
+			return &failedConn{Conn: c, err: err}
+		}
+		tried = n
+		var m int
+		m, err = c.Read(hdr[n:])
+		n += m
+	}
+}
+
+// remember records that the stream of ip matched the key k of u in s.
+func (db *userDB) remember(ip netip.Addr, s *userSet, u *user, k *core.AeadCipher) {
+	now := time.Now().UnixNano()
+	if v, ok := db.recent.Load(ip); ok && v.(*recentKey).ciph == k && v.(*recentKey).set == s {
+		v.(*recentKey).seen.Store(now)
+	} else {
+		r := &recentKey{set: s, user: u, ciph: k}
+		r.seen.Store(now)
+		db.recent.Store(ip, r)
+	}
+	timeout := recentTimeout.Nanoseconds()
+	if last := db.lastRecentPrune.Load(); now-last > timeout && db.lastRecentPrune.CompareAndSwap(last, now) {
+		db.recent.Range(func(k, v any) bool {
+			if now-v.(*recentKey).seen.Load() > timeout {
+				db.recent.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+// authenticates reports whether the key of ciph authenticates the length
+// chunk following the salt at the start of hdr, the first bytes of a stream.
+func authenticates(hdr []byte, ciph *core.AeadCipher) bool {
+	salt := hdr[:ciph.SaltSize()]
+	aead, err := ciph.Decrypter(salt)
+	if err != nil {
+		return false
+	}
+	var buf [2 + aeadOverhead]byte
+	chunk := hdr[len(salt) : len(salt)+2+aead.Overhead()]
+	_, err = aead.Open(buf[:0], zeroNonce[:aead.NonceSize()], chunk, nil)
+	return err == nil
+}
+
+// PacketConn decrypts packets read from pc with the key of the user they
+// authenticate with, and encrypts packets to a peer with the key of the user
+// last seen there.
+func (db *userDB) PacketConn(pc net.PacketConn) net.PacketConn {
+	return &userPacketConn{PacketConn: pc, db: db, rbuf: make([]byte, udpBufSize), wbuf: make([]byte, udpBufSize)}
+}
+
+// packetUser returns the user last seen sending packets from addr.
+func (db *userDB) packetUser(addr netip.AddrPort) *user {
+	if db == nil {
+		return nil
+	}
+	if p, ok := db.peers.Load(natKey(addr)); ok {
+		return p.(*peer).user
+	}
+	return nil
+}
+
+func (db *userDB) seePeer(addr netip.AddrPort, u *user, ciph *core.AeadCipher) {
+	addr = natKey(addr)
+	now := time.Now().UnixNano()
+	if p, ok := db.peers.Load(addr); ok && p.(*peer).user == u && p.(*peer).ciph == ciph {
+		p.(*peer).seen.Store(now)
+	} else {
+		p := &peer{user: u, ciph: ciph}
+		p.seen.Store(now)
+		db.peers.Store(addr, p)
+	}
+	// forget peers idle for longer than their NAT entries live
+	timeout := config.UDPTimeout.Nanoseconds()
+	if last := db.lastPrune.Load(); now-last > timeout && db.lastPrune.CompareAndSwap(last, now) {
+		db.peers.Range(func(k, v any) bool {
+			if now-v.(*peer).seen.Load() > timeout {
+				db.peers.Delete(k)
+			}
+			return true
+		})
+	}
+}
+
+type userPacketConn struct {
+	net.PacketConn
+	db   *userDB
+	rmu  sync.Mutex
+	rbuf []byte
+	wmu  sync.Mutex
+	wbuf []byte
+}
+
+func (c *userPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, addr, err := c.PacketConn.ReadFrom(c.rbuf)
+	if err != nil {
+		return n, addr, err
+	}
+	ua, _ := addr.(*net.UDPAddr)
+	if ua != nil {
+		// the key of the peer first, as for streams
+		if v, ok := c.db.peers.Load(natKey(ua.AddrPort())); ok && v.(*peer).user.accepts(v.(*peer).ciph) {
+			p := v.(*peer)
+			if pt, err := shadowaead.Unpack(b, c.rbuf[:n], p.ciph); err == nil {
+				c.db.seePeer(ua.AddrPort(), p.user, p.ciph)
+				return len(pt), addr, nil
+			}
+		}
+	}
+	for _, u := range c.db.set.Load().users {
+		for _, k := range u.keys() {
+			pt, err := shadowaead.Unpack(b, c.rbuf[:n], k)
+			if err != nil {
+				continue
+			}
+			if ua != nil {
+				c.db.seePeer(ua.AddrPort(), u, k)
+			}
+			return len(pt), addr, nil
+		}
+	}
+	return 0, addr, errUnknownUser
+}
+
+func (c *userPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errUnknownUser
+	}
+	p, ok := c.db.peers.Load(natKey(ua.AddrPort()))
+	if !ok {
+		return 0, errUnknownUser
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	pkt, err := shadowaead.Pack(c.wbuf, b, p.(*peer).ciph)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(pkt, addr)
+	return len(b), err
+}
+
+// Overhead returns the largest number of bytes added to a packet.
+func (c *userPacketConn) Overhead() int { return c.db.set.Load().overhead }
+
+// userConn is a client stream authenticated as user.
+type userConn struct {
+	net.Conn
+	user *user
+}
+
+// userOf returns the user c was authenticated as, nil in single-user mode.
+func userOf(c net.Conn) *user {
+	if uc, ok := c.(*userConn); ok {
+		return uc.user
+	}
+	return nil
+}
+
+// withUser returns c, a stream carried inside one of u, as authenticated as u.
+func withUser(c net.Conn, u *user) net.Conn {
+	if u == nil {
+		return c
+	}
+	return &userConn{Conn: c, user: u}
+}
+
+// failedConn is a connection whose reads fail with err.
+type failedConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failedConn) Read([]byte) (int, error) { return 0, c.err }
+
+// policy restricts the destinations a user may relay to.
+type policy struct {
+	nets    []netip.Prefix
+	domains []string
+	ports   map[uint16]bool
+}
+
+// newPolicy allows IPs, CIDR prefixes and domains (with their subdomains)
+// listed in allow, on ports. Empty lists allow anything.
+func newPolicy(allow []string, ports []uint16) (*policy, error) {
+	if len(allow) == 0 && len(ports) == 0 {
+		return nil, nil
+	}
+	p := &policy{}
+	for _, s := range allow {
+		if pf, err := netip.ParsePrefix(s); err == nil {
+			p.nets = append(p.nets, pf.Masked())
+		} else if ip, err := netip.ParseAddr(s); err == nil {
+			p.nets = append(p.nets, netip.PrefixFrom(ip, ip.BitLen()))
+		} else if s != "" && !strings.ContainsAny(s, "/: ") {
+			p.domains = append(p.domains, strings.ToLower(strings.TrimSuffix(s, ".")))
+		} else {
+			return nil, fmt.Errorf("invalid allowed destination %q", s)
+		}
+	}
+	if len(ports) > 0 {
+		p.ports = make(map[uint16]bool)
+		for _, port := range ports {
+			p.ports[port] = true
+		}
+	}
+	return p, nil
+}
+
+// permits reports whether the policy allows relaying to tgt, resolved to ap.
+func (p *policy) permits(tgt socks.Addr, ap netip.AddrPort) bool {
+	if p == nil {
+		return true
+	}
+	if p.ports != nil && !p.ports[ap.Port()] {
+		return false
+	}
+	if p.nets == nil && p.domains == nil {
+		return true
+	}
+	if tgt[0] == socks.AtypDomainName {
+		host := strings.ToLower(strings.TrimSuffix(string(tgt[2:2+int(tgt[1])]), "."))
+		for _, d := range p.domains {
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+	}
+	ip := ap.Addr().Unmap()
+	for _, n := range p.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+)
+
+// writeUsers writes a users file of body and returns its path.
+func writeUsers(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// streamStart returns the bytes a client of cipher and password sends
+// first, up to and including the first length chunk.
+func streamStart(t *testing.T, cipher, password string) []byte {
+	t.Helper()
+	ciph, err := core.PickCipher(cipher, nil, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		ciph.StreamConn(c).Write([]byte("x"))
+		c.Close()
+	}()
+	salt := ciph.(*core.AeadCipher).SaltSize()
+	b := make([]byte, salt+2+aeadOverhead)
+	if _, err := io.ReadFull(peer, b); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(io.Discard, peer)
+	return b
+}
+
+func TestUsersMixedSaltSizes(t *testing.T) {
+	db, err := loadUsers(writeUsers(t, `[
+		{"name": "long", "cipher": "AEAD_AES_256_GCM", "password": "long-pw"},
+		{"name": "short", "cipher": "AEAD_AES_128_GCM", "password": "short-pw"}
+	]`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name, cipher, password string
+	}{
+		{"short", "AEAD_AES_128_GCM", "short-pw"},
+		{"long", "AEAD_AES_256_GCM", "long-pw"},
+	} {
+		hdr := streamStart(t, tt.cipher, tt.password)
+		c, client := net.Pipe()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		go func() {
+			// split, so that the longer header arrives in two reads
+			client.Write(hdr[:len(hdr)/2])
+			client.Write(hdr[len(hdr)/2:])
+		}()
+		// a client sends nothing more until it has a header from the server
+		sc := db.StreamConn(c)
+		if u := userOf(sc); u == nil || u.Name != tt.name {
+			t.Errorf("stream of %s taken for %v: %v", tt.name, u, sc)
+		}
+		c.Close()
+		client.Close()
+	}
+}
+
+func TestUsersDuplicatePassword(t *testing.T) {
+	for _, body := range []string{
+		`[{"name": "a", "password": "pw"}, {"name": "b", "password": "pw"}]`,
+		`[{"name": "a", "password": "pw"}, {"name": "b", "password": "new", "old_password": "pw", "old_until": "2099-01-01"}]`,
+	} {
+		_, err := readUsers(writeUsers(t, body), "AEAD_CHACHA20_POLY1305")
+		if err == nil || !strings.Contains(err.Error(), "same password") {
+			t.Errorf("%s: %v, want an error for the same password", body, err)
+		}
+	}
+}
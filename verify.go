@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Potterli20/go-shadowsocks2/core"
+	"github.com/Potterli20/go-shadowsocks2/socks"
+)
+
+// The verify command checks a deployment after changes, through each server
+// of a client configuration and its transport:
+//
+//	connect    the server is reachable
+//	TCP relay  a URL is fetched, or data echoed by the echo server of -target
+//	UDP relay  a DNS query is answered, or packets echoed by -target
+//	integrity  a large transfer is echoed unchanged (with -target only)
+//	replay     a connection replayed byte for byte is not relayed (AEAD
+//	           ciphers, a warning only since SIP004 does not require it)
+
+// verifyCommand runs the verify command, as in
+//
+//	go-shadowsocks2 verify -c client.json
+//	go-shadowsocks2 verify -c ss://AEAD_CHACHA20_POLY1305:your-password@server:8488 -target 127.0.0.1:9999
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	conf := fs.String("c", "", "config file of a client, as read with -config, or ss:// URLs of the servers to verify")
+	target := fs.String("target", "", "address of an echo server of the echo command as seen from the servers, to echo through it")
+	checkURL := fs.String("url", "http://www.gstatic.com/generate_204", "http:// or https:// URL fetched through the servers without -target")
+	dns := fs.String("dns", "8.8.8.8:53", "DNS server queried over UDP and TCP through the servers without -target")
+	size := fs.Int("size", 8, "MiB echoed by the integrity check")
+	udp := fs.Bool("udp", true, "check UDP relaying too")
+	fs.Parse(args)
+	if *conf == "" {
+		return errors.New("verify: -c is required")
+	}
+	servers, err := verifyServers(*conf)
+	if err != nil {
+		return err
+	}
+	u, err := parseHealthURL(*checkURL)
+	if err != nil {
+		return err
+	}
+	var tgt socks.Addr
+	if *target != "" {
+		if tgt = socks.ParseAddr(*target); tgt == nil {
+			return fmt.Errorf("invalid target address %q", *target)
+		}
+	}
+	dnsAddr := socks.ParseAddr(*dns)
+	if dnsAddr == nil {
+		return fmt.Errorf("invalid DNS server address %q", *dns)
+	}
+
+	failed := false
+	for i, s := range servers {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("server %s (%s, %s transport)\n", s.name, s.cipher, config.Transport)
+		r := &verifyReport{w: os.Stdout}
+		s.verify(r, u, tgt, dnsAddr, *size<<20, *udp)
+		failed = failed || r.failed
+	}
+	if failed {
+		return errors.New("verify: some checks failed")
+	}
+	return nil
+}
+
+type verifyServer struct {
+	name, addr, cipher string
+	ciph               core.Cipher
+}
+
+// verifyServers returns the servers of conf, ss:// URLs or the path of a
+// client config file whose options are then set as the client would.
+func verifyServers(conf string) ([]verifyServer, error) {
+	list, cipher, password := conf, "", ""
+	var key []byte
+	if !strings.HasPrefix(conf, "ss://") {
+		if err := loadConfigFile(conf); err != nil {
+			return nil, err
+		}
+		option := func(name string) string { return flag.Lookup(name).Value.String() }
+		list, cipher, password = option("c"), option("cipher"), option("password")
+		if list == "" {
+			return nil, fmt.Errorf("verify: config %s has no servers in \"c\"", conf)
+		}
+		if k := option("key"); k != "" {
+			var err error
+			if key, err = base64.URLEncoding.DecodeString(k); err != nil {
+				return nil, err
+			}
+		}
+		core.AllowLegacy = option("allow-legacy") == "true"
+		if err := setOutbound(option("outbound-ip"), option("outbound-interface")); err != nil {
+			return nil, err
+		}
+		if mark, err := strconv.Atoi(option("fwmark")); err != nil || setMark(mark) != nil {
+			return nil, fmt.Errorf("verify: invalid fwmark %q", option("fwmark"))
+		}
+		if dns := option("dns"); dns != "" {
+			if err := setResolver(dns); err != nil {
+				return nil, err
+			}
+		}
+		if up := option("upstream"); up != "" {
+			if err := setUpstream(up); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var servers []verifyServer
+	for _, s := range strings.Split(list, ",") {
+		vs := verifyServer{name: s, addr: s, cipher: cipher}
+		pass := password
+		if strings.HasPrefix(s, "ss://") {
+			var err error
+			if vs.addr, vs.cipher, pass, err = parseURL(s); err != nil {
+				return nil, err
+			}
+			vs.name = vs.addr
+		}
+		vs.cipher = strings.ToUpper(resolveCipher(vs.cipher))
+		ciph, err := core.PickCipher(vs.cipher, key, pass)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %v", vs.name, err)
+		}
+		vs.ciph = padded(ciph)
+		servers = append(servers, vs)
+	}
+	return servers, nil
+}
+
+type verifyReport struct {
+	w      io.Writer
+	failed bool
+}
+
+func (r *verifyReport) add(check string, err error, format string, v ...any) {
+	if err != nil {
+		r.failed = true
+		fmt.Fprintf(r.w, "  %-10s FAIL  %v\n", check, err)
+		return
+	}
+	fmt.Fprintf(r.w, "  %-10s ok    "+format+"\n", append([]any{check}, v...)...)
+}
+
+// warn reports the failure of a check not required by the protocol.
+func (r *verifyReport) warn(check string, err error, format string, v ...any) {
+	if err != nil {
+		fmt.Fprintf(r.w, "  %-10s warn  %v\n", check, err)
+		return
+	}
+	r.add(check, nil, format, v...)
+}
+
+func (r *verifyReport) skip(check, why string) {
+	fmt.Fprintf(r.w, "  %-10s skip  %s\n", check, why)
+}
+
+// verify runs the checks of s, echoing through tgt if not nil, or fetching
+// u and querying dns otherwise.
+func (s verifyServer) verify(r *verifyReport, u *url.URL, tgt, dns socks.Addr, size int, udp bool) {
+	start := time.Now()
+	c, err := dial(s.addr)
+	if err != nil {
+		r.add("connect", err, "")
+		return
+	}
+	c.Close()
+	r.add("connect", nil, "in %v", time.Since(start).Round(time.Millisecond))
+
+	dialTo := func(tgt socks.Addr) func() (net.Conn, error) {
+		return func() (net.Conn, error) {
+			c, err := shadowDial(s.addr, s.ciph)()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.Write(tgt); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+	if tgt != nil {
+		rtt, err := testTCPEcho(dialTo(tgt))
+		r.add("TCP relay", err, "echo round trip %v", rtt.Round(time.Millisecond))
+	} else {
+		start := time.Now()
+		err := fetchThrough(shadowDial(s.addr, s.ciph), u, start.Add(echoTimeout))
+		r.add("TCP relay", err, "fetched %s in %v", u, time.Since(start).Round(time.Millisecond))
+	}
+
+	switch {
+	case !udp:
+		r.skip("UDP relay", "-udp=false")
+	case tgt != nil:
+		got, rtt, err := testUDPEcho(s.addr, s.ciph, tgt)
+		r.add("UDP relay", err, "%d/%d packets echoed, round trip %v", got, udpEchoPackets, rtt.Round(time.Millisecond))
+	default:
+		rtt, err := testUDPQuery(s.addr, s.ciph, dns)
+		r.add("UDP relay", err, "DNS query to %s answered in %v", dns, rtt.Round(time.Millisecond))
+	}
+
+	if tgt != nil {
+		err := testIntegrity(dialTo(tgt), size)
+		r.add("integrity", err, "%s echoed unchanged", formatBytes(int64(size)))
+	} else {
+		r.skip("integrity", "needs an echo server, see -target")
+	}
+
+	if _, ok := s.ciph.(*core.AeadCipher); !ok {
+		r.skip("replay", "only AEAD ciphers reject replays")
+		return
+	}
+	replayTo, payload := tgt, []byte("replay check\n") // longer than the commands of the echo server
+	if tgt == nil {
+		replayTo, payload = dns, exampleQuery(true)
+	}
+	// Rejecting replays is only required of SIP022 servers; those of the
+	// original AEAD ciphers may relay them, which is worth knowing.
+	r.warn("replay", testReplay(s.addr, s.ciph, replayTo, payload), "replayed connection refused")
+}
+
+// exampleQuery returns a DNS query of the A record of example.com, prefixed
+// with its length over TCP.
+func exampleQuery(tcp bool) []byte {
+	var q []byte
+	if tcp {
+		q = []byte{0, 0}
+	}
+	id := make([]byte, 2)
+	rand.Read(id)
+	q = append(q, id...)
+	q = append(q, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0) // recursion desired, one question
+	q = append(q, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+	if tcp {
+		binary.BigEndian.PutUint16(q, uint16(len(q)-2))
+	}
+	return q
+}
+
+// testUDPQuery sends a DNS query to dns through the server at addr and
+// waits for the answer.
+func testUDPQuery(addr string, ciph core.Cipher, dns socks.Addr) (time.Duration, error) {
+	srv, err := resolveUDPAddr(addr)
+	if err != nil {
+		return 0, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+	spc := ciph.PacketConn(pc)
+	q := exampleQuery(false)
+	start := time.Now()
+	if _, err := spc.WriteTo(append(append([]byte(nil), dns...), q...), srv); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, udpBufSize)
+	spc.SetReadDeadline(start.Add(echoTimeout))
+	for {
+		n, _, err := spc.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		a := buf[:n]
+		if src := socks.SplitAddr(a); src != nil && len(a) >= len(src)+2 && bytes.Equal(a[len(src):len(src)+2], q[:2]) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// testIntegrity sends size bytes of random data to the echo server and
+// checks that they come back unchanged.
+func testIntegrity(dial func() (net.Conn, error), size int) error {
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(echoTimeout + time.Duration(size>>20)*time.Second))
+	sent := make([]byte, size)
+	rand.Read(sent)
+	go c.Write(sent)
+	got := sha256.New()
+	if _, err := io.CopyN(got, c, int64(size)); err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(sent); !bytes.Equal(got.Sum(nil), sum[:]) {
+		return errors.New("echoed data differs")
+	}
+	return nil
+}
+
+// testReplay sends payload to tgt through the server at addr, then the
+// bytes of that connection again on a new one, which the server must not
+// relay.
+func testReplay(addr string, ciph core.Cipher, tgt socks.Addr, payload []byte) error {
+	c, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	tape := &tapeConn{Conn: c}
+	sc := ciph.StreamConn(tape)
+	sc.SetDeadline(time.Now().Add(echoTimeout))
+	buf := make([]byte, 512)
+	_, err = sc.Write(append(append([]byte(nil), tgt...), payload...))
+	if err == nil {
+		_, err = sc.Read(buf)
+	}
+	c.Close()
+	if err != nil {
+		return fmt.Errorf("original connection: %v", err)
+	}
+
+	rc, err := dial(addr)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if _, err := rc.Write(tape.sent.Bytes()); err != nil {
+		return nil // refused
+	}
+	src := ciph.StreamConn(rc)
+	src.SetDeadline(time.Now().Add(3 * time.Second))
+	if n, _ := src.Read(buf); n > 0 {
+		return errors.New("replayed connection relayed")
+	}
+	return nil
+}
+
+// tapeConn records what is written to it.
+type tapeConn struct {
+	net.Conn
+	sent bytes.Buffer
+}
+
+func (c *tapeConn) Write(b []byte) (int, error) {
+	c.sent.Write(b)
+	return c.Conn.Write(b)
+}
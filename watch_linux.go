@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// watchFiles calls changed when one of paths changes, watching their
+// directories with inotify so as to see files replaced by a rename.
+func watchFiles(paths []string, changed func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("inotify_init1", err)
+	}
+	const mask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ATTRIB
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		dir := filepath.Dir(p)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+			syscall.Close(fd)
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+	}
+	w := newChangeWatch(paths, changed)
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n < syscall.SizeofInotifyEvent {
+				mainLog.Errorf("stopped watching %v: %v", paths, err)
+				return
+			}
+			// Any event in the directories has the files checked: names are
+			// not matched, as files may be symbolic links to others.
+			w.event()
+		}
+	}()
+	return nil
+}
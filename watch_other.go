@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "time"
+
+// watchPoll is how often files are checked for changes without inotify.
+const watchPoll = 2 * time.Second
+
+// watchFiles calls changed when one of paths changes, polling them.
+func watchFiles(paths []string, changed func()) error {
+	w := newChangeWatch(paths, changed)
+	go func() {
+		for range time.Tick(watchPoll) {
+			w.event()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsListener accepts WebSocket connections upgraded at path, and serves
+// every other HTTP request with the decoy handler.
+type wsListener struct {
+	*connListener
+	l net.Listener
+}
+
+func newWSListener(l net.Listener, path string, decoy http.Handler) *wsListener {
+	wl := &wsListener{connListener: newConnListener(l.Addr()), l: l}
+	ws := websocket.Server{Handler: wl.serveWS} // no Handshake so that non-browser clients without Origin are accepted
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		decoy.ServeHTTP(w, r)
+	})
+	go (&http.Server{Handler: handler, ErrorLog: tcpLog.std(slog.LevelWarn)}).Serve(l)
+	return wl
+}
+
+// serveWS hands ws to Accept and blocks until it is closed, since the
+// WebSocket server closes the connection when the handler returns.
+func (l *wsListener) serveWS(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	c := &wsConn{Conn: ws, done: make(chan struct{})}
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		c.remote = addr
+	}
+	l.put(c)
+	<-c.done
+}
+
+func (l *wsListener) Close() error {
+	l.connListener.Close()
+	return l.l.Close()
+}
+
+// wsConn is a WebSocket connection reporting the client address, rather than
+// the origin, as its remote address.
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *wsConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+// dialWS opens a WebSocket connection to the server at addr, over TLS if
+// secure. The request is addressed to -ws-host if set, e.g. for a CDN.
+func dialWS(d *net.Dialer, addr string, secure bool) (net.Conn, error) {
+	scheme, origin := "ws://", "http://"
+	if secure {
+		scheme, origin = "wss://", "https://"
+	}
+	host := addr
+	if config.WSHost != "" {
+		host = config.WSHost
+	}
+	cfg, err := websocket.NewConfig(scheme+host+config.WSPath, origin+host)
+	if err != nil {
+		return nil, err
+	}
+
+	var c net.Conn
+	if secure {
+		c, err = dialTLS(d, addr)
+	} else {
+		c, err = dialTCP(d, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(cfg, c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}